@@ -1,17 +1,18 @@
 package builder
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"espore/builder/image"
+	"espore/builder/secrets"
+	"espore/builder/signing"
 	"espore/config"
 	"espore/initializer"
 	"espore/session"
 	"espore/utils"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -30,51 +31,137 @@ type DeviceInfo struct {
 }
 
 type FirmwareLib struct {
+	Name         string
+	Version      string
+	Hash         string
 	BasePath     string
 	Files        map[string]*FileEntry
+	Overrides    []string
 	Modules      []ModuleDef `json:"modules"`
 	Dependencies []*FirmwareLib
 }
 
+// Dependency is a module required by a Lua file. Pcall is set when the module
+// is only loaded with pcall(require, ...), that is, it is optional.
+type Dependency struct {
+	Module string
+	Pcall  bool
+}
+
 type FileEntry struct {
-	Base         string   `json:"base"`
-	Path         string   `json:"path"`
-	Hash         string   `json:"hash"`
-	Dependencies []string `json:"-"`
-	Datafiles    []string `json:"datafiles,omitempty"`
-	Content      []byte   `json:"-"`
+	Base         string       `json:"base"`
+	Path         string       `json:"path"`
+	Hash         string       `json:"hash"`
+	Dependencies []Dependency `json:"-"`
+	Datafiles    []string     `json:"datafiles,omitempty"`
+	Content      []byte       `json:"-"`
+	// LFSFiles lists the sources compiled into an LFS image entry
+	LFSFiles []*FileEntry `json:"-"`
 }
 
 type LibDef struct {
 	Dependencies []string    `json:"dependencies"`
 	Include      []string    `json:"include"`
-	Exclude      []string    `json:"exclude`
+	Exclude      []string    `json:"exclude"`
 	Name         string      `json:"name"`
+	Version      string      `json:"version"`
 	Modules      []ModuleDef `json:"modules"`
+	Overrides    []string    `json:"overrides"`
 }
 
 type ModuleDef struct {
 	Name      string          `json:"name"`
 	Autostart bool            `json:"autostart"`
 	Config    json.RawMessage `json:"config,omitempty"`
+	File      string          `json:"file,omitempty"`
 }
 
 type FirmwareLFSConfig struct {
 	Include []string `json:"include"`
-	Exclude []string `json:"exclude`
+	Exclude []string `json:"exclude"`
+	// Flash also builds an absolute LFS image, flashed at the LFS partition
+	// instead of loaded with node.flashreload
+	Flash *FirmwareLFSFlashConfig `json:"flash"`
+}
+
+// FirmwareLFSFlashConfig describes the LFS partition of the NodeMCU firmware,
+// as LFS._config reports it on the device
+type FirmwareLFSFlashConfig struct {
+	// Base is the flash offset of the partition, lfs_base
+	Base int64 `json:"base"`
+	// Mapped is the address the partition is mapped at, lfs_mapped. It
+	// defaults to where the ESP8266 maps Base.
+	Mapped int64 `json:"mapped"`
+	Size   int64 `json:"size"`
+}
+
+type FirmwareMinifyConfig struct {
+	Enabled      bool `json:"enabled"`
+	RenameLocals bool `json:"renameLocals"`
+}
+
+type FirmwareCompileConfig struct {
+	Enabled bool `json:"enabled"`
+	Strip   bool `json:"strip"`
+}
+
+// FirmwareSPIFFSConfig describes the file system partition of the device,
+// as the NodeMCU firmware is built, for the build to write a SPIFFS image
+// that can be flashed at its offset
+type FirmwareSPIFFSConfig struct {
+	Offset int64 `json:"offset"`
+	// Size defaults to spiffsSize
+	Size       int64 `json:"size"`
+	PageSize   int   `json:"pageSize"`
+	BlockSize  int   `json:"blockSize"`
+	MetaLength int   `json:"metaLength"`
+	// IncludeKeys adds the signing keys the device trusts. The image then
+	// holds the keys, so it must not be published.
+	IncludeKeys bool `json:"includeKeys"`
 }
 
 type FirmwareDef struct {
 	DeviceInfo
-	NodeMCUFirmware string            `json:"nodemcu-firmware"`
-	Libs            []string          `json:"libs"`
-	LFS             FirmwareLFSConfig `json:"lfs"`
+	NodeMCUFirmware string                 `json:"nodemcu-firmware"`
+	Libs            []string               `json:"libs"`
+	LFS             FirmwareLFSConfig      `json:"lfs"`
+	Minify          FirmwareMinifyConfig   `json:"minify"`
+	Compile         FirmwareCompileConfig  `json:"compile"`
+	Overrides       map[string]string      `json:"overrides"`
+	LFSSize         int64                  `json:"lfsSize"`
+	SPIFFSSize      int64                  `json:"spiffsSize"`
+	BudgetPolicy    string                 `json:"budgetPolicy"`
+	Modules         []ModuleOverride       `json:"modules"`
+	Vars            map[string]interface{} `json:"vars"`
+	VarsFile        string                 `json:"varsFile"`
+	// Secrets lists the names of the secrets written to the secrets.json
+	// datafile of the device
+	Secrets []string `json:"secrets"`
+	// Version is the semantic version of the firmware, written to version.json
+	Version string `json:"version"`
+	// Defines sets the flags and constants of the Lua preprocessor
+	Defines map[string]interface{} `json:"defines"`
+	// Extends is the directory of a device whose definition this one
+	// builds upon, relative to this device
+	Extends string `json:"extends"`
+	// Compress stores the files of the image LZSS compressed when that makes
+	// them smaller. Devices must already run a bootloader that supports it.
+	Compress bool `json:"compress"`
+	// SPIFFS writes a file system image holding the firmware
+	SPIFFS *FirmwareSPIFFSConfig `json:"spiffs"`
+	// NodeMCUFirmwareOffset is where the NodeMCU firmware is flashed: 0 on
+	// the ESP8266, the application partition on the ESP32
+	NodeMCUFirmwareOffset int64 `json:"nodemcu-firmware-offset"`
 }
 
 type FirmwareManifest struct {
 	DeviceInfo
-	NodeMCUFirmware string
-	Files           []*FileEntry `json:"files"`
+	NodeMCUFirmware       string
+	NodeMCUFirmwareOffset int64                   `json:"nodemcuFirmwareOffset,omitempty"`
+	Compress              bool                    `json:"compress,omitempty"`
+	SPIFFS                *FirmwareSPIFFSConfig   `json:"spiffs,omitempty"`
+	LFSFlash              *FirmwareLFSFlashConfig `json:"lfsFlash,omitempty"`
+	Files                 []*FileEntry            `json:"files"`
 }
 
 var parseDepRegex = []*regexp.Regexp{
@@ -87,56 +174,81 @@ var LFSEmbeddedFiles = map[string]string{
 	"__lfsinit.lua": lfsInitLua,
 }
 
-func extractFile(file string, contents string, outputDir string) error {
-	path := filepath.Join(outputDir, file)
-	if _, err := os.Stat(path); err != nil {
-		if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
-			return fmt.Errorf("Error creating file %s: %s", file, err)
-		}
-	}
-	return nil
+func Luac(sourceEntries []*FileEntry, dstFile string) (err error) {
+	return luac(sourceEntries, dstFile)
 }
 
-func Luac(sourceEntries []*FileEntry, dstFile string) (err error) {
+// luac compiles the sources into an LFS image, passing options such as -a to
+// luac.cross
+func luac(sourceEntries []*FileEntry, dstFile string, options ...string) (err error) {
 
 	tmpDir, err := ioutil.TempDir("", "espore-luac")
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(tmpDir)
+	dstFile, err = filepath.Abs(dstFile)
+	if err != nil {
+		return err
+	}
+	// sources are passed relative to the temp dir so its name does not end
+	// up in the image
 	var sources []string
 	for _, f := range sourceEntries {
 		dst := strings.ReplaceAll(strings.ReplaceAll(f.Path, "/", ","), "\\", ",")
-		dst = filepath.Join(tmpDir, dst)
-		utils.CopyFile(filepath.Join(f.Base, f.Path), dst, false)
+		content, err := f.ReadContent()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, dst), content, 0666); err != nil {
+			return err
+		}
 		sources = append(sources, dst)
 	}
 
-	cmd := exec.Command("luac.cross", append([]string{"-o", dstFile, "-f"}, sources...)...)
+	args := append(append([]string{"-o", dstFile, "-f"}, options...), sources...)
+	return luacCross(tmpDir, args...)
+}
+
+// luacCross runs luac.cross in dir
+func luacCross(dir string, args ...string) error {
+	cmd := exec.Command("luac.cross", args...)
+	cmd.Dir = dir
 	outputBytes, err := cmd.CombinedOutput()
 	if err != nil {
-		exitErr := err.(*exec.ExitError)
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return fmt.Errorf("Error running luac.cross: %s", err)
+		}
 		var code int
-		if exitErr != nil {
-			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-				code = status.ExitStatus()
-			}
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			code = status.ExitStatus()
 		}
 		return fmt.Errorf("Error compiling lua, error code %d:\n%s", code, outputBytes)
 	}
 	return nil
 }
 
-func ReadDependenciesAndDatafiles(luaFile string) (deps, datafiles []string, err error) {
+func ReadDependenciesAndDatafiles(luaFile string) (deps []Dependency, datafiles []string, err error) {
 	code, err := ioutil.ReadFile(luaFile)
 	if err != nil {
 		return nil, nil, err
 	}
+	deps, datafiles = parseDependenciesAndDatafiles(code)
+	return deps, datafiles, nil
+}
+
+func parseDependenciesAndDatafiles(code []byte) (deps []Dependency, datafiles []string) {
+	// depMap tells whether each module is only required through pcall
 	depMap := make(map[string]bool)
-	for _, regex := range parseDepRegex {
+	for i, regex := range parseDepRegex {
+		pcall := i == 0
 		matches := regex.FindAllStringSubmatch(string(code), -1)
 		if matches != nil {
 			for _, match := range matches {
-				depMap[match[1]] = true
+				if onlyPcall, ok := depMap[match[1]]; !ok || onlyPcall {
+					depMap[match[1]] = pcall
+				}
 			}
 		}
 	}
@@ -149,28 +261,41 @@ func ReadDependenciesAndDatafiles(luaFile string) (deps, datafiles []string, err
 		}
 	}
 
-	for dep := range depMap {
-		deps = append(deps, dep)
+	for dep, pcall := range depMap {
+		deps = append(deps, Dependency{Module: dep, Pcall: pcall})
 	}
+	sort.Slice(deps, func(i, j int) bool {
+		return deps[i].Module < deps[j].Module
+	})
 
 	for df := range dfMap {
 		datafiles = append(datafiles, df)
 	}
+	sort.Strings(datafiles)
 
-	return deps, datafiles, nil
+	return deps, datafiles
 }
 
-func LoadLibrary(path string, allLibs map[string]*FirmwareLib, level int) (*FirmwareLib, error) {
-	lib := allLibs[path]
+// LoadLibrary loads the library in path and its dependencies. chain holds
+// the libraries that led to this one and is used to report circular
+// dependencies.
+func LoadLibrary(path string, libs *LibrarySet, chain []string) (*FirmwareLib, error) {
+	lib := libs.Libs[path]
 	if lib != nil {
 		return lib, nil
 	}
-	if level > 100 {
-		return nil, fmt.Errorf("Circular dependency in %q", path)
+	chain = append(chain[:len(chain):len(chain)], path)
+	for _, p := range chain[:len(chain)-1] {
+		if p == path {
+			return nil, fmt.Errorf("Circular library dependency: %s", formatChain(chain))
+		}
 	}
 
 	list, err := utils.EnumerateDir(path)
 	if err != nil {
+		if len(chain) > 1 {
+			return nil, fmt.Errorf("Cannot load library %s: %s", formatChain(chain), err)
+		}
 		return nil, err
 	}
 
@@ -244,20 +369,33 @@ func LoadLibrary(path string, allLibs map[string]*FirmwareLib, level int) (*Firm
 
 	var dependencies []*FirmwareLib
 	for _, depLibName := range libDef.Dependencies {
-		dep, err := LoadLibrary(depLibName, allLibs, level+1)
+		depPath, err := libs.resolve(depLibName)
 		if err != nil {
-			return nil, fmt.Errorf("Error resolving dependency %q of library %q", depLibName, path)
+			return nil, fmt.Errorf("Error resolving dependency %q of library %s: %s", depLibName, formatChain(chain), err)
+		}
+		dep, err := LoadLibrary(depPath, libs, chain)
+		if err != nil {
+			return nil, err
 		}
 		dependencies = append(dependencies, dep)
 	}
 
+	hash, err := hashLibrary(path, list)
+	if err != nil {
+		return nil, err
+	}
+
 	lib = &FirmwareLib{
+		Name:         libDef.Name,
+		Version:      libDef.Version,
+		Hash:         hash,
 		BasePath:     path,
 		Files:        entries,
+		Overrides:    libDef.Overrides,
 		Modules:      libDef.Modules,
 		Dependencies: dependencies,
 	}
-	allLibs[path] = lib
+	libs.Libs[path] = lib
 	return lib, nil
 }
 
@@ -293,39 +431,73 @@ func FindInLibraries(fileName string, libs []*FirmwareLib) (*FileEntry, error) {
 	return nil, ErrFileEntryNotFound
 }
 
-func AddFilesFromModule(moduleName string, libs []*FirmwareLib, fileMap map[string]*FileEntry) error {
+// MissingModuleError is returned when a required module cannot be found in
+// the libraries used by a device
+type MissingModuleError struct {
+	Module string
+	// Chain is the list of modules that led to the missing one
+	Chain []string
+}
+
+func (e *MissingModuleError) Error() string {
+	if len(e.Chain) == 1 {
+		return fmt.Sprintf("Cannot find module %q (%s)", e.Module, Mod2File(e.Module))
+	}
+	return fmt.Sprintf("Cannot find module %q (%s) required by %s", e.Module, Mod2File(e.Module), formatChain(e.Chain[:len(e.Chain)-1]))
+}
+
+func formatChain(chain []string) string {
+	return strings.Join(chain, " → ")
+}
+
+// AddFilesFromModule adds the file of a module and, recursively, of the
+// modules it requires to fileMap. Circular requires are reported but
+// accepted, since they work as long as one of the requires in the cycle runs
+// lazily.
+func AddFilesFromModule(moduleName string, files map[string]*FileEntry, fileMap map[string]*FileEntry, chain []string) error {
+	chain = append(chain[:len(chain):len(chain)], moduleName)
+	for _, m := range chain[:len(chain)-1] {
+		if m == moduleName {
+			Log.Printf("WARNING: circular require %s\n", formatChain(chain))
+			return nil
+		}
+	}
 	moduleFileName := Mod2File(moduleName)
 	if _, ok := fileMap[moduleFileName]; ok {
 		return nil
 	}
-	entry, err := FindInLibraries(moduleFileName, libs)
-	if err != nil {
-		return fmt.Errorf("Error finding %s: %s", moduleFileName, err)
+	entry, ok := files[moduleFileName]
+	if !ok {
+		return &MissingModuleError{Module: moduleName, Chain: chain}
 	}
 	fileMap[moduleFileName] = entry
 	for _, dep := range entry.Dependencies {
-		if err := AddFilesFromModule(dep, libs, fileMap); err != nil {
-			return fmt.Errorf("Cannot resolve dependency %q of %s: %s", dep, entry.Path, err)
+		if err := AddFilesFromModule(dep.Module, files, fileMap, chain); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func AddOtherFiles(libs []*FirmwareLib, fileMap map[string]*FileEntry) error {
-	for _, lib := range libs {
-		for path, entry := range lib.Files {
-			if !isLua(path) {
-				fileMap[path] = entry
-			}
+// librariesProviding lists the loaded libraries that contain the given file
+func librariesProviding(fileName string, libs *LibrarySet) []string {
+	var names []string
+	for _, lib := range libs.Libs {
+		if _, ok := lib.Files[fileName]; ok {
+			names = append(names, lib.BasePath)
 		}
 	}
-	return nil
+	sort.Strings(names)
+	return names
 }
 
-func AddDeviceSpecificFiles(deviceRootLib *FirmwareLib, fileMap map[string]*FileEntry) {
-	for _, fe := range deviceRootLib.Files {
-		fileMap[fe.Path] = fe
+func AddOtherFiles(files map[string]*FileEntry, fileMap map[string]*FileEntry) error {
+	for path, entry := range files {
+		if !isLua(path) {
+			fileMap[path] = entry
+		}
 	}
+	return nil
 }
 
 func removeDuplicateModules(mods []ModuleDef) []ModuleDef {
@@ -345,6 +517,15 @@ func removeDuplicateModules(mods []ModuleDef) []ModuleDef {
 	return mods
 }
 
+// ReadContent returns the bytes of the file, either from memory for virtual
+// entries or from disk
+func (fe *FileEntry) ReadContent() ([]byte, error) {
+	if fe.Content != nil {
+		return fe.Content, nil
+	}
+	return ioutil.ReadFile(filepath.Join(fe.Base, fe.Path))
+}
+
 func NewVirtualFileEntry(data []byte, path string) *FileEntry {
 	var fe FileEntry
 	fe.Path = path
@@ -426,21 +607,8 @@ func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		for file, content := range LFSEmbeddedFiles {
-			if err := extractFile(file, content, tmpDir); err != nil {
-				return err
-			}
-		}
-
-		for file := range LFSEmbeddedFiles {
-			lfsFiles = append(lfsFiles, &FileEntry{
-				Base: tmpDir,
-				Path: file,
-			})
-		}
-
 		lfsFile := filepath.Join(tmpDir, fmt.Sprintf("%s.lfs", lfsHash))
-		if err := Luac(lfsFiles, lfsFile); err != nil {
+		if err := Luac(withLFSEmbeddedFiles(lfsFiles), lfsFile); err != nil {
 			return fmt.Errorf("Error compiling lua firmware for %s: %s", manifest.DeviceInfo.Name, err)
 		}
 		lfsData, err := ioutil.ReadFile(lfsFile)
@@ -449,7 +617,8 @@ func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
 		}
 		lfsFileEntry := NewVirtualFileEntry(lfsData, "lfs.img")
 		lfsFileEntry.Hash, err = utils.HashFile(lfsFile)
-		lfsFileEntry.Datafiles = lfsDatafiles
+		lfsFileEntry.Datafiles = sortUnique(lfsDatafiles)
+		lfsFileEntry.LFSFiles = lfsFiles
 		if err != nil {
 			return fmt.Errorf("Error hasing lfs file %s for %s: %s", lfsFile, manifest.DeviceInfo.Name, err)
 		}
@@ -459,37 +628,84 @@ func packLFS(manifest *FirmwareManifest, LFSConfig FirmwareLFSConfig) error {
 	return nil
 }
 
-func buildDeviceFirmwareManifest(deviceRootLib *FirmwareLib, fwDef FirmwareDef) (*FirmwareManifest, error) {
-	usedLibs := getLibraryList(deviceRootLib, nil)
+// withLFSEmbeddedFiles returns the sources of an LFS image followed by the
+// files every image embeds, in a stable order
+func withLFSEmbeddedFiles(sources []*FileEntry) []*FileEntry {
+	files := append([]*FileEntry(nil), sources...)
+	var embedded []string
+	for file := range LFSEmbeddedFiles {
+		embedded = append(embedded, file)
+	}
+	sort.Strings(embedded)
+	for _, file := range embedded {
+		files = append(files, NewVirtualFileEntry([]byte(LFSEmbeddedFiles[file]), file))
+	}
+	return files
+}
 
+// deviceModules returns the modules a device runs: those declared by the
+// device and the libraries it uses, plus the main module
+func deviceModules(deviceRootLib *FirmwareLib, usedLibs []*FirmwareLib) []ModuleDef {
 	var modules []ModuleDef
 	modules = append(modules, deviceRootLib.Modules...)
 	for _, lib := range usedLibs {
 		modules = append(modules, lib.Modules...)
 	}
 	modules = removeDuplicateModules(modules)
-	modules = append(modules, MainModule)
+	return append(modules, MainModule)
+}
+
+func buildDeviceFirmwareManifest(deviceRootLib *FirmwareLib, fwDef FirmwareDef, allLibs *LibrarySet, store *secrets.Store) (*FirmwareManifest, error) {
+	usedLibs := getLibraryList(deviceRootLib, nil)
+	var usedSecrets bool
+	modules, err := configureModules(deviceModules(deviceRootLib, usedLibs), fwDef, deviceVarLookup(fwDef, store, &usedSecrets))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkOverrides(usedLibs, fwDef); err != nil {
+		return nil, err
+	}
+	files, conflicts := buildFileIndex(usedLibs, fwDef)
+	if len(conflicts) > 0 {
+		return nil, conflictError(conflicts)
+	}
+	if err := preprocessFiles(files, fwDef); err != nil {
+		return nil, err
+	}
 
 	fileMap := make(map[string]*FileEntry)
 	for _, modDef := range modules {
-		if err := AddFilesFromModule(modDef.Name, usedLibs, fileMap); err != nil {
-			return nil, fmt.Errorf("Cannot add files from module %s: %s. Are you including the library where %s is defined?", modDef.Name, err, modDef.Name)
+		if err := AddFilesFromModule(modDef.Name, files, fileMap, nil); err != nil {
+			if missing, ok := err.(*MissingModuleError); ok {
+				candidates := librariesProviding(Mod2File(missing.Module), allLibs)
+				if len(candidates) > 0 {
+					return nil, fmt.Errorf("%s. It is provided by %s; add one of them to the dependencies of the device", err, strings.Join(candidates, ", "))
+				}
+				return nil, fmt.Errorf("%s. No loaded library provides it", err)
+			}
+			return nil, err
 		}
 	}
 
-	if err := AddOtherFiles(usedLibs, fileMap); err != nil {
+	if err := AddOtherFiles(files, fileMap); err != nil {
 		return nil, fmt.Errorf("Error adding other files in device %s: %s", fwDef.Name, err)
 	}
 
-	AddDeviceSpecificFiles(deviceRootLib, fileMap)
-
-	modbytes, err := json.MarshalIndent(modules, "", "\t")
-	if err != nil {
-		return nil, err
+	delete(fileMap, "modules.json") // generated once the final file names are known
+	if entry, ok := fileMap[fwDef.varsFile()]; ok && entry.Base == deviceRootLib.BasePath {
+		delete(fileMap, entry.Path) // only used at build time
 	}
-	fileMap["modules.json"] = NewVirtualFileEntry(modbytes, "modules.json")
 	fileMap["init.lua"] = NewVirtualFileEntry([]byte(initializer.InitLua), "init.lua")
 	fileMap["__espore.lua"] = NewVirtualFileEntry([]byte(session.EsporeLua), "__espore.lua")
+	if len(fwDef.Secrets) > 0 {
+		if entry, ok := fileMap[SecretsFile]; ok {
+			return nil, fmt.Errorf("%s is generated from the declared secrets but %s also provides it", SecretsFile, entry.Base)
+		}
+		if fileMap[SecretsFile], err = secretsFileEntry(fwDef, store); err != nil {
+			return nil, err
+		}
+	}
 
 	var manifest FirmwareManifest
 	manifest.DeviceInfo = fwDef.DeviceInfo
@@ -498,162 +714,323 @@ func buildDeviceFirmwareManifest(deviceRootLib *FirmwareLib, fwDef FirmwareDef)
 	for _, file := range fileMap {
 		manifest.Files = append(manifest.Files, file)
 	}
+	sortFiles(manifest.Files)
 	manifest.NodeMCUFirmware = fwDef.NodeMCUFirmware
+	manifest.NodeMCUFirmwareOffset = fwDef.NodeMCUFirmwareOffset
+	manifest.Compress = fwDef.Compress
+	if fwDef.LFS.Flash != nil {
+		flashConfig := *fwDef.LFS.Flash
+		if flashConfig.Mapped == 0 {
+			flashConfig.Mapped = esp8266FlashMapped + flashConfig.Base
+		}
+		manifest.LFSFlash = &flashConfig
+	}
+	if fwDef.SPIFFS != nil {
+		spiffsConfig := *fwDef.SPIFFS
+		if spiffsConfig.Size == 0 {
+			spiffsConfig.Size = fwDef.SPIFFSSize
+		}
+		manifest.SPIFFS = &spiffsConfig
+	}
 
 	err = packLFS(&manifest, fwDef.LFS)
 	if err != nil {
 		return nil, err
 	}
 
+	if fwDef.Minify.Enabled {
+		if err := minifyFiles(&manifest, fwDef.Minify); err != nil {
+			return nil, err
+		}
+	}
+
+	if fwDef.Compile.Enabled {
+		if err := compileFiles(&manifest, fwDef.Compile); err != nil {
+			return nil, err
+		}
+		setModuleFiles(modules, manifest.Files)
+	}
+
+	modbytes, err := json.MarshalIndent(modules, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	modulesEntry := NewVirtualFileEntry(modbytes, "modules.json")
+	if usedSecrets {
+		modulesEntry.Hash = "" // see secretsFileEntry
+	}
+	manifest.Files = append(manifest.Files, modulesEntry)
+
 	return &manifest, nil
 }
 
-func writeFileToImage(imageFile io.Writer, path string, size int64, sourceFile io.Reader) error {
-	fmt.Fprintln(imageFile, path)
-	fmt.Fprintln(imageFile, size)
-	_, err := io.Copy(imageFile, sourceFile)
-	return err
+func sortFiles(files []*FileEntry) {
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Compare(files[i].Path, files[j].Path) < 0
+	})
+}
+
+func sortUnique(list []string) []string {
+	sort.Strings(list)
+	unique := list[:0]
+	for i, st := range list {
+		if i == 0 || st != list[i-1] {
+			unique = append(unique, st)
+		}
+	}
+	return unique
 }
 
-func writeFirmwareImage(manifest *FirmwareManifest, outputDir string) error {
+// encodeFirmwareImage packs the files of the manifest into a signed image
+func encodeFirmwareImage(manifest *FirmwareManifest, keyring *signing.Keyring) (*image.Image, []byte, error) {
 
 	// sort the files alphabetically to avoid variations in order that would affect
 	// the checksum
-	sort.Slice(manifest.Files, func(i, j int) bool {
-		return strings.Compare(manifest.Files[i].Path, manifest.Files[j].Path) < 0
-	})
+	sortFiles(manifest.Files)
 
 	var datafiles = []string{} // init like this so when converting to JSON we get an empty array
 
 	for _, fe := range manifest.Files {
 		datafiles = append(datafiles, fe.Datafiles...)
 	}
+	datafiles = sortUnique(datafiles)
 
-	imgFilename := filepath.Join(outputDir, fmt.Sprintf("%s.img", manifest.ID))
-	imgFile, err := os.Create(imgFilename)
-	if err != nil {
-		return err
+	img := &image.Image{
+		DeviceID:   manifest.ID,
+		DeviceName: manifest.Name,
 	}
-	defer imgFile.Close()
-	var imgBuf = &bytes.Buffer{}
-	fmt.Fprintf(imgBuf, "Version: 1 -- ESPore Device Image File\n")
-	fmt.Fprintf(imgBuf, "Device Id: %s\n", manifest.ID)
-	fmt.Fprintf(imgBuf, "Device Name: %s\n", manifest.Name)
-	fmt.Fprintf(imgBuf, "Total files: %d\n", len(manifest.Files)+1)
-	fmt.Fprintln(imgBuf)
-
 	for _, fe := range manifest.Files {
-		err := func() error {
-			var r io.Reader
-			var size int64
-			if fe.Content != nil {
-				r = bytes.NewReader(fe.Content)
-				size = int64(len(fe.Content))
-			} else {
-				path := filepath.Join(fe.Base, fe.Path)
-				f, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-				fi, err := f.Stat()
-				if err != nil {
-					return err
-				}
-				r = f
-				size = fi.Size()
-			}
-			if err := writeFileToImage(imgBuf, fe.Path, size, r); err != nil {
-				return err
-			}
-			return nil
-		}()
+		content, err := fe.ReadContent()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		img.Files = append(img.Files, &image.File{Path: fe.Path, Data: content})
 	}
 	datafilesJSON, err := json.Marshal(datafiles)
-	if err := writeFileToImage(imgBuf, "datafiles.json", int64(len(datafilesJSON)), bytes.NewReader(datafilesJSON)); err != nil {
-		return err
+	if err != nil {
+		return nil, nil, err
+	}
+	img.Files = append(img.Files, &image.File{Path: "datafiles.json", Data: datafilesJSON})
+	if !keyring.Empty() {
+		// devices replace their keys with those of the project, so keys are
+		// rotated and retired over the air
+		keys, err := keyring.DeviceKeysUpdate()
+		if err != nil {
+			return nil, nil, err
+		}
+		img.Files = append(img.Files, &image.File{Path: signing.DeviceKeysUpdateFile, Data: keys})
 	}
 
-	var hash string
-	hasher := sha1.New()
-	_, err = io.Copy(imgFile, io.TeeReader(imgBuf, hasher))
+	if manifest.Compress {
+		saved := img.Compress()
+		Log.Printf("Compression saves %d bytes in the image of %s\n", saved, manifest.Name)
+	}
+	imgBytes, err := encodeImage(img, keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, imgBytes, nil
+}
+
+func writeFirmwareImage(manifest *FirmwareManifest, outputDir string, keyring *signing.Keyring) error {
+	img, imgBytes, err := encodeFirmwareImage(manifest, keyring)
 	if err != nil {
 		return err
 	}
+	return writeEncodedFirmwareImage(manifest, img, imgBytes, outputDir, keyring)
+}
 
-	hash = hex.EncodeToString(hasher.Sum(nil))
-	if err = ioutil.WriteFile(imgFilename+".hash", []byte(hash), 0666); err != nil {
+// writeEncodedFirmwareImage writes an image built by encodeFirmwareImage and
+// the flash images derived from it
+func writeEncodedFirmwareImage(manifest *FirmwareManifest, img *image.Image, imgBytes []byte, outputDir string, keyring *signing.Keyring) error {
+	imgFilename := filepath.Join(outputDir, fmt.Sprintf("%s.img", manifest.ID))
+	if err := ioutil.WriteFile(imgFilename, imgBytes, 0666); err != nil {
+		return err
+	}
+	sum := sha1.Sum(imgBytes)
+	hash := hex.EncodeToString(sum[:])
+	err := ioutil.WriteFile(imgFilename+".hash", []byte(hash), 0666)
+	if err != nil {
 		return err
 	}
 
+	if manifest.LFSFlash != nil {
+		if err := writeLFSFlashImage(manifest, outputDir); err != nil {
+			return fmt.Errorf("Cannot write LFS flash image: %s", err)
+		}
+	}
+	if manifest.SPIFFS != nil {
+		if err := writeSPIFFSImage(manifest, img, imgBytes, outputDir, keyring); err != nil {
+			return fmt.Errorf("Cannot write SPIFFS image: %s", err)
+		}
+	}
+
 	if manifest.NodeMCUFirmware != "" {
 		binFilename := filepath.Join(outputDir, fmt.Sprintf("%s.bin", manifest.ID))
 		hash, err = utils.CopyFile(manifest.NodeMCUFirmware, binFilename, true)
 		if err != nil {
 			return fmt.Errorf("Cannot copy NodeMCU firmware image %s to %s: %s", manifest.NodeMCUFirmware, outputDir, err)
 		}
-		err = ioutil.WriteFile(binFilename+".hash", []byte(hash), 0666)
+		if err = ioutil.WriteFile(binFilename+".hash", []byte(hash), 0666); err != nil {
+			return err
+		}
+		err = writeFirmwareRegion(manifest, binFilename)
 	}
 
 	return err
 }
 
-func Build(config *config.BuildConfig) error {
-	if err := utils.RemoveDirContents(config.Output); err != nil {
-		return fmt.Errorf("cannot remove output dir (%s) contents: %s", config.Output, err)
-	}
+// Device is a device definition found in the project
+type Device struct {
+	Path     string
+	RootLib  *FirmwareLib
+	Firmware FirmwareDef
+}
 
-	allLibs := make(map[string]*FirmwareLib)
+// loadProject loads all the libraries and device definitions referenced by
+// the build configuration
+func loadProject(config *config.BuildConfig) (*LibrarySet, []*Device, error) {
+	lock, err := readLockFile(config.GetLockFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	return loadLibraries(config, lock)
+}
 
+func loadDevices(config *config.BuildConfig, allLibs *LibrarySet) ([]*Device, error) {
 	for _, libGlob := range config.Libs {
 		libNames, _ := filepath.Glob(libGlob)
 		for _, libName := range libNames {
 			fi, err := os.Stat(libName)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if fi.IsDir() {
-				_, err = LoadLibrary(libName, allLibs, 0)
+				_, err = LoadLibrary(libName, allLibs, nil)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 		}
 	}
 
+	var devices []*Device
 	for _, deviceDef := range config.Devices {
-		devices, _ := filepath.Glob(deviceDef)
-		for _, devicePath := range devices {
+		devicePaths, _ := filepath.Glob(deviceDef)
+		for _, devicePath := range devicePaths {
 			fi, err := os.Stat(devicePath)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if fi.IsDir() {
-				deviceRootLib, err := LoadLibrary(devicePath, allLibs, 0)
+				deviceRootLib, err := LoadLibrary(devicePath, allLibs, nil)
 				if err != nil {
-					return err
+					return nil, err
 				}
 
-				var fwDef FirmwareDef
 				deviceName := filepath.Base(devicePath)
-				if err := utils.ReadJSON(filepath.Join(devicePath, "firmware.json"), &fwDef); err != nil {
-					return fmt.Errorf("Cannot read firmware file for %s in %s: %s", deviceName, devicePath, err)
-				}
-
-				manifest, err := buildDeviceFirmwareManifest(deviceRootLib, fwDef)
+				fwDef, err := ReadFirmwareDef(devicePath)
 				if err != nil {
-					return fmt.Errorf("Error building device firmware for device with name %q: %s", fi.Name(), err)
+					return nil, fmt.Errorf("Cannot read firmware file for %s in %s: %s", deviceName, devicePath, err)
 				}
-				if err := utils.WriteJSON(filepath.Join(config.Output, manifest.ID+".json"), manifest); err != nil {
-					return err
+				if err := loadVars(devicePath, &fwDef); err != nil {
+					return nil, fmt.Errorf("%s: %s", deviceName, err)
 				}
-				if err = writeFirmwareImage(manifest, config.Output); err != nil {
-					return fmt.Errorf("Error writing firmware image for %s: %s", devicePath, err)
+				if deviceRootLib, err = withFirmwareLibs(deviceRootLib, fwDef, allLibs); err != nil {
+					return nil, err
 				}
+				devices = append(devices, &Device{
+					Path:     devicePath,
+					RootLib:  deviceRootLib,
+					Firmware: fwDef,
+				})
+			}
+		}
+	}
+	if config.Inventory != "" {
+		inventoryDevices, err := loadInventoryDevices(config.Inventory, allLibs)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, inventoryDevices...)
+	}
+	if err := checkDeviceIDs(devices); err != nil {
+		return nil, err
+	}
+	if err := applyProfile(config, devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// Build builds the image of every device in the project. Secret values are
+// redacted from the log and the returned error.
+func Build(config *config.BuildConfig) error {
+	store, err := loadSecrets(config)
+	if err != nil {
+		return err
+	}
+	defer func(logger Logger) {
+		Log = logger
+	}(Log)
+	Log = &redactingLogger{logger: Log, secrets: store}
+	return store.RedactError(build(config, store))
+}
+
+func build(config *config.BuildConfig, store *secrets.Store) error {
+	if err := os.MkdirAll(config.Output, 0755); err != nil {
+		return err
+	}
+	if err := utils.RemoveDirContents(config.Output); err != nil {
+		return fmt.Errorf("cannot remove output dir (%s) contents: %s", config.Output, err)
+	}
+
+	libs, devices, err := loadProject(config)
+	if err != nil {
+		return err
+	}
+	if err := checkLockFile(config.GetLockFile(), libs); err != nil {
+		return err
+	}
+	info, err := readBuildInfo()
+	if err != nil {
+		return err
+	}
+	keyring, err := LoadKeyring(config)
+	if err != nil {
+		return err
+	}
 
+	for _, device := range devices {
+		manifest, err := buildDeviceFirmwareManifest(device.RootLib, device.Firmware, libs, store)
+		if err != nil {
+			return fmt.Errorf("Error building device firmware for device with name %q: %s", device.Firmware.Name, err)
+		}
+		version, err := addVersionFile(manifest, device.Firmware, info)
+		if err != nil {
+			return fmt.Errorf("Error generating %s for %s: %s", VersionFile, device.Firmware.Name, err)
+		}
+		img, imgBytes, err := encodeFirmwareImage(manifest, keyring)
+		if err != nil {
+			return fmt.Errorf("Error building firmware image for %s: %s", device.Path, err)
+		}
+		// check the budget first, so an oversized firmware leaves no image,
+		// delta or history entry behind
+		if err = reportSize(manifest, device.Firmware, int64(len(imgBytes)), config.Output); err != nil {
+			return err
+		}
+		if err := utils.WriteJSON(filepath.Join(config.Output, manifest.ID+".json"), manifest); err != nil {
+			return err
+		}
+		if err = writeEncodedFirmwareImage(manifest, img, imgBytes, config.Output, keyring); err != nil {
+			return fmt.Errorf("Error writing firmware image for %s: %s", device.Path, err)
+		}
+		if err = writeVersionFile(version, manifest.ID, config.Output); err != nil {
+			return err
+		}
+		if config.Deltas > 0 {
+			if err = writeDeltaImages(config, manifest.ID, keyring); err != nil {
+				return fmt.Errorf("Error writing delta images for %s: %s", device.Path, err)
 			}
 		}
 	}
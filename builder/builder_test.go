@@ -0,0 +1,96 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"espore/builder/image"
+	"espore/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// quietLogger drops the build log
+type quietLogger struct{}
+
+func (ql *quietLogger) Printf(format string, a ...interface{}) {}
+
+func TestMain(m *testing.M) {
+	builder.Log = &quietLogger{}
+	os.Exit(m.Run())
+}
+
+// newProject writes files, given by their path relative to a new project
+// directory, and returns the build configuration of the project: devices in
+// devices/*, libraries in libs/*, and every other file inside the project
+func newProject(t *ut.DefaultTestTools, files map[string]string) *config.BuildConfig {
+	dir, err := ioutil.TempDir("", "espore-builder")
+	t.Ok(err)
+	for path, content := range files {
+		writeProjectFile(t, dir, path, content)
+	}
+	t.Ok(os.MkdirAll(filepath.Join(dir, "dist"), 0755))
+	return &config.BuildConfig{
+		Libs:        []string{filepath.Join(dir, "libs", "*")},
+		Devices:     []string{filepath.Join(dir, "devices", "*")},
+		Output:      filepath.Join(dir, "dist"),
+		LockFile:    filepath.Join(dir, config.DefaultLockFile),
+		Secrets:     filepath.Join(dir, config.DefaultSecretsFile),
+		SigningKeys: filepath.Join(dir, config.DefaultSigningKeysFile),
+		History:     filepath.Join(dir, config.DefaultHistoryDir),
+	}
+}
+
+// buildProject creates a project with newProject and returns its directory
+// and a function building it. configure, if not nil, adjusts the build
+// configuration of the project before it is built.
+func buildProject(t *ut.DefaultTestTools, files map[string]string, configure func(config *config.BuildConfig)) (string, func() error) {
+	config := newProject(t, files)
+	if configure != nil {
+		configure(config)
+	}
+	return projectDir(config), func() error {
+		return builder.Build(config)
+	}
+}
+
+// firmware returns a firmware.json with the given fields that keeps every
+// file in SPIFFS, so builds do not need luac.cross
+func firmware(fields string) string {
+	return `{"lfs": {"exclude": ["*", "**/*"]}, ` + fields + `}`
+}
+
+// devFirmware is the firmware.json of the device most tests build
+var devFirmware = firmware(`"id": "1", "name": "dev"`)
+
+// projectDir returns the directory of a project created with newProject
+func projectDir(config *config.BuildConfig) string {
+	return filepath.Dir(config.Output)
+}
+
+func writeProjectFile(t *ut.DefaultTestTools, dir, path, content string) {
+	path = filepath.Join(dir, filepath.FromSlash(path))
+	t.Ok(os.MkdirAll(filepath.Dir(path), 0755))
+	t.Ok(ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+// readImage returns the device name and the files of an image
+func readImage(t *ut.DefaultTestTools, file string) (string, map[string]string) {
+	img, err := image.ReadFile(file)
+	t.Ok(err)
+	files := make(map[string]string)
+	for _, f := range img.Files {
+		files[f.Path] = string(f.Data)
+	}
+	return img.DeviceName, files
+}
+
+// imageFile returns the contents of a file in the image built for device 1
+func imageFile(t *ut.DefaultTestTools, dir, path string) string {
+	_, files := readImage(t, filepath.Join(dir, "dist", "1.img"))
+	data, ok := files[path]
+	t.Assert(ok, "%s not found in the image", path)
+	return data
+}
@@ -0,0 +1,72 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compileFiles replaces the Lua sources that stay in SPIFFS with bytecode
+// compiled by luac.cross, so the device does not have to compile them at
+// require time. init.lua is kept as source since the firmware only runs
+// init.lua on boot.
+func compileFiles(manifest *FirmwareManifest, config FirmwareCompileConfig) error {
+	tmpDir, err := ioutil.TempDir("", "espore-luac")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i, fe := range manifest.Files {
+		if !isLua(fe.Path) || fe.Path == "init.lua" {
+			continue
+		}
+		src, err := fe.ReadContent()
+		if err != nil {
+			return fmt.Errorf("Error reading %s for compilation: %s", fe.Path, err)
+		}
+		// relative names keep the temp dir out of the debug info
+		name := strings.ReplaceAll(fe.Path, "/", ",")
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), src, 0666); err != nil {
+			return err
+		}
+		args := []string{"-o", lcFile(name)}
+		if config.Strip {
+			args = append(args, "-s")
+		}
+		if err := luacCross(tmpDir, append(args, name)...); err != nil {
+			return fmt.Errorf("Error compiling %s for %s: %s", fe.Path, manifest.Name, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, lcFile(name)))
+		if err != nil {
+			return err
+		}
+		compiled := NewVirtualFileEntry(data, lcFile(fe.Path))
+		compiled.Base = fe.Base
+		compiled.Datafiles = fe.Datafiles
+		compiled.Dependencies = fe.Dependencies
+		manifest.Files[i] = compiled
+	}
+	return nil
+}
+
+// setModuleFiles records in each module definition the compiled file that
+// implements it, if any
+func setModuleFiles(modules []ModuleDef, files []*FileEntry) {
+	compiled := make(map[string]bool)
+	for _, fe := range files {
+		compiled[fe.Path] = true
+	}
+	for i := range modules {
+		lc := lcFile(Mod2File(modules[i].Name))
+		if compiled[lc] {
+			modules[i].File = lc
+		}
+	}
+}
+
+func lcFile(luaFile string) string {
+	return strings.TrimSuffix(luaFile, ".lua") + ".lc"
+}
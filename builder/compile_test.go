@@ -0,0 +1,73 @@
+package builder_test
+
+import (
+	"encoding/json"
+	"espore/builder"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// fakeLuacCross puts a luac.cross on the PATH that writes its arguments
+// followed by the source, and returns a function restoring the PATH
+func fakeLuacCross(t *ut.DefaultTestTools, dir string) func() {
+	script := `#!/bin/sh
+out=""
+src=""
+flags=""
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-o) out="$2"; shift 2;;
+	-*) flags="$flags $1"; shift;;
+	*) src="$1"; shift;;
+	esac
+done
+{ echo "luac$flags"; cat "$src"; } > "$out"
+`
+	binDir := filepath.Join(dir, "bin")
+	t.Ok(os.MkdirAll(binDir, 0755))
+	t.Ok(ioutil.WriteFile(filepath.Join(binDir, "luac.cross"), []byte(script), 0755))
+	path := os.Getenv("PATH")
+	t.Ok(os.Setenv("PATH", binDir+string(os.PathListSeparator)+path))
+	return func() {
+		os.Setenv("PATH", path)
+	}
+}
+
+func TestCompile(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+	if runtime.GOOS == "windows" {
+		tx.Skip("the fake luac.cross is a shell script")
+	}
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json":  firmware(`"id": "1", "name": "dev", "compile": {"enabled": true, "strip": true}`),
+		"devices/dev/main.lua":       `require("net.client")`,
+		"devices/dev/net/client.lua": "return {}",
+		"devices/dev/data.json":      "{}",
+	})
+	dir := projectDir(config)
+	defer os.RemoveAll(dir)
+	defer fakeLuacCross(t, dir)()
+	t.Ok(builder.Build(config))
+
+	// nested modules are compiled under their relative name, stripped
+	t.Equals("luac -s\nreturn {}", imageFile(t, dir, "net/client.lc"))
+	t.Equals("luac -s\n"+`require("net.client")`, imageFile(t, dir, "main.lc"))
+	t.Equals("{}", imageFile(t, dir, "data.json"))
+	t.Assert(strings.Contains(imageFile(t, dir, "init.lua"), "function"), "init.lua must stay as source")
+
+	var modules []builder.ModuleDef
+	t.Ok(json.Unmarshal([]byte(imageFile(t, dir, "modules.json")), &modules))
+	files := make(map[string]string)
+	for _, mod := range modules {
+		files[mod.Name] = mod.File
+	}
+	t.Equals("main.lc", files["main"])
+}
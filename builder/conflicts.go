@@ -0,0 +1,141 @@
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// FileConflict is a path provided by more than one of the libraries used by a
+// device, with no override saying which one wins
+type FileConflict struct {
+	Path      string
+	Libraries []*FirmwareLib
+}
+
+func (fc *FileConflict) String() string {
+	var names []string
+	for _, lib := range fc.Libraries {
+		names = append(names, lib.Name)
+	}
+	return fmt.Sprintf("%s is provided by %s", fc.Path, strings.Join(names, ", "))
+}
+
+func conflictError(conflicts []*FileConflict) error {
+	var lines []string
+	for _, c := range conflicts {
+		lines = append(lines, "  "+c.String())
+	}
+	return fmt.Errorf("Conflicting file paths:\n%s\nList the path in \"overrides\" in the library.json of the library that should win, or map it to that library in the \"overrides\" of firmware.json", strings.Join(lines, "\n"))
+}
+
+func matchLibrary(lib *FirmwareLib, name string) bool {
+	return lib.Name == name || lib.BasePath == name
+}
+
+// declaresOverride tells whether the library.json of lib lists path in its
+// overrides. Entries are globs, so a library can override a whole directory.
+func declaresOverride(lib *FirmwareLib, path string) bool {
+	for _, o := range lib.Overrides {
+		g, err := glob.Compile(o, '/')
+		if err == nil && g.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOverrides makes sure every firmware.json override maps its path to one
+// of the libraries used by the device that provides the path
+func checkOverrides(usedLibs []*FirmwareLib, fwDef FirmwareDef) error {
+	var paths []string
+	for path := range fwDef.Overrides {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		name := fwDef.Overrides[path]
+		var lib *FirmwareLib
+		for _, l := range usedLibs {
+			if matchLibrary(l, name) {
+				lib = l
+				break
+			}
+		}
+		if lib == nil {
+			return fmt.Errorf("Unknown library %q in the override of %s in firmware.json of %s", name, path, fwDef.Name)
+		}
+		if _, ok := lib.Files[path]; !ok {
+			return fmt.Errorf("Library %q in the override of %s in firmware.json of %s does not provide that file", name, path, fwDef.Name)
+		}
+	}
+	return nil
+}
+
+// buildFileIndex merges the files of the libraries used by a device into a
+// single map. usedLibs is the list returned by getLibraryList, so the last
+// library is the root one: the device directory, or the library under test.
+// When several libraries ship the same path, firmware.json overrides take
+// precedence, then the root library, logging the files it shadows, then a
+// single library declaring the path in its library.json overrides. Any other
+// collision is returned as a conflict; the index then holds the entry of the
+// first library so callers that only inspect the device, like the graph, can
+// still work.
+func buildFileIndex(usedLibs []*FirmwareLib, fwDef FirmwareDef) (map[string]*FileEntry, []*FileConflict) {
+	var rootLib *FirmwareLib
+	if len(usedLibs) > 0 {
+		rootLib = usedLibs[len(usedLibs)-1]
+	}
+	providers := make(map[string][]*FirmwareLib)
+	var paths []string
+	for _, lib := range usedLibs {
+		for path := range lib.Files {
+			if _, ok := providers[path]; !ok {
+				paths = append(paths, path)
+			}
+			providers[path] = append(providers[path], lib)
+		}
+	}
+	sort.Strings(paths)
+
+	files := make(map[string]*FileEntry)
+	var conflicts []*FileConflict
+	for _, path := range paths {
+		libs := providers[path]
+		winner := libs[0]
+		if len(libs) > 1 {
+			var candidates []*FirmwareLib
+			if name, ok := fwDef.Overrides[path]; ok {
+				for _, lib := range libs {
+					if matchLibrary(lib, name) {
+						candidates = append(candidates, lib)
+					}
+				}
+			} else if _, ok := rootLib.Files[path]; ok {
+				candidates = append(candidates, rootLib)
+				var shadowed []string
+				for _, lib := range libs {
+					if lib != rootLib {
+						shadowed = append(shadowed, lib.Name)
+					}
+				}
+				Log.Printf("%s of %s shadows the one in %s\n", path, rootLib.Name, strings.Join(shadowed, ", "))
+			} else {
+				for _, lib := range libs {
+					if declaresOverride(lib, path) {
+						candidates = append(candidates, lib)
+					}
+				}
+			}
+			if len(candidates) == 1 {
+				winner = candidates[0]
+			} else {
+				conflicts = append(conflicts, &FileConflict{Path: path, Libraries: libs})
+			}
+		}
+		files[path] = winner.Files[path]
+	}
+	return files, conflicts
+}
@@ -0,0 +1,107 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"espore/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// conflictFiles returns a device requiring util.lua, which libraries a and b
+// both ship, with the given files added or replaced
+func conflictFiles(changes map[string]string) map[string]string {
+	files := map[string]string{
+		"libs/a/library.json":       `{"name": "a"}`,
+		"libs/a/util.lua":           "return 'a'",
+		"libs/b/library.json":       `{"name": "b"}`,
+		"libs/b/util.lua":           "return 'b'",
+		"devices/dev/firmware.json": devFirmware,
+		"devices/dev/main.lua":      `local util = require("util")`,
+	}
+	for path, content := range changes {
+		files[path] = content
+	}
+	return files
+}
+
+// dependOnLibraries makes the device depend on libraries a and b
+func dependOnLibraries(t *ut.DefaultTestTools) func(config *config.BuildConfig) {
+	return func(config *config.BuildConfig) {
+		dir := projectDir(config)
+		writeProjectFile(t, dir, "devices/dev/library.json",
+			`{"dependencies": ["`+filepath.Join(dir, "libs", "a")+`", "`+filepath.Join(dir, "libs", "b")+`"]}`)
+	}
+}
+
+func TestConflict(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, build := buildProject(t, conflictFiles(nil), dependOnLibraries(t))
+	defer os.RemoveAll(dir)
+	err := build()
+	t.Assert(err != nil, "expected a conflict")
+	t.Assert(strings.Contains(err.Error(), "util.lua is provided by a, b"), "unexpected error: %s", err)
+}
+
+func TestDeviceOverridesLibraries(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, build := buildProject(t, conflictFiles(map[string]string{
+		"devices/dev/util.lua": "return 'device'",
+	}), dependOnLibraries(t))
+	defer os.RemoveAll(dir)
+	defer func(logger builder.Logger) {
+		builder.Log = logger
+	}(builder.Log)
+	logger := &recordingLogger{}
+	builder.Log = logger
+
+	t.Ok(build())
+	t.Equals("return 'device'", imageFile(t, dir, "util.lua"))
+	// the shadowed files do not go unnoticed
+	shadows := "util.lua of " + filepath.Join(dir, "devices", "dev") + " shadows the one in a, b\n"
+	var logged bool
+	for _, line := range logger.lines {
+		logged = logged || line == shadows
+	}
+	t.Assert(logged, "expected %q in the build log:\n%s", shadows, strings.Join(logger.lines, ""))
+}
+
+func TestFirmwareOverride(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// firmware.json overrides win over the device files too
+	dir, build := buildProject(t, conflictFiles(map[string]string{
+		"devices/dev/firmware.json": firmware(`"id": "1", "name": "dev", "overrides": {"util.lua": "b"}`),
+		"devices/dev/util.lua":      "return 'device'",
+	}), dependOnLibraries(t))
+	defer os.RemoveAll(dir)
+	t.Ok(build())
+	t.Equals("return 'b'", imageFile(t, dir, "util.lua"))
+}
+
+func TestUnknownOverride(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	for override, message := range map[string]string{
+		`{"util.lua": "c"}`:     `Unknown library "c" in the override of util.lua`,
+		`{"config.lua": "a"}`:   `Library "a" in the override of config.lua in firmware.json of dev does not provide that file`,
+		`{"util.lua": "libs/"}`: `Unknown library "libs/" in the override of util.lua`,
+	} {
+		dir, build := buildProject(t, conflictFiles(map[string]string{
+			"devices/dev/firmware.json": firmware(`"id": "1", "name": "dev", "overrides": ` + override),
+		}), dependOnLibraries(t))
+		err := build()
+		os.RemoveAll(dir)
+		t.Assert(err != nil, "expected an error for %s", override)
+		t.Assert(strings.Contains(err.Error(), message), "unexpected error for %s: %s", override, err)
+	}
+}
@@ -0,0 +1,132 @@
+package builder
+
+import (
+	"espore/builder/image"
+	"espore/builder/signing"
+	"espore/config"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// writeDeltaImages writes a delta image from each of the previous images of
+// the device kept in the history to the image just built, then adds the new
+// image to the history, keeping the config.Deltas most recent ones. Delta
+// images left from other builds are removed: they would rebuild an image
+// that is not the current one.
+func writeDeltaImages(config *config.BuildConfig, id string, keyring *signing.Keyring) error {
+	imgFilename := filepath.Join(config.Output, id+".img")
+	target, err := ioutil.ReadFile(imgFilename)
+	if err != nil {
+		return err
+	}
+	hash, err := ioutil.ReadFile(imgFilename + ".hash")
+	if err != nil {
+		return err
+	}
+	historyDir := filepath.Join(config.GetHistoryDir(), id)
+	if err := os.MkdirAll(historyDir, 0755); err != nil {
+		return err
+	}
+	previous, err := historyImages(historyDir, string(hash))
+	if err != nil {
+		return err
+	}
+	if len(previous) > config.Deltas {
+		for _, path := range previous[config.Deltas:] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		previous = previous[:config.Deltas]
+	}
+
+	written := make(map[string]bool)
+	for _, path := range previous {
+		base, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		delta, err := image.MakeDelta(base, target)
+		if err != nil {
+			return fmt.Errorf("Cannot build delta from %s: %s", path, err)
+		}
+		data, err := encodeImage(delta, keyring)
+		if err != nil {
+			return err
+		}
+		if _, err := image.ApplyDelta(base, delta); err != nil {
+			return fmt.Errorf("Delta from %s is invalid: %s", path, err)
+		}
+		deltaFilename := filepath.Join(config.Output, image.DeltaFileName(id, delta.BaseSHA1))
+		if err := ioutil.WriteFile(deltaFilename, data, 0666); err != nil {
+			return err
+		}
+		written[deltaFilename] = true
+		Log.Printf("Delta image %s: %d bytes, %d files changed\n", filepath.Base(deltaFilename), len(data), len(delta.Files)-1)
+	}
+	if err := removeStaleDeltas(config.Output, id, written); err != nil {
+		return err
+	}
+
+	historyFile := filepath.Join(historyDir, string(hash)+".img")
+	if err := ioutil.WriteFile(historyFile, target, 0644); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := os.Chtimes(historyFile, now, now); err != nil {
+		return err
+	}
+	// the new image is the most recent one, the oldest is no longer needed
+	if len(previous) == config.Deltas {
+		return os.Remove(previous[len(previous)-1])
+	}
+	return nil
+}
+
+// removeStaleDeltas removes the delta images of the device in the output
+// directory that are not in keep
+func removeStaleDeltas(outputDir, id string, keep map[string]bool) error {
+	paths, err := filepath.Glob(filepath.Join(outputDir, image.DeltaFileName(id, "*")))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if !keep[path] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// historyImages lists the images in the history directory except the one
+// with the given hash, most recent first
+func historyImages(dir string, except string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var images []os.FileInfo
+	for _, fi := range entries {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".img") && fi.Name() != except+".img" {
+			images = append(images, fi)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if !images[i].ModTime().Equal(images[j].ModTime()) {
+			return images[i].ModTime().After(images[j].ModTime())
+		}
+		return images[i].Name() < images[j].Name()
+	})
+	var paths []string
+	for _, fi := range images {
+		paths = append(paths, filepath.Join(dir, fi.Name()))
+	}
+	return paths, nil
+}
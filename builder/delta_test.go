@@ -0,0 +1,106 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"espore/builder/image"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestDeltaHistory(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json": devFirmware,
+	})
+	defer os.RemoveAll(projectDir(config))
+	config.Deltas = 2
+
+	var hashes []string
+	for i := 1; i <= 4; i++ {
+		writeProjectFile(t, projectDir(config), "devices/dev/main.lua", fmt.Sprintf("print('build %d')", i))
+		t.Ok(builder.Build(config))
+		hash, err := ioutil.ReadFile(filepath.Join(config.Output, "1.img.hash"))
+		t.Ok(err)
+		hashes = append(hashes, string(hash))
+	}
+
+	// deltas from the two previous builds, both rebuilding the last one
+	deltas, err := filepath.Glob(filepath.Join(config.Output, "1.*.delta.img"))
+	t.Ok(err)
+	sort.Strings(deltas)
+	expected := []string{
+		filepath.Join(config.Output, image.DeltaFileName("1", hashes[1])),
+		filepath.Join(config.Output, image.DeltaFileName("1", hashes[2])),
+	}
+	sort.Strings(expected)
+	t.Equals(expected, deltas)
+	for _, path := range deltas {
+		delta, err := image.ReadFile(path)
+		t.Ok(err)
+		t.Equals(hashes[3], delta.TargetSHA1)
+	}
+
+	// the history keeps the last two images, the next bases
+	history, err := ioutil.ReadDir(filepath.Join(config.History, "1"))
+	t.Ok(err)
+	var kept []string
+	for _, fi := range history {
+		kept = append(kept, fi.Name())
+	}
+	expected = []string{hashes[2] + ".img", hashes[3] + ".img"}
+	sort.Strings(expected)
+	t.Equals(expected, kept)
+}
+
+func TestVerifyReproducibleDeltas(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json": devFirmware,
+	})
+	defer os.RemoveAll(projectDir(config))
+	config.Deltas = 2
+
+	// fill the history
+	var hashes []string
+	for i := 1; i <= 3; i++ {
+		writeProjectFile(t, projectDir(config), "devices/dev/main.lua", fmt.Sprintf("print('build %d')", i))
+		t.Ok(builder.Build(config))
+		hash, err := ioutil.ReadFile(filepath.Join(config.Output, "1.img.hash"))
+		t.Ok(err)
+		hashes = append(hashes, string(hash))
+	}
+	historyFiles := func() map[string]int64 {
+		history, err := ioutil.ReadDir(filepath.Join(config.History, "1"))
+		t.Ok(err)
+		files := make(map[string]int64)
+		for _, fi := range history {
+			files[fi.Name()] = fi.ModTime().UnixNano()
+		}
+		return files
+	}
+	before := historyFiles()
+	t.Equals(2, len(before))
+	// both builds write a delta from each image in the history
+	writeProjectFile(t, projectDir(config), "devices/dev/main.lua", "print('build 4')")
+	t.Ok(builder.VerifyReproducible(config))
+	deltas, err := filepath.Glob(filepath.Join(config.Output, "1.*.delta.img"))
+	t.Ok(err)
+	t.Equals(2, len(deltas))
+
+	// the history is left as it was, so devices still running the oldest
+	// image get a delta from the next build
+	t.Equals(before, historyFiles())
+	t.Ok(builder.Build(config))
+	_, err = os.Stat(filepath.Join(config.Output, image.DeltaFileName("1", hashes[1])))
+	t.Ok(err)
+}
@@ -0,0 +1,121 @@
+package builder
+
+import (
+	"espore/config"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// EmulationImage is a device image built to run in the emulator
+type EmulationImage struct {
+	Manifest *FirmwareManifest
+	// Image is the path to the image file
+	Image string
+	// LFS holds the sources of the modules packed into lfs.img, by the name
+	// luac.cross gives them
+	LFS map[string][]byte
+	// Keys is the content of the device keys file provisioning would
+	// install, or nil if images are not signed
+	Keys []byte
+}
+
+// lfsModuleName returns the name luac.cross gives the module in the file
+func lfsModuleName(path string) string {
+	return strings.TrimSuffix(strings.Replace(path, "/", ",", -1), filepath.Ext(path))
+}
+
+// lfsSources returns the sources compiled into the LFS image of the manifest,
+// or nil if it has none
+func (manifest *FirmwareManifest) lfsSources() (map[string][]byte, error) {
+	for _, fe := range manifest.Files {
+		if fe.LFSFiles == nil {
+			continue
+		}
+		sources := make(map[string][]byte)
+		for _, lfsFile := range fe.LFSFiles {
+			content, err := lfsFile.ReadContent()
+			if err != nil {
+				return nil, err
+			}
+			sources[lfsModuleName(lfsFile.Path)] = content
+		}
+		for path, content := range LFSEmbeddedFiles {
+			sources[lfsModuleName(path)] = []byte(content)
+		}
+		return sources, nil
+	}
+	return nil, nil
+}
+
+// BuildEmulationImage builds the image of the device with the given id or
+// name into outputDir. Files are not compiled to bytecode, which the emulator
+// cannot run.
+func BuildEmulationImage(config *config.BuildConfig, device string, outputDir string) (*EmulationImage, error) {
+	store, err := loadSecrets(config)
+	if err != nil {
+		return nil, err
+	}
+	defer func(logger Logger) {
+		Log = logger
+	}(Log)
+	Log = &redactingLogger{logger: Log, secrets: store}
+
+	libs, devices, err := loadProject(config)
+	if err != nil {
+		return nil, store.RedactError(err)
+	}
+	var dev *Device
+	for _, d := range devices {
+		if d.Firmware.ID == device || d.Firmware.Name == device {
+			dev = d
+			break
+		}
+	}
+	if dev == nil {
+		return nil, fmt.Errorf("Unknown device %q", device)
+	}
+	info, err := readBuildInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	fwDef := dev.Firmware
+	fwDef.Compile.Enabled = false
+	// the emulator installs the image, flash images are not needed
+	fwDef.SPIFFS, fwDef.LFS.Flash = nil, nil
+	manifest, err := buildDeviceFirmwareManifest(dev.RootLib, fwDef, libs, store)
+	if err != nil {
+		return nil, store.RedactError(fmt.Errorf("Error building device firmware for device with name %q: %s", fwDef.Name, err))
+	}
+	version, err := addVersionFile(manifest, fwDef, info)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating %s for %s: %s", VersionFile, fwDef.Name, err)
+	}
+	keyring, err := LoadKeyring(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFirmwareImage(manifest, outputDir, keyring); err != nil {
+		return nil, err
+	}
+	if err := writeVersionFile(version, manifest.ID, outputDir); err != nil {
+		return nil, err
+	}
+	var keys []byte
+	if !keyring.Empty() {
+		if keys, err = keyring.DeviceFile(); err != nil {
+			return nil, err
+		}
+	}
+	lfs, err := manifest.lfsSources()
+	if err != nil {
+		return nil, err
+	}
+	return &EmulationImage{
+		Manifest: manifest,
+		Image:    filepath.Join(outputDir, manifest.ID+".img"),
+		LFS:      lfs,
+		Keys:     keys,
+	}, nil
+}
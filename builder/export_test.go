@@ -0,0 +1,9 @@
+package builder
+
+// exposed to the tests of package builder_test
+var (
+	FindCycles       = findCycles
+	DeepMerge        = deepMerge
+	ExpandVars       = expandVars
+	ConfigureModules = configureModules
+)
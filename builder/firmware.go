@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// FirmwareFile is the device definition file found in each device directory
+const FirmwareFile = "firmware.json"
+
+// ReadFirmwareDef reads the firmware.json of a device directory, resolving
+// "extends". The extended definition is read first and the device's own
+// definition is applied on top: fields it sets replace the inherited ones,
+// lists such as libs, lfs include/exclude, secrets and module overrides are
+// appended, and maps are merged. Id and name are never inherited.
+func ReadFirmwareDef(devicePath string) (FirmwareDef, error) {
+	return readFirmwareDef(devicePath, nil)
+}
+
+func readFirmwareDef(devicePath string, chain []string) (FirmwareDef, error) {
+	var fwDef FirmwareDef
+	path := filepath.Clean(devicePath)
+	chain = append(chain[:len(chain):len(chain)], path)
+	for _, p := range chain[:len(chain)-1] {
+		if p == path {
+			return fwDef, fmt.Errorf("Circular firmware extends: %s", formatChain(chain))
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(path, FirmwareFile))
+	if err != nil {
+		if len(chain) > 1 {
+			return fwDef, fmt.Errorf("Cannot read firmware file extended by %s: %s", chain[len(chain)-2], err)
+		}
+		return fwDef, err
+	}
+	var own FirmwareDef
+	if err := json.Unmarshal(data, &own); err != nil {
+		return fwDef, fmt.Errorf("%s: %s", filepath.Join(path, FirmwareFile), err)
+	}
+	if own.Extends == "" {
+		return own, nil
+	}
+
+	basePath := own.Extends
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(path, basePath)
+	}
+	fwDef, err = readFirmwareDef(basePath, chain)
+	if err != nil {
+		return fwDef, err
+	}
+	inherited := fwDef
+	fwDef.DeviceInfo = DeviceInfo{}
+	// the decoder would reuse the backing arrays of the inherited lists
+	fwDef.Libs, fwDef.LFS.Include, fwDef.LFS.Exclude, fwDef.Secrets, fwDef.Modules = nil, nil, nil, nil, nil
+	// decoding on top of the inherited values only replaces what the file sets
+	if err := json.Unmarshal(data, &fwDef); err != nil {
+		return fwDef, err
+	}
+	fwDef.Libs = appendUnique(inherited.Libs, own.Libs)
+	fwDef.LFS.Include = appendUnique(inherited.LFS.Include, own.LFS.Include)
+	fwDef.LFS.Exclude = appendUnique(inherited.LFS.Exclude, own.LFS.Exclude)
+	fwDef.Secrets = appendUnique(inherited.Secrets, own.Secrets)
+	fwDef.Modules = append(append([]ModuleOverride(nil), inherited.Modules...), own.Modules...)
+	if own.VarsFile == "" && inherited.VarsFile != "" && !filepath.IsAbs(inherited.VarsFile) {
+		// keep pointing at the vars file of the extended definition
+		if rel, err := filepath.Rel(path, filepath.Join(basePath, inherited.VarsFile)); err == nil {
+			fwDef.VarsFile = rel
+		}
+	}
+	return fwDef, nil
+}
+
+func appendUnique(a, b []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, list := range [][]string{a, b} {
+		for _, s := range list {
+			if !seen[s] {
+				seen[s] = true
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+// withFirmwareLibs returns the root library of a device with the libraries
+// listed in the libs field of firmware.json added to its dependencies. The
+// loaded library is shared, so it is copied rather than modified.
+func withFirmwareLibs(rootLib *FirmwareLib, fwDef FirmwareDef, allLibs *LibrarySet) (*FirmwareLib, error) {
+	if len(fwDef.Libs) == 0 {
+		return rootLib, nil
+	}
+	lib := *rootLib
+	lib.Dependencies = append([]*FirmwareLib(nil), rootLib.Dependencies...)
+	for _, name := range fwDef.Libs {
+		depPath, err := allLibs.resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving library %q of device %s: %s", name, fwDef.Name, err)
+		}
+		dep, err := LoadLibrary(depPath, allLibs, []string{rootLib.BasePath})
+		if err != nil {
+			return nil, err
+		}
+		lib.Dependencies = append(lib.Dependencies, dep)
+	}
+	return &lib, nil
+}
@@ -0,0 +1,100 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestExtendsChain(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-firmware")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	// device extends bases/sensor, which extends bases/common
+	writeProjectFile(t, dir, "bases/common/firmware.json", `{
+		"id": "0", "name": "common", "version": "1.0.0", "varsFile": "common.vars.json",
+		"libs": ["libs/core"], "lfs": {"include": ["core/*"]}, "compile": {"enabled": true, "strip": true},
+		"secrets": ["WIFI"], "vars": {"LEVEL": "info", "ROOM": "none"}, "overrides": {"a.lua": "core"},
+		"modules": [{"name": "logger", "config": {"level": "${LEVEL}"}}]}`)
+	writeProjectFile(t, dir, "bases/sensor/firmware.json", `{
+		"extends": "../common", "name": "sensor", "version": "1.1.0",
+		"libs": ["libs/net", "libs/core"], "lfs": {"include": ["net/*"], "exclude": ["net/debug.lua"]},
+		"secrets": ["MQTT", "WIFI"], "vars": {"ROOM": "lab"}, "overrides": {"b.lua": "net"},
+		"modules": [{"name": "net.client", "config": {"topic": "t/${ROOM}"}}]}`)
+	writeProjectFile(t, dir, "devices/dev/firmware.json", `{
+		"extends": "../../bases/sensor", "id": "7", "name": "dev",
+		"libs": ["libs/extra"], "compile": {"strip": false}, "vars": {"ROOM": "kitchen"},
+		"modules": [{"name": "logger", "config": {"level": "debug"}}]}`)
+
+	fwDef, err := builder.ReadFirmwareDef(filepath.Join(dir, "devices", "dev"))
+	t.Ok(err)
+	// id and name come from the device only
+	t.Equals("7", fwDef.ID)
+	t.Equals("dev", fwDef.Name)
+	// fields set along the chain replace the inherited ones
+	t.Equals("1.1.0", fwDef.Version)
+	t.Equals(builder.FirmwareCompileConfig{Enabled: true, Strip: false}, fwDef.Compile)
+	// lists are appended from the base to the device, without duplicates
+	t.Equals([]string{"libs/core", "libs/net", "libs/extra"}, fwDef.Libs)
+	t.Equals([]string{"core/*", "net/*"}, fwDef.LFS.Include)
+	t.Equals([]string{"net/debug.lua"}, fwDef.LFS.Exclude)
+	t.Equals([]string{"WIFI", "MQTT"}, fwDef.Secrets)
+	var modules []string
+	for _, m := range fwDef.Modules {
+		modules = append(modules, m.Name+" "+string(m.Config))
+	}
+	t.Equals([]string{
+		`logger {"level": "${LEVEL}"}`,
+		`net.client {"topic": "t/${ROOM}"}`,
+		`logger {"level": "debug"}`,
+	}, modules)
+	// maps are merged, the most specific definition wins
+	t.Equals(map[string]interface{}{"LEVEL": "info", "ROOM": "kitchen"}, fwDef.Vars)
+	t.Equals(map[string]string{"a.lua": "core", "b.lua": "net"}, fwDef.Overrides)
+	// the inherited vars file keeps pointing at the base directory
+	t.Equals(filepath.Join("..", "..", "bases", "common", "common.vars.json"), fwDef.VarsFile)
+
+	// the bases are unchanged when read on their own
+	sensor, err := builder.ReadFirmwareDef(filepath.Join(dir, "bases", "sensor"))
+	t.Ok(err)
+	t.Equals("", sensor.ID)
+	t.Equals("sensor", sensor.Name)
+	t.Equals([]string{"libs/core", "libs/net"}, sensor.Libs)
+	t.Equals(map[string]interface{}{"LEVEL": "info", "ROOM": "lab"}, sensor.Vars)
+	t.Equals(filepath.Join("..", "common", "common.vars.json"), sensor.VarsFile)
+}
+
+func TestExtendsErrors(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-firmware")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	writeProjectFile(t, dir, "a/firmware.json", `{"extends": "../b"}`)
+	writeProjectFile(t, dir, "b/firmware.json", `{"extends": "../c"}`)
+	writeProjectFile(t, dir, "c/firmware.json", `{"extends": "../a"}`)
+
+	_, err = builder.ReadFirmwareDef(a)
+	t.Assert(err != nil, "expected a circular extends error")
+	t.Equals("Circular firmware extends: "+a+" → "+b+" → "+c+" → "+a, err.Error())
+
+	writeProjectFile(t, dir, "c/firmware.json", `{"extends": "../missing"}`)
+	_, err = builder.ReadFirmwareDef(a)
+	t.Assert(err != nil, "expected an error reading a missing base")
+	t.Equals("Cannot read firmware file extended by "+c+": open "+filepath.Join(dir, "missing", builder.FirmwareFile)+": no such file or directory", err.Error())
+
+	writeProjectFile(t, dir, "c/firmware.json", `{"id": 1}`)
+	_, err = builder.ReadFirmwareDef(a)
+	t.Assert(err != nil && strings.HasPrefix(err.Error(), filepath.Join(c, builder.FirmwareFile)+": json: cannot unmarshal"),
+		"expected an error naming the invalid file, got %v", err)
+}
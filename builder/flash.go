@@ -0,0 +1,193 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/builder/image"
+	"espore/builder/signing"
+	"espore/builder/spiffs"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// flashSectorSize is the erase unit of the flash, partitions start at a
+// multiple of it
+const flashSectorSize = 4096
+
+// esp8266FlashMapped is the address the ESP8266 maps the start of the flash at
+const esp8266FlashMapped = 0x40200000
+
+// FlashLayout lists the images written for a device to program its flash
+// directly, by partition. It is written to <id>.flash.json.
+type FlashLayout struct {
+	Firmware *FlashRegion `json:"firmware,omitempty"`
+	SPIFFS   *FlashRegion `json:"spiffs,omitempty"`
+	LFS      *FlashRegion `json:"lfs,omitempty"`
+}
+
+// FlashRegion is an image in the output directory and the flash offset it is
+// written at
+type FlashRegion struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// FlashLayoutFile returns the path of the flash layout of a device
+func FlashLayoutFile(outputDir, id string) string {
+	return filepath.Join(outputDir, id+".flash.json")
+}
+
+// ReadFlashLayout reads the flash layout of a device from the output directory
+func ReadFlashLayout(outputDir, id string) (*FlashLayout, error) {
+	var layout FlashLayout
+	if err := utils.ReadJSON(FlashLayoutFile(outputDir, id), &layout); err != nil {
+		return nil, err
+	}
+	return &layout, nil
+}
+
+// updateFlashLayout applies update to the flash layout of a device,
+// creating it if needed
+func updateFlashLayout(outputDir, id string, update func(*FlashLayout)) error {
+	layout, err := ReadFlashLayout(outputDir, id)
+	if os.IsNotExist(err) {
+		layout, err = &FlashLayout{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	update(layout)
+	return utils.WriteJSON(FlashLayoutFile(outputDir, id), layout)
+}
+
+// writeFirmwareRegion adds the NodeMCU firmware copied to the output
+// directory to the flash layout of the device
+func writeFirmwareRegion(manifest *FirmwareManifest, binFilename string) error {
+	if manifest.NodeMCUFirmwareOffset%flashSectorSize != 0 {
+		return fmt.Errorf("NodeMCU firmware offset %#x is not a multiple of the flash sector size", manifest.NodeMCUFirmwareOffset)
+	}
+	fi, err := os.Stat(binFilename)
+	if err != nil {
+		return err
+	}
+	return updateFlashLayout(filepath.Dir(binFilename), manifest.ID, func(layout *FlashLayout) {
+		layout.Firmware = &FlashRegion{File: filepath.Base(binFilename), Offset: manifest.NodeMCUFirmwareOffset, Size: fi.Size()}
+	})
+}
+
+// writeSPIFFSImage writes <id>.spiffs.bin, a file system holding the files of
+// the image as the bootloader unpacks them. The image itself is kept as
+// update.old, as if the device had accepted it after an update, so it can
+// roll back a failed first update. lfs.img is flashed on the first boot,
+// unless an absolute LFS image is flashed along with the file system.
+func writeSPIFFSImage(manifest *FirmwareManifest, img *image.Image, imgBytes []byte, outputDir string, keyring *signing.Keyring) error {
+	config := manifest.SPIFFS
+	if config.Size <= 0 {
+		return fmt.Errorf("the size of the file system is not set")
+	}
+	if config.Offset%flashSectorSize != 0 {
+		return fmt.Errorf("offset %#x is not a multiple of the flash sector size", config.Offset)
+	}
+	var files []*spiffs.File
+	for _, f := range img.Files {
+		if f.Path == "lfs.img" && manifest.LFSFlash != nil {
+			continue
+		}
+		files = append(files, &spiffs.File{Name: f.Path, Data: f.Data})
+	}
+	files = append(files, &spiffs.File{Name: "update.old", Data: imgBytes})
+	if config.IncludeKeys && !keyring.Empty() {
+		keys, err := keyring.DeviceFile()
+		if err != nil {
+			return err
+		}
+		files = append(files, &spiffs.File{Name: signing.DeviceKeysFile, Data: keys})
+	}
+
+	fsConfig := spiffs.Config{
+		PageSize:   config.PageSize,
+		BlockSize:  config.BlockSize,
+		MetaLength: config.MetaLength,
+	}
+	data, err := spiffs.Write(fsConfig, int(config.Size), files)
+	if err != nil {
+		return err
+	}
+	name := manifest.ID + ".spiffs.bin"
+	if err := ioutil.WriteFile(filepath.Join(outputDir, name), data, 0666); err != nil {
+		return err
+	}
+	Log.Printf("SPIFFS image %s: %d files, flash at %#x\n", name, len(files), config.Offset)
+	return updateFlashLayout(outputDir, manifest.ID, func(layout *FlashLayout) {
+		layout.SPIFFS = &FlashRegion{File: name, Offset: config.Offset, Size: config.Size}
+	})
+}
+
+// writeLFSFlashImage writes <id>.lfs.bin, the LFS image of the device compiled
+// for the address its LFS partition is mapped at, to be flashed at its base
+func writeLFSFlashImage(manifest *FirmwareManifest, outputDir string) error {
+	config := manifest.LFSFlash
+	if config.Size <= 0 {
+		return fmt.Errorf("the size of the LFS partition is not set")
+	}
+	if config.Base%flashSectorSize != 0 {
+		return fmt.Errorf("base %#x is not a multiple of the flash sector size", config.Base)
+	}
+	var sources []*FileEntry
+	for _, fe := range manifest.Files {
+		if fe.LFSFiles != nil {
+			sources = fe.LFSFiles
+		}
+	}
+	if sources == nil {
+		Log.Printf("WARNING: %s has no LFS modules, not writing an LFS flash image\n", manifest.Name)
+		return nil
+	}
+
+	name := manifest.ID + ".lfs.bin"
+	path := filepath.Join(outputDir, name)
+	options := []string{"-a", fmt.Sprintf("%#x", config.Mapped), "-m", strconv.FormatInt(config.Size, 10)}
+	if err := luac(withLFSEmbeddedFiles(sources), path, options...); err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > config.Size {
+		return fmt.Errorf("%s is %d bytes, the LFS partition only %d", name, fi.Size(), config.Size)
+	}
+	Log.Printf("LFS image %s: %d bytes, flash at %#x\n", name, fi.Size(), config.Base)
+	return updateFlashLayout(outputDir, manifest.ID, func(layout *FlashLayout) {
+		layout.LFS = &FlashRegion{File: name, Offset: config.Base, Size: config.Size}
+	})
+}
+
+// SetLFSFlash stores the LFS partition in the firmware.json of a device, so
+// the build writes an absolute LFS image for it. Other settings are kept,
+// though the file is rewritten with its keys sorted.
+func SetLFSFlash(devicePath string, config *FirmwareLFSFlashConfig) error {
+	path := filepath.Join(devicePath, FirmwareFile)
+	var fwDef map[string]json.RawMessage
+	if err := utils.ReadJSON(path, &fwDef); err != nil {
+		return err
+	}
+	lfs := make(map[string]json.RawMessage)
+	if data, ok := fwDef["lfs"]; ok {
+		if err := json.Unmarshal(data, &lfs); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	var err error
+	if lfs["flash"], err = json.Marshal(config); err != nil {
+		return err
+	}
+	if fwDef["lfs"], err = json.Marshal(lfs); err != nil {
+		return err
+	}
+	return utils.WriteJSON(path, fwDef)
+}
@@ -0,0 +1,297 @@
+package builder
+
+import (
+	"bytes"
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	NodeModule   = "module"
+	NodeDatafile = "datafile"
+	NodeLibrary  = "library"
+
+	EdgeRequire    = "require"
+	EdgePcall      = "pcall"
+	EdgeDatafile   = "datafile"
+	EdgeDependency = "dependency"
+)
+
+type GraphNode struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Library is the library a module was resolved from
+	Library string `json:"library,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+	InCycle bool   `json:"inCycle,omitempty"`
+}
+
+type GraphEdge struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Label   string `json:"label"`
+	InCycle bool   `json:"inCycle,omitempty"`
+}
+
+// DependencyGraph explains why each module, datafile and library ends up in
+// a device firmware
+type DependencyGraph struct {
+	DeviceInfo
+	Nodes  []*GraphNode `json:"nodes"`
+	Edges  []*GraphEdge `json:"edges"`
+	Cycles [][]string   `json:"cycles"`
+	nodes  map[string]*GraphNode
+}
+
+func nodeID(kind, name string) string {
+	return kind + ":" + name
+}
+
+func (g *DependencyGraph) node(kind, name string) (*GraphNode, bool) {
+	id := nodeID(kind, name)
+	if n, ok := g.nodes[id]; ok {
+		return n, false
+	}
+	n := &GraphNode{ID: id, Kind: kind}
+	g.nodes[id] = n
+	g.Nodes = append(g.Nodes, n)
+	return n, true
+}
+
+func (g *DependencyGraph) addModule(moduleName string, files map[string]*FileEntry) *GraphNode {
+	n, added := g.node(NodeModule, moduleName)
+	if !added {
+		return n
+	}
+	entry, ok := files[Mod2File(moduleName)]
+	if !ok {
+		n.Missing = true
+		return n
+	}
+	n.Library = entry.Base
+	for _, df := range entry.Datafiles {
+		g.node(NodeDatafile, df)
+		g.Edges = append(g.Edges, &GraphEdge{From: n.ID, To: nodeID(NodeDatafile, df), Label: EdgeDatafile})
+	}
+	for _, dep := range entry.Dependencies {
+		label := EdgeRequire
+		if dep.Pcall {
+			label = EdgePcall
+		}
+		depNode := g.addModule(dep.Module, files)
+		g.Edges = append(g.Edges, &GraphEdge{From: n.ID, To: depNode.ID, Label: label})
+	}
+	return n
+}
+
+// BuildDependencyGraph walks the modules of a device the same way the
+// firmware builder does, but keeps going when a module cannot be found so
+// the graph can show what is missing.
+func BuildDependencyGraph(deviceRootLib *FirmwareLib, fwDef FirmwareDef) *DependencyGraph {
+	g := &DependencyGraph{
+		DeviceInfo: fwDef.DeviceInfo,
+		Cycles:     [][]string{},
+		nodes:      make(map[string]*GraphNode),
+	}
+	usedLibs := getLibraryList(deviceRootLib, nil)
+	for _, lib := range usedLibs {
+		n, _ := g.node(NodeLibrary, lib.BasePath)
+		for _, dep := range lib.Dependencies {
+			g.Edges = append(g.Edges, &GraphEdge{From: n.ID, To: nodeID(NodeLibrary, dep.BasePath), Label: EdgeDependency})
+		}
+	}
+	if err := checkOverrides(usedLibs, fwDef); err != nil {
+		Log.Printf("%s: %s\n", fwDef.Name, err)
+	}
+	files, conflicts := buildFileIndex(usedLibs, fwDef)
+	for _, c := range conflicts {
+		Log.Printf("%s: %s\n", fwDef.Name, c)
+	}
+	if err := preprocessFiles(files, fwDef); err != nil {
+		Log.Printf("%s: %s\n", fwDef.Name, err)
+	}
+	for _, mod := range deviceModules(deviceRootLib, usedLibs) {
+		g.addModule(mod.Name, files)
+	}
+	g.Cycles = append(g.Cycles, findCycles(g.Nodes, g.Edges)...)
+	inCycle := make(map[string]int)
+	for i, cycle := range g.Cycles {
+		for _, id := range cycle {
+			inCycle[id] = i + 1
+			g.nodes[id].InCycle = true
+		}
+	}
+	for _, e := range g.Edges {
+		e.InCycle = inCycle[e.From] != 0 && inCycle[e.From] == inCycle[e.To]
+	}
+
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		return g.Nodes[i].ID < g.Nodes[j].ID
+	})
+	sort.SliceStable(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g
+}
+
+// findCycles returns the strongly connected components of the graph that
+// contain more than one node or a node that depends on itself, using
+// Tarjan's algorithm.
+func findCycles(nodes []*GraphNode, edges []*GraphEdge) [][]string {
+	adjacency := make(map[string][]string)
+	for _, e := range edges {
+		adjacency[e.From] = append(adjacency[e.From], e.To)
+	}
+	ids := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ids = append(ids, n.ID)
+	}
+	sort.Strings(ids)
+
+	index := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var cycles [][]string
+	next := 0
+
+	var connect func(v string)
+	connect = func(v string) {
+		index[v] = next
+		lowlink[v] = next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+		selfLoop := false
+		for _, w := range adjacency[v] {
+			if w == v {
+				selfLoop = true
+			}
+			if _, visited := index[w]; !visited {
+				connect(w)
+				if lowlink[w] < lowlink[v] {
+					lowlink[v] = lowlink[w]
+				}
+			} else if onStack[w] && index[w] < lowlink[v] {
+				lowlink[v] = index[w]
+			}
+		}
+		if lowlink[v] != index[v] {
+			return
+		}
+		var component []string
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			component = append(component, w)
+			if w == v {
+				break
+			}
+		}
+		if len(component) > 1 || selfLoop {
+			sort.Strings(component)
+			cycles = append(cycles, component)
+		}
+	}
+
+	for _, id := range ids {
+		if _, visited := index[id]; !visited {
+			connect(id)
+		}
+	}
+	return cycles
+}
+
+// DOT renders the graph in Graphviz format. Modules are grouped by the
+// library they were resolved from and cycles are drawn in red.
+func (g *DependencyGraph) DOT() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph %q {\n", g.Name+" ("+g.ID+")")
+	fmt.Fprintf(&buf, "\trankdir=LR;\n")
+
+	byLibrary := make(map[string][]*GraphNode)
+	var libraries []string
+	for _, n := range g.Nodes {
+		if _, ok := byLibrary[n.Library]; !ok {
+			libraries = append(libraries, n.Library)
+		}
+		byLibrary[n.Library] = append(byLibrary[n.Library], n)
+	}
+	sort.Strings(libraries)
+
+	for i, lib := range libraries {
+		indent := "\t"
+		if lib != "" {
+			fmt.Fprintf(&buf, "\tsubgraph cluster_%d {\n\t\tlabel=%q;\n", i, lib)
+			indent = "\t\t"
+		}
+		for _, n := range byLibrary[lib] {
+			attrs := ""
+			switch n.Kind {
+			case NodeLibrary:
+				attrs = "shape=folder"
+			case NodeDatafile:
+				attrs = "shape=note"
+			default:
+				attrs = "shape=box"
+			}
+			if n.Missing {
+				attrs += ",style=dashed"
+			}
+			if n.InCycle {
+				attrs += ",color=red"
+			}
+			fmt.Fprintf(&buf, "%s%q [label=%q,%s];\n", indent, n.ID, n.ID[len(n.Kind)+1:], attrs)
+		}
+		if lib != "" {
+			fmt.Fprintf(&buf, "\t}\n")
+		}
+	}
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=%q", e.Label)
+		if e.Label == EdgePcall {
+			attrs += ",style=dashed"
+		}
+		if e.InCycle {
+			attrs += ",color=red"
+		}
+		fmt.Fprintf(&buf, "\t%q -> %q [%s];\n", e.From, e.To, attrs)
+	}
+	fmt.Fprintf(&buf, "}\n")
+	return buf.Bytes()
+}
+
+// WriteGraphs writes <id>.graph.dot and <id>.graph.json to the output
+// directory for each device in the project
+func WriteGraphs(config *config.BuildConfig) error {
+	_, devices, err := loadProject(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.Output, 0755); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		g := BuildDependencyGraph(device.RootLib, device.Firmware)
+		base := filepath.Join(config.Output, g.ID+".graph")
+		if err := ioutil.WriteFile(base+".dot", g.DOT(), 0666); err != nil {
+			return err
+		}
+		if err := utils.WriteJSON(base+".json", g); err != nil {
+			return err
+		}
+		for _, cycle := range g.Cycles {
+			Log.Printf("%s: dependency cycle between %v\n", g.Name, cycle)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestFindCycles(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	graph := func(edges ...string) ([]*builder.GraphNode, []*builder.GraphEdge) {
+		var nodes []*builder.GraphNode
+		var graphEdges []*builder.GraphEdge
+		seen := make(map[string]bool)
+		for _, e := range edges {
+			ends := strings.Split(e, "->")
+			for _, id := range ends {
+				if !seen[id] {
+					seen[id] = true
+					nodes = append(nodes, &builder.GraphNode{ID: id})
+				}
+			}
+			if len(ends) == 2 {
+				graphEdges = append(graphEdges, &builder.GraphEdge{From: ends[0], To: ends[1]})
+			}
+		}
+		return nodes, graphEdges
+	}
+
+	// a chain and a diamond have no cycles
+	t.Equals([][]string(nil), builder.FindCycles(graph("a->b", "b->c", "a->d", "d->c", "e")))
+
+	// nested strongly connected components are found once each, the inner
+	// one first; a node depending on itself is a cycle too
+	t.Equals([][]string{{"d", "e"}, {"a", "b", "c"}, {"f"}},
+		builder.FindCycles(graph("a->b", "b->c", "c->a", "c->d", "d->e", "e->d", "a->g", "f->f", "g")))
+
+	// two cycles sharing a node are a single component
+	t.Equals([][]string{{"a", "b", "c"}}, builder.FindCycles(graph("a->b", "b->a", "b->c", "c->b")))
+}
+
+func TestDependencyGraph(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/main.lua": "-- datafile: cfg.json\n" + `require("a")` + "\n" + `pcall(require, "missing")`,
+		"devices/dev/a.lua":    `require("b")`,
+		"devices/dev/b.lua":    `local function a() return require("a") end`,
+	})
+	dir := projectDir(config)
+	defer os.RemoveAll(dir)
+	devicePath := filepath.Join(dir, "devices", "dev")
+	lib, err := builder.LoadLibrary(devicePath, builder.NewLibrarySet(nil), nil)
+	t.Ok(err)
+	fwDef := builder.FirmwareDef{DeviceInfo: builder.DeviceInfo{ID: "1", Name: "dev"}}
+
+	g := builder.BuildDependencyGraph(lib, fwDef)
+	t.Equals([][]string{{"module:a", "module:b"}}, g.Cycles)
+	nodes := make(map[string]*builder.GraphNode)
+	for _, n := range g.Nodes {
+		nodes[n.ID] = n
+	}
+	t.Equals(6, len(nodes))
+	t.Equals(&builder.GraphNode{ID: "module:main", Kind: builder.NodeModule, Library: devicePath}, nodes["module:main"])
+	t.Equals(&builder.GraphNode{ID: "module:a", Kind: builder.NodeModule, Library: devicePath, InCycle: true}, nodes["module:a"])
+	t.Equals(&builder.GraphNode{ID: "module:missing", Kind: builder.NodeModule, Missing: true}, nodes["module:missing"])
+	t.Equals(&builder.GraphNode{ID: "datafile:cfg.json", Kind: builder.NodeDatafile}, nodes["datafile:cfg.json"])
+	t.Equals(&builder.GraphNode{ID: "library:" + devicePath, Kind: builder.NodeLibrary}, nodes["library:"+devicePath])
+
+	t.Equals([]*builder.GraphEdge{
+		{From: "module:a", To: "module:b", Label: builder.EdgeRequire, InCycle: true},
+		{From: "module:b", To: "module:a", Label: builder.EdgeRequire, InCycle: true},
+		{From: "module:main", To: "datafile:cfg.json", Label: builder.EdgeDatafile},
+		{From: "module:main", To: "module:a", Label: builder.EdgeRequire},
+		{From: "module:main", To: "module:missing", Label: builder.EdgePcall},
+	}, g.Edges)
+
+	dot := string(g.DOT())
+	for _, line := range []string{
+		`digraph "dev (1)" {`,
+		`label=` + `"` + devicePath + `";`,
+		`"module:a" [label="a",shape=box,color=red];`,
+		`"module:missing" [label="missing",shape=box,style=dashed];`,
+		`"datafile:cfg.json" [label="cfg.json",shape=note];`,
+		`"module:a" -> "module:b" [label="require",color=red];`,
+		`"module:main" -> "module:missing" [label="pcall",style=dashed];`,
+	} {
+		t.Assert(strings.Contains(dot, line), "%q not found in\n%s", line, dot)
+	}
+}
+
+func TestWriteGraphs(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json": `{"id": "1", "name": "dev"}`,
+		"devices/dev/main.lua":      `print(1)`,
+	})
+	dir := projectDir(config)
+	defer os.RemoveAll(dir)
+	// the output directory does not exist before the first build
+	config.Output = filepath.Join(dir, "out")
+	t.Ok(builder.WriteGraphs(config))
+	for _, file := range []string{"1.graph.dot", "1.graph.json"} {
+		_, err := os.Stat(filepath.Join(config.Output, file))
+		t.Ok(err)
+	}
+}
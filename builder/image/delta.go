@@ -0,0 +1,136 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// TypeDelta is the type of delta images
+const TypeDelta = "delta"
+
+// DeltaTargetFile is the first file of a delta image. It holds the header of
+// the target image as is, followed by the paths of its files in order, one
+// per line.
+const DeltaTargetFile = ".target"
+
+// DeltaFileName returns the name of the delta image that updates the device
+// with the given id from the image with hash baseHash to its latest image
+func DeltaFileName(id, baseHash string) string {
+	return fmt.Sprintf("%s.%s.delta.img", id, baseHash)
+}
+
+// IsHash tells whether st is a hex encoded SHA1, as image hashes are
+func IsHash(st string) bool {
+	return hashRegex.MatchString(st)
+}
+
+// MakeDelta returns a delta image that turns the encoded image base into the
+// encoded image target. It holds the files of the target that are not in the
+// base with the same content and encoding, in the order of the target. Files
+// of the base missing from the target list are deleted.
+//
+// Applying the delta rebuilds the target byte for byte, so the result is
+// checked like a full image, signature included.
+func MakeDelta(base, target []byte) (*Image, error) {
+	baseImg, err := Read(base)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base image: %s", err)
+	}
+	targetImg, err := Read(target)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid target image: %s", err)
+	}
+	if baseImg.Version < Version2 || baseImg.Type != "" || targetImg.Version < Version2 || targetImg.Type != "" {
+		return nil, fmt.Errorf("Deltas can only be made between full version %d images", Version2)
+	}
+	var index bytes.Buffer
+	index.Write(target[:bytes.Index(target, []byte("\n\n"))+2])
+	delta := &Image{
+		DeviceID:        targetImg.DeviceID,
+		DeviceName:      targetImg.DeviceName,
+		Type:            TypeDelta,
+		BaseSHA1:        hashHex(base),
+		TargetSHA1:      hashHex(target),
+		TargetSignature: targetImg.Signature,
+		Files:           []*File{{Path: DeltaTargetFile}},
+	}
+	for _, f := range targetImg.Files {
+		index.WriteString(f.Path + "\n")
+		if bf := baseImg.File(f.Path); bf == nil || bf.SHA1() != f.SHA1() || bf.Compressed != f.Compressed {
+			delta.Files = append(delta.Files, f)
+		}
+	}
+	delta.Files[0].Data = index.Bytes()
+	return delta, nil
+}
+
+// Deleted returns the files of base that the delta image removes
+func (img *Image) Deleted(base *Image) []string {
+	_, paths, _ := img.deltaTarget()
+	keep := make(map[string]bool)
+	for _, path := range paths {
+		keep[path] = true
+	}
+	var deleted []string
+	for _, f := range base.Files {
+		if !keep[f.Path] {
+			deleted = append(deleted, f.Path)
+		}
+	}
+	return deleted
+}
+
+// deltaTarget splits DeltaTargetFile into the target header and file paths
+func (img *Image) deltaTarget() (header []byte, paths []string, err error) {
+	if img.Type != TypeDelta || len(img.Files) == 0 || img.Files[0].Path != DeltaTargetFile {
+		return nil, nil, fmt.Errorf("Not a delta image")
+	}
+	data := img.Files[0].Data
+	i := bytes.Index(data, []byte("\n\n"))
+	if i < 0 {
+		return nil, nil, fmt.Errorf("Invalid %s in delta image", DeltaTargetFile)
+	}
+	header = data[:i+2]
+	if rest := strings.TrimSuffix(string(data[i+2:]), "\n"); rest != "" {
+		paths = strings.Split(rest, "\n")
+	}
+	return header, paths, nil
+}
+
+// ApplyDelta rebuilds the target image of a delta from the encoded base
+// image, as the bootloader does
+func ApplyDelta(base []byte, delta *Image) ([]byte, error) {
+	header, paths, err := delta.deltaTarget()
+	if err != nil {
+		return nil, err
+	}
+	if hashHex(base) != delta.BaseSHA1 {
+		return nil, fmt.Errorf("Delta does not apply to this base image")
+	}
+	baseImg, err := Read(base)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base image: %s", err)
+	}
+	var buf bytes.Buffer
+	buf.Write(header)
+	for _, path := range paths {
+		f := delta.File(path)
+		if f == nil {
+			if f = baseImg.File(path); f == nil {
+				return nil, fmt.Errorf("%s is neither in the delta nor in the base image", path)
+			}
+		}
+		if err := f.encode(&buf, Version2); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Fprintf(&buf, "%s%s\n", trailerPrefix, hashHex(buf.Bytes()))
+	if delta.TargetSignature != "" {
+		fmt.Fprintf(&buf, "%s%s\n", signaturePrefix, delta.TargetSignature)
+	}
+	if hashHex(buf.Bytes()) != delta.TargetSHA1 {
+		return nil, fmt.Errorf("Rebuilt image does not match the target hash")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,52 @@
+package image_test
+
+import (
+	"espore/builder/image"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestDelta(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	base := testImage()
+	base.KeyID = "k1"
+	baseData, err := base.Sign([]byte("secret"))
+	t.Ok(err)
+
+	target := testImage()
+	target.KeyID = "k1"
+	target.Files[0].Data = []byte("return function() print(1) end")
+	target.Files = append(target.Files[:1], target.Files[2:]...)
+	target.Files = append(target.Files, &image.File{Path: "new.lua", Data: []byte("x")})
+	targetData, err := target.Sign([]byte("secret"))
+	t.Ok(err)
+
+	delta, err := image.MakeDelta(baseData, targetData)
+	t.Ok(err)
+	var paths []string
+	for _, f := range delta.Files[1:] {
+		paths = append(paths, f.Path)
+	}
+	t.Equals([]string{"main.lua", "new.lua"}, paths)
+	t.Equals([]string{"lib/empty.lua"}, delta.Deleted(base))
+
+	delta.KeyID = "k1"
+	deltaData, err := delta.Sign([]byte("secret"))
+	t.Ok(err)
+	delta, err = image.Read(deltaData)
+	t.Ok(err)
+	t.Equals(image.TypeDelta, delta.Type)
+	t.Ok(delta.Verify([]byte("secret")))
+
+	rebuilt, err := image.ApplyDelta(baseData, delta)
+	t.Ok(err)
+	t.Equals(string(targetData), string(rebuilt))
+
+	_, err = image.ApplyDelta(targetData, delta)
+	t.Equals("Delta does not apply to this base image", err.Error())
+	_, err = image.ApplyDelta(baseData, testImage())
+	t.Equals("Not a delta image", err.Error())
+}
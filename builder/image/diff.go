@@ -0,0 +1,57 @@
+package image
+
+import "sort"
+
+// ChangeKind tells how a file differs between two images
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Change is a file that differs between two images. OldSize is zero for
+// added files and NewSize for removed ones.
+type Change struct {
+	Path    string
+	Kind    ChangeKind
+	OldSize int
+	NewSize int
+}
+
+// Delta returns how much the file grew
+func (c *Change) Delta() int {
+	return c.NewSize - c.OldSize
+}
+
+// Diff lists the files added, removed or changed from a to b, by path
+func Diff(a, b *Image) []*Change {
+	var changes []*Change
+	for _, fa := range a.Files {
+		fb := b.File(fa.Path)
+		if fb == nil {
+			changes = append(changes, &Change{Path: fa.Path, Kind: Removed, OldSize: len(fa.Data)})
+		} else if fa.SHA1() != fb.SHA1() {
+			changes = append(changes, &Change{Path: fa.Path, Kind: Changed, OldSize: len(fa.Data), NewSize: len(fb.Data)})
+		}
+	}
+	for _, fb := range b.Files {
+		if a.File(fb.Path) == nil {
+			changes = append(changes, &Change{Path: fb.Path, Kind: Added, NewSize: len(fb.Data)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// Size returns the total size of the files in the image
+func (img *Image) Size() int {
+	size := 0
+	for _, f := range img.Files {
+		size += len(f.Data)
+	}
+	return size
+}
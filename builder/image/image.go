@@ -0,0 +1,387 @@
+// Package image reads and writes ESPore device images, the files the
+// bootloader unpacks onto the device.
+//
+// An image starts with a header of "Key: value" lines ended by an empty
+// line, followed by the files. Version 1 stores each file as its path, its
+// size and its bytes. Version 2 adds the SHA1 of each file after its size and
+// ends with an "Image SHA1:" trailer hashing everything before it.
+//
+// From version 2 a file can be stored LZSS compressed, which its size line
+// tells as "<stored size> lzss <size>". Its hash is that of the original
+// content.
+//
+// A version 2 image can be signed: its header names the signing key in a
+// "Key Id" line and a final "Signature:" line holds the HMAC-SHA256 of
+// everything before it, so the bootloader can check it with crypto.hmac.
+//
+// A delta image only carries the files that changed from a base image; see
+// MakeDelta.
+package image
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"espore/builder/lzss"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	Version1 = 1
+	Version2 = 2
+	// CurrentVersion is the version written by default
+	CurrentVersion = Version2
+)
+
+const (
+	headerVersion    = "Version"
+	headerDeviceID   = "Device Id"
+	headerDeviceName = "Device Name"
+	headerTotalFiles = "Total files"
+	headerKeyID      = "Key Id"
+	headerType       = "Type"
+	headerBase       = "Base SHA1"
+	headerTarget     = "Target SHA1"
+	headerTargetSig  = "Target Signature"
+	trailerPrefix    = "Image SHA1: "
+	signaturePrefix  = "Signature: "
+	encodingLZSS     = "lzss"
+)
+
+type File struct {
+	Path string
+	Data []byte
+	// Compressed stores the file LZSS compressed in the encoded image
+	Compressed bool
+}
+
+// SHA1 returns the hex encoded SHA1 of the file content
+func (f *File) SHA1() string {
+	return hashHex(f.Data)
+}
+
+// encode writes the entry of the file in an image of the given version
+func (f *File) encode(buf *bytes.Buffer, version int) error {
+	if f.Path == "" || strings.ContainsAny(f.Path, "\r\n") {
+		return fmt.Errorf("Invalid file name %q", f.Path)
+	}
+	data := f.Data
+	fmt.Fprintln(buf, f.Path)
+	if f.Compressed {
+		if version < Version2 {
+			return fmt.Errorf("Version %d images cannot hold compressed files", version)
+		}
+		data = lzss.Compress(f.Data)
+		fmt.Fprintf(buf, "%d %s %d\n", len(data), encodingLZSS, len(f.Data))
+	} else {
+		fmt.Fprintln(buf, len(data))
+	}
+	if version >= Version2 {
+		fmt.Fprintln(buf, f.SHA1())
+	}
+	buf.Write(data)
+	return nil
+}
+
+type Image struct {
+	// Version is the format version. Zero means CurrentVersion
+	Version    int
+	DeviceID   string
+	DeviceName string
+	// KeyID names the key the image is signed with, if any
+	KeyID string
+	// Signature is the hex encoded signature of an image read with Read
+	Signature string
+	// Type is TypeDelta for delta images and empty for full ones
+	Type string
+	// BaseSHA1 and TargetSHA1 are the hashes of the encoded images a delta
+	// image turns one into the other. TargetSignature is the signature of
+	// the target, if signed.
+	BaseSHA1        string
+	TargetSHA1      string
+	TargetSignature string
+	Files           []*File
+	// signed holds the bytes covered by the signature of a read image
+	signed []byte
+}
+
+func hashHex(data []byte) string {
+	h := sha1.Sum(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Bytes encodes the image
+func (img *Image) Bytes() ([]byte, error) {
+	version := img.Version
+	if version == 0 {
+		version = CurrentVersion
+	}
+	if version != Version1 && version != Version2 {
+		return nil, fmt.Errorf("Unsupported image version %d", version)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %d -- ESPore Device Image File\n", headerVersion, version)
+	fmt.Fprintf(&buf, "%s: %s\n", headerDeviceID, img.DeviceID)
+	fmt.Fprintf(&buf, "%s: %s\n", headerDeviceName, img.DeviceName)
+	fmt.Fprintf(&buf, "%s: %d\n", headerTotalFiles, len(img.Files))
+	if img.Type != "" {
+		if version < Version2 {
+			return nil, fmt.Errorf("Version %d images cannot be deltas", version)
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", headerType, img.Type)
+		fmt.Fprintf(&buf, "%s: %s\n", headerBase, img.BaseSHA1)
+		fmt.Fprintf(&buf, "%s: %s\n", headerTarget, img.TargetSHA1)
+		if img.TargetSignature != "" {
+			fmt.Fprintf(&buf, "%s: %s\n", headerTargetSig, img.TargetSignature)
+		}
+	}
+	if img.KeyID != "" {
+		if version < Version2 {
+			return nil, fmt.Errorf("Version %d images cannot be signed", version)
+		}
+		if strings.ContainsAny(img.KeyID, "\r\n") {
+			return nil, fmt.Errorf("Invalid key id %q", img.KeyID)
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", headerKeyID, img.KeyID)
+	}
+	fmt.Fprintln(&buf)
+	for _, f := range img.Files {
+		if err := f.encode(&buf, version); err != nil {
+			return nil, err
+		}
+	}
+	if version >= Version2 {
+		fmt.Fprintf(&buf, "%s%s\n", trailerPrefix, hashHex(buf.Bytes()))
+	}
+	return buf.Bytes(), nil
+}
+
+func sign(data, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign encodes the image and signs it with key, which must be the key named
+// by KeyID
+func (img *Image) Sign(key []byte) ([]byte, error) {
+	if img.KeyID == "" {
+		return nil, fmt.Errorf("Cannot sign an image without a key id")
+	}
+	data, err := img.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, fmt.Sprintf("%s%s\n", signaturePrefix, sign(data, key))...), nil
+}
+
+// Verify checks the signature of an image read with Read against key
+func (img *Image) Verify(key []byte) error {
+	if img.Signature == "" {
+		return fmt.Errorf("Image is not signed")
+	}
+	if !hmac.Equal([]byte(strings.ToLower(img.Signature)), []byte(sign(img.signed, key))) {
+		return fmt.Errorf("Signature mismatch for key %s", img.KeyID)
+	}
+	return nil
+}
+
+// Extract writes the files of the image under dir
+func (img *Image) Extract(dir string) error {
+	for _, f := range img.Files {
+		target := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("Refusing to extract %s outside of %s", f.Path, dir)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, f.Data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compress marks for compression the files that LZSS makes smaller and
+// returns the bytes saved
+func (img *Image) Compress() int {
+	saved := 0
+	for _, f := range img.Files {
+		if n := len(lzss.Compress(f.Data)); n < len(f.Data) {
+			f.Compressed = true
+			saved += len(f.Data) - n
+		}
+	}
+	return saved
+}
+
+// File returns the file with the given path, or nil
+func (img *Image) File(path string) *File {
+	for _, f := range img.Files {
+		if f.Path == path {
+			return f
+		}
+	}
+	return nil
+}
+
+var versionRegex = regexp.MustCompile(`^Version:\s*(\d+)`)
+var sizeRegex = regexp.MustCompile(`^(\d+)(?: ` + encodingLZSS + ` (\d+))?$`)
+var hashRegex = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
+// reader walks the image bytes line by line
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) line() (string, bool) {
+	i := bytes.IndexByte(r.data[r.pos:], '\n')
+	if i < 0 {
+		return "", false
+	}
+	line := string(r.data[r.pos : r.pos+i])
+	r.pos += i + 1
+	return line, true
+}
+
+// Read decodes an image of any supported version and checks its integrity:
+// the header, the sizes and, from version 2, the hash of every file and of
+// the whole image
+func Read(data []byte) (*Image, error) {
+	r := &reader{data: data}
+	line, ok := r.line()
+	match := versionRegex.FindStringSubmatch(line)
+	if !ok || match == nil {
+		return nil, fmt.Errorf("Not an ESPore image")
+	}
+	img := &Image{}
+	img.Version, _ = strconv.Atoi(match[1])
+	if img.Version != Version1 && img.Version != Version2 {
+		return nil, fmt.Errorf("Unsupported image version %d", img.Version)
+	}
+
+	header := make(map[string]string)
+	for {
+		line, ok := r.line()
+		if !ok {
+			return nil, fmt.Errorf("Cannot find image file body")
+		}
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i >= 0 {
+			header[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	img.DeviceID = header[headerDeviceID]
+	img.DeviceName = header[headerDeviceName]
+	img.KeyID = header[headerKeyID]
+	img.Type = header[headerType]
+	img.BaseSHA1 = header[headerBase]
+	img.TargetSHA1 = header[headerTarget]
+	img.TargetSignature = header[headerTargetSig]
+	totalFiles, err := strconv.Atoi(header[headerTotalFiles])
+	if err != nil || totalFiles < 0 {
+		return nil, fmt.Errorf("Cannot find Total Files header in firmware image")
+	}
+	if img.Version >= Version2 && img.DeviceID == "" {
+		return nil, fmt.Errorf("Cannot find Device Id header in firmware image")
+	}
+	if img.Version < Version2 && img.KeyID != "" {
+		return nil, fmt.Errorf("Version %d images cannot be signed", img.Version)
+	}
+	switch img.Type {
+	case "":
+	case TypeDelta:
+		if img.Version < Version2 || !hashRegex.MatchString(img.BaseSHA1) || !hashRegex.MatchString(img.TargetSHA1) {
+			return nil, fmt.Errorf("Delta image without valid base and target hashes")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported image type %q", img.Type)
+	}
+
+	for i := 0; i < totalFiles; i++ {
+		path, ok := r.line()
+		if !ok || path == "" {
+			return nil, fmt.Errorf("Cannot read the name of file %d of %d", i+1, totalFiles)
+		}
+		sizeLine, _ := r.line()
+		match := sizeRegex.FindStringSubmatch(sizeLine)
+		if match == nil || (match[2] != "" && img.Version < Version2) {
+			return nil, fmt.Errorf("Cannot parse the size of %s", path)
+		}
+		size, _ := strconv.Atoi(match[1])
+		var hash string
+		if img.Version >= Version2 {
+			hash, _ = r.line()
+			if !hashRegex.MatchString(hash) {
+				return nil, fmt.Errorf("Cannot parse the hash of %s", path)
+			}
+		}
+		if r.pos+size > len(data) {
+			return nil, fmt.Errorf("Image is truncated: %s needs %d bytes, %d left", path, size, len(data)-r.pos)
+		}
+		f := &File{Path: path, Data: data[r.pos : r.pos+size]}
+		r.pos += size
+		if match[2] != "" {
+			f.Compressed = true
+			if f.Data, err = lzss.Decompress(f.Data); err != nil {
+				return nil, fmt.Errorf("Cannot decompress %s: %s", path, err)
+			}
+			if strconv.Itoa(len(f.Data)) != match[2] {
+				return nil, fmt.Errorf("%s decompresses to %d bytes instead of %s", path, len(f.Data), match[2])
+			}
+		}
+		if hash != "" && !strings.EqualFold(hash, f.SHA1()) {
+			return nil, fmt.Errorf("Hash mismatch in %s", path)
+		}
+		img.Files = append(img.Files, f)
+	}
+
+	if img.Version >= Version2 {
+		bodyEnd := r.pos
+		line, ok := r.line()
+		if !ok || !strings.HasPrefix(line, trailerPrefix) {
+			return nil, fmt.Errorf("Cannot find the image hash trailer")
+		}
+		if !strings.EqualFold(strings.TrimPrefix(line, trailerPrefix), hashHex(data[:bodyEnd])) {
+			return nil, fmt.Errorf("Image hash mismatch")
+		}
+	}
+	if img.KeyID != "" {
+		signedEnd := r.pos
+		line, ok := r.line()
+		if !ok || !strings.HasPrefix(line, signaturePrefix) {
+			return nil, fmt.Errorf("Cannot find the signature of the image")
+		}
+		img.Signature = strings.TrimPrefix(line, signaturePrefix)
+		img.signed = data[:signedEnd]
+	}
+	if r.pos != len(data) {
+		return nil, fmt.Errorf("Unexpected %d bytes after the last file", len(data)-r.pos)
+	}
+	return img, nil
+}
+
+// ReadFile reads and checks the image in the given file
+func ReadFile(path string) (*Image, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := Read(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return img, nil
+}
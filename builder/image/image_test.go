@@ -0,0 +1,205 @@
+package image_test
+
+import (
+	"bytes"
+	"espore/builder/image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func testImage() *image.Image {
+	return &image.Image{
+		DeviceID:   "1234",
+		DeviceName: "test",
+		Files: []*image.File{
+			{Path: "main.lua", Data: []byte("return function() end")},
+			{Path: "lib/empty.lua", Data: []byte{}},
+			{Path: "data.bin", Data: []byte("line\nwith\nnewlines\n")},
+		},
+	}
+}
+
+func TestRoundTrip(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	data, err := testImage().Bytes()
+	t.Ok(err)
+	t.Assert(bytes.HasPrefix(data, []byte("Version: 2 -- ESPore Device Image File\nDevice Id: 1234\n")), "Unexpected header:\n%s", data)
+
+	img, err := image.Read(data)
+	t.Ok(err)
+	t.Equals(image.Version2, img.Version)
+	t.Equals("1234", img.DeviceID)
+	t.Equals("test", img.DeviceName)
+	t.Equals(3, len(img.Files))
+	t.Equals("line\nwith\nnewlines\n", string(img.File("data.bin").Data))
+	t.Equals(0, len(img.File("lib/empty.lua").Data))
+	t.Assert(img.File("missing") == nil, "Expected no file")
+}
+
+func TestReadVersion1(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	data := "Version: 1 -- ESPore Device Image File\nDevice Id: 1\nDevice Name: old\nTotal files: 2\n\n" +
+		"main.lua\n3\nabcdata.json\n2\n[]"
+	img, err := image.Read([]byte(data))
+	t.Ok(err)
+	t.Equals(image.Version1, img.Version)
+	t.Equals(2, len(img.Files))
+	t.Equals("abc", string(img.File("main.lua").Data))
+
+	src := testImage()
+	src.Version = image.Version1
+	encoded, err := src.Bytes()
+	t.Ok(err)
+	img, err = image.Read(encoded)
+	t.Ok(err)
+	t.Equals(3, len(img.Files))
+}
+
+func TestInvalidImages(tx *testing.T) {
+	data, err := testImage().Bytes()
+	if err != nil {
+		tx.Fatal(err)
+	}
+	replace := func(old, new string) []byte {
+		return []byte(strings.Replace(string(data), old, new, 1))
+	}
+	tests := []struct {
+		name  string
+		data  []byte
+		error string
+	}{
+		{"not an image", []byte("hello\n"), "Not an ESPore image"},
+		{"unknown version", replace("Version: 2", "Version: 3"), "Unsupported image version 3"},
+		{"no body", []byte("Version: 2\nDevice Id: 1\n"), "Cannot find image file body"},
+		{"no file count", replace("Total files: 3\n", ""), "Cannot find Total Files header in firmware image"},
+		{"no device id", replace("Device Id: 1234\n", ""), "Cannot find Device Id header in firmware image"},
+		{"file hash", replace("return function", "return Function"), "Hash mismatch in main.lua"},
+		{"image hash", replace("Device Name: test", "Device Name: tEst"), "Image hash mismatch"},
+		{"truncated", data[:len(data)-60], "Image is truncated: data.bin needs 19 bytes, 12 left"},
+		{"no trailer", data[:bytes.LastIndex(data, []byte("Image SHA1"))], "Cannot find the image hash trailer"},
+		{"trailing bytes", append(append([]byte{}, data...), 'x'), "Unexpected 1 bytes after the last file"},
+	}
+	for _, test := range tests {
+		tx.Run(test.name, func(tx *testing.T) {
+			t := ut.BeginTest(tx, false)
+			defer t.FinishTest()
+
+			_, err := image.Read(test.data)
+			t.Assert(err != nil, "Expected %q", test.error)
+			t.Equals(test.error, err.Error())
+		})
+	}
+}
+
+func TestInvalidFileName(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	img := &image.Image{Files: []*image.File{{Path: "a\nb"}}}
+	_, err := img.Bytes()
+	t.Assert(err != nil, "Expected an error")
+	t.Equals(`Invalid file name "a\nb"`, err.Error())
+}
+
+func TestSign(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	src := testImage()
+	src.KeyID = "k1"
+	data, err := src.Sign([]byte("secret"))
+	t.Ok(err)
+
+	img, err := image.Read(data)
+	t.Ok(err)
+	t.Equals("k1", img.KeyID)
+	t.Ok(img.Verify([]byte("secret")))
+	t.Equals("Signature mismatch for key k1", img.Verify([]byte("other")).Error())
+
+	_, err = image.Read(data[:bytes.LastIndex(data, []byte("Signature: "))])
+	t.Equals("Cannot find the signature of the image", err.Error())
+
+	unsigned, err := image.Read(mustBytes(t, testImage()))
+	t.Ok(err)
+	t.Equals("Image is not signed", unsigned.Verify([]byte("secret")).Error())
+
+	_, err = testImage().Sign([]byte("secret"))
+	t.Equals("Cannot sign an image without a key id", err.Error())
+	src.Version = image.Version1
+	_, err = src.Sign([]byte("secret"))
+	t.Equals("Version 1 images cannot be signed", err.Error())
+}
+
+func mustBytes(t *ut.DefaultTestTools, img *image.Image) []byte {
+	data, err := img.Bytes()
+	t.Ok(err)
+	return data
+}
+
+func TestDiff(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	a := testImage()
+	b := testImage()
+	b.Files[0].Data = []byte("return function() print(1) end")
+	b.Files = append(b.Files[:1], b.Files[2:]...)
+	b.Files = append(b.Files, &image.File{Path: "new.lua", Data: []byte("x")})
+
+	changes := image.Diff(a, b)
+	t.Equals(3, len(changes))
+	t.Equals(image.Change{Path: "lib/empty.lua", Kind: image.Removed}, *changes[0])
+	t.Equals(image.Change{Path: "main.lua", Kind: image.Changed, OldSize: 21, NewSize: 30}, *changes[1])
+	t.Equals(9, changes[1].Delta())
+	t.Equals(image.Change{Path: "new.lua", Kind: image.Added, NewSize: 1}, *changes[2])
+	t.Equals(0, len(image.Diff(a, testImage())))
+}
+
+func TestExtract(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-image")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+
+	t.Ok(testImage().Extract(dir))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "lib", "empty.lua"))
+	t.Ok(err)
+	t.Equals(0, len(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	t.Ok(err)
+	t.Equals("line\nwith\nnewlines\n", string(data))
+
+	img := &image.Image{Files: []*image.File{{Path: "../escape.lua"}}}
+	t.Assert(img.Extract(dir) != nil, "Expected an error extracting outside of the directory")
+}
+
+func TestCompress(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	src := testImage()
+	repetitive := strings.Repeat("print('hello world')\n", 100)
+	src.Files = append(src.Files, &image.File{Path: "big.lua", Data: []byte(repetitive)})
+	t.Assert(src.Compress() > 0, "Expected compression to save space")
+	t.Equals(false, src.File("main.lua").Compressed)
+	t.Equals(true, src.File("big.lua").Compressed)
+
+	data := mustBytes(t, src)
+	t.Assert(bytes.Contains(data, []byte(" lzss 2100\n")), "Expected a compressed entry:\n%s", data)
+	img, err := image.Read(data)
+	t.Ok(err)
+	t.Equals(true, img.File("big.lua").Compressed)
+	t.Equals(repetitive, string(img.File("big.lua").Data))
+	t.Equals("return function() end", string(img.File("main.lua").Data))
+}
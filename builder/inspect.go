@@ -0,0 +1,115 @@
+package builder
+
+import (
+	"espore/builder/image"
+	"espore/builder/signing"
+	"espore/session"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyImage checks an image written by the builder: its own integrity, the
+// hash in the .hash file and <id>.version.json next to it, the file hashes of
+// the <id>.json manifest next to it and, for signed images, the signature with
+// the key in the keyring. Delta images are checked against the full image
+// they build.
+func VerifyImage(path string, keyring *signing.Keyring) (*image.Image, error) {
+	img, err := image.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	if img.Type == image.TypeDelta {
+		problems = checkDelta(path, img)
+	} else if problems, err = checkFullImage(path, img); err != nil {
+		return nil, err
+	}
+
+	if img.KeyID != "" {
+		if key, ok := keyring.Key(img.KeyID); !ok {
+			problems = append(problems, fmt.Sprintf("signed with unknown key %s", img.KeyID))
+		} else if err := img.Verify(key); err != nil {
+			problems = append(problems, err.Error())
+		}
+	} else if !keyring.Empty() {
+		Log.Printf("WARNING: %s is not signed, devices with signing keys will refuse it\n", path)
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s is invalid:\n%s", path, strings.Join(problems, "\n"))
+	}
+	return img, nil
+}
+
+// checkFullImage compares the image with its .hash file, version file and
+// manifest
+func checkFullImage(path string, img *image.Image) ([]string, error) {
+	var problems []string
+	actual, err := utils.HashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := ioutil.ReadFile(path + ".hash")
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("cannot read hash file: %s", err))
+	} else if strings.TrimSpace(string(hash)) != actual {
+		problems = append(problems, fmt.Sprintf("image hash is %s, %s.hash says %s", actual, path, strings.TrimSpace(string(hash))))
+	}
+	versionPath := strings.TrimSuffix(path, ".img") + ".version.json"
+	var version session.FirmwareVersion
+	if err := utils.ReadJSON(versionPath, &version); err == nil && version.ImageHash != actual {
+		problems = append(problems, fmt.Sprintf("image hash is %s, %s says %s", actual, versionPath, version.ImageHash))
+	}
+
+	manifestPath := strings.TrimSuffix(path, ".img") + ".json"
+	var manifest FirmwareManifest
+	if err := utils.ReadJSON(manifestPath, &manifest); err != nil {
+		problems = append(problems, fmt.Sprintf("cannot read manifest %s: %s", manifestPath, err))
+	} else {
+		problems = append(problems, checkManifest(img, &manifest)...)
+	}
+	return problems, nil
+}
+
+// checkDelta compares the target of a delta image with the full image of the
+// device written next to it
+func checkDelta(path string, img *image.Image) []string {
+	fullPath := filepath.Join(filepath.Dir(path), img.DeviceID+".img")
+	hash, err := ioutil.ReadFile(fullPath + ".hash")
+	if err != nil {
+		return []string{fmt.Sprintf("cannot read the hash of the full image: %s", err)}
+	}
+	if strings.TrimSpace(string(hash)) != img.TargetSHA1 {
+		return []string{fmt.Sprintf("delta builds %s, %s is %s", img.TargetSHA1, fullPath, strings.TrimSpace(string(hash)))}
+	}
+	return nil
+}
+
+// checkManifest compares the files of the image with those of the manifest it
+// was built from. Datafiles.json and the keys update are generated with the
+// image and generated files holding secrets have no hash in the manifest.
+func checkManifest(img *image.Image, manifest *FirmwareManifest) []string {
+	var problems []string
+	if img.DeviceID != manifest.ID || img.DeviceName != manifest.Name {
+		problems = append(problems, fmt.Sprintf("image is for %s (%s), manifest for %s (%s)", img.DeviceName, img.DeviceID, manifest.Name, manifest.ID))
+	}
+	inManifest := map[string]bool{"datafiles.json": true, signing.DeviceKeysUpdateFile: true}
+	for _, fe := range manifest.Files {
+		inManifest[fe.Path] = true
+		f := img.File(fe.Path)
+		if f == nil {
+			problems = append(problems, fmt.Sprintf("%s is missing from the image", fe.Path))
+		} else if fe.Hash != "" && f.SHA1() != fe.Hash {
+			problems = append(problems, fmt.Sprintf("%s does not match the manifest", fe.Path))
+		}
+	}
+	for _, f := range img.Files {
+		if !inManifest[f.Path] {
+			problems = append(problems, fmt.Sprintf("%s is not in the manifest", f.Path))
+		}
+	}
+	return problems
+}
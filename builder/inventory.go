@@ -0,0 +1,137 @@
+package builder
+
+import (
+	"encoding/csv"
+	"espore/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InventoryEntry describes one device built from a template device
+// directory. Vars take precedence over the vars of the template.
+type InventoryEntry struct {
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	Template string                 `json:"template"`
+	Vars     map[string]interface{} `json:"vars"`
+}
+
+// readInventory reads a JSON array of entries or a CSV file whose header
+// names the id, name and template columns. Any other CSV column is a
+// variable. Templates are relative to the inventory file. A row with the id
+// DEFAULT builds the image given to chips that are not listed.
+func readInventory(path string) ([]*InventoryEntry, error) {
+	var entries []*InventoryEntry
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		entries, err = readInventoryCSV(path)
+	} else {
+		err = utils.ReadJSON(path, &entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read inventory %s: %s", path, err)
+	}
+	for i, e := range entries {
+		if e.ID == "" || e.Template == "" {
+			return nil, fmt.Errorf("Inventory %s: entry %d needs an id and a template", path, i+1)
+		}
+		if e.Name == "" {
+			e.Name = e.ID
+		}
+		if !filepath.IsAbs(e.Template) {
+			e.Template = filepath.Join(filepath.Dir(path), e.Template)
+		}
+	}
+	return entries, nil
+}
+
+func readInventoryCSV(path string) ([]*InventoryEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	var entries []*InventoryEntry
+	for _, record := range records[1:] {
+		e := &InventoryEntry{Vars: make(map[string]interface{})}
+		for i, column := range header {
+			value := record[i]
+			switch column {
+			case "id":
+				e.ID = value
+			case "name":
+				e.Name = value
+			case "template":
+				e.Template = value
+			default:
+				e.Vars[column] = value
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// loadInventoryDevices expands the inventory rows into devices
+func loadInventoryDevices(path string, allLibs *LibrarySet) ([]*Device, error) {
+	entries, err := readInventory(path)
+	if err != nil {
+		return nil, err
+	}
+	var devices []*Device
+	for _, e := range entries {
+		rootLib, err := LoadLibrary(e.Template, allLibs, nil)
+		if err != nil {
+			return nil, err
+		}
+		fwDef, err := ReadFirmwareDef(e.Template)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read firmware file of template %s for %s: %s", e.Template, e.Name, err)
+		}
+		fwDef.ID = e.ID
+		fwDef.Name = e.Name
+		if fwDef.Vars == nil {
+			fwDef.Vars = make(map[string]interface{})
+		}
+		for k, v := range e.Vars {
+			fwDef.Vars[k] = v
+		}
+		if err := loadVars(e.Template, &fwDef); err != nil {
+			return nil, fmt.Errorf("%s: %s", e.Name, err)
+		}
+		if rootLib, err = withFirmwareLibs(rootLib, fwDef, allLibs); err != nil {
+			return nil, err
+		}
+		devices = append(devices, &Device{
+			Path:     e.Template,
+			RootLib:  rootLib,
+			Firmware: fwDef,
+		})
+	}
+	return devices, nil
+}
+
+// checkDeviceIDs fails if two devices would write the same image
+func checkDeviceIDs(devices []*Device) error {
+	seen := make(map[string]*Device)
+	for _, d := range devices {
+		if other, ok := seen[d.Firmware.ID]; ok {
+			return fmt.Errorf("Devices %q and %q have the same id %s", other.Firmware.Name, d.Firmware.Name, d.Firmware.ID)
+		}
+		seen[d.Firmware.ID] = d
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package builder_test
+
+import (
+	"encoding/json"
+	"espore/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// inventoryFiles returns a sensor template whose main module is configured
+// with the ROOM and LEVEL variables, and an inventory file next to it
+func inventoryFiles(inventoryFile, inventory string) map[string]string {
+	return map[string]string{
+		"templates/sensor/firmware.json": firmware(`"id": "0", "name": "template", "vars": {"LEVEL": "warn"},
+			"modules": [{"name": "main", "config": {"room": "${ROOM}", "level": "${LEVEL}", "id": "${DEVICE_ID}"}}]`),
+		"templates/sensor/vars.json": `{"ROOM": "none", "LEVEL": "info"}`,
+		"templates/sensor/main.lua":  "print(1)",
+		inventoryFile:                inventory,
+	}
+}
+
+func withInventory(inventoryFile string) func(config *config.BuildConfig) {
+	return func(config *config.BuildConfig) {
+		config.Inventory = filepath.Join(projectDir(config), inventoryFile)
+	}
+}
+
+// mainConfig returns the name of the device an image is for and the config
+// of its main module
+func mainConfig(t *ut.DefaultTestTools, dir, id string) (string, map[string]interface{}) {
+	name, files := readImage(t, filepath.Join(dir, "dist", id+".img"))
+	var modules []struct {
+		Name   string                 `json:"name"`
+		Config map[string]interface{} `json:"config"`
+	}
+	t.Ok(json.Unmarshal([]byte(files["modules.json"]), &modules))
+	for _, mod := range modules {
+		if mod.Name == "main" {
+			return name, mod.Config
+		}
+	}
+	t.Assert(false, "main module not found in %s.img", id)
+	return "", nil
+}
+
+func TestInventoryCSV(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, build := buildProject(t, inventoryFiles("inventory.csv", `# devices of the house
+id,name,template,ROOM
+100,kitchen,templates/sensor,kitchen
+101,,templates/sensor, hall
+DEFAULT,fallback,templates/sensor,unknown
+`), withInventory("inventory.csv"))
+	defer os.RemoveAll(dir)
+	t.Ok(build())
+
+	// inventory variables win over the template ones, which still provide
+	// the variables the inventory does not set
+	name, config := mainConfig(t, dir, "100")
+	t.Equals("kitchen", name)
+	t.Equals(map[string]interface{}{"room": "kitchen", "level": "warn", "id": "100"}, config)
+	name, config = mainConfig(t, dir, "101")
+	t.Equals("101", name)
+	t.Equals(map[string]interface{}{"room": "hall", "level": "warn", "id": "101"}, config)
+	name, config = mainConfig(t, dir, "DEFAULT")
+	t.Equals("fallback", name)
+	t.Equals("unknown", config["room"])
+}
+
+func TestInventoryJSON(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, build := buildProject(t, inventoryFiles("inventory.json", `[
+		{"id": "200", "name": "garage", "template": "templates/sensor", "vars": {"ROOM": "garage", "LEVEL": "debug"}},
+		{"id": "201", "template": "templates/sensor"}
+	]`), withInventory("inventory.json"))
+	defer os.RemoveAll(dir)
+	t.Ok(build())
+
+	name, config := mainConfig(t, dir, "200")
+	t.Equals("garage", name)
+	t.Equals(map[string]interface{}{"room": "garage", "level": "debug", "id": "200"}, config)
+	// firmware.json vars win over vars.json
+	name, config = mainConfig(t, dir, "201")
+	t.Equals("201", name)
+	t.Equals(map[string]interface{}{"room": "none", "level": "warn", "id": "201"}, config)
+}
+
+func TestInventoryErrors(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	for inventory, message := range map[string]string{
+		"id,name,template\n1,a,templates/sensor\n2,b,\n":                 "entry 2 needs an id and a template",
+		"id,name,template\n1,a,templates/sensor\n1,b,templates/sensor\n": `Devices "a" and "b" have the same id 1`,
+		"id,name,template\n1,a,templates/nope\n":                         "templates/nope",
+		"id,name,template\n1,a\n":                                        "wrong number of fields",
+	} {
+		dir, build := buildProject(t, inventoryFiles("inventory.csv", inventory), withInventory("inventory.csv"))
+		err := build()
+		os.RemoveAll(dir)
+		t.Assert(err != nil, "expected an error building %q", inventory)
+		t.Assert(strings.Contains(err.Error(), message), "unexpected error for %q: %s", inventory, err)
+	}
+}
@@ -0,0 +1,269 @@
+// Package luatoken implements a tokenizer for Lua 5.1 source code that
+// follows the rules of the reference lexer (llex.c) closely enough to be used
+// for source-to-source transformations.
+package luatoken
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kind identifies the class of a token
+type Kind int
+
+const (
+	EOF Kind = iota
+	Name
+	Keyword
+	Number
+	String
+	Operator
+	Comment
+)
+
+var kindNames = []string{"EOF", "Name", "Keyword", "Number", "String", "Operator", "Comment"}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Token is a lexical element of a Lua source file
+type Token struct {
+	Kind Kind
+	// Text is the exact source text of the token, including quotes,
+	// brackets and comment markers
+	Text string
+	// Offset is the byte offset of the token in the source
+	Offset int
+	// Line is the 1-based line number where the token starts
+	Line int
+}
+
+// Keywords contains the reserved words of Lua 5.1
+var Keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+type lexer struct {
+	src    string
+	pos    int
+	line   int
+	tokens []Token
+}
+
+// Tokenize splits src into tokens. Whitespace is dropped, comments are
+// returned as Comment tokens. A leading "#" line, which the Lua loader skips,
+// is also returned as a comment.
+func Tokenize(src []byte) ([]Token, error) {
+	l := &lexer{
+		src:  string(src),
+		line: 1,
+	}
+	if strings.HasPrefix(l.src, "#") {
+		end := strings.IndexByte(l.src, '\n')
+		if end < 0 {
+			end = len(l.src)
+		}
+		l.emit(Comment, 0, end)
+		l.pos = end
+	}
+	for {
+		if err := l.next(); err != nil {
+			return nil, err
+		}
+		if l.pos >= len(l.src) {
+			return l.tokens, nil
+		}
+	}
+}
+
+// Filter returns the tokens that are not comments
+func Filter(tokens []Token) []Token {
+	filtered := make([]Token, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Kind != Comment {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+func (l *lexer) emit(kind Kind, start, end int) {
+	text := l.src[start:end]
+	l.tokens = append(l.tokens, Token{
+		Kind:   kind,
+		Text:   text,
+		Offset: start,
+		Line:   l.line,
+	})
+	l.line += strings.Count(text, "\n")
+}
+
+func (l *lexer) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("line %d: %s", l.line, fmt.Sprintf(format, a...))
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlnum(c byte) bool {
+	return isAlpha(c) || isDigit(c)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == '\v'
+}
+
+// longBracketLevel returns the level of a long bracket opening at the current
+// position ("[[" is level 0, "[=[" is level 1 ...) or -1 if there is none.
+func (l *lexer) longBracketLevel() int {
+	if l.peek(0) != '[' {
+		return -1
+	}
+	level := 0
+	for l.peek(level+1) == '=' {
+		level++
+	}
+	if l.peek(level+1) == '[' {
+		return level
+	}
+	return -1
+}
+
+// skipLongBracket advances past a long bracket of the given level,
+// assuming the opening bracket starts at the current position.
+func (l *lexer) skipLongBracket(level int) error {
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos+level+2:], closing)
+	if end < 0 {
+		return l.errorf("unfinished long string or comment")
+	}
+	l.pos += level + 2 + end + len(closing)
+	return nil
+}
+
+func (l *lexer) next() error {
+	for l.pos < len(l.src) && isSpace(l.src[l.pos]) {
+		if l.src[l.pos] == '\n' {
+			l.line++
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return nil
+	}
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == '-' && l.peek(1) == '-':
+		l.pos += 2
+		if level := l.longBracketLevel(); level >= 0 {
+			if err := l.skipLongBracket(level); err != nil {
+				return err
+			}
+		} else {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		}
+		l.emit(Comment, start, l.pos)
+	case c == '[':
+		if level := l.longBracketLevel(); level >= 0 {
+			if err := l.skipLongBracket(level); err != nil {
+				return err
+			}
+			l.emit(String, start, l.pos)
+		} else {
+			l.pos++
+			l.emit(Operator, start, l.pos)
+		}
+	case c == '"' || c == '\'':
+		l.pos++
+		for {
+			if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+				return l.errorf("unfinished string")
+			}
+			ch := l.src[l.pos]
+			if ch == '\\' {
+				l.pos += 2
+				continue
+			}
+			l.pos++
+			if ch == c {
+				break
+			}
+		}
+		l.emit(String, start, l.pos)
+	case c == '.' && isDigit(l.peek(1)) || isDigit(c):
+		l.readNumeral()
+		l.emit(Number, start, l.pos)
+	case c == '.':
+		if l.peek(1) == '.' {
+			if l.peek(2) == '.' {
+				l.pos += 3
+			} else {
+				l.pos += 2
+			}
+		} else {
+			l.pos++
+		}
+		l.emit(Operator, start, l.pos)
+	case isAlpha(c):
+		for l.pos < len(l.src) && isAlnum(l.src[l.pos]) {
+			l.pos++
+		}
+		kind := Name
+		if Keywords[l.src[start:l.pos]] {
+			kind = Keyword
+		}
+		l.emit(kind, start, l.pos)
+	case c == '=' || c == '<' || c == '>' || c == '~':
+		l.pos++
+		if l.peek(0) == '=' {
+			l.pos++
+		} else if c == '~' {
+			return l.errorf("unexpected symbol '~'")
+		}
+		l.emit(Operator, start, l.pos)
+	case strings.IndexByte("+-*/%^#(){}];:,", c) >= 0:
+		l.pos++
+		l.emit(Operator, start, l.pos)
+	default:
+		return l.errorf("unexpected symbol %q", c)
+	}
+	return nil
+}
+
+// readNumeral mimics read_numeral() in llex.c, which is greedy: it consumes
+// any trailing alphanumeric characters so that "3and" is a single (malformed)
+// token.
+func (l *lexer) readNumeral() {
+	for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+		l.pos++
+	}
+	if c := l.peek(0); c == 'e' || c == 'E' {
+		l.pos++
+		if c := l.peek(0); c == '+' || c == '-' {
+			l.pos++
+		}
+	}
+	for l.pos < len(l.src) && isAlnum(l.src[l.pos]) {
+		l.pos++
+	}
+}
@@ -0,0 +1,63 @@
+package luatoken_test
+
+import (
+	"espore/builder/luatoken"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestTokenize(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	src := `#!/usr/bin/lua
+local x = 3.5e-2 .. "a\"b" -- comment
+--[==[ long
+comment ]==]
+print(x ~= [[long
+string]], t[ [=[k]=] ], ...)
+`
+	tokens, err := luatoken.Tokenize([]byte(src))
+	t.Ok(err)
+
+	var texts []string
+	var kinds []luatoken.Kind
+	for _, tk := range tokens {
+		texts = append(texts, tk.Text)
+		kinds = append(kinds, tk.Kind)
+	}
+	t.Equals([]string{
+		"#!/usr/bin/lua", "local", "x", "=", "3.5e-2", "..", `"a\"b"`, "-- comment",
+		"--[==[ long\ncomment ]==]", "print", "(", "x", "~=", "[[long\nstring]]", ",",
+		"t", "[", "[=[k]=]", "]", ",", "...", ")",
+	}, texts)
+	t.Equals(luatoken.Comment, kinds[0])
+	t.Equals(luatoken.Keyword, kinds[1])
+	t.Equals(luatoken.Number, kinds[4])
+	t.Equals(luatoken.String, kinds[6])
+	t.Equals(6, tokens[len(tokens)-1].Line)
+
+	t.Equals(len(tokens)-3, len(luatoken.Filter(tokens)))
+}
+
+func TestTokenizeErrors(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	for _, src := range []string{`x = "abc`, "x = 'a\nb'", "x = [[abc", "--[[ abc", "x ~ y", "x = @"} {
+		_, err := luatoken.Tokenize([]byte(src))
+		t.Assert(err != nil, "Expected error tokenizing %q", src)
+	}
+}
+
+func TestGreedyNumerals(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	tokens, err := luatoken.Tokenize([]byte("0x1Fand 1..2"))
+	t.Ok(err)
+	t.Equals(2, len(tokens))
+	t.Equals("0x1Fand", tokens[0].Text)
+	t.Equals("1..2", tokens[1].Text)
+}
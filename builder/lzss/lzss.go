@@ -0,0 +1,116 @@
+// Package lzss implements the LZSS compression of image files. The format is
+// kept simple enough for the bootloader to decompress it in Lua with little
+// RAM: a 1KB window and no bit operations.
+//
+// The data is a sequence of groups: a flag byte followed by up to eight
+// items, one per bit of the flag from the least significant. A set bit is a
+// literal byte. A clear bit is a two byte reference to a match in the last
+// WindowSize bytes of output: the first byte and the top two bits of the
+// second hold the distance minus one, the low six bits the length minus
+// MinMatch.
+package lzss
+
+import "fmt"
+
+const (
+	// WindowSize is how far back a reference can point
+	WindowSize = 1 << 10
+	// MinMatch is the shortest match worth a reference
+	MinMatch = 3
+	// MaxMatch is the longest match a reference can hold
+	MaxMatch = MinMatch + 1<<6 - 1
+	// maxCandidates bounds the positions tried for each match, trading
+	// compression for speed
+	maxCandidates = 256
+)
+
+// Compress compresses data. The result is deterministic.
+func Compress(data []byte) []byte {
+	out := make([]byte, 0, len(data)/2)
+	chains := make(map[[MinMatch]byte][]int)
+	var flagPos, items int
+	emit := func(literal bool, b ...byte) {
+		if items == 0 {
+			flagPos = len(out)
+			out = append(out, 0)
+		}
+		if literal {
+			out[flagPos] |= 1 << uint(items)
+		}
+		out = append(out, b...)
+		items = (items + 1) % 8
+	}
+	index := func(from, to int) {
+		for p := from; p < to && p+MinMatch <= len(data); p++ {
+			var key [MinMatch]byte
+			copy(key[:], data[p:])
+			chains[key] = append(chains[key], p)
+		}
+	}
+
+	for i := 0; i < len(data); {
+		bestLen, bestDist := 0, 0
+		if i+MinMatch <= len(data) {
+			var key [MinMatch]byte
+			copy(key[:], data[i:])
+			chain := chains[key]
+			for c, tried := len(chain)-1, 0; c >= 0 && tried < maxCandidates; c, tried = c-1, tried+1 {
+				p := chain[c]
+				if i-p > WindowSize {
+					break
+				}
+				n := 0
+				for n < MaxMatch && i+n < len(data) && data[p+n] == data[i+n] {
+					n++
+				}
+				if n > bestLen {
+					bestLen, bestDist = n, i-p
+					if n == MaxMatch {
+						break
+					}
+				}
+			}
+		}
+		if bestLen >= MinMatch {
+			d := bestDist - 1
+			emit(false, byte(d>>2), byte(d&3)<<6|byte(bestLen-MinMatch))
+			index(i, i+bestLen)
+			i += bestLen
+		} else {
+			emit(true, data[i])
+			index(i, i+1)
+			i++
+		}
+	}
+	return out
+}
+
+// Decompress restores data compressed with Compress
+func Decompress(data []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(data); {
+		flags := data[i]
+		i++
+		for bit := uint(0); bit < 8 && i < len(data); bit++ {
+			if flags&(1<<bit) != 0 {
+				out = append(out, data[i])
+				i++
+				continue
+			}
+			if i+1 >= len(data) {
+				return nil, fmt.Errorf("Truncated reference at %d", i)
+			}
+			dist := int(data[i])<<2 | int(data[i+1]>>6) + 1
+			length := int(data[i+1]&0x3f) + MinMatch
+			i += 2
+			if dist > len(out) {
+				return nil, fmt.Errorf("Reference at %d points before the start of the data", i-2)
+			}
+			start := len(out) - dist
+			for n := 0; n < length; n++ {
+				out = append(out, out[start+n])
+			}
+		}
+	}
+	return out, nil
+}
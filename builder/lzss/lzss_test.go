@@ -0,0 +1,47 @@
+package lzss_test
+
+import (
+	"bytes"
+	"espore/builder/lzss"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestRoundTrip(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabc"),
+		bytes.Repeat([]byte{0}, 10000),
+		[]byte(strings.Repeat("local function f(x) return x * 2 end\n", 200)),
+		random,
+	}
+	for _, input := range inputs {
+		compressed := lzss.Compress(input)
+		output, err := lzss.Decompress(compressed)
+		t.Ok(err)
+		t.Assert(bytes.Equal(input, output), "Round trip failed for %d bytes", len(input))
+	}
+
+	text := []byte(strings.Repeat("local function f(x) return x * 2 end\n", 200))
+	t.Assert(len(lzss.Compress(text)) < len(text)/10, "Expected repetitive text to compress well")
+	t.Equals(string(lzss.Compress(text)), string(lzss.Compress(text)))
+}
+
+func TestInvalid(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	_, err := lzss.Decompress([]byte{0, 0, 0})
+	t.Assert(err != nil, "Expected a reference before the start to fail")
+	_, err = lzss.Decompress([]byte{0xfe, 'a', 0})
+	t.Assert(err != nil, "Expected a truncated reference to fail")
+}
@@ -0,0 +1,35 @@
+package builder
+
+import (
+	"espore/builder/minify"
+	"fmt"
+)
+
+// minifyFiles shrinks the Lua files that will be stored in SPIFFS as source.
+// Files packed into LFS are compiled anyway and are left alone. Datafile
+// annotations were already collected when the library was loaded, so removing
+// the comments that hold them does not affect datafiles.json.
+func minifyFiles(manifest *FirmwareManifest, config FirmwareMinifyConfig) error {
+	options := &minify.Options{
+		RenameLocals: config.RenameLocals,
+	}
+	for i, fe := range manifest.Files {
+		if !isLua(fe.Path) {
+			continue
+		}
+		src, err := fe.ReadContent()
+		if err != nil {
+			return fmt.Errorf("Error reading %s for minification: %s", fe.Path, err)
+		}
+		data, err := minify.Minify(src, options)
+		if err != nil {
+			return fmt.Errorf("Error minifying %s: %s", fe.Path, err)
+		}
+		minified := NewVirtualFileEntry(data, fe.Path)
+		minified.Base = fe.Base
+		minified.Datafiles = fe.Datafiles
+		minified.Dependencies = fe.Dependencies
+		manifest.Files[i] = minified
+	}
+	return nil
+}
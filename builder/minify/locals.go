@@ -0,0 +1,606 @@
+package minify
+
+import (
+	"espore/builder/luatoken"
+	"fmt"
+)
+
+// local is a local variable declaration
+type local struct {
+	name string
+	// newName is the identifier the variable is renamed to. Implicit locals
+	// (self, arg) keep their names since there is no declaration to rename.
+	newName string
+}
+
+type scope struct {
+	locals []*local
+}
+
+// resolver walks a token stream following the Lua 5.1 grammar just closely
+// enough to know, for every identifier, whether it refers to a local variable
+// and which one.
+type resolver struct {
+	tokens []luatoken.Token
+	pos    int
+	scopes []*scope
+	active int // number of locals currently in scope, across functions
+	pool   []string
+	// generated counts the candidate names tried for the pool
+	generated int
+	globals   map[string]bool
+	renames   map[int]string
+	// reads collects the names that read a global variable, if not nil
+	reads map[int]bool
+}
+
+// resolveLocals returns, for each token index that names a local variable,
+// the new name of that variable.
+//
+// Names are assigned by stack position: a new local gets the n-th name of the
+// pool, where n is the number of locals visible at that point. Since all
+// visible locals then have distinct names and the pool never contains a name
+// used as a global in the chunk, no reference can be captured by a different
+// variable after renaming.
+func resolveLocals(tokens []luatoken.Token) (map[int]string, error) {
+	r := &resolver{
+		tokens:  tokens,
+		globals: make(map[string]bool),
+		renames: make(map[int]string),
+	}
+	// first pass collects every identifier so generated names never collide
+	// with globals or fields.
+	for _, t := range tokens {
+		if t.Kind == luatoken.Name {
+			r.globals[t.Text] = true
+		}
+	}
+	if err := r.chunk(); err != nil {
+		return nil, err
+	}
+	return r.renames, nil
+}
+
+// GlobalReads returns the token indexes of the names that read a global
+// variable. Locals, fields and the targets of assignments and function
+// statements are not included.
+func GlobalReads(tokens []luatoken.Token) (map[int]bool, error) {
+	r := &resolver{
+		tokens:  tokens,
+		globals: make(map[string]bool),
+		renames: make(map[int]string),
+		reads:   make(map[int]bool),
+	}
+	if err := r.chunk(); err != nil {
+		return nil, err
+	}
+	return r.reads, nil
+}
+
+// chunk resolves the whole token stream
+func (r *resolver) chunk() error {
+	r.openScope()
+	if err := r.block(); err != nil {
+		return err
+	}
+	if r.pos < len(r.tokens) {
+		return r.errorf("'<eof>' expected")
+	}
+	return nil
+}
+
+func (r *resolver) errorf(format string, a ...interface{}) error {
+	line := 0
+	near := "<eof>"
+	if r.pos < len(r.tokens) {
+		line = r.tokens[r.pos].Line
+		near = r.tokens[r.pos].Text
+	} else if len(r.tokens) > 0 {
+		line = r.tokens[len(r.tokens)-1].Line
+	}
+	return fmt.Errorf("line %d: %s near '%s'", line, fmt.Sprintf(format, a...), near)
+}
+
+func (r *resolver) peek() string {
+	if r.pos < len(r.tokens) {
+		t := r.tokens[r.pos]
+		if t.Kind == luatoken.Name {
+			return "<name>"
+		}
+		if t.Kind == luatoken.Number || t.Kind == luatoken.String {
+			return "<" + t.Kind.String() + ">"
+		}
+		return t.Text
+	}
+	return "<eof>"
+}
+
+func (r *resolver) check(text string) bool {
+	if r.peek() == text {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+func (r *resolver) expect(text string) error {
+	if !r.check(text) {
+		return r.errorf("'%s' expected", text)
+	}
+	return nil
+}
+
+// poolName returns the i-th shortest identifier that is neither a keyword
+// nor used anywhere in the chunk
+func (r *resolver) poolName(i int) string {
+	const first = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_"
+	const rest = first + "0123456789"
+	for len(r.pool) <= i {
+		n := r.generated
+		r.generated++
+		name := string(first[n%len(first)])
+		for n /= len(first); n > 0; n /= len(rest) {
+			n--
+			name += string(rest[n%len(rest)])
+		}
+		if luatoken.Keywords[name] || r.globals[name] || name == "self" || name == "arg" {
+			continue
+		}
+		r.pool = append(r.pool, name)
+	}
+	return r.pool[i]
+}
+
+func (r *resolver) openScope() {
+	r.scopes = append(r.scopes, &scope{})
+}
+
+func (r *resolver) closeScope() {
+	s := r.scopes[len(r.scopes)-1]
+	r.active -= len(s.locals)
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+// declare brings a local into scope. tokenIndex is the position of the
+// declaring identifier or -1 for implicit locals.
+func (r *resolver) declare(name string, tokenIndex int) {
+	l := &local{name: name, newName: name}
+	if tokenIndex >= 0 {
+		l.newName = r.poolName(r.active)
+		r.renames[tokenIndex] = l.newName
+	}
+	s := r.scopes[len(r.scopes)-1]
+	s.locals = append(s.locals, l)
+	r.active++
+}
+
+// reference resolves the identifier at tokenIndex
+func (r *resolver) reference(tokenIndex int) {
+	name := r.tokens[tokenIndex].Text
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		locals := r.scopes[i].locals
+		for j := len(locals) - 1; j >= 0; j-- {
+			if locals[j].name == name {
+				if locals[j].newName != name {
+					r.renames[tokenIndex] = locals[j].newName
+				}
+				return
+			}
+		}
+	}
+	if r.reads != nil {
+		r.reads[tokenIndex] = true
+	}
+}
+
+func (r *resolver) name() (int, error) {
+	if r.peek() != "<name>" {
+		return 0, r.errorf("<name> expected")
+	}
+	r.pos++
+	return r.pos - 1, nil
+}
+
+func blockFollow(token string) bool {
+	switch token {
+	case "else", "elseif", "end", "until", "<eof>":
+		return true
+	}
+	return false
+}
+
+func (r *resolver) block() error {
+	for !blockFollow(r.peek()) {
+		if r.peek() == "return" {
+			r.pos++
+			if !blockFollow(r.peek()) && r.peek() != ";" {
+				if err := r.exprList(); err != nil {
+					return err
+				}
+			}
+			r.check(";")
+			return nil
+		}
+		if r.check("break") {
+			r.check(";")
+			return nil
+		}
+		if err := r.statement(); err != nil {
+			return err
+		}
+		r.check(";")
+	}
+	return nil
+}
+
+// scopedBlock parses a block in a new scope, closed by the given keyword
+func (r *resolver) scopedBlock(closing string) error {
+	r.openScope()
+	if err := r.block(); err != nil {
+		return err
+	}
+	r.closeScope()
+	return r.expect(closing)
+}
+
+func (r *resolver) statement() error {
+	switch r.peek() {
+	case "if":
+		r.pos++
+		for {
+			if err := r.expr(); err != nil {
+				return err
+			}
+			if err := r.expect("then"); err != nil {
+				return err
+			}
+			r.openScope()
+			if err := r.block(); err != nil {
+				return err
+			}
+			r.closeScope()
+			if !r.check("elseif") {
+				break
+			}
+		}
+		if r.check("else") {
+			return r.scopedBlock("end")
+		}
+		return r.expect("end")
+	case "while":
+		r.pos++
+		if err := r.expr(); err != nil {
+			return err
+		}
+		if err := r.expect("do"); err != nil {
+			return err
+		}
+		return r.scopedBlock("end")
+	case "do":
+		r.pos++
+		return r.scopedBlock("end")
+	case "for":
+		return r.forStatement()
+	case "repeat":
+		r.pos++
+		// the condition can see the locals declared in the loop body
+		r.openScope()
+		if err := r.block(); err != nil {
+			return err
+		}
+		if err := r.expect("until"); err != nil {
+			return err
+		}
+		if err := r.expr(); err != nil {
+			return err
+		}
+		r.closeScope()
+		return nil
+	case "function":
+		r.pos++
+		n, err := r.name()
+		if err != nil {
+			return err
+		}
+		r.reference(n)
+		if r.peek() != "." && r.peek() != ":" {
+			// function NAME() assigns NAME
+			delete(r.reads, n)
+		}
+		for r.check(".") {
+			if _, err := r.name(); err != nil {
+				return err
+			}
+		}
+		method := false
+		if r.check(":") {
+			if _, err := r.name(); err != nil {
+				return err
+			}
+			method = true
+		}
+		return r.funcBody(method)
+	case "local":
+		r.pos++
+		if r.check("function") {
+			n, err := r.name()
+			if err != nil {
+				return err
+			}
+			r.declare(r.tokens[n].Text, n)
+			return r.funcBody(false)
+		}
+		var names []int
+		for {
+			n, err := r.name()
+			if err != nil {
+				return err
+			}
+			names = append(names, n)
+			if !r.check(",") {
+				break
+			}
+		}
+		if r.check("=") {
+			if err := r.exprList(); err != nil {
+				return err
+			}
+		}
+		for _, n := range names {
+			r.declare(r.tokens[n].Text, n)
+		}
+		return nil
+	default:
+		// assignment or function call
+		targets := []int{r.pos}
+		if err := r.suffixedExpr(); err != nil {
+			return err
+		}
+		if r.peek() == "=" || r.peek() == "," {
+			// a target that is a plain name is written, not read
+			plain := func(start int) {
+				if r.pos == start+1 {
+					delete(r.reads, start)
+				}
+			}
+			plain(targets[0])
+			for r.check(",") {
+				start := r.pos
+				if err := r.suffixedExpr(); err != nil {
+					return err
+				}
+				plain(start)
+			}
+			if err := r.expect("="); err != nil {
+				return err
+			}
+			return r.exprList()
+		}
+		return nil
+	}
+}
+
+func (r *resolver) forStatement() error {
+	r.pos++
+	var names []int
+	n, err := r.name()
+	if err != nil {
+		return err
+	}
+	names = append(names, n)
+	if r.check("=") {
+		if err := r.exprList(); err != nil {
+			return err
+		}
+	} else {
+		for r.check(",") {
+			n, err := r.name()
+			if err != nil {
+				return err
+			}
+			names = append(names, n)
+		}
+		if err := r.expect("in"); err != nil {
+			return err
+		}
+		if err := r.exprList(); err != nil {
+			return err
+		}
+	}
+	if err := r.expect("do"); err != nil {
+		return err
+	}
+	r.openScope()
+	for _, n := range names {
+		r.declare(r.tokens[n].Text, n)
+	}
+	if err := r.scopedBlock("end"); err != nil {
+		return err
+	}
+	r.closeScope()
+	return nil
+}
+
+func (r *resolver) funcBody(method bool) error {
+	r.openScope()
+	if method {
+		r.declare("self", -1)
+	}
+	if err := r.expect("("); err != nil {
+		return err
+	}
+	if !r.check(")") {
+		for {
+			if r.check("...") {
+				// Lua 5.1 vararg functions get an implicit "arg" local
+				r.declare("arg", -1)
+				break
+			}
+			n, err := r.name()
+			if err != nil {
+				return err
+			}
+			r.declare(r.tokens[n].Text, n)
+			if !r.check(",") {
+				break
+			}
+		}
+		if err := r.expect(")"); err != nil {
+			return err
+		}
+	}
+	if err := r.block(); err != nil {
+		return err
+	}
+	r.closeScope()
+	return r.expect("end")
+}
+
+func (r *resolver) exprList() error {
+	for {
+		if err := r.expr(); err != nil {
+			return err
+		}
+		if !r.check(",") {
+			return nil
+		}
+	}
+}
+
+func isBinaryOperator(token string) bool {
+	switch token {
+	case "+", "-", "*", "/", "%", "^", "..", "==", "~=", "<", "<=", ">", ">=", "and", "or":
+		return true
+	}
+	return false
+}
+
+func (r *resolver) expr() error {
+	for r.check("not") || r.check("-") || r.check("#") {
+	}
+	if err := r.simpleExpr(); err != nil {
+		return err
+	}
+	for isBinaryOperator(r.peek()) {
+		r.pos++
+		for r.check("not") || r.check("-") || r.check("#") {
+		}
+		if err := r.simpleExpr(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *resolver) simpleExpr() error {
+	switch r.peek() {
+	case "<Number>", "<String>", "nil", "true", "false", "...":
+		r.pos++
+		return nil
+	case "{":
+		return r.table()
+	case "function":
+		r.pos++
+		return r.funcBody(false)
+	}
+	return r.suffixedExpr()
+}
+
+func (r *resolver) suffixedExpr() error {
+	switch r.peek() {
+	case "<name>":
+		r.reference(r.pos)
+		r.pos++
+	case "(":
+		r.pos++
+		if err := r.expr(); err != nil {
+			return err
+		}
+		if err := r.expect(")"); err != nil {
+			return err
+		}
+	default:
+		return r.errorf("unexpected symbol")
+	}
+	for {
+		switch r.peek() {
+		case ".":
+			r.pos++
+			if _, err := r.name(); err != nil {
+				return err
+			}
+		case "[":
+			r.pos++
+			if err := r.expr(); err != nil {
+				return err
+			}
+			if err := r.expect("]"); err != nil {
+				return err
+			}
+		case ":":
+			r.pos++
+			if _, err := r.name(); err != nil {
+				return err
+			}
+			if err := r.callArgs(); err != nil {
+				return err
+			}
+		case "(", "{", "<String>":
+			if err := r.callArgs(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (r *resolver) callArgs() error {
+	switch r.peek() {
+	case "<String>":
+		r.pos++
+		return nil
+	case "{":
+		return r.table()
+	case "(":
+		r.pos++
+		if r.check(")") {
+			return nil
+		}
+		if err := r.exprList(); err != nil {
+			return err
+		}
+		return r.expect(")")
+	}
+	return r.errorf("function arguments expected")
+}
+
+func (r *resolver) table() error {
+	if err := r.expect("{"); err != nil {
+		return err
+	}
+	for !r.check("}") {
+		switch {
+		case r.check("["):
+			if err := r.expr(); err != nil {
+				return err
+			}
+			if err := r.expect("]"); err != nil {
+				return err
+			}
+			if err := r.expect("="); err != nil {
+				return err
+			}
+		case r.peek() == "<name>" && r.pos+1 < len(r.tokens) && r.tokens[r.pos+1].Text == "=":
+			// record field name, not a variable
+			r.pos += 2
+		}
+		if err := r.expr(); err != nil {
+			return err
+		}
+		if !r.check(",") && !r.check(";") {
+			return r.expect("}")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Package minify reduces the size of Lua 5.1 source code by removing
+// comments and whitespace and, optionally, renaming local variables.
+package minify
+
+import (
+	"espore/builder/luatoken"
+	"strings"
+)
+
+// Options controls the transformations applied by Minify
+type Options struct {
+	// RenameLocals replaces local variable names with the shortest
+	// available identifiers
+	RenameLocals bool
+}
+
+// Minify returns a compact version of the given Lua source. The output only
+// depends on the input and the options, so minifying the same file twice
+// yields identical bytes.
+func Minify(src []byte, options *Options) ([]byte, error) {
+	tokens, err := luatoken.Tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	tokens = luatoken.Filter(tokens)
+
+	if options != nil && options.RenameLocals {
+		renames, err := resolveLocals(tokens)
+		if err != nil {
+			return nil, err
+		}
+		for i, name := range renames {
+			tokens[i].Text = name
+		}
+	}
+
+	var sb strings.Builder
+	for i, t := range tokens {
+		if i > 0 && needsSeparator(tokens[i-1].Text, t.Text) {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(t.Text)
+	}
+	if sb.Len() > 0 {
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String()), nil
+}
+
+// needsSeparator reports whether writing a and b next to each other would
+// make the lexer read something other than a followed by b, for example
+// "local" "x" -> "localx", "-" "-1" -> "--1" or "1" ".." -> "1..".
+func needsSeparator(a, b string) bool {
+	// the leading space keeps a "#" from being taken as a shebang line
+	tokens, err := luatoken.Tokenize([]byte(" " + a + b))
+	if err != nil || len(tokens) != 2 {
+		return true
+	}
+	return tokens[0].Text != a || tokens[1].Text != b
+}
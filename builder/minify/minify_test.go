@@ -0,0 +1,73 @@
+package minify_test
+
+import (
+	"espore/builder/minify"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestMinify(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	src := `-- datafile: config.json
+local M = {} -- module table
+
+--[[ adds two
+numbers ]]
+function M.add(a, b)
+    return a - -b
+end
+
+local s = [[
+keep   this]] .. 1 .. "x"
+return M
+`
+	out, err := minify.Minify([]byte(src), nil)
+	t.Ok(err)
+	t.Equals("local M={}function M.add(a,b)return a- -b end local s=[[\nkeep   this]]..1 ..\"x\"return M\n", string(out))
+
+	again, err := minify.Minify([]byte(src), nil)
+	t.Ok(err)
+	t.Equals(out, again)
+}
+
+func TestRenameLocals(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	src := `
+local counter = 0
+local function increment(step, ...)
+    local value = counter + step
+    counter = value
+    return value, arg
+end
+local obj = {counter = counter, increment = increment}
+function obj:get() return self.counter end
+for index, item in ipairs(list) do
+    local a = index
+    print(a, item)
+end
+repeat local done = true until done
+local x = x
+return obj, increment
+`
+	out, err := minify.Minify([]byte(src), &minify.Options{RenameLocals: true})
+	t.Ok(err)
+	// "a" is used in the source, so the pool starts at "b". The implicit "arg"
+	// local of the vararg function takes a slot, hence "f" for value.
+	t.Equals("local b=0 local function c(d,...)local f=b+d b=f return f,arg end "+
+		"local d={counter=b,increment=c}function d:get()return self.counter end "+
+		"for e,f in ipairs(list)do local g=e print(g,f)end "+
+		"repeat local e=true until e local e=x return d,c\n", string(out))
+}
+
+func TestRenameLocalsSyntaxError(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	_, err := minify.Minify([]byte("local function (x) end"), &minify.Options{RenameLocals: true})
+	t.Assert(err != nil, "Expected syntax error")
+}
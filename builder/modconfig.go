@@ -0,0 +1,256 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"espore/builder/secrets"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultVarsFile is the per-device file, relative to the device directory,
+// holding values for ${VAR} placeholders in module configs
+const DefaultVarsFile = "vars.json"
+
+// ModuleOverride changes the definition of a module for a single device. The
+// config is deep-merged into the one declared by the library unless Replace
+// is set. A null value in the override removes the key, a null config
+// removes the whole config.
+type ModuleOverride struct {
+	Name      string          `json:"name"`
+	Autostart *bool           `json:"autostart"`
+	Config    json.RawMessage `json:"config"`
+	Replace   bool            `json:"replace"`
+}
+
+var varRegex = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_.:-]*)\}`)
+
+func decodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (fwDef *FirmwareDef) varsFile() string {
+	if fwDef.VarsFile == "" {
+		return DefaultVarsFile
+	}
+	return filepath.ToSlash(fwDef.VarsFile)
+}
+
+// loadVars adds the values of the device vars file to fwDef.Vars. Values
+// declared inline in firmware.json take precedence.
+func loadVars(devicePath string, fwDef *FirmwareDef) error {
+	f, err := os.Open(filepath.Join(devicePath, fwDef.varsFile()))
+	if err != nil {
+		if os.IsNotExist(err) && fwDef.VarsFile == "" {
+			return nil
+		}
+		return fmt.Errorf("Cannot read vars file: %s", err)
+	}
+	defer f.Close()
+	var vars map[string]interface{}
+	d := json.NewDecoder(f)
+	d.UseNumber()
+	if err := d.Decode(&vars); err != nil {
+		return fmt.Errorf("Cannot parse vars file %s: %s", f.Name(), err)
+	}
+	if fwDef.Vars == nil {
+		fwDef.Vars = make(map[string]interface{})
+	}
+	for k, v := range vars {
+		if _, ok := fwDef.Vars[k]; !ok {
+			fwDef.Vars[k] = v
+		}
+	}
+	return nil
+}
+
+// VarLookup returns the value of a template variable
+type VarLookup func(name string) (interface{}, bool)
+
+// deviceVarLookup resolves variables from the device vars, then the
+// environment. DEVICE_ID and DEVICE_NAME are always defined and
+// ${secret:NAME} takes NAME from the secrets store. usedSecrets is set when
+// a secret is looked up.
+func deviceVarLookup(fwDef FirmwareDef, store *secrets.Store, usedSecrets *bool) VarLookup {
+	return func(name string) (interface{}, bool) {
+		if strings.HasPrefix(name, secretVarPrefix) {
+			*usedSecrets = true
+			return store.Get(name[len(secretVarPrefix):])
+		}
+		if v, ok := fwDef.Vars[name]; ok {
+			return v, true
+		}
+		switch name {
+		case "DEVICE_ID":
+			return fwDef.ID, true
+		case "DEVICE_NAME":
+			return fwDef.Name, true
+		}
+		return os.LookupEnv(name)
+	}
+}
+
+func varToString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// expandVars replaces ${VAR} placeholders in all the strings of a decoded
+// JSON value. A string that consists of a single placeholder takes the value
+// of the variable as is, so vars files can provide numbers or objects. "$$"
+// stands for a literal "$".
+func expandVars(value interface{}, lookup VarLookup) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if m := varRegex.FindStringSubmatch(v); m != nil && m[0] == v && m[1] != "" {
+			val, ok := lookup(m[1])
+			if !ok {
+				return nil, fmt.Errorf("Undefined variable %q", m[1])
+			}
+			return val, nil
+		}
+		var err error
+		expanded := varRegex.ReplaceAllStringFunc(v, func(match string) string {
+			if match == "$$" {
+				return "$"
+			}
+			name := match[2 : len(match)-1]
+			val, ok := lookup(name)
+			if !ok {
+				err = fmt.Errorf("Undefined variable %q", name)
+				return match
+			}
+			return varToString(val)
+		})
+		return expanded, err
+	case map[string]interface{}:
+		for k, item := range v {
+			expanded, err := expandVars(item, lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = expanded
+		}
+	case []interface{}:
+		for i, item := range v {
+			expanded, err := expandVars(item, lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return value, nil
+}
+
+// deepMerge merges override into base. Objects are merged key by key,
+// anything else in override replaces the value in base. A null removes the
+// key, so nulls never reach the result, even inside objects base lacks.
+func deepMerge(base, override interface{}) interface{} {
+	overrideMap, ok := override.(map[string]interface{})
+	if !ok {
+		return override
+	}
+	baseMap, ok := base.(map[string]interface{})
+	if !ok {
+		baseMap = make(map[string]interface{})
+	}
+	for k, v := range overrideMap {
+		if v == nil {
+			delete(baseMap, k)
+			continue
+		}
+		baseMap[k] = deepMerge(baseMap[k], v)
+	}
+	return baseMap
+}
+
+// configureModules applies the module overrides of firmware.json and expands
+// template variables in every module config. Overrides for modules no
+// library declares add them to the device.
+func configureModules(modules []ModuleDef, fwDef FirmwareDef, lookup VarLookup) ([]ModuleDef, error) {
+	index := make(map[string]*ModuleDef)
+	for i := range modules {
+		index[modules[i].Name] = &modules[i]
+	}
+	var added []*ModuleDef
+	for _, o := range fwDef.Modules {
+		mod, ok := index[o.Name]
+		if !ok {
+			mod = &ModuleDef{Name: o.Name}
+			index[o.Name] = mod
+			added = append(added, mod)
+		}
+		if o.Autostart != nil {
+			mod.Autostart = *o.Autostart
+		}
+		if len(o.Config) > 0 {
+			if string(bytes.TrimSpace(o.Config)) == "null" {
+				mod.Config = nil
+			} else if o.Replace {
+				mod.Config = o.Config
+			} else {
+				var base interface{}
+				if len(mod.Config) > 0 {
+					var err error
+					if base, err = decodeJSON(mod.Config); err != nil {
+						return nil, fmt.Errorf("Invalid config in module %s: %s", mod.Name, err)
+					}
+				}
+				override, err := decodeJSON(o.Config)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid config override for module %s: %s", mod.Name, err)
+				}
+				mod.Config, err = json.Marshal(deepMerge(base, override))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	sort.SliceStable(added, func(i, j int) bool {
+		return strings.Compare(added[i].Name, added[j].Name) < 0
+	})
+	// keep the main module last
+	var main []ModuleDef
+	if n := len(modules); n > 0 && modules[n-1].Name == MainModule.Name {
+		main = modules[n-1:]
+		modules = modules[:n-1]
+	}
+	configured := append([]ModuleDef(nil), modules...)
+	for _, mod := range added {
+		configured = append(configured, *mod)
+	}
+	modules = append(configured, main...)
+
+	for i, mod := range modules {
+		if len(mod.Config) == 0 {
+			continue
+		}
+		config, err := decodeJSON(mod.Config)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config in module %s: %s", mod.Name, err)
+		}
+		config, err = expandVars(config, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("Error expanding config of module %s: %s", mod.Name, err)
+		}
+		if modules[i].Config, err = json.Marshal(config); err != nil {
+			return nil, err
+		}
+	}
+	return modules, nil
+}
@@ -0,0 +1,143 @@
+package builder_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"espore/builder"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func decode(t *ut.DefaultTestTools, st string) interface{} {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader([]byte(st)))
+	d.UseNumber()
+	t.Ok(d.Decode(&v))
+	return v
+}
+
+func encode(t *ut.DefaultTestTools, v interface{}) string {
+	data, err := json.Marshal(v)
+	t.Ok(err)
+	return string(data)
+}
+
+func TestDeepMerge(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	for _, c := range []struct{ base, override, merged string }{
+		// objects merge key by key, at any depth
+		{`{"a": 1, "b": {"c": 2, "d": 3}}`, `{"b": {"d": 4, "e": 5}, "f": 6}`, `{"a":1,"b":{"c":2,"d":4,"e":5},"f":6}`},
+		// anything else replaces, arrays included
+		{`{"a": [1, 2], "b": {"c": 1}}`, `{"a": [3], "b": "x"}`, `{"a":[3],"b":"x"}`},
+		{`{"a": 1}`, `[1]`, `[1]`},
+		{`"x"`, `{"a": 1}`, `{"a":1}`},
+		// null removes a key, missing keys included
+		{`{"a": 1, "b": {"c": 2, "d": 3}}`, `{"a": null, "b": {"c": null}, "x": null}`, `{"b":{"d":3}}`},
+		// and never reaches the result inside objects the base lacks
+		{`{"a": 1}`, `{"b": {"c": null, "d": {"e": null}}}`, `{"a":1,"b":{"d":{}}}`},
+		{`{"a": 1}`, `{"a": {"b": null, "c": 2}}`, `{"a":{"c":2}}`},
+	} {
+		t.Equals(c.merged, encode(t, builder.DeepMerge(decode(t, c.base), decode(t, c.override))))
+	}
+}
+
+func TestExpandVars(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	vars := map[string]interface{}{
+		"ROOM":      "kitchen",
+		"PORT":      json.Number("1883"),
+		"CAL":       map[string]interface{}{"offset": json.Number("2")},
+		"secret:PW": "hunter2",
+	}
+	lookup := func(name string) (interface{}, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+
+	for _, c := range []struct{ value, expanded string }{
+		{`"sensors/${ROOM}/temp"`, `"sensors/kitchen/temp"`},
+		{`"${ROOM}-${ROOM}"`, `"kitchen-kitchen"`},
+		// a single placeholder keeps the type of the value
+		{`"${PORT}"`, `1883`},
+		{`"${CAL}"`, `{"offset":2}`},
+		{`"cal=${CAL}"`, `"cal={\"offset\":2}"`},
+		{`"${secret:PW}"`, `"hunter2"`},
+		// $$ is a literal $, also before something that looks like a variable
+		{`"$$5"`, `"$5"`},
+		{`"$$"`, `"$"`},
+		{`"$${ROOM}"`, `"${ROOM}"`},
+		{`"$$$${ROOM}"`, `"$${ROOM}"`},
+		{`"$$${ROOM}"`, `"$kitchen"`},
+		{`"$ {ROOM} $5"`, `"$ {ROOM} $5"`},
+		// all strings are expanded, not keys nor other values
+		{`{"${ROOM}": ["${PORT}", {"a": "${ROOM}"}], "n": 1, "b": true, "z": null}`,
+			`{"${ROOM}":[1883,{"a":"kitchen"}],"b":true,"n":1,"z":null}`},
+	} {
+		expanded, err := builder.ExpandVars(decode(t, c.value), lookup)
+		t.Ok(err)
+		t.Equals(c.expanded, encode(t, expanded))
+	}
+
+	for _, value := range []string{`"${NOPE}"`, `"a/${NOPE}/b"`, `["${ROOM}", {"x": "${NOPE}"}]`} {
+		_, err := builder.ExpandVars(decode(t, value), lookup)
+		t.Assert(err != nil, "expected an error expanding %s", value)
+		t.Equals(`Undefined variable "NOPE"`, err.Error())
+	}
+}
+
+func TestConfigureModules(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	modules := []builder.ModuleDef{
+		{Name: "net.client", Autostart: true, Config: json.RawMessage(`{"topic": "a", "extra": {"x": 1, "y": 2}}`)},
+		{Name: "sensor", Config: json.RawMessage(`{"pin": 4, "unit": "C"}`)},
+		{Name: "logger", Config: json.RawMessage(`{"level": "${LEVEL}"}`)},
+		{Name: "led", Config: json.RawMessage(`{"pin": 2}`)},
+		{Name: "buzzer", Config: json.RawMessage(`{"pin": 3}`)},
+		builder.MainModule,
+	}
+	off := false
+	fwDef := builder.FirmwareDef{Modules: []builder.ModuleOverride{
+		{Name: "net.client", Autostart: &off, Config: json.RawMessage(`{"topic": "t/${ROOM}", "extra": {"y": null, "z": 3}}`)},
+		{Name: "sensor", Replace: true, Config: json.RawMessage(`{"pin": 5}`)},
+		{Name: "zeta", Config: json.RawMessage(`{"a": null, "b": 1}`)},
+		{Name: "alpha"},
+		{Name: "led", Config: json.RawMessage(`null`)},
+		{Name: "buzzer", Replace: true, Config: json.RawMessage(` null `)},
+	}}
+	lookup := func(name string) (interface{}, bool) {
+		v, ok := map[string]interface{}{"ROOM": "kitchen", "LEVEL": "debug"}[name]
+		return v, ok
+	}
+
+	configured, err := builder.ConfigureModules(modules, fwDef, lookup)
+	t.Ok(err)
+	var names []string
+	configs := make(map[string]string)
+	for _, mod := range configured {
+		names = append(names, mod.Name)
+		configs[mod.Name] = string(mod.Config)
+	}
+	// modules only firmware.json declares come sorted, before main
+	t.Equals([]string{"net.client", "sensor", "logger", "led", "buzzer", "alpha", "zeta", "main"}, names)
+	t.Equals(false, configured[0].Autostart)
+	t.Equals(`{"extra":{"x":1,"z":3},"topic":"t/kitchen"}`, configs["net.client"])
+	t.Equals(`{"pin":5}`, configs["sensor"])
+	t.Equals(`{"level":"debug"}`, configs["logger"])
+	t.Equals(`{"b":1}`, configs["zeta"])
+	t.Equals("", configs["alpha"])
+	// a null config clears the one of the library
+	t.Equals("", configs["led"])
+	t.Equals("", configs["buzzer"])
+
+	fwDef.Modules = []builder.ModuleOverride{{Name: "logger", Config: json.RawMessage(`{"level": "${NOPE}"}`)}}
+	_, err = builder.ConfigureModules(modules, fwDef, lookup)
+	t.Assert(err != nil, "expected an undefined variable error")
+	t.Equals(`Error expanding config of module logger: Undefined variable "NOPE"`, err.Error())
+}
@@ -0,0 +1,112 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func moduleFiles(requires map[string][]builder.Dependency) map[string]*builder.FileEntry {
+	files := make(map[string]*builder.FileEntry)
+	for module, deps := range requires {
+		path := builder.Mod2File(module)
+		files[path] = &builder.FileEntry{Path: path, Dependencies: deps}
+	}
+	return files
+}
+
+func TestMissingModuleError(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	files := moduleFiles(map[string][]builder.Dependency{
+		"main":     {{Module: "app.util"}},
+		"app.util": {{Module: "net.client", Pcall: true}},
+	})
+	err := builder.AddFilesFromModule("main", files, make(map[string]*builder.FileEntry), nil)
+	missing, ok := err.(*builder.MissingModuleError)
+	t.Assert(ok, "expected a MissingModuleError, got %v", err)
+	t.Equals("net.client", missing.Module)
+	t.Equals([]string{"main", "app.util", "net.client"}, missing.Chain)
+	t.Equals(`Cannot find module "net.client" (net/client.lua) required by main → app.util`, err.Error())
+
+	err = builder.AddFilesFromModule("app", files, make(map[string]*builder.FileEntry), nil)
+	t.Equals(`Cannot find module "app" (app.lua)`, err.Error())
+}
+
+func TestMissingModule(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"libs/net/net/client.lua":   "return {}",
+		"devices/dev/firmware.json": devFirmware,
+		"devices/dev/main.lua":      `require("app")`,
+		"devices/dev/app.lua":       `local ok, client = pcall(require, "net.client")`,
+	})
+	dir := projectDir(config)
+	defer os.RemoveAll(dir)
+
+	err := builder.Build(config)
+	t.Assert(err != nil, "expected a missing module error")
+	expected := `Cannot find module "net.client" (net/client.lua) required by main → app. It is provided by ` +
+		filepath.Join(dir, "libs", "net") + "; add one of them to the dependencies of the device"
+	t.Assert(strings.HasSuffix(err.Error(), expected), "unexpected error: %s", err)
+
+	writeProjectFile(t, dir, "devices/dev/app.lua", `require("mqtt")`)
+	err = builder.Build(config)
+	t.Assert(err != nil, "expected a missing module error")
+	expected = `Cannot find module "mqtt" (mqtt.lua) required by main → app. No loaded library provides it`
+	t.Assert(strings.HasSuffix(err.Error(), expected), "unexpected error: %s", err)
+}
+
+func TestCircularRequire(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json": devFirmware,
+		"devices/dev/main.lua":      `require("a")`,
+		"devices/dev/a.lua":         `require("b")`,
+		"devices/dev/b.lua":         `local function a() return require("a") end`,
+	})
+	defer os.RemoveAll(projectDir(config))
+	defer func(logger builder.Logger) {
+		builder.Log = logger
+	}(builder.Log)
+	logger := &recordingLogger{}
+	builder.Log = logger
+
+	t.Ok(builder.Build(config))
+	var warned bool
+	for _, line := range logger.lines {
+		if line == "WARNING: circular require main → a → b → a\n" {
+			warned = true
+		}
+	}
+	t.Assert(warned, "expected a circular require warning, got %v", logger.lines)
+}
+
+func TestCircularLibraryDependency(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json": `{"id": "1", "name": "dev"}`,
+		"devices/dev/main.lua":      "",
+	})
+	dir := projectDir(config)
+	defer os.RemoveAll(dir)
+	libA, libB := filepath.Join(dir, "libs", "a"), filepath.Join(dir, "libs", "b")
+	writeProjectFile(t, dir, "libs/a/library.json", `{"dependencies": ["`+libB+`"]}`)
+	writeProjectFile(t, dir, "libs/b/library.json", `{"dependencies": ["`+libA+`"]}`)
+
+	err := builder.Build(config)
+	t.Assert(err != nil, "expected a circular dependency error")
+	t.Assert(strings.Contains(err.Error(), "Circular library dependency: "+strings.Join([]string{libA, libB, libA}, " → ")),
+		"unexpected error: %s", err)
+}
@@ -0,0 +1,111 @@
+package builder
+
+import (
+	"espore/builder/preprocess"
+	"espore/config"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// luaLiteral converts a define from JSON into Lua source
+func luaLiteral(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "nil", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case string:
+		var sb strings.Builder
+		sb.WriteByte('"')
+		for i := 0; i < len(v); i++ {
+			switch c := v[i]; {
+			case c == '"' || c == '\\':
+				sb.WriteByte('\\')
+				sb.WriteByte(c)
+			case c < 32 || c == 127:
+				fmt.Fprintf(&sb, "\\%03d", c)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		sb.WriteByte('"')
+		return sb.String(), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// applyProfile adds the defines of the selected build profile to every
+// device. Defines in firmware.json take precedence.
+func applyProfile(config *config.BuildConfig, devices []*Device) error {
+	if config.Profile == "" {
+		return nil
+	}
+	profile, ok := config.Profiles[config.Profile]
+	if !ok {
+		return fmt.Errorf("Unknown build profile %q", config.Profile)
+	}
+	for _, device := range devices {
+		defines := make(map[string]interface{})
+		for k, v := range profile {
+			defines[k] = v
+		}
+		for k, v := range device.Firmware.Defines {
+			defines[k] = v
+		}
+		device.Firmware.Defines = defines
+	}
+	return nil
+}
+
+func deviceDefines(fwDef FirmwareDef) (preprocess.Defines, error) {
+	defines := make(preprocess.Defines)
+	for name, value := range fwDef.Defines {
+		lua, err := luaLiteral(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid define %s: %s", name, err)
+		}
+		defines[name] = lua
+	}
+	return defines, nil
+}
+
+// preprocessFiles runs the preprocessor on the Lua files of a device and scans
+// the result for dependencies again, so requires in inactive branches are
+// ignored. Processed files replace the entries in the index, which are shared
+// with other devices.
+func preprocessFiles(files map[string]*FileEntry, fwDef FirmwareDef) error {
+	defines, err := deviceDefines(fwDef)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for path := range files {
+		if isLua(path) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fe := files[path]
+		src, err := fe.ReadContent()
+		if err != nil {
+			return err
+		}
+		out, err := preprocess.Process(src, defines)
+		if err != nil {
+			return fmt.Errorf("Error preprocessing %s: %s", path, err)
+		}
+		if string(out) == string(src) {
+			continue
+		}
+		processed := NewVirtualFileEntry(out, fe.Path)
+		processed.Base = fe.Base
+		processed.Dependencies, processed.Datafiles = parseDependenciesAndDatafiles(out)
+		files[path] = processed
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+// Package preprocess implements conditional compilation and build-time
+// constants for Lua sources. Directives are Lua comments, so unprocessed
+// files still run:
+//
+//	--#define NAME [value]
+//	--#if NAME | !NAME | NAME==value | NAME!=value
+//	--#elif ...
+//	--#else
+//	--#endif
+//
+// Lines in inactive branches are blanked rather than removed so line numbers
+// in error messages still match the sources. Names defined with a value are
+// replaced by it wherever they read a global variable in the code, in
+// parentheses unless the value is a single name or literal; a local,
+// parameter or for variable of the same name shadows the define.
+package preprocess
+
+import (
+	"bytes"
+	"espore/builder/luatoken"
+	"espore/builder/minify"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var directiveRegex = regexp.MustCompile(`^\s*--#(\w+)\s*(.*?)\s*$`)
+var conditionRegex = regexp.MustCompile(`^(!?)\s*([A-Za-z_]\w*)\s*(?:(==|!=)\s*(.+))?$`)
+
+// Defines maps names to their Lua value, e.g. "true", "3" or "\"debug\""
+type Defines map[string]string
+
+// Copy returns a new set of defines with the same values
+func (d Defines) Copy() Defines {
+	c := make(Defines, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
+
+type branch struct {
+	parentActive bool // whether the enclosing block is active
+	taken        bool // whether a previous branch of this block was active
+	active       bool
+	hasElse      bool
+	line         int
+}
+
+// Process applies the directives in src given the initial defines. The map
+// is not modified; --#define only affects the rest of the file.
+func Process(src []byte, defines Defines) ([]byte, error) {
+	if !bytes.Contains(src, []byte("--#")) && !mentions(src, defines) {
+		return src, nil
+	}
+	defines = defines.Copy()
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	var stack []*branch
+	active := true
+	var out bytes.Buffer
+	for i, line := range lines {
+		lineNumber := i + 1
+		m := directiveRegex.FindSubmatch(line)
+		if m == nil {
+			if active {
+				out.Write(line)
+			} else {
+				blank(&out, line)
+			}
+			continue
+		}
+		directive, arg := string(m[1]), string(m[2])
+		switch directive {
+		case "define":
+			if active {
+				fields := strings.SplitN(arg, " ", 2)
+				if fields[0] == "" {
+					return nil, fmt.Errorf("line %d: --#define needs a name", lineNumber)
+				}
+				value := "true"
+				if len(fields) == 2 {
+					value = strings.TrimSpace(fields[1])
+				}
+				defines[fields[0]] = value
+			}
+		case "if":
+			cond, err := evaluate(arg, defines)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+			b := &branch{parentActive: active, active: active && cond, line: lineNumber}
+			b.taken = b.active
+			stack = append(stack, b)
+			active = b.active
+		case "elif", "else":
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("line %d: --#%s without --#if", lineNumber, directive)
+			}
+			b := stack[len(stack)-1]
+			if b.hasElse {
+				return nil, fmt.Errorf("line %d: --#%s after --#else", lineNumber, directive)
+			}
+			cond := true
+			if directive == "elif" {
+				var err error
+				if cond, err = evaluate(arg, defines); err != nil {
+					return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+				}
+			} else {
+				b.hasElse = true
+			}
+			b.active = b.parentActive && !b.taken && cond
+			b.taken = b.taken || b.active
+			active = b.active
+		case "endif":
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("line %d: --#endif without --#if", lineNumber)
+			}
+			active = stack[len(stack)-1].parentActive
+			stack = stack[:len(stack)-1]
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive --#%s", lineNumber, directive)
+		}
+		blank(&out, line)
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("line %d: --#if without --#endif", stack[len(stack)-1].line)
+	}
+	return substitute(out.Bytes(), defines)
+}
+
+// blank writes the line break of line, if any
+func blank(out *bytes.Buffer, line []byte) {
+	if bytes.HasSuffix(line, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+}
+
+func mentions(src []byte, defines Defines) bool {
+	for name := range defines {
+		if bytes.Contains(src, []byte(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Truthy tells whether a define counts as set in a condition: it must exist
+// and not be false, nil or 0
+func Truthy(value string, ok bool) bool {
+	return ok && value != "false" && value != "nil" && value != "0"
+}
+
+func evaluate(expr string, defines Defines) (bool, error) {
+	m := conditionRegex.FindStringSubmatch(expr)
+	if m == nil {
+		return false, fmt.Errorf("invalid condition %q", expr)
+	}
+	negate, name, op, operand := m[1] == "!", m[2], m[3], m[4]
+	value, ok := defines[name]
+	var result bool
+	switch op {
+	case "":
+		result = Truthy(value, ok)
+	case "==", "!=":
+		if negate {
+			return false, fmt.Errorf("invalid condition %q", expr)
+		}
+		result = ok && unquote(value) == unquote(strings.TrimSpace(operand))
+		if op == "!=" {
+			result = !result
+		}
+	}
+	if negate {
+		result = !result
+	}
+	return result, nil
+}
+
+// unquote returns the contents of a Lua string literal or s as is
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// substitute replaces the names that have a define with its value where
+// they read a global variable. Locals, parameters and for variables of the
+// same name shadow the define; field names and assignment targets are left
+// alone.
+func substitute(src []byte, defines Defines) ([]byte, error) {
+	if len(defines) == 0 {
+		return src, nil
+	}
+	tokens, err := luatoken.Tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	tokens = luatoken.Filter(tokens)
+	used := false
+	for _, t := range tokens {
+		if _, ok := defines[t.Text]; ok && t.Kind == luatoken.Name {
+			used = true
+			break
+		}
+	}
+	if !used {
+		return src, nil
+	}
+	reads, err := minify.GlobalReads(tokens)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	last := 0
+	for i, t := range tokens {
+		value, ok := defines[t.Text]
+		if !ok || t.Kind != luatoken.Name || !reads[i] {
+			continue
+		}
+		end := t.Offset + len(t.Text)
+		out.Write(src[last:t.Offset])
+		if needsParens(value, src[end:]) {
+			out.WriteString("(" + value + ")")
+		} else {
+			out.WriteString(value)
+		}
+		last = end
+	}
+	out.Write(src[last:])
+	return out.Bytes(), nil
+}
+
+// needsParens tells whether a define value must be wrapped in parentheses
+// before it replaces a name followed by rest. Only names, strings, true,
+// false, nil and non-negative numbers are pasted as is: 10-OFFSET must not
+// become the comment 10--5 and OFFSET^2 must not become -5^2. A number
+// followed by "." is wrapped too, N..x would read as a malformed number.
+func needsParens(value string, rest []byte) bool {
+	tokens, err := luatoken.Tokenize([]byte(value))
+	if err != nil {
+		return true
+	}
+	tokens = luatoken.Filter(tokens)
+	if len(tokens) != 1 {
+		return true
+	}
+	switch t := tokens[0]; t.Kind {
+	case luatoken.Name, luatoken.String:
+		return false
+	case luatoken.Keyword:
+		return t.Text != "true" && t.Text != "false" && t.Text != "nil"
+	case luatoken.Number:
+		return bytes.HasPrefix(rest, []byte("."))
+	}
+	return true
+}
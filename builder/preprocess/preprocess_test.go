@@ -0,0 +1,119 @@
+package preprocess_test
+
+import (
+	"espore/builder/preprocess"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestConditionals(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	src := `local log = require("log")
+--#if DEBUG
+local trace = require("trace")
+--#elif LEVEL==2
+local stats = require("stats")
+--#else
+local quiet = true
+--#endif
+--#if !DEBUG
+print("release")
+--#endif
+`
+	out, err := preprocess.Process([]byte(src), preprocess.Defines{"DEBUG": "true"})
+	t.Ok(err)
+	t.Equals("local log = require(\"log\")\n\nlocal trace = require(\"trace\")\n\n\n\n\n\n\n\n\n", string(out))
+
+	out, err = preprocess.Process([]byte(src), preprocess.Defines{"LEVEL": "2"})
+	t.Ok(err)
+	t.Equals("local log = require(\"log\")\n\n\n\nlocal stats = require(\"stats\")\n\n\n\n\nprint(\"release\")\n\n", string(out))
+
+	out, err = preprocess.Process([]byte(src), nil)
+	t.Ok(err)
+	t.Equals("local log = require(\"log\")\n\n\n\n\n\nlocal quiet = true\n\n\nprint(\"release\")\n\n", string(out))
+}
+
+func TestConstants(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	src := `--#define VERSION "1.2"
+local t = {HOST = HOST}
+print(VERSION, HOST, t.HOST, "HOST") -- HOST
+`
+	out, err := preprocess.Process([]byte(src), preprocess.Defines{"HOST": `"example.com"`})
+	t.Ok(err)
+	t.Equals("\nlocal t = {HOST = \"example.com\"}\nprint(\"1.2\", \"example.com\", t.HOST, \"HOST\") -- HOST\n", string(out))
+}
+
+func TestExpressionConstants(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defines := preprocess.Defines{"OFFSET": "-5", "AREA": "W * H", "N": "2", "NAME": "x"}
+	for src, expected := range map[string]string{
+		// a negative number must not start a comment nor change precedence
+		"local y = 10-OFFSET":  "local y = 10-(-5)",
+		"local z = OFFSET^2":   "local z = (-5)^2",
+		"local a = 2 * AREA":   "local a = 2 * (W * H)",
+		"local b = AREA / N":   "local b = (W * H) / 2",
+		"local s = N..NAME":    "local s = (2)..x",
+		"local c = NAME.field": "local c = x.field",
+	} {
+		out, err := preprocess.Process([]byte(src), defines)
+		t.Ok(err)
+		t.Equals(expected, string(out))
+	}
+
+	out, err := preprocess.Process([]byte("--#define OFFSET -5\nprint(10-OFFSET)"), nil)
+	t.Ok(err)
+	t.Equals("\nprint(10-(-5))", string(out))
+}
+
+func TestShadowing(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	defines := preprocess.Defines{"DEBUG": "true", "LEVEL": "3"}
+	for src, expected := range map[string]string{
+		// parameters
+		"local function f(DEBUG) return DEBUG end print(DEBUG)": "local function f(DEBUG) return DEBUG end print(true)",
+		"g = function(a, LEVEL) return LEVEL end":               "g = function(a, LEVEL) return LEVEL end",
+		// for variables, only inside the loop
+		"for k, DEBUG in pairs(t) do print(DEBUG) end print(DEBUG)": "for k, DEBUG in pairs(t) do print(DEBUG) end print(true)",
+		"for LEVEL = 1, LEVEL do print(LEVEL) end":                  "for LEVEL = 1, 3 do print(LEVEL) end",
+		// locals, from the next statement and until the end of their block
+		"local LEVEL=5 print(LEVEL)":                    "local LEVEL=5 print(LEVEL)",
+		"local LEVEL = LEVEL + 1":                       "local LEVEL = 3 + 1",
+		"do local DEBUG = false end print(DEBUG)":       "do local DEBUG = false end print(true)",
+		"local function DEBUG() end DEBUG()":            "local function DEBUG() end DEBUG()",
+		"if x then local a, LEVEL = 1 return LEVEL end": "if x then local a, LEVEL = 1 return LEVEL end",
+		// assignments write the global, they do not read the define
+		"DEBUG = false LEVEL, x = LEVEL, DEBUG": "DEBUG = false LEVEL, x = 3, true",
+		"function LEVEL() end":                  "function LEVEL() end",
+		"t[LEVEL] = DEBUG":                      "t[3] = true",
+	} {
+		out, err := preprocess.Process([]byte(src), defines)
+		t.Ok(err)
+		t.Equals(expected, string(out))
+	}
+}
+
+func TestErrors(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	for _, src := range []string{
+		"--#if DEBUG\n",
+		"--#endif\n",
+		"--#if A\n--#else\n--#else\n--#endif\n",
+		"--#if A ==\n--#endif\n",
+		"--#include x\n",
+	} {
+		_, err := preprocess.Process([]byte(src), nil)
+		t.Assert(err != nil, "Expected error processing %q", src)
+	}
+}
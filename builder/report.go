@@ -0,0 +1,211 @@
+package builder
+
+import (
+	"bytes"
+	"espore/utils"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// Logger receives the builder's progress and report output
+type Logger interface {
+	Printf(format string, a ...interface{})
+}
+
+type defaultLogger struct{}
+
+func (dl *defaultLogger) Printf(format string, a ...interface{}) {
+	log.Printf(format, a...)
+}
+
+// Log is where the builder prints reports and warnings
+var Log Logger = &defaultLogger{}
+
+const (
+	BudgetPolicyFail = "fail"
+	BudgetPolicyWarn = "warn"
+
+	locationSPIFFS = "spiffs"
+	locationLFS    = "lfs"
+	generatedLib   = "(generated)"
+)
+
+type FileSize struct {
+	Path     string `json:"path"`
+	Library  string `json:"library"`
+	Location string `json:"location"`
+	Size     int64  `json:"size"`
+}
+
+type LibrarySize struct {
+	Library    string `json:"library"`
+	Files      int    `json:"files"`
+	SPIFFSSize int64  `json:"spiffsSize"`
+	LFSSize    int64  `json:"lfsSourceSize"`
+}
+
+// SizeReport describes how much flash a device firmware uses. SPIFFSSize is
+// the space taken by the unpacked files plus the image itself, which the
+// bootloader keeps as update.old to be able to roll back.
+type SizeReport struct {
+	DeviceInfo
+	Files        []FileSize    `json:"files"`
+	Libraries    []LibrarySize `json:"libraries"`
+	LFSImageSize int64         `json:"lfsImageSize"`
+	ImageSize    int64         `json:"imageSize"`
+	SPIFFSSize   int64         `json:"spiffsSize"`
+	LFSBudget    int64         `json:"lfsBudget,omitempty"`
+	SPIFFSBudget int64         `json:"spiffsBudget,omitempty"`
+}
+
+func libraryName(fe *FileEntry) string {
+	if fe.Base == "" {
+		return generatedLib
+	}
+	return fe.Base
+}
+
+func fileSize(fe *FileEntry) (int64, error) {
+	if fe.Content != nil {
+		return int64(len(fe.Content)), nil
+	}
+	fi, err := os.Stat(filepath.Join(fe.Base, fe.Path))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func buildSizeReport(manifest *FirmwareManifest, fwDef FirmwareDef, imageSize int64) (*SizeReport, error) {
+	report := &SizeReport{
+		DeviceInfo:   manifest.DeviceInfo,
+		LFSBudget:    fwDef.LFSSize,
+		SPIFFSBudget: fwDef.SPIFFSSize,
+	}
+	libs := make(map[string]*LibrarySize)
+	add := func(fe *FileEntry, location string) error {
+		size, err := fileSize(fe)
+		if err != nil {
+			return err
+		}
+		lib := libraryName(fe)
+		report.Files = append(report.Files, FileSize{
+			Path:     fe.Path,
+			Library:  lib,
+			Location: location,
+			Size:     size,
+		})
+		ls := libs[lib]
+		if ls == nil {
+			ls = &LibrarySize{Library: lib}
+			libs[lib] = ls
+		}
+		ls.Files++
+		if location == locationLFS {
+			ls.LFSSize += size
+		} else {
+			ls.SPIFFSSize += size
+			report.SPIFFSSize += size
+		}
+		return nil
+	}
+
+	for _, fe := range manifest.Files {
+		if err := add(fe, locationSPIFFS); err != nil {
+			return nil, err
+		}
+		if fe.LFSFiles != nil {
+			report.LFSImageSize = int64(len(fe.Content))
+			for _, lfsFile := range fe.LFSFiles {
+				if err := add(lfsFile, locationLFS); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	report.ImageSize = imageSize
+	report.SPIFFSSize += report.ImageSize
+
+	for _, ls := range libs {
+		report.Libraries = append(report.Libraries, *ls)
+	}
+	sort.Slice(report.Libraries, func(i, j int) bool {
+		a, b := report.Libraries[i], report.Libraries[j]
+		if a.SPIFFSSize+a.LFSSize != b.SPIFFSSize+b.LFSSize {
+			return a.SPIFFSSize+a.LFSSize > b.SPIFFSSize+b.LFSSize
+		}
+		return a.Library < b.Library
+	})
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].Path < report.Files[j].Path
+	})
+	return report, nil
+}
+
+func budgetString(size, budget int64) string {
+	if budget == 0 {
+		return fmt.Sprintf("%d", size)
+	}
+	return fmt.Sprintf("%d / %d (%d%%)", size, budget, size*100/budget)
+}
+
+func (r *SizeReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Size report for %s (%s)\n", r.Name, r.ID)
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Library\tFiles\tSPIFFS\tLFS source\t\n")
+	for _, ls := range r.Libraries {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", ls.Library, ls.Files, ls.SPIFFSSize, ls.LFSSize)
+	}
+	tw.Flush()
+	fmt.Fprintf(&buf, "LFS image: %s\n", budgetString(r.LFSImageSize, r.LFSBudget))
+	fmt.Fprintf(&buf, "SPIFFS:    %s\n", budgetString(r.SPIFFSSize, r.SPIFFSBudget))
+	fmt.Fprintf(&buf, "Image:     %d\n", r.ImageSize)
+	return buf.String()
+}
+
+// checkBudget returns the list of budgets the firmware exceeds
+func (r *SizeReport) checkBudget() []string {
+	var exceeded []string
+	if r.LFSBudget > 0 && r.LFSImageSize > r.LFSBudget {
+		exceeded = append(exceeded, fmt.Sprintf("LFS image is %d bytes, budget is %d", r.LFSImageSize, r.LFSBudget))
+	}
+	if r.SPIFFSBudget > 0 && r.SPIFFSSize > r.SPIFFSBudget {
+		exceeded = append(exceeded, fmt.Sprintf("SPIFFS usage is %d bytes, budget is %d", r.SPIFFSSize, r.SPIFFSBudget))
+	}
+	return exceeded
+}
+
+// reportSize prints and writes the size report of a firmware whose image is
+// imageSize bytes long, and checks it against the budget of the device
+func reportSize(manifest *FirmwareManifest, fwDef FirmwareDef, imageSize int64, outputDir string) error {
+	report, err := buildSizeReport(manifest, fwDef, imageSize)
+	if err != nil {
+		return fmt.Errorf("Error building size report for %s: %s", manifest.Name, err)
+	}
+	if err := utils.WriteJSON(filepath.Join(outputDir, manifest.ID+".size.json"), report); err != nil {
+		return err
+	}
+	Log.Printf("%s", report)
+
+	exceeded := report.checkBudget()
+	if len(exceeded) == 0 {
+		return nil
+	}
+	switch fwDef.BudgetPolicy {
+	case BudgetPolicyWarn:
+		for _, e := range exceeded {
+			Log.Printf("WARNING: %s: %s\n", manifest.Name, e)
+		}
+		return nil
+	case BudgetPolicyFail, "":
+		return fmt.Errorf("Firmware for %s exceeds its size budget: %s", manifest.Name, exceeded[0])
+	default:
+		return fmt.Errorf("Unknown budgetPolicy %q in firmware definition of %s", fwDef.BudgetPolicy, manifest.Name)
+	}
+}
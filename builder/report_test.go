@@ -0,0 +1,79 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"espore/config"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// recordingLogger keeps the build log lines
+type recordingLogger struct {
+	lines []string
+}
+
+func (rl *recordingLogger) Printf(format string, a ...interface{}) {
+	rl.lines = append(rl.lines, fmt.Sprintf(format, a...))
+}
+
+// budgetFiles is a device whose SPIFFS files exceed its budget
+func budgetFiles(policy string) map[string]string {
+	return map[string]string{
+		"devices/dev/firmware.json": firmware(fmt.Sprintf(`"id": "1", "name": "dev", "spiffsSize": 100, "budgetPolicy": %q`, policy)),
+		"devices/dev/main.lua":      "print('" + strings.Repeat("x", 200) + "')",
+	}
+}
+
+// withDeltas keeps a history of images, which a failed build must not touch
+func withDeltas(config *config.BuildConfig) {
+	config.Deltas = 1
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestBudgetFail(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, build := buildProject(t, budgetFiles(builder.BudgetPolicyFail), withDeltas)
+	defer os.RemoveAll(dir)
+
+	err := build()
+	t.Assert(err != nil, "expected the build to fail")
+	t.Assert(strings.Contains(err.Error(), "exceeds its size budget"), "unexpected error: %s", err)
+	t.Assert(exists(filepath.Join(dir, "dist", "1.size.json")), "expected a size report")
+	for _, path := range []string{"dist/1.img", "dist/1.img.hash", "dist/1.json", config.DefaultHistoryDir} {
+		t.Assert(!exists(filepath.Join(dir, path)), "%s written for an oversized firmware", path)
+	}
+}
+
+func TestBudgetWarn(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, build := buildProject(t, budgetFiles(builder.BudgetPolicyWarn), withDeltas)
+	defer os.RemoveAll(dir)
+	defer func(logger builder.Logger) {
+		builder.Log = logger
+	}(builder.Log)
+	logger := &recordingLogger{}
+	builder.Log = logger
+
+	t.Ok(build())
+	t.Assert(exists(filepath.Join(dir, "dist", "1.img")), "expected the image to be written")
+	var warned bool
+	for _, line := range logger.lines {
+		if strings.HasPrefix(line, "WARNING: dev: SPIFFS usage is") {
+			warned = true
+		}
+	}
+	t.Assert(warned, "expected a budget warning, got %v", logger.lines)
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"bytes"
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyReproducible builds the project into the output directory and once
+// more into a temporary directory, and fails if any output differs. Both
+// builds start from their own copy of the history and the lock file, so they
+// produce the same delta images and the project is left untouched.
+func VerifyReproducible(config *config.BuildConfig) error {
+	tmpDir, err := ioutil.TempDir("", "espore-verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	first, err := isolatedConfig(config, filepath.Join(tmpDir, "first"))
+	if err != nil {
+		return err
+	}
+	if err := Build(first); err != nil {
+		return err
+	}
+	second, err := isolatedConfig(config, filepath.Join(tmpDir, "second"))
+	if err != nil {
+		return err
+	}
+	second.Output = filepath.Join(tmpDir, "output")
+	if err := os.MkdirAll(second.Output, 0755); err != nil {
+		return err
+	}
+	if err := Build(second); err != nil {
+		return fmt.Errorf("Second build failed: %s", err)
+	}
+	differences, err := compareDirs(config.Output, second.Output)
+	if err != nil {
+		return err
+	}
+	if len(differences) > 0 {
+		return fmt.Errorf("Build is not reproducible, these outputs differ between two builds:\n%s", strings.Join(differences, "\n"))
+	}
+	Log.Printf("Build is reproducible\n")
+	return nil
+}
+
+// isolatedConfig returns a copy of config that uses copies of the history and
+// the lock file in dir
+func isolatedConfig(config *config.BuildConfig, dir string) (*config.BuildConfig, error) {
+	isolated := *config
+	isolated.History = filepath.Join(dir, "history")
+	if err := copyTree(config.GetHistoryDir(), isolated.History); err != nil {
+		return nil, fmt.Errorf("Cannot copy the history: %s", err)
+	}
+	isolated.LockFile = filepath.Join(dir, filepath.Base(config.GetLockFile()))
+	if err := copyTree(config.GetLockFile(), isolated.LockFile); err != nil {
+		return nil, fmt.Errorf("Cannot copy the lock file: %s", err)
+	}
+	return &isolated, nil
+}
+
+// copyTree copies a file or directory, if it exists, keeping modification
+// times since they order the images in the history
+func copyTree(src, dst string) error {
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if _, err := utils.CopyFile(path, target, false); err != nil {
+			return err
+		}
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// compareDirs lists the files that are not identical in both directories
+func compareDirs(a, b string) ([]string, error) {
+	filesA, err := utils.EnumerateDir(a)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := utils.EnumerateDir(b)
+	if err != nil {
+		return nil, err
+	}
+	inB := make(map[string]bool)
+	for _, f := range filesB {
+		inB[f] = true
+	}
+	var differences []string
+	for _, f := range filesA {
+		if !inB[f] {
+			differences = append(differences, f+" (only in first build)")
+			continue
+		}
+		delete(inB, f)
+		dataA, err := ioutil.ReadFile(filepath.Join(a, f))
+		if err != nil {
+			return nil, err
+		}
+		dataB, err := ioutil.ReadFile(filepath.Join(b, f))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(dataA, dataB) {
+			differences = append(differences, f)
+		}
+	}
+	for _, f := range filesB {
+		if inB[f] {
+			differences = append(differences, f+" (only in second build)")
+		}
+	}
+	return differences, nil
+}
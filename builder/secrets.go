@@ -0,0 +1,66 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/builder/secrets"
+	"espore/config"
+	"fmt"
+	"sort"
+)
+
+// SecretsFile is the datafile generated in images of devices that declare
+// secrets in firmware.json
+const SecretsFile = "secrets.json"
+
+const secretVarPrefix = "secret:"
+
+type redactingLogger struct {
+	logger  Logger
+	secrets *secrets.Store
+}
+
+func (rl *redactingLogger) Printf(format string, a ...interface{}) {
+	rl.logger.Printf("%s", rl.secrets.Redact(fmt.Sprintf(format, a...)))
+}
+
+func loadSecrets(config *config.BuildConfig) (*secrets.Store, error) {
+	path := config.GetSecretsFile()
+	store, err := secrets.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if store.Len() > 0 && !store.Encrypted() {
+		ignoreSecretsFile("secrets", path)
+	}
+	return store, nil
+}
+
+// ignoreSecretsFile adds a plain secrets file to .gitignore if git would
+// commit it
+func ignoreSecretsFile(kind, path string) {
+	ignored, err := secrets.Ignore(path)
+	if err != nil {
+		Log.Printf("WARNING: cannot add %s file %s to .gitignore: %s. Add it by hand or encrypt it\n", kind, path, err)
+	} else if ignored {
+		Log.Printf("Added %s file %s to .gitignore\n", kind, path)
+	}
+}
+
+// secretsFileEntry generates the secrets datafile with the secrets the device
+// asks for. The entry has no hash so the manifest reveals nothing about the
+// values.
+func secretsFileEntry(fwDef FirmwareDef, store *secrets.Store) (*FileEntry, error) {
+	names := append([]string(nil), fwDef.Secrets...)
+	sort.Strings(names)
+	values, err := store.Select(names)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	entry := NewVirtualFileEntry(data, SecretsFile)
+	entry.Hash = ""
+	return entry, nil
+}
@@ -0,0 +1,367 @@
+// Package secrets reads the project secrets file, a JSON object mapping names
+// to values such as Wi-Fi passwords or MQTT credentials. The file can be
+// encrypted with a passphrase so it can be shared or backed up safely.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PassphraseEnv is the environment variable holding the passphrase of an
+// encrypted secrets file
+const PassphraseEnv = "ESPORE_SECRETS_PASSPHRASE"
+
+const (
+	cipherName = "aes-256-gcm"
+	kdfName    = "pbkdf2-sha256"
+	iterations = 100000
+	saltSize   = 16
+	// values shorter than this are not redacted, as they would garble
+	// unrelated output
+	minRedactLength = 4
+	redacted        = "******"
+)
+
+// Store holds the secrets of the project
+type Store struct {
+	values    map[string]string
+	encrypted bool
+}
+
+type encryptedFile struct {
+	Encrypted struct {
+		Cipher     string `json:"cipher"`
+		KDF        string `json:"kdf"`
+		Iterations int    `json:"iterations"`
+		Salt       []byte `json:"salt"`
+		Nonce      []byte `json:"nonce"`
+		Data       []byte `json:"data"`
+	} `json:"espore-encrypted"`
+}
+
+// New returns a store with the given values
+func New(values map[string]string) *Store {
+	if values == nil {
+		values = make(map[string]string)
+	}
+	return &Store{values: values}
+}
+
+// Load reads a secrets file. A missing file yields an empty store. Encrypted
+// files are decrypted with the passphrase in the environment.
+func Load(path string) (*Store, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return New(nil), nil
+		}
+		return nil, err
+	}
+	values, encrypted, err := decode(data, os.Getenv(PassphraseEnv))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read secrets file %s: %s", path, err)
+	}
+	s := New(values)
+	s.encrypted = encrypted
+	return s, nil
+}
+
+// Encrypted tells whether the store was loaded from an encrypted file
+func (s *Store) Encrypted() bool {
+	return s.encrypted
+}
+
+// Len returns the number of secrets in the store
+func (s *Store) Len() int {
+	return len(s.values)
+}
+
+// Names returns the sorted names of the secrets in the store
+func (s *Store) Names() []string {
+	var names []string
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Set adds or replaces a secret
+func (s *Store) Set(name, value string) {
+	s.values[name] = value
+}
+
+// Delete removes a secret
+func (s *Store) Delete(name string) {
+	delete(s.values, name)
+}
+
+// Save writes the store to path, encrypting it with the passphrase in the
+// environment if it was loaded from an encrypted file. A plain file created by
+// Save is added to .gitignore.
+func (s *Store) Save(path string) error {
+	data, err := json.MarshalIndent(s.values, "", "\t")
+	if err != nil {
+		return err
+	}
+	if s.encrypted {
+		passphrase := os.Getenv(PassphraseEnv)
+		if passphrase == "" {
+			return fmt.Errorf("Set %s to the passphrase of %s", PassphraseEnv, path)
+		}
+		if data, err = Encrypt(data, passphrase); err != nil {
+			return err
+		}
+	}
+	_, err = os.Stat(path)
+	created := os.IsNotExist(err)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	if created && !s.encrypted {
+		_, err = Ignore(path)
+		return err
+	}
+	return nil
+}
+
+func decode(data []byte, passphrase string) (values map[string]string, encrypted bool, err error) {
+	var ef encryptedFile
+	if err := json.Unmarshal(data, &ef); err == nil && ef.Encrypted.Data != nil {
+		if passphrase == "" {
+			return nil, true, fmt.Errorf("file is encrypted, set %s", PassphraseEnv)
+		}
+		data, err = decrypt(&ef, passphrase)
+		if err != nil {
+			return nil, true, err
+		}
+		encrypted = true
+	}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, encrypted, fmt.Errorf("secrets must be a JSON object of strings: %s", err)
+	}
+	return values, encrypted, nil
+}
+
+// NotIgnored tells whether path is inside a git work tree and would be
+// committed, i.e. git does not ignore it
+func NotIgnored(path string) bool {
+	cmd := exec.Command("git", "check-ignore", "-q", filepath.Base(path))
+	cmd.Dir = filepath.Dir(path)
+	err := cmd.Run()
+	// git exits with 1 when the path is not ignored and 128 outside a repo
+	exitErr, ok := err.(*exec.ExitError)
+	return ok && exitErr.ExitCode() == 1
+}
+
+// Ignore adds path to the .gitignore of its directory if git would commit it,
+// and tells whether it did
+func Ignore(path string) (bool, error) {
+	if !NotIgnored(path) {
+		return false, nil
+	}
+	gitignore := filepath.Join(filepath.Dir(path), ".gitignore")
+	data, err := ioutil.ReadFile(gitignore)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	entry := "/" + filepath.Base(path) + "\n"
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		entry = "\n" + entry
+	}
+	f, err := os.OpenFile(gitignore, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.WriteString(entry)
+	return err == nil, err
+}
+
+// Get returns the value of a secret
+func (s *Store) Get(name string) (string, bool) {
+	v, ok := s.values[name]
+	return v, ok
+}
+
+// Select returns the named secrets, failing if any of them is not defined
+func (s *Store) Select(names []string) (map[string]string, error) {
+	selected := make(map[string]string)
+	var missing []string
+	for _, name := range names {
+		v, ok := s.values[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		selected[name] = v
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Undefined secrets: %s", strings.Join(missing, ", "))
+	}
+	return selected, nil
+}
+
+// Redact replaces every secret value found in st, as is or encoded as a JSON
+// string. Values shorter than 4 characters are left alone, since replacing
+// them would garble unrelated output.
+func (s *Store) Redact(st string) string {
+	var values []string
+	for _, v := range s.values {
+		if len(v) >= minRedactLength {
+			values = append(values, jsonForms(v)...)
+		}
+	}
+	// longest first, so a secret containing another is fully redacted
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, v := range values {
+		st = strings.Replace(st, v, redacted, -1)
+	}
+	return st
+}
+
+// jsonForms returns v and the different contents of the JSON strings that
+// encode it, with and without escaping of HTML characters
+func jsonForms(v string) []string {
+	forms := []string{v}
+	for _, escapeHTML := range []bool{true, false} {
+		var buf strings.Builder
+		e := json.NewEncoder(&buf)
+		e.SetEscapeHTML(escapeHTML)
+		if err := e.Encode(v); err != nil {
+			continue
+		}
+		// drop the quotes and the line break of Encode
+		encoded := strings.TrimSuffix(buf.String(), "\n")
+		encoded = encoded[1 : len(encoded)-1]
+		if encoded != forms[len(forms)-1] && encoded != v {
+			forms = append(forms, encoded)
+		}
+	}
+	return forms
+}
+
+// RedactError returns err with any secret value removed from its message
+func (s *Store) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := s.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
+
+func newGCM(passphrase string, salt []byte, iter int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, iter, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func decrypt(ef *encryptedFile, passphrase string) ([]byte, error) {
+	e := &ef.Encrypted
+	if e.Cipher != cipherName || e.KDF != kdfName {
+		return nil, fmt.Errorf("unsupported encryption %s/%s", e.Cipher, e.KDF)
+	}
+	gcm, err := newGCM(passphrase, e.Salt, e.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	data, err := gcm.Open(nil, e.Nonce, e.Data, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupt file")
+	}
+	return data, nil
+}
+
+// Encrypt returns the encrypted form of a plain secrets file
+func Encrypt(plain []byte, passphrase string) ([]byte, error) {
+	var ef encryptedFile
+	if err := json.Unmarshal(plain, &ef); err == nil && ef.Encrypted.Data != nil {
+		return nil, errors.New("file is already encrypted")
+	}
+	var values map[string]string
+	if err := json.Unmarshal(plain, &values); err != nil {
+		return nil, fmt.Errorf("secrets must be a JSON object of strings: %s", err)
+	}
+	e := &ef.Encrypted
+	e.Cipher = cipherName
+	e.KDF = kdfName
+	e.Iterations = iterations
+	e.Salt = make([]byte, saltSize)
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, e.Salt, e.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Data = gcm.Seal(nil, e.Nonce, plain, nil)
+	return json.MarshalIndent(&ef, "", "\t")
+}
+
+// Decrypt returns the plain form of an encrypted secrets file
+func Decrypt(data []byte, passphrase string) ([]byte, error) {
+	values, encrypted, err := decode(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return nil, errors.New("file is not encrypted")
+	}
+	return json.MarshalIndent(values, "", "\t")
+}
+
+// EncryptFile encrypts a secrets file in place using the passphrase in the
+// environment
+func EncryptFile(path string) error {
+	return transformFile(path, Encrypt)
+}
+
+// DecryptFile decrypts a secrets file in place using the passphrase in the
+// environment
+func DecryptFile(path string) error {
+	return transformFile(path, Decrypt)
+}
+
+func transformFile(path string, transform func([]byte, string) ([]byte, error)) error {
+	passphrase := os.Getenv(PassphraseEnv)
+	if passphrase == "" {
+		return fmt.Errorf("Set %s to the passphrase of the secrets file", PassphraseEnv)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := transform(data, passphrase)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return ioutil.WriteFile(path, out, 0600)
+}
@@ -0,0 +1,112 @@
+package secrets_test
+
+import (
+	"errors"
+	"espore/builder/secrets"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestEncryptDecrypt(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	plain := []byte(`{"WIFI_PASSWORD":"hunter22","MQTT_TOKEN":"abc:def"}`)
+	encrypted, err := secrets.Encrypt(plain, "correct horse")
+	t.Ok(err)
+	t.Assert(!strings.Contains(string(encrypted), "hunter22"), "Encrypted file contains a secret")
+
+	_, err = secrets.Encrypt(encrypted, "correct horse")
+	t.Assert(err != nil, "Expected error encrypting twice")
+
+	_, err = secrets.Decrypt(encrypted, "wrong")
+	t.Assert(err != nil, "Expected error with wrong passphrase")
+
+	decrypted, err := secrets.Decrypt(encrypted, "correct horse")
+	t.Ok(err)
+	t.Equals("{\n\t\"MQTT_TOKEN\": \"abc:def\",\n\t\"WIFI_PASSWORD\": \"hunter22\"\n}", string(decrypted))
+}
+
+func TestRedact(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	store := secrets.New(map[string]string{
+		"PASSWORD": "hunter22",
+		"LONGER":   "hunter22xyz",
+		"SHORT":    "on",
+		"TOKEN":    `a"b\c<d>`,
+	})
+	t.Equals("connect with ****** and ****** on port 1", store.Redact("connect with hunter22xyz and hunter22 on port 1"))
+	t.Equals("bad ******", store.RedactError(errors.New("bad hunter22")).Error())
+	// JSON-encoded values are redacted too
+	t.Equals(`{"TOKEN":"******","X":"******"}`, store.Redact(`{"TOKEN":"a\"b\\c\u003cd\u003e","X":"a\"b\\c<d>"}`))
+	t.Equals(`raw ******`, store.Redact(`raw a"b\c<d>`))
+	// short values are left alone
+	t.Equals("turn on", store.Redact("turn on"))
+	t.Assert(store.RedactError(nil) == nil, "Expected nil error")
+
+	selected, err := store.Select([]string{"PASSWORD"})
+	t.Ok(err)
+	t.Equals(map[string]string{"PASSWORD": "hunter22"}, selected)
+	_, err = store.Select([]string{"PASSWORD", "MISSING"})
+	t.Equals("Undefined secrets: MISSING", err.Error())
+}
+
+func TestDecryptCompatibility(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// files encrypted by earlier versions keep decrypting with the same key
+	encrypted := `{
+	"espore-encrypted": {
+		"cipher": "aes-256-gcm",
+		"kdf": "pbkdf2-sha256",
+		"iterations": 100000,
+		"salt": "7rIltLlK3/9mdgo8X+Ix8Q==",
+		"nonce": "bgexJXeHdZ843LeG",
+		"data": "pYTckVt1cpSlH7ltTcWknMMCycQZa8B2EDPCsEaKiMdfweojIjLYNNEwuZg="
+	}
+}`
+	decrypted, err := secrets.Decrypt([]byte(encrypted), "correct horse")
+	t.Ok(err)
+	t.Equals("{\n\t\"WIFI_PASSWORD\": \"hunter22\"\n}", string(decrypted))
+}
+
+func TestIgnore(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+	if _, err := exec.LookPath("git"); err != nil {
+		tx.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "espore-secrets")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	t.Ok(exec.Command("git", "init", "-q", dir).Run())
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("/dist"), 0644))
+
+	// a plain file created by Save is ignored right away
+	path := filepath.Join(dir, "secrets.json")
+	store := secrets.New(map[string]string{"PASSWORD": "hunter22"})
+	t.Ok(store.Save(path))
+	t.Assert(!secrets.NotIgnored(path), "Expected %s to be ignored", path)
+	gitignore, err := ioutil.ReadFile(filepath.Join(dir, ".gitignore"))
+	t.Ok(err)
+	t.Equals("/dist\n/secrets.json\n", string(gitignore))
+
+	// and only once
+	ignored, err := secrets.Ignore(path)
+	t.Ok(err)
+	t.Equals(false, ignored)
+	t.Ok(store.Save(path))
+	gitignore, err = ioutil.ReadFile(filepath.Join(dir, ".gitignore"))
+	t.Ok(err)
+	t.Equals("/dist\n/secrets.json\n", string(gitignore))
+}
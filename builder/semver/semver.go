@@ -0,0 +1,253 @@
+// Package semver parses semantic versions and the version constraints used
+// in library dependencies, such as "^1.2", "~1.4.0" or ">=1.0 <2".
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version
+type Version struct {
+	Major, Minor, Patch int
+	Prerelease          string
+}
+
+// Parse parses a version such as "1.2.3" or "v1.2.3-beta.1". Build
+// metadata after "+" is ignored.
+func Parse(st string) (*Version, error) {
+	v, parts, err := parsePartial(st)
+	if err != nil {
+		return nil, err
+	}
+	if parts != 3 {
+		return nil, fmt.Errorf("Invalid version %q: expected major.minor.patch", st)
+	}
+	return v, nil
+}
+
+// parsePartial parses versions that may omit minor and patch numbers or use
+// "x" or "*" as wildcards. It returns the number of components present.
+func parsePartial(st string) (*Version, int, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(st), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	var v Version
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.Prerelease = s[i+1:]
+		s = s[:i]
+	}
+	components := strings.Split(s, ".")
+	if len(components) > 3 {
+		return nil, 0, fmt.Errorf("Invalid version %q", st)
+	}
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	parts := 0
+	for i, c := range components {
+		if c == "x" || c == "X" || c == "*" {
+			continue
+		}
+		if parts < i {
+			// a number after a wildcard, as in "1.x.3"
+			return nil, 0, fmt.Errorf("Invalid version %q", st)
+		}
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("Invalid version %q", st)
+		}
+		*numbers[i] = n
+		parts++
+	}
+	return &v, parts, nil
+}
+
+func (v *Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or greater than o.
+// A prerelease version is lower than the same version without prerelease.
+func (v *Version) Compare(o *Version) int {
+	if c := compareInt(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+	return comparePrerelease(v.Prerelease, o.Prerelease)
+}
+
+// comparePrerelease compares the dot separated identifiers of two prereleases
+// as SemVer specifies: numeric identifiers compare as numbers and are lower
+// than alphanumeric ones, and a shorter list of equal identifiers is lower.
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.ParseUint(as[i], 10, 64)
+		bn, bErr := strconv.ParseUint(bs[i], 10, 64)
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			switch {
+			case an < bn:
+				c = -1
+			case an > bn:
+				c = 1
+			}
+		case aErr == nil:
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(as[i], bs[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInt(len(as), len(bs))
+}
+
+type comparison struct {
+	op      string
+	version *Version
+}
+
+func (c *comparison) match(v *Version) bool {
+	r := v.Compare(c.version)
+	switch c.op {
+	case "=":
+		return r == 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	}
+	return false
+}
+
+// Constraint is a set of comparisons a version must satisfy
+type Constraint struct {
+	text        string
+	comparisons []comparison
+}
+
+// ParseConstraint parses a space separated list of requirements. Each one can
+// be an exact or partial version ("1.2.3", "1.2", "1.x"), a caret range
+// ("^1.2": compatible with 1.2), a tilde range ("~1.2.3": patch updates
+// only), a comparison (">=1.0", "<2") or "*" for any version.
+func ParseConstraint(st string) (*Constraint, error) {
+	c := &Constraint{text: st}
+	for _, field := range strings.Fields(st) {
+		if field == "*" {
+			continue
+		}
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+			if strings.HasPrefix(field, prefix) {
+				op = prefix
+				break
+			}
+		}
+		v, parts, err := parsePartial(field[len(op):])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid version constraint %q: %s", st, err)
+		}
+		switch op {
+		case "^":
+			c.add(">=", v)
+			switch {
+			case v.Major > 0 || parts < 2:
+				c.add("<", &Version{Major: v.Major + 1})
+			case v.Minor > 0 || parts < 3:
+				c.add("<", &Version{Minor: v.Minor + 1})
+			default:
+				c.add("<", &Version{Patch: v.Patch + 1})
+			}
+		case "~":
+			c.add(">=", v)
+			if parts < 2 {
+				c.add("<", &Version{Major: v.Major + 1})
+			} else {
+				c.add("<", &Version{Major: v.Major, Minor: v.Minor + 1})
+			}
+		case "", "=":
+			switch parts {
+			case 0:
+			case 1:
+				c.add(">=", v)
+				c.add("<", &Version{Major: v.Major + 1})
+			case 2:
+				c.add(">=", v)
+				c.add("<", &Version{Major: v.Major, Minor: v.Minor + 1})
+			default:
+				c.add("=", v)
+			}
+		default:
+			c.add(op, v)
+		}
+	}
+	return c, nil
+}
+
+func (c *Constraint) add(op string, v *Version) {
+	c.comparisons = append(c.comparisons, comparison{op: op, version: v})
+}
+
+// Match tells whether v satisfies the constraint. Prerelease versions only
+// match constraints that name a prerelease of the same version.
+func (c *Constraint) Match(v *Version) bool {
+	if v.Prerelease != "" {
+		allowed := false
+		for _, cmp := range c.comparisons {
+			if cmp.version.Prerelease != "" && cmp.version.Major == v.Major &&
+				cmp.version.Minor == v.Minor && cmp.version.Patch == v.Patch {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for _, cmp := range c.comparisons {
+		if !cmp.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Constraint) String() string {
+	return c.text
+}
@@ -0,0 +1,67 @@
+package semver_test
+
+import (
+	"espore/builder/semver"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestCompare(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	ordered := []string{"0.1.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.10", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.2.0", "1.10.0", "2.0.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, err := semver.Parse(ordered[i-1])
+		t.Ok(err)
+		b, err := semver.Parse(ordered[i])
+		t.Ok(err)
+		t.Equals(-1, a.Compare(b))
+		t.Equals(1, b.Compare(a))
+	}
+
+	_, err := semver.Parse("1.2")
+	t.Assert(err != nil, "Expected error parsing a partial version")
+	_, err = semver.Parse("1.a.3")
+	t.Assert(err != nil, "Expected error parsing an invalid version")
+}
+
+func TestConstraints(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	cases := []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{"^1.2", []string{"1.2.0", "1.9.3"}, []string{"1.1.9", "2.0.0"}},
+		{"^0.2.1", []string{"0.2.1", "0.2.9"}, []string{"0.3.0", "0.2.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.10"}, []string{"1.3.0", "1.2.2"}},
+		{"1.2", []string{"1.2.0", "1.2.7"}, []string{"1.3.0"}},
+		{"1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{">=1.0 <2", []string{"1.0.0", "1.99.0"}, []string{"0.9.0", "2.0.0"}},
+		{"*", []string{"0.0.1", "7.0.0"}, []string{"1.0.0-rc.1"}},
+		{"1.0.0-rc.1", []string{"1.0.0-rc.1"}, []string{"1.0.0"}},
+	}
+	for _, c := range cases {
+		constraint, err := semver.ParseConstraint(c.constraint)
+		t.Ok(err)
+		for _, st := range c.match {
+			v, err := semver.Parse(st)
+			t.Ok(err)
+			t.Assert(constraint.Match(v), "Expected %s to match %s", st, c.constraint)
+		}
+		for _, st := range c.noMatch {
+			v, err := semver.Parse(st)
+			t.Ok(err)
+			t.Assert(!constraint.Match(v), "Expected %s not to match %s", st, c.constraint)
+		}
+	}
+
+	_, err := semver.ParseConstraint("^1.x.y")
+	t.Assert(err != nil, "Expected error parsing an invalid constraint")
+}
@@ -0,0 +1,49 @@
+package builder
+
+import (
+	"espore/builder/image"
+	"espore/builder/signing"
+	"espore/config"
+	"fmt"
+)
+
+// LoadKeyring reads the signing keys of the project
+func LoadKeyring(config *config.BuildConfig) (*signing.Keyring, error) {
+	path := config.GetSigningKeysFile()
+	keyring, err := signing.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if keyring.Empty() {
+		Log.Printf("WARNING: no signing keys in %s, images will not be signed. Run 'espore keys rotate' to create one\n", path)
+	} else if !keyring.Encrypted() {
+		ignoreSecretsFile("signing keys", path)
+	}
+	return keyring, nil
+}
+
+// encodeImage encodes the image, signed with the current key if the keyring
+// has one, and reads it back as the bootloader would to catch a broken image
+// before it reaches a device
+func encodeImage(img *image.Image, keyring *signing.Keyring) ([]byte, error) {
+	var data []byte
+	var err error
+	id, key, signed := keyring.Current()
+	if signed {
+		img.KeyID = id
+		data, err = img.Sign(key)
+	} else {
+		data, err = img.Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+	check, err := image.Read(data)
+	if err == nil && signed {
+		err = check.Verify(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Generated image is invalid: %s", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,261 @@
+// Package signing manages the project keys device images are signed with.
+//
+// Keys live in a file with the same format as the secrets file, so it can be
+// encrypted with the same passphrase. Each key has an id such as "k3". One
+// key, the current one, signs new images; older ones stay trusted by devices
+// until they are retired, and newer ones are pending until activated.
+//
+// Every signed image carries the keys of the keyring in DeviceKeysUpdateFile,
+// encrypted with the key that signs the image, and the bootloader replaces the
+// keys of the device with them. Keys are thus rotated over the air:
+//
+//  1. "keys rotate" adds a pending key. Images are still signed with the
+//     current key, which devices trust, and install the new one.
+//  2. Once every device runs such an image, "keys activate" makes the new key
+//     the current one.
+//  3. "keys retire" removes the old key. Devices stop trusting it when they
+//     install the next image.
+package signing
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"espore/builder/secrets"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DeviceKeysFile is the file on the device listing the trusted keys
+const DeviceKeysFile = "boot.keys"
+
+// DeviceKeysUpdateFile is the image file holding the encrypted keys the
+// bootloader installs as DeviceKeysFile
+const DeviceKeysUpdateFile = "boot.keys.new"
+
+const (
+	idPrefix = "k"
+	keySize  = 32
+	// currentEntry names the entry of the keys file holding the id of the
+	// current key. Without it, the newest key is the current one.
+	currentEntry = "current"
+)
+
+// Keyring holds the signing keys of the project
+type Keyring struct {
+	store *secrets.Store
+}
+
+// Load reads the keys file. A missing file yields an empty keyring.
+func Load(path string) (*Keyring, error) {
+	store, err := secrets.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range store.Names() {
+		if id != currentEntry && idNumber(id) <= 0 {
+			return nil, fmt.Errorf("Invalid key id %q in %s", id, path)
+		}
+	}
+	return &Keyring{store: store}, nil
+}
+
+// New returns a keyring holding the given keys, by id
+func New(keys map[string]string) *Keyring {
+	copied := make(map[string]string, len(keys))
+	for id, key := range keys {
+		copied[id] = key
+	}
+	return &Keyring{store: secrets.New(copied)}
+}
+
+func idNumber(id string) int {
+	if !strings.HasPrefix(id, idPrefix) {
+		return 0
+	}
+	n, err := strconv.Atoi(id[len(idPrefix):])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// IDs returns the ids of the keys, oldest first
+func (k *Keyring) IDs() []string {
+	var ids []string
+	for _, name := range k.store.Names() {
+		if name != currentEntry {
+			ids = append(ids, name)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return idNumber(ids[i]) < idNumber(ids[j])
+	})
+	return ids
+}
+
+// Encrypted tells whether the keyring was loaded from an encrypted file
+func (k *Keyring) Encrypted() bool {
+	return k.store.Encrypted()
+}
+
+// Empty tells whether the keyring has no keys, so images are not signed
+func (k *Keyring) Empty() bool {
+	return len(k.IDs()) == 0
+}
+
+// Current returns the id and value of the key new images are signed with
+func (k *Keyring) Current() (string, []byte, bool) {
+	ids := k.IDs()
+	if len(ids) == 0 {
+		return "", nil, false
+	}
+	id := ids[len(ids)-1]
+	if current, ok := k.store.Get(currentEntry); ok {
+		if _, ok := k.store.Get(current); ok {
+			id = current
+		}
+	}
+	key, _ := k.Key(id)
+	return id, key, true
+}
+
+// Pending returns the ids of the keys newer than the current one, which
+// images install on devices but are not signed with yet
+func (k *Keyring) Pending() []string {
+	current, _, _ := k.Current()
+	var pending []string
+	for _, id := range k.IDs() {
+		if idNumber(id) > idNumber(current) {
+			pending = append(pending, id)
+		}
+	}
+	return pending
+}
+
+// Key returns the value of the key with the given id. The bootloader uses the
+// hex encoded key as is, so this is also what the HMAC is computed with.
+func (k *Keyring) Key(id string) ([]byte, bool) {
+	key, ok := k.store.Get(id)
+	return []byte(key), ok
+}
+
+// Rotate generates a new key and returns its id. The first key becomes the
+// current one; later ones are pending until activated, since devices only
+// learn them from images signed with a key they already trust.
+func (k *Keyring) Rotate() (string, error) {
+	next := 1
+	if ids := k.IDs(); len(ids) > 0 {
+		next = idNumber(ids[len(ids)-1]) + 1
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	if current, _, ok := k.Current(); ok {
+		k.store.Set(currentEntry, current)
+	}
+	id := idPrefix + strconv.Itoa(next)
+	k.store.Set(id, hex.EncodeToString(key))
+	return id, nil
+}
+
+// Activate makes a key the current one, so new images are signed with it.
+// Devices must have installed it from an earlier image.
+func (k *Keyring) Activate(id string) error {
+	if _, ok := k.Key(id); !ok || id == currentEntry {
+		return fmt.Errorf("Unknown key %q", id)
+	}
+	k.store.Set(currentEntry, id)
+	return nil
+}
+
+// Retire removes a key so devices provisioned from now on no longer trust it.
+// The current key cannot be retired.
+func (k *Keyring) Retire(id string) error {
+	if _, ok := k.store.Get(id); !ok || id == currentEntry {
+		return fmt.Errorf("Unknown key %q", id)
+	}
+	if current, _, _ := k.Current(); id == current {
+		return fmt.Errorf("Cannot retire %s, it is the current signing key. Rotate and activate another key first", id)
+	}
+	k.store.Delete(id)
+	return nil
+}
+
+// Save writes the keyring to path, encrypted if it was loaded encrypted
+func (k *Keyring) Save(path string) error {
+	return k.store.Save(path)
+}
+
+// DeviceFile returns the content of DeviceKeysFile: a JSON object mapping
+// the id of every key in the keyring to its value
+func (k *Keyring) DeviceFile() ([]byte, error) {
+	keys := make(map[string]string)
+	for _, id := range k.IDs() {
+		key, _ := k.store.Get(id)
+		keys[id] = key
+	}
+	return json.Marshal(keys)
+}
+
+// DeviceKeysUpdate returns the content of DeviceKeysUpdateFile for an image
+// signed with the current key: DeviceFile encrypted with AES-128-CBC as the
+// NodeMCU crypto module does, zero padded, with a key made of the first 16
+// bytes of the SHA256 of the signing key. The IV, written first, is derived
+// from the content so builds are reproducible.
+func (k *Keyring) DeviceKeysUpdate() ([]byte, error) {
+	_, key, ok := k.Current()
+	if !ok {
+		return nil, fmt.Errorf("No signing key")
+	}
+	plain, err := k.DeviceFile()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(plain)
+	iv := mac.Sum(nil)[:aes.BlockSize]
+	block, err := aes.NewCipher(updateKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if pad := len(plain) % aes.BlockSize; pad != 0 {
+		plain = append(plain, make([]byte, aes.BlockSize-pad)...)
+	}
+	out := append([]byte(nil), iv...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+	return append(out, encrypted...), nil
+}
+
+// DecryptDeviceKeysUpdate returns the keys in the content of
+// DeviceKeysUpdateFile given the key the image is signed with
+func DecryptDeviceKeysUpdate(data, key []byte) (map[string]string, error) {
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid %s", DeviceKeysUpdateFile)
+	}
+	block, err := aes.NewCipher(updateKey(key))
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[aes.BlockSize:])
+	var keys map[string]string
+	if err := json.Unmarshal(bytes.TrimRight(plain, "\x00"), &keys); err != nil {
+		return nil, fmt.Errorf("Cannot decrypt %s: %s", DeviceKeysUpdateFile, err)
+	}
+	return keys, nil
+}
+
+func updateKey(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:16]
+}
@@ -0,0 +1,114 @@
+package signing_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"espore/builder/signing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestRotate(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-signing")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	keyring, err := signing.Load(path)
+	t.Ok(err)
+	t.Assert(keyring.Empty(), "Expected an empty keyring")
+	_, _, ok := keyring.Current()
+	t.Assert(!ok, "Expected no current key")
+	_, err = keyring.DeviceKeysUpdate()
+	t.Assert(err != nil, "Expected an error without signing key")
+
+	for _, expected := range []string{"k1", "k2", "k3"} {
+		id, err := keyring.Rotate()
+		t.Ok(err)
+		t.Equals(expected, id)
+	}
+	// the first key signs images, newer ones wait for devices to have them
+	id, _, _ := keyring.Current()
+	t.Equals("k1", id)
+	t.Equals([]string{"k2", "k3"}, keyring.Pending())
+	t.Equals(`Unknown key "k4"`, keyring.Activate("k4").Error())
+	t.Ok(keyring.Activate("k3"))
+	t.Equals(0, len(keyring.Pending()))
+	t.Equals("Cannot retire k3, it is the current signing key. Rotate and activate another key first", keyring.Retire("k3").Error())
+	t.Ok(keyring.Retire("k1"))
+	t.Equals(`Unknown key "k1"`, keyring.Retire("k1").Error())
+	t.Ok(keyring.Save(path))
+
+	keyring, err = signing.Load(path)
+	t.Ok(err)
+	t.Equals([]string{"k2", "k3"}, keyring.IDs())
+	id, key, ok := keyring.Current()
+	t.Assert(ok, "Expected a current key")
+	t.Equals("k3", id)
+	t.Equals(64, len(key))
+
+	var deviceKeys map[string]string
+	data, err := keyring.DeviceFile()
+	t.Ok(err)
+	t.Ok(json.Unmarshal(data, &deviceKeys))
+	t.Equals(string(key), deviceKeys["k3"])
+	t.Equals(2, len(deviceKeys))
+}
+
+func TestOrder(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	keyring := signing.New(map[string]string{"k9": "a", "k10": "b", "k2": "c"})
+	t.Equals([]string{"k2", "k9", "k10"}, keyring.IDs())
+	id, key, _ := keyring.Current()
+	t.Equals("k10", id)
+	t.Equals("b", string(key))
+	id, err := keyring.Rotate()
+	t.Ok(err)
+	t.Equals("k11", id)
+	id, _, _ = keyring.Current()
+	t.Equals("k10", id)
+}
+
+func TestDeviceKeysUpdate(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	keyring := signing.New(map[string]string{"k1": "old key", "k2": "new key"})
+	t.Ok(keyring.Activate("k1"))
+	data, err := keyring.DeviceKeysUpdate()
+	t.Ok(err)
+	t.Assert(!bytes.Contains(data, []byte("new key")), "Keys are not encrypted")
+	again, err := keyring.DeviceKeysUpdate()
+	t.Ok(err)
+	t.Equals(data, again)
+
+	keys, err := signing.DecryptDeviceKeysUpdate(data, []byte("old key"))
+	t.Ok(err)
+	t.Equals(map[string]string{"k1": "old key", "k2": "new key"}, keys)
+	_, err = signing.DecryptDeviceKeysUpdate(data, []byte("new key"))
+	t.Assert(err != nil, "Expected an error decrypting with another key")
+	_, err = signing.DecryptDeviceKeysUpdate(data[:20], []byte("old key"))
+	t.Equals("Invalid boot.keys.new", err.Error())
+}
+
+func TestInvalidID(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-signing")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	t.Ok(ioutil.WriteFile(path, []byte(`{"main":"abc"}`), 0600))
+	_, err = signing.Load(path)
+	t.Assert(err != nil, "Expected an error loading an invalid key id")
+}
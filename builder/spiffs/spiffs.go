@@ -0,0 +1,329 @@
+// Package spiffs writes and reads SPIFFS file system images as the NodeMCU
+// firmware mounts them, so a device can be programmed with its files instead
+// of uploading and unpacking an image on the first boot.
+//
+// The layout follows SPIFFS 0.3.7 as NodeMCU configures it: 16 bit object,
+// span and page indexes, 32 byte names, aligned object index tables and a
+// magic number, including the file system length, in every block.
+//
+// Every block starts with object lookup pages holding one object id per
+// remaining page of the block. A file is an index header page with its size
+// and name, followed by as many index pages as needed to list its data pages.
+package spiffs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Defaults of the NodeMCU firmware
+const (
+	DefaultPageSize  = 256
+	DefaultBlockSize = 8192
+)
+
+// NameLength is SPIFFS_OBJ_NAME_LEN, including the terminating zero
+const NameLength = 32
+
+const (
+	magic           = 0x20140529
+	pageHeaderSize  = 5 // object id, span index and flags
+	indexHeaderSize = 8 // page header padded to 4 bytes
+	typeFile        = 1
+
+	flagUsed         = 1 << 0
+	flagFinal        = 1 << 1
+	flagIndex        = 1 << 2
+	flagIndexDeleted = 1 << 6
+	flagDeleted      = 1 << 7
+
+	idIndexFlag     = 0x8000
+	idFree          = 0xffff
+	idDeleted       = 0
+	undefinedLength = 0xffffffff
+)
+
+// Config is the geometry of the file system, as the firmware was built with
+type Config struct {
+	PageSize  int
+	BlockSize int
+	// MetaLength is SPIFFS_OBJ_META_LEN, 0 unless the firmware keeps
+	// metadata such as file times in the index header
+	MetaLength int
+}
+
+// File is a file in the file system
+type File struct {
+	Name string
+	Data []byte
+}
+
+type geometry struct {
+	Config
+	blocks        int
+	pagesPerBlock int
+	lookupPages   int
+	// dataSize is the payload of a data page
+	dataSize int
+	// headerEntries and indexEntries are the data pages listed by the index
+	// header page and by the other index pages of a file
+	headerEntries int
+	indexEntries  int
+}
+
+func newGeometry(config Config, size int) (*geometry, error) {
+	if config.PageSize == 0 {
+		config.PageSize = DefaultPageSize
+	}
+	if config.BlockSize == 0 {
+		config.BlockSize = DefaultBlockSize
+	}
+	g := &geometry{Config: config}
+	if g.PageSize < 64 || g.BlockSize%g.PageSize != 0 {
+		return nil, fmt.Errorf("Invalid page size %d for block size %d", g.PageSize, g.BlockSize)
+	}
+	if size <= 0 || size%g.BlockSize != 0 {
+		return nil, fmt.Errorf("File system size %d is not a multiple of the block size %d", size, g.BlockSize)
+	}
+	g.blocks = size / g.BlockSize
+	g.pagesPerBlock = g.BlockSize / g.PageSize
+	g.lookupPages = g.pagesPerBlock * 2 / g.PageSize
+	if g.lookupPages == 0 {
+		g.lookupPages = 1
+	}
+	// the erase count and the magic take the last two entries of the lookup
+	if (g.pagesPerBlock-g.lookupPages+2)*2 > g.lookupPages*g.PageSize {
+		return nil, fmt.Errorf("Unsupported geometry: %d byte pages in %d byte blocks", g.PageSize, g.BlockSize)
+	}
+	g.dataSize = g.PageSize - pageHeaderSize
+	g.headerEntries = (g.PageSize - g.objectHeaderSize()) / 2
+	g.indexEntries = (g.PageSize - indexHeaderSize) / 2
+	return g, nil
+}
+
+// objectHeaderSize is the size of the index header: page header, padding,
+// size, type, name and metadata, aligned to the size of a page index
+func (g *geometry) objectHeaderSize() int {
+	size := indexHeaderSize + 4 + 1 + NameLength + g.MetaLength
+	return size + size%2
+}
+
+// usablePages is the number of pages of a block that can hold objects
+func (g *geometry) usablePages() int {
+	return g.pagesPerBlock - g.lookupPages
+}
+
+// pageOffset returns the offset of the page with the given index
+func (g *geometry) pageOffset(page int) int {
+	return page * g.PageSize
+}
+
+// lookupOffset returns the offset of the lookup entry of a page
+func (g *geometry) lookupOffset(page int) int {
+	block := page / g.pagesPerBlock
+	return block*g.BlockSize + (page%g.pagesPerBlock-g.lookupPages)*2
+}
+
+// magic returns the magic number of a block and its offset
+func (g *geometry) magic(block int) (uint16, int) {
+	offset := block*g.BlockSize + g.lookupPages*g.PageSize - 4
+	return uint16(magic ^ g.PageSize ^ (g.blocks - block)), offset
+}
+
+// Write returns a file system image of the given size holding the files. It
+// is flashed as is at the start of the file system partition.
+func Write(config Config, size int, files []*File) ([]byte, error) {
+	g, err := newGeometry(config, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) >= idIndexFlag-1 {
+		return nil, fmt.Errorf("Too many files: %d", len(files))
+	}
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = 0xff
+	}
+	le := binary.LittleEndian
+	for block := 0; block < g.blocks; block++ {
+		m, offset := g.magic(block)
+		le.PutUint16(data[offset:], m)
+		le.PutUint16(data[offset+2:], 0) // erase count
+	}
+
+	next := 0
+	allocate := func(id uint16) (int, error) {
+		if next%g.pagesPerBlock < g.lookupPages {
+			next += g.lookupPages - next%g.pagesPerBlock
+		}
+		if next >= g.blocks*g.pagesPerBlock {
+			return 0, fmt.Errorf("Files do not fit in a %d bytes file system", size)
+		}
+		page := next
+		next++
+		le.PutUint16(data[g.lookupOffset(page):], id)
+		return page, nil
+	}
+	writeHeader := func(page int, id uint16, span int, flags byte) []byte {
+		p := data[g.pageOffset(page) : g.pageOffset(page)+g.PageSize]
+		le.PutUint16(p, id)
+		le.PutUint16(p[2:], uint16(span))
+		p[4] = flags
+		return p
+	}
+
+	seen := make(map[string]bool)
+	for i, f := range files {
+		if len(f.Name) == 0 || len(f.Name) >= NameLength {
+			return nil, fmt.Errorf("Invalid file name %q: names must have 1 to %d characters", f.Name, NameLength-1)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("Duplicate file %s", f.Name)
+		}
+		seen[f.Name] = true
+		id := uint16(i + 1)
+
+		dataPages := (len(f.Data) + g.dataSize - 1) / g.dataSize
+		indexPages := 1
+		if dataPages > g.headerEntries {
+			indexPages += (dataPages - g.headerEntries + g.indexEntries - 1) / g.indexEntries
+		}
+		index := make([]int, indexPages)
+		for span := range index {
+			if index[span], err = allocate(id | idIndexFlag); err != nil {
+				return nil, err
+			}
+		}
+		for span := 0; span < dataPages; span++ {
+			page, err := allocate(id)
+			if err != nil {
+				return nil, err
+			}
+			p := writeHeader(page, id, span, 0xff&^(flagUsed|flagFinal))
+			chunk := f.Data[span*g.dataSize:]
+			if len(chunk) > g.dataSize {
+				chunk = chunk[:g.dataSize]
+			}
+			copy(p[pageHeaderSize:], chunk)
+
+			ix, entry := g.indexEntry(span)
+			le.PutUint16(data[g.pageOffset(index[ix])+entry:], uint16(page))
+		}
+		for span, page := range index {
+			p := writeHeader(page, id|idIndexFlag, span, 0xff&^(flagUsed|flagFinal|flagIndex))
+			if span == 0 {
+				le.PutUint32(p[indexHeaderSize:], uint32(len(f.Data)))
+				p[indexHeaderSize+4] = typeFile
+				name := p[indexHeaderSize+5 : indexHeaderSize+5+NameLength]
+				for i := range name {
+					name[i] = 0
+				}
+				copy(name, f.Name)
+			}
+		}
+	}
+	return data, nil
+}
+
+// indexEntry returns the span of the index page listing the data page with
+// the given span and the offset of its entry in that page
+func (g *geometry) indexEntry(span int) (int, int) {
+	if span < g.headerEntries {
+		return 0, g.objectHeaderSize() + span*2
+	}
+	span -= g.headerEntries
+	return 1 + span/g.indexEntries, indexHeaderSize + span%g.indexEntries*2
+}
+
+// Read returns the files of a file system image, in the order they were
+// created
+func Read(config Config, data []byte) ([]*File, error) {
+	g, err := newGeometry(config, len(data))
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	valid := func(p []byte, flags byte) bool {
+		return p[4]&(flagUsed|flagFinal|flags) == 0 && p[4]&flagDeleted != 0
+	}
+
+	index := make(map[uint16]map[int]int)
+	for block := 0; block < g.blocks; block++ {
+		m, offset := g.magic(block)
+		if le.Uint16(data[offset:]) != m {
+			return nil, fmt.Errorf("Block %d has no SPIFFS magic, this is not a file system with this geometry", block)
+		}
+		for i := 0; i < g.usablePages(); i++ {
+			page := block*g.pagesPerBlock + g.lookupPages + i
+			id := le.Uint16(data[g.lookupOffset(page):])
+			if id == idFree || id == idDeleted || id&idIndexFlag == 0 {
+				continue
+			}
+			p := data[g.pageOffset(page):]
+			if le.Uint16(p) != id {
+				return nil, fmt.Errorf("Page %d belongs to object %x, the lookup says %x", page, le.Uint16(p), id)
+			}
+			if !valid(p, flagIndex) || p[4]&flagIndexDeleted == 0 {
+				continue
+			}
+			id &^= idIndexFlag
+			if index[id] == nil {
+				index[id] = make(map[int]int)
+			}
+			index[id][int(le.Uint16(p[2:]))] = page
+		}
+	}
+
+	ids := make([]int, 0, len(index))
+	for id := range index {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	var files []*File
+	for _, id := range ids {
+		spans := index[uint16(id)]
+		header, ok := spans[0]
+		if !ok {
+			return nil, fmt.Errorf("Object %x has no index header", id)
+		}
+		p := data[g.pageOffset(header):]
+		size := le.Uint32(p[indexHeaderSize:])
+		if p[indexHeaderSize+4] != typeFile {
+			continue
+		}
+		name := p[indexHeaderSize+5 : indexHeaderSize+5+NameLength]
+		for i, c := range name {
+			if c == 0 {
+				name = name[:i]
+				break
+			}
+		}
+		if size == undefinedLength {
+			return nil, fmt.Errorf("%s has no size", name)
+		}
+		f := &File{Name: string(name), Data: make([]byte, 0, size)}
+		for span := 0; len(f.Data) < int(size); span++ {
+			ix, entry := g.indexEntry(span)
+			indexPage, ok := spans[ix]
+			if !ok {
+				return nil, fmt.Errorf("%s: missing index page %d", f.Name, ix)
+			}
+			page := int(le.Uint16(data[g.pageOffset(indexPage)+entry:]))
+			if page >= g.blocks*g.pagesPerBlock {
+				return nil, fmt.Errorf("%s: invalid data page %d", f.Name, page)
+			}
+			dp := data[g.pageOffset(page) : g.pageOffset(page)+g.PageSize]
+			if le.Uint16(dp) != uint16(id) || int(le.Uint16(dp[2:])) != span || !valid(dp, 0) || dp[4]&flagIndex == 0 {
+				return nil, fmt.Errorf("%s: page %d is not data page %d of the file", f.Name, page, span)
+			}
+			chunk := dp[pageHeaderSize:]
+			if left := int(size) - len(f.Data); len(chunk) > left {
+				chunk = chunk[:left]
+			}
+			f.Data = append(f.Data, chunk...)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
@@ -0,0 +1,88 @@
+package spiffs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"espore/builder/spiffs"
+	"math/rand"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestRoundTrip(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	big := make([]byte, 40000) // needs a second index page
+	rand.New(rand.NewSource(1)).Read(big)
+	files := []*spiffs.File{
+		{Name: "init.lua", Data: []byte("print('hello')")},
+		{Name: "empty", Data: []byte{}},
+		{Name: "lfs.img", Data: big},
+		{Name: "lib/a-file-with-a-31-chars-name", Data: bytes.Repeat([]byte("x"), 251)},
+	}
+	data, err := spiffs.Write(spiffs.Config{}, 64*1024, files)
+	t.Ok(err)
+	t.Equals(64*1024, len(data))
+
+	read, err := spiffs.Read(spiffs.Config{}, data)
+	t.Ok(err)
+	t.Equals(len(files), len(read))
+	for i, f := range files {
+		t.Equals(f.Name, read[i].Name)
+		t.Assert(bytes.Equal(f.Data, read[i].Data), "Content of %s differs", f.Name)
+	}
+}
+
+func TestLayout(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	data, err := spiffs.Write(spiffs.Config{}, 2*8192, []*spiffs.File{{Name: "a", Data: []byte("abc")}})
+	t.Ok(err)
+	le := binary.LittleEndian
+	// lookup of the first block: index header and data page of object 1
+	t.Equals(uint16(0x8001), le.Uint16(data[0:]))
+	t.Equals(uint16(0x0001), le.Uint16(data[2:]))
+	t.Equals(uint16(0xffff), le.Uint16(data[4:]))
+	// magic and erase count of both blocks
+	t.Equals(uint16(0x0529^256^2), le.Uint16(data[252:]))
+	t.Equals(uint16(0), le.Uint16(data[254:]))
+	t.Equals(uint16(0x0529^256^1), le.Uint16(data[8192+252:]))
+	// index header in page 1, listing the data page
+	header := data[256:512]
+	t.Equals([]byte{0x01, 0x80, 0, 0, 0xf8}, header[:5])
+	t.Equals(uint32(3), le.Uint32(header[8:]))
+	t.Equals(byte(1), header[12])
+	t.Equals("a\x00", string(header[13:15]))
+	t.Equals(uint16(2), le.Uint16(header[46:]))
+	// data page in page 2
+	t.Equals([]byte{0x01, 0x00, 0, 0, 0xfc, 'a', 'b', 'c', 0xff}, data[512:521])
+}
+
+func TestErrors(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	_, err := spiffs.Write(spiffs.Config{}, 8192, []*spiffs.File{{Name: "a-file-name-with-32-characters.."}})
+	t.Assert(err != nil, "Expected a name error")
+	t.Equals(`Invalid file name "a-file-name-with-32-characters..": names must have 1 to 31 characters`, err.Error())
+
+	_, err = spiffs.Write(spiffs.Config{}, 8192, []*spiffs.File{{Name: "big", Data: make([]byte, 8192)}})
+	t.Assert(err != nil, "Expected a size error")
+	t.Equals("Files do not fit in a 8192 bytes file system", err.Error())
+
+	_, err = spiffs.Write(spiffs.Config{}, 10000, nil)
+	t.Assert(err != nil, "Expected a geometry error")
+	t.Equals("File system size 10000 is not a multiple of the block size 8192", err.Error())
+
+	empty, err := spiffs.Write(spiffs.Config{}, 8192, nil)
+	t.Ok(err)
+	_, err = spiffs.Read(spiffs.Config{PageSize: 512}, empty)
+	t.Assert(err != nil, "Expected a magic error")
+	t.Equals("Block 0 has no SPIFFS magic, this is not a file system with this geometry", err.Error())
+	files, err := spiffs.Read(spiffs.Config{}, empty)
+	t.Ok(err)
+	t.Equals(0, len(files))
+}
@@ -0,0 +1,54 @@
+package builder
+
+import (
+	"espore/config"
+	"espore/luatest"
+	"sort"
+	"strings"
+)
+
+// TestFileSuffix marks the Lua unit tests of a library. Nothing requires
+// them, so they never end up in a firmware.
+const TestFileSuffix = "_test.lua"
+
+// LibraryTestSuites returns a suite for each loaded library with test files.
+// The tests can load the files of the library and its dependencies.
+func LibraryTestSuites(config *config.BuildConfig) ([]*luatest.Suite, error) {
+	libs, _, err := loadProject(config)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for path := range libs.Libs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var suites []*luatest.Suite
+	for _, path := range paths {
+		lib := libs.Libs[path]
+		var tests []string
+		for file := range lib.Files {
+			if strings.HasSuffix(file, TestFileSuffix) {
+				tests = append(tests, file)
+			}
+		}
+		if len(tests) == 0 {
+			continue
+		}
+		sort.Strings(tests)
+		files, _ := buildFileIndex(getLibraryList(lib, nil), FirmwareDef{})
+		suite := &luatest.Suite{
+			Name:  lib.BasePath,
+			Tests: tests,
+			Files: make(map[string][]byte, len(files)),
+		}
+		for file, entry := range files {
+			if suite.Files[file], err = entry.ReadContent(); err != nil {
+				return nil, err
+			}
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
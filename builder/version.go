@@ -0,0 +1,106 @@
+package builder
+
+import (
+	"encoding/json"
+	"espore/builder/semver"
+	"espore/session"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EsporeVersion is the version of the tool, set at release time with
+// -ldflags "-X espore/builder.EsporeVersion=x.y.z"
+var EsporeVersion = "dev"
+
+// VersionFile is the file generated in every image describing the build
+const VersionFile = "version.json"
+
+// BuildInfo holds what is common to all the devices of a build
+type BuildInfo struct {
+	Commit    string
+	Dirty     bool
+	BuildTime time.Time
+}
+
+// gitOutput runs git in the current directory. Failures yield an empty
+// string, as projects are not required to be in a git repository.
+func gitOutput(args ...string) string {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// readBuildInfo gets the commit of the project and whether tracked files
+// have uncommitted changes. So that builds are reproducible, the build time
+// is taken from SOURCE_DATE_EPOCH or the time of the commit. Outside git it
+// is the Unix epoch, as there is nothing stable to derive it from.
+func readBuildInfo() (*BuildInfo, error) {
+	info := &BuildInfo{
+		Commit: gitOutput("rev-parse", "HEAD"),
+	}
+	if info.Commit != "" {
+		info.Dirty = gitOutput("status", "--porcelain", "--untracked-files=no") != ""
+	}
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" && info.Commit != "" {
+		epoch = gitOutput("log", "-1", "--format=%ct")
+	}
+	if epoch == "" {
+		epoch = "0"
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SOURCE_DATE_EPOCH %q", epoch)
+	}
+	info.BuildTime = time.Unix(seconds, 0).UTC()
+	return info, nil
+}
+
+// addVersionFile adds version.json to a manifest. The copy next to the
+// image, written by writeVersionFile, also holds the hash of the image.
+func addVersionFile(manifest *FirmwareManifest, fwDef FirmwareDef, info *BuildInfo) (*session.FirmwareVersion, error) {
+	if fwDef.Version != "" {
+		if _, err := semver.Parse(fwDef.Version); err != nil {
+			return nil, err
+		}
+	}
+	for _, fe := range manifest.Files {
+		if fe.Path == VersionFile {
+			return nil, fmt.Errorf("%s is generated but %s also provides it", VersionFile, fe.Base)
+		}
+	}
+	version := &session.FirmwareVersion{
+		Version:   fwDef.Version,
+		Commit:    info.Commit,
+		Dirty:     info.Dirty,
+		BuildTime: info.BuildTime.Format(time.RFC3339),
+		Espore:    EsporeVersion,
+	}
+	data, err := json.Marshal(version)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Files = append(manifest.Files, NewVirtualFileEntry(data, VersionFile))
+	return version, nil
+}
+
+// writeVersionFile writes <id>.version.json for the firmware server once the
+// image and its .hash file are written
+func writeVersionFile(version *session.FirmwareVersion, id, outputDir string) error {
+	hash, err := ioutil.ReadFile(filepath.Join(outputDir, id+".img.hash"))
+	if err != nil {
+		return err
+	}
+	withHash := *version
+	withHash.ImageHash = strings.TrimSpace(string(hash))
+	return utils.WriteJSON(filepath.Join(outputDir, id+".version.json"), &withHash)
+}
@@ -0,0 +1,75 @@
+package builder_test
+
+import (
+	"encoding/json"
+	"espore/builder"
+	"espore/session"
+	"espore/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestVersionImageHash(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json": firmware(`"id": "1", "name": "dev", "version": "1.2.0"`),
+		"devices/dev/main.lua":      "print(1)",
+	})
+	defer os.RemoveAll(projectDir(config))
+	t.Ok(builder.Build(config))
+
+	imgPath := filepath.Join(config.Output, "1.img")
+	hash, err := ioutil.ReadFile(imgPath + ".hash")
+	t.Ok(err)
+	var version session.FirmwareVersion
+	t.Ok(utils.ReadJSON(filepath.Join(config.Output, "1.version.json"), &version))
+	t.Equals("1.2.0", version.Version)
+	t.Equals(string(hash), version.ImageHash)
+
+	// the copy in the image cannot know the hash of the image
+	var inImage session.FirmwareVersion
+	t.Ok(json.Unmarshal([]byte(imageFile(t, projectDir(config), builder.VersionFile)), &inImage))
+	t.Equals("", inImage.ImageHash)
+
+	keyring, err := builder.LoadKeyring(config)
+	t.Ok(err)
+	_, err = builder.VerifyImage(imgPath, keyring)
+	t.Ok(err)
+
+	version.ImageHash = strings.Repeat("0", 40)
+	t.Ok(utils.WriteJSON(filepath.Join(config.Output, "1.version.json"), &version))
+	_, err = builder.VerifyImage(imgPath, keyring)
+	t.Assert(err != nil && strings.Contains(err.Error(), "1.version.json says "+version.ImageHash), "unexpected error: %v", err)
+}
+
+func TestBuildTimeOutsideGit(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	config := newProject(t, map[string]string{
+		"devices/dev/firmware.json": devFirmware,
+		"devices/dev/main.lua":      "print(1)",
+	})
+	dir := projectDir(config)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	t.Ok(err)
+	t.Ok(os.Chdir(dir))
+	defer os.Chdir(wd)
+	if epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		defer os.Setenv("SOURCE_DATE_EPOCH", epoch)
+		os.Unsetenv("SOURCE_DATE_EPOCH")
+	}
+
+	t.Ok(builder.VerifyReproducible(config))
+	var version session.FirmwareVersion
+	t.Ok(utils.ReadJSON(filepath.Join(config.Output, "1.version.json"), &version))
+	t.Equals("1970-01-01T00:00:00Z", version.BuildTime)
+}
@@ -0,0 +1,307 @@
+package builder
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"espore/builder/semver"
+	"espore/config"
+	"espore/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LockedLibrary is a versioned library as resolved for the project
+type LockedLibrary struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+}
+
+// LockFile pins the versioned libraries of a project so every build uses the
+// same library contents
+type LockFile struct {
+	Libraries []*LockedLibrary `json:"libraries"`
+}
+
+// LibrarySet holds the libraries loaded for a build and resolves versioned
+// dependencies against the library roots
+type LibrarySet struct {
+	// Libs contains every loaded library by path
+	Libs  map[string]*FirmwareLib
+	Roots []string
+	// Resolved contains the versioned libraries picked so far, by name
+	Resolved map[string]*LockedLibrary
+	// Locked contains the entries of the lock file, if any. Resolution
+	// prefers locked versions as long as they satisfy the constraints.
+	Locked map[string]*LockedLibrary
+	// Constraints contains every constraint seen for each versioned library,
+	// including those found in earlier loading passes
+	Constraints map[string][]*semver.Constraint
+	// restart is set when a library was resolved to a version that a later
+	// constraint rejects while another version satisfies all of them
+	restart bool
+}
+
+func NewLibrarySet(roots []string) *LibrarySet {
+	return &LibrarySet{
+		Libs:        make(map[string]*FirmwareLib),
+		Roots:       roots,
+		Resolved:    make(map[string]*LockedLibrary),
+		Constraints: make(map[string][]*semver.Constraint),
+	}
+}
+
+// loadLibraries loads the libraries and devices of the project. A versioned
+// library is resolved as soon as it is first required, so when a later
+// constraint rules the chosen version out, loading starts over knowing all
+// the constraints found so far. Every pass adds a constraint, so this ends.
+func loadLibraries(config *config.BuildConfig, lock map[string]*LockedLibrary) (*LibrarySet, []*Device, error) {
+	constraints := make(map[string][]*semver.Constraint)
+	for {
+		libs := NewLibrarySet(config.LibraryRoots)
+		libs.Locked = lock
+		libs.Constraints = constraints
+		devices, err := loadDevices(config, libs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !libs.restart {
+			return libs, devices, nil
+		}
+	}
+}
+
+// hashLibrary computes a content hash of all the files of a library
+func hashLibrary(path string, list []string) (string, error) {
+	sorted := append([]string{}, list...)
+	sort.Strings(sorted)
+	hasher := sha1.New()
+	for _, f := range sorted {
+		h, err := utils.HashFile(filepath.Join(path, f))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hasher, "%s\x00%s\n", filepath.ToSlash(f), h)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+type libraryVersion struct {
+	version *semver.Version
+	path    string
+}
+
+// findVersions lists the available versions of a library in the library
+// roots. The version is read from library.json, falling back to the name of
+// the version directory.
+func (libs *LibrarySet) findVersions(name string) ([]libraryVersion, error) {
+	var versions []libraryVersion
+	for _, root := range libs.Roots {
+		dirs, err := ioutil.ReadDir(filepath.Join(root, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, dir := range dirs {
+			if !dir.IsDir() {
+				continue
+			}
+			path := filepath.Join(root, name, dir.Name())
+			var libDef LibDef
+			utils.ReadJSON(filepath.Join(path, "library.json"), &libDef)
+			st := libDef.Version
+			if st == "" {
+				st = dir.Name()
+			}
+			v, err := semver.Parse(st)
+			if err != nil {
+				return nil, fmt.Errorf("Library %s: %s", path, err)
+			}
+			versions = append(versions, libraryVersion{version: v, path: path})
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].version.Compare(versions[j].version) > 0
+	})
+	return versions, nil
+}
+
+// resolve turns a dependency declaration into a library path. Plain
+// dependencies are paths already; "name@constraint" picks the highest version
+// from the library roots that satisfies every constraint seen for the
+// library, preferring the locked one.
+func (libs *LibrarySet) resolve(dependency string) (string, error) {
+	at := strings.IndexByte(dependency, '@')
+	if at < 0 {
+		return dependency, nil
+	}
+	name := dependency[:at]
+	constraint, err := semver.ParseConstraint(dependency[at+1:])
+	if err != nil {
+		return "", err
+	}
+	libs.addConstraint(name, constraint)
+
+	if resolved, ok := libs.Resolved[name]; ok {
+		v, err := semver.Parse(resolved.Version)
+		if err != nil {
+			return "", err
+		}
+		if constraint.Match(v) {
+			return resolved.Path, nil
+		}
+		if _, err := libs.choose(name); err != nil {
+			return "", err
+		}
+		// another version satisfies every constraint, load everything again
+		libs.restart = true
+		return resolved.Path, nil
+	}
+
+	chosen, err := libs.choose(name)
+	if err != nil {
+		return "", err
+	}
+	resolved := &LockedLibrary{
+		Name:    name,
+		Version: chosen.version.String(),
+		Path:    filepath.ToSlash(chosen.path),
+	}
+	libs.Resolved[name] = resolved
+	return chosen.path, nil
+}
+
+func (libs *LibrarySet) addConstraint(name string, constraint *semver.Constraint) {
+	for _, c := range libs.Constraints[name] {
+		if c.String() == constraint.String() {
+			return
+		}
+	}
+	libs.Constraints[name] = append(libs.Constraints[name], constraint)
+}
+
+// choose picks the version of a library that satisfies all of its known
+// constraints
+func (libs *LibrarySet) choose(name string) (libraryVersion, error) {
+	versions, err := libs.findVersions(name)
+	if err != nil {
+		return libraryVersion{}, err
+	}
+	constraints := libs.Constraints[name]
+	var candidates []libraryVersion
+	for _, lv := range versions {
+		match := true
+		for _, c := range constraints {
+			if !c.Match(lv.version) {
+				match = false
+				break
+			}
+		}
+		if match {
+			candidates = append(candidates, lv)
+		}
+	}
+	if len(candidates) == 0 {
+		var quoted []string
+		for _, c := range constraints {
+			quoted = append(quoted, fmt.Sprintf("%q", c))
+		}
+		return libraryVersion{}, fmt.Errorf("No version of %s satisfying %s found in library roots %v", name, strings.Join(quoted, ", "), libs.Roots)
+	}
+	if locked, ok := libs.Locked[name]; ok {
+		for _, lv := range candidates {
+			if lv.version.String() == locked.Version {
+				return lv, nil
+			}
+		}
+	}
+	return candidates[0], nil
+}
+
+// lockEntries returns the resolved versioned libraries with their content
+// hashes, sorted by name
+func (libs *LibrarySet) lockEntries() []*LockedLibrary {
+	var entries []*LockedLibrary
+	for _, resolved := range libs.Resolved {
+		entry := *resolved
+		if lib, ok := libs.Libs[filepath.FromSlash(resolved.Path)]; ok {
+			entry.Hash = lib.Hash
+		}
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+func readLockFile(path string) (map[string]*LockedLibrary, error) {
+	var lock LockFile
+	if err := utils.ReadJSON(path, &lock); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error reading lock file %s: %s", path, err)
+	}
+	locked := make(map[string]*LockedLibrary)
+	for _, l := range lock.Libraries {
+		locked[l.Name] = l
+	}
+	return locked, nil
+}
+
+// checkLockFile verifies that the resolved libraries match the lock file.
+// The lock file is created on the first build that resolves a versioned
+// library.
+func checkLockFile(path string, libs *LibrarySet) error {
+	entries := libs.lockEntries()
+	if libs.Locked == nil {
+		if len(entries) == 0 {
+			return nil
+		}
+		Log.Printf("Creating %s\n", path)
+		return utils.WriteJSON(path, &LockFile{Libraries: entries})
+	}
+
+	var mismatches []string
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.Name] = true
+		locked, ok := libs.Locked[e.Name]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s@%s is not locked", e.Name, e.Version))
+		case locked.Version != e.Version:
+			mismatches = append(mismatches, fmt.Sprintf("%s is locked at %s but resolved to %s", e.Name, locked.Version, e.Version))
+		case locked.Hash != e.Hash:
+			mismatches = append(mismatches, fmt.Sprintf("%s@%s contents changed: locked hash %s, found %s in %s", e.Name, e.Version, locked.Hash, e.Hash, e.Path))
+		}
+	}
+	for name, locked := range libs.Locked {
+		if !seen[name] {
+			mismatches = append(mismatches, fmt.Sprintf("%s@%s is locked but no longer used", name, locked.Version))
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("%s does not match the resolved libraries:\n  %s\nRun the lock command to update it", path, strings.Join(mismatches, "\n  "))
+	}
+	return nil
+}
+
+// UpdateLockFile resolves all versioned libraries from scratch, ignoring the
+// current lock file, and writes the result
+func UpdateLockFile(config *config.BuildConfig) error {
+	libs, _, err := loadLibraries(config, nil)
+	if err != nil {
+		return err
+	}
+	return utils.WriteJSON(config.GetLockFile(), &LockFile{Libraries: libs.lockEntries()})
+}
@@ -0,0 +1,66 @@
+package builder_test
+
+import (
+	"espore/builder"
+	"espore/config"
+	"espore/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// versionFiles returns a device depending on "logger@>=1.0" and on a
+// library x that requires xConstraint of logger. Versions 1.0.0, 1.2.0 and
+// 2.0.0 of logger are available in vlibs, see withLibraryRoot.
+func versionFiles(xConstraint string) map[string]string {
+	files := map[string]string{
+		"devices/dev/firmware.json": devFirmware,
+		"devices/dev/main.lua":      `require("logger")`,
+		"other/x/library.json":      `{"dependencies": ["logger@` + xConstraint + `"]}`,
+	}
+	for _, version := range []string{"1.0.0", "1.2.0", "2.0.0"} {
+		files["vlibs/logger/"+version+"/logger.lua"] = "return '" + version + "'"
+	}
+	return files
+}
+
+// withLibraryRoot resolves versioned libraries in vlibs and writes the
+// dependencies of the device
+func withLibraryRoot(t *ut.DefaultTestTools) func(config *config.BuildConfig) {
+	return func(config *config.BuildConfig) {
+		dir := projectDir(config)
+		config.LibraryRoots = []string{filepath.Join(dir, "vlibs")}
+		writeProjectFile(t, dir, "devices/dev/library.json",
+			`{"dependencies": ["logger@>=1.0", "`+filepath.Join(dir, "other", "x")+`"]}`)
+	}
+}
+
+func TestResolveAllConstraints(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// the device alone would get 2.0.0, x later rules it out
+	dir, build := buildProject(t, versionFiles("<1.2"), withLibraryRoot(t))
+	defer os.RemoveAll(dir)
+	t.Ok(build())
+	t.Equals("return '1.0.0'", imageFile(t, dir, "logger.lua"))
+
+	var lock builder.LockFile
+	t.Ok(utils.ReadJSON(filepath.Join(dir, "espore.lock"), &lock))
+	t.Equals(1, len(lock.Libraries))
+	t.Equals("1.0.0", lock.Libraries[0].Version)
+}
+
+func TestResolveUnsatisfiable(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, build := buildProject(t, versionFiles("<1.0"), withLibraryRoot(t))
+	defer os.RemoveAll(dir)
+	err := build()
+	t.Assert(err != nil, "expected a resolution error")
+	t.Assert(strings.Contains(err.Error(), `No version of logger satisfying ">=1.0", "<1.0" found`), "unexpected error: %s", err)
+}
@@ -2,6 +2,7 @@ package cli
 
 import (
 	"espore/builder"
+	"espore/builder/signing"
 	"espore/cli/syncer"
 	"espore/initializer"
 	"fmt"
@@ -105,6 +106,21 @@ func (ui *UI) cat(path string) error {
 	`, path))
 }
 
+func (ui *UI) info() error {
+	info, err := ui.Session.DeviceInfo()
+	if err != nil {
+		return err
+	}
+	ui.Printf("Chip id: %s\nFree heap: %d\n", info.ChipID, info.Heap)
+	if info.Firmware == nil {
+		ui.Printf("Firmware: unknown, no version.json\n")
+		return nil
+	}
+	fw := info.Firmware
+	ui.Printf("Firmware: %s\nBuilt: %s with espore %s\nImage hash: %s\n", fw, fw.BuildTime, fw.Espore, fw.ImageHash)
+	return nil
+}
+
 func (ui *UI) install_runtime() error {
 	return ui.Session.InstallRuntime()
 }
@@ -126,7 +142,11 @@ func (ui *UI) buildCommandHandlers() map[string]*commandHandler {
 		"init": &commandHandler{
 			minParameters: 0,
 			handler: func(p []string) error {
-				return initializer.Initialize(ui.EsporeConfig.Build.Output, ui.Session)
+				keyring, err := signing.Load(ui.EsporeConfig.Build.GetSigningKeysFile())
+				if err != nil {
+					return err
+				}
+				return initializer.Initialize(ui.EsporeConfig.Build.Output, ui.Session, keyring)
 			},
 		},
 		"install-runtime": &commandHandler{
@@ -169,6 +189,11 @@ func (ui *UI) buildCommandHandlers() map[string]*commandHandler {
 				return ui.cat(p[0])
 			},
 		},
+		"info": &commandHandler{
+			handler: func(p []string) error {
+				return ui.info()
+			},
+		},
 		"restart": &commandHandler{
 			handler: func(p []string) error {
 				return ui.Session.NodeRestart()
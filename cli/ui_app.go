@@ -2,6 +2,7 @@ package cli
 
 import (
 	"errors"
+	"espore/builder"
 	"espore/cli/history"
 	"espore/cli/syncer"
 	"espore/config"
@@ -61,6 +62,7 @@ func New(config *Config) *UI {
 	}
 	ui.commandHandlers = ui.buildCommandHandlers()
 	ui.Session.Log = ui
+	builder.Log = ui
 	ui.dumper = &Dumper{
 		R: ui.Session,
 		W: ui.output,
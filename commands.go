@@ -0,0 +1,596 @@
+package main
+
+import (
+	"espore/builder"
+	"espore/builder/image"
+	"espore/builder/secrets"
+	"espore/builder/signing"
+	"espore/config"
+	"espore/emulator"
+	"espore/flasher"
+	"espore/hil"
+	"espore/initializer"
+	"espore/luatest"
+	"espore/session"
+	"espore/testreport"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type commandHandler struct {
+	handler       func(config *config.EsporeConfig, parameters []string) error
+	minParameters int
+	usage         string
+}
+
+var commandHandlers = map[string]*commandHandler{
+	"lock": &commandHandler{
+		usage: "Resolve versioned libraries again and rewrite the lock file",
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return builder.UpdateLockFile(&config.Build)
+		},
+	},
+	"build": &commandHandler{
+		usage: "build [--verify-reproducible]: build all device images. With --verify-reproducible, build twice from copies of the history and lock file and fail if the outputs differ",
+		handler: func(config *config.EsporeConfig, p []string) error {
+			if len(p) == 0 {
+				return builder.Build(&config.Build)
+			}
+			if p[0] != "--verify-reproducible" && p[0] != "-verify-reproducible" {
+				return fmt.Errorf("Unknown build option %q", p[0])
+			}
+			return builder.VerifyReproducible(&config.Build)
+		},
+	},
+	"graph": &commandHandler{
+		usage: "Write the module dependency graph of each device as DOT and JSON",
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return builder.WriteGraphs(&config.Build)
+		},
+	},
+	"secrets": &commandHandler{
+		usage:         "secrets encrypt|decrypt: encrypt or decrypt the secrets file in place with the passphrase in " + secrets.PassphraseEnv,
+		minParameters: 1,
+		handler: func(config *config.EsporeConfig, p []string) error {
+			path := config.Build.GetSecretsFile()
+			switch p[0] {
+			case "encrypt":
+				return secrets.EncryptFile(path)
+			case "decrypt":
+				return secrets.DecryptFile(path)
+			}
+			return fmt.Errorf("Unknown secrets command %q", p[0])
+		},
+	},
+	"keys": &commandHandler{
+		usage:         "keys list|rotate|activate [id]|retire <id>|install [-port device]: manage the keys images are signed with. Images install the keys on devices that trust their signature, so to rotate keys over the air: rotate adds a pending key, deploy an image, activate then signs new images with it (default: the newest key), and retire stops trusting an old key from the next deployed image. install writes the keys to the device on the serial port, to provision it",
+		minParameters: 1,
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return manageKeys(&config.Build, p)
+		},
+	},
+	"image": &commandHandler{
+		usage:         "image ls <img> | extract <img> <dir> | verify <img>... | diff <a.img> <b.img>: list or extract the files of an image, check it against its .hash file, manifest and signature, or compare two images",
+		minParameters: 2,
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return imageCommand(&config.Build, p)
+		},
+	},
+	"lfs": &commandHandler{
+		usage:         "lfs config [-port device] [device dir]: read the LFS partition of the device on the serial port and, given a device directory, store it in its firmware.json so the build writes an absolute LFS image",
+		minParameters: 1,
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return lfsCommand(p)
+		},
+	},
+	"flash": &commandHandler{
+		usage: "flash [-port device] [-spiffs] [-lfs] [-no-reset] [-unverified] [-flash-size bytes] [device id]: write the NodeMCU firmware built for the device on the serial port through its ROM bootloader, optionally with its SPIFFS and LFS images, then reconnect to it. The device id defaults to the chip id of an ESP8266. The ESP8266 ROM cannot verify what was written, so it needs -unverified. DTR and RTS can only reset the chip into the bootloader on Linux and macOS, elsewhere put it there by hand and pass -no-reset",
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return flashDevice(&config.Build, p)
+		},
+	},
+	"emulate": &commandHandler{
+		usage:         "emulate <device> [seconds]: build the image of a device and boot it in the emulator for the given virtual time (default 30s). Fails on panics, boot loops or firmware load errors",
+		minParameters: 1,
+		handler: func(config *config.EsporeConfig, p []string) error {
+			seconds := 30
+			if len(p) > 1 {
+				var err error
+				if seconds, err = strconv.Atoi(p[1]); err != nil || seconds <= 0 {
+					return fmt.Errorf("Invalid emulation time %q", p[1])
+				}
+			}
+			return emulate(&config.Build, p[0], time.Duration(seconds)*time.Second)
+		},
+	},
+	"test": &commandHandler{
+		usage: "test [-junit] [-o file] [library...]: run the *_test.lua files of the libraries in the emulator and report the results as TAP, or JUnit XML with -junit",
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return runTests(&config.Build, p)
+		},
+	},
+	"hil": &commandHandler{
+		usage:         "hil [-port device] [-junit] [-o file] [-transcripts dir] script...: run hardware-in-the-loop test scripts against the board on the serial port. Writes a TAP or JUnit report and a transcript per test (default dir: <output>/hil)",
+		minParameters: 1,
+		handler: func(config *config.EsporeConfig, p []string) error {
+			return runHIL(&config.Build, p)
+		},
+	},
+}
+
+func manageKeys(config *config.BuildConfig, args []string) error {
+	path := config.GetSigningKeysFile()
+	keyring, err := signing.Load(path)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		current, _, _ := keyring.Current()
+		pending := make(map[string]bool)
+		for _, id := range keyring.Pending() {
+			pending[id] = true
+		}
+		for _, id := range keyring.IDs() {
+			switch {
+			case id == current:
+				fmt.Printf("%s (current)\n", id)
+			case pending[id]:
+				fmt.Printf("%s (pending)\n", id)
+			default:
+				fmt.Println(id)
+			}
+		}
+		return nil
+	case "rotate":
+		id, err := keyring.Rotate()
+		if err != nil {
+			return err
+		}
+		if err := keyring.Save(path); err != nil {
+			return err
+		}
+		if current, _, _ := keyring.Current(); current == id {
+			fmt.Printf("New images will be signed with %s. Install the keys on devices that must accept them\n", id)
+		} else {
+			fmt.Printf("New images will install %s on devices and are still signed with %s. Run 'espore keys activate %s' once every device runs one of them\n", id, current, id)
+		}
+		return nil
+	case "activate":
+		var id string
+		if pending := keyring.Pending(); len(args) > 1 {
+			id = args[1]
+		} else if len(pending) > 0 {
+			id = pending[len(pending)-1]
+		} else {
+			return fmt.Errorf("No pending key to activate")
+		}
+		if err := keyring.Activate(id); err != nil {
+			return err
+		}
+		if err := keyring.Save(path); err != nil {
+			return err
+		}
+		fmt.Printf("New images will be signed with %s. Devices that did not install it will reject them\n", id)
+		return nil
+	case "retire":
+		if len(args) < 2 {
+			return fmt.Errorf("Missing the id of the key to retire")
+		}
+		if err := keyring.Retire(args[1]); err != nil {
+			return err
+		}
+		return keyring.Save(path)
+	case "install":
+		flags := flag.NewFlagSet("keys install", flag.ContinueOnError)
+		port := flags.String("port", "/dev/ttyUSB0", "Serial port the device is connected to")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if keyring.Empty() {
+			return fmt.Errorf("No signing keys in %s", path)
+		}
+		s, close, err := getSerialSession(*port)
+		if err != nil {
+			return err
+		}
+		defer close()
+		return initializer.InstallKeys(s, keyring)
+	}
+	return fmt.Errorf("Unknown keys command %q", args[0])
+}
+
+func imageCommand(config *config.BuildConfig, args []string) error {
+	switch args[0] {
+	case "ls":
+		img, err := image.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		printImage(os.Stdout, img)
+		return nil
+	case "extract":
+		if len(args) < 3 {
+			return fmt.Errorf("Missing the directory to extract to")
+		}
+		img, err := image.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		if err := img.Extract(args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("Extracted %d files to %s\n", len(img.Files), args[2])
+		return nil
+	case "verify":
+		keyring, err := signing.Load(config.GetSigningKeysFile())
+		if err != nil {
+			return err
+		}
+		var failed bool
+		for _, path := range args[1:] {
+			if _, err := builder.VerifyImage(path, keyring); err != nil {
+				fmt.Println(err)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s: OK\n", path)
+		}
+		if failed {
+			return fmt.Errorf("Some images are invalid")
+		}
+		return nil
+	case "diff":
+		if len(args) < 3 {
+			return fmt.Errorf("Missing the image to compare with")
+		}
+		a, err := image.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		b, err := image.ReadFile(args[2])
+		if err != nil {
+			return err
+		}
+		printDiff(os.Stdout, a, b)
+		return nil
+	}
+	return fmt.Errorf("Unknown image command %q", args[0])
+}
+
+func lfsCommand(args []string) error {
+	if args[0] != "config" {
+		return fmt.Errorf("Unknown lfs command %q", args[0])
+	}
+	flags := flag.NewFlagSet("lfs config", flag.ContinueOnError)
+	port := flags.String("port", "/dev/ttyUSB0", "Serial port the device is connected to")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	s, close, err := getSerialSession(*port)
+	if err != nil {
+		return err
+	}
+	defer close()
+	lfs, err := s.LFSConfig()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("LFS base %#x, mapped at %#x, size %d\n", lfs.Base, lfs.Mapped, lfs.Size)
+	if flags.NArg() == 0 {
+		return nil
+	}
+	return builder.SetLFSFlash(flags.Arg(0), &builder.FirmwareLFSFlashConfig{
+		Base:   lfs.Base,
+		Mapped: lfs.Mapped,
+		Size:   lfs.Size,
+	})
+}
+
+func flashDevice(config *config.BuildConfig, args []string) error {
+	flags := flag.NewFlagSet("flash", flag.ContinueOnError)
+	port := flags.String("port", "/dev/ttyUSB0", "Serial port the device is connected to")
+	withSPIFFS := flags.Bool("spiffs", false, "Also write the SPIFFS image of the device")
+	withLFS := flags.Bool("lfs", false, "Also write the absolute LFS image of the device")
+	noReset := flags.Bool("no-reset", false, "Do not reset the chip into the bootloader with DTR and RTS, it was put there by hand")
+	unverified := flags.Bool("unverified", false, "Write to chips whose ROM cannot verify the flash, such as the ESP8266")
+	flashSize := flags.Int("flash-size", 4<<20, "Size of the flash of the chip")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	serialPort, err := flasher.OpenSerial(*port)
+	if err != nil {
+		return err
+	}
+	defer serialPort.Close()
+	loader, err := flasher.Connect(&flasher.Config{Port: serialPort, NoReset: *noReset, FlashSize: *flashSize, AllowUnverified: *unverified})
+	if err != nil {
+		return err
+	}
+	defer loader.Close()
+	fmt.Printf("Connected to the %s ROM bootloader\n", loader.Chip.Name)
+
+	id := flags.Arg(0)
+	if id == "" {
+		if id, err = loader.ChipID(); err != nil {
+			return fmt.Errorf("%s, give the device id", err)
+		}
+		if _, err := os.Stat(builder.FlashLayoutFile(config.Output, id)); err != nil {
+			id = "DEFAULT"
+		}
+	}
+	layout, err := builder.ReadFlashLayout(config.Output, id)
+	if err != nil {
+		return fmt.Errorf("Cannot read the flash layout of %s, build a NodeMCU firmware for it first: %s", id, err)
+	}
+	if layout.Firmware == nil {
+		return fmt.Errorf("No NodeMCU firmware was built for %s", id)
+	}
+	regions := []*builder.FlashRegion{layout.Firmware}
+	if *withSPIFFS {
+		if layout.SPIFFS == nil {
+			return fmt.Errorf("No SPIFFS image was built for %s", id)
+		}
+		regions = append(regions, layout.SPIFFS)
+	}
+	if *withLFS {
+		if layout.LFS == nil {
+			return fmt.Errorf("No LFS image was built for %s", id)
+		}
+		regions = append(regions, layout.LFS)
+	}
+
+	for _, region := range regions {
+		data, err := ioutil.ReadFile(filepath.Join(config.Output, region.File))
+		if err != nil {
+			return err
+		}
+		err = loader.WriteFlash(int(region.Offset), data, func(written, total int) {
+			fmt.Printf("\rWriting %s at %#x: %3d%%", region.File, region.Offset, written*100/total)
+		})
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+	}
+	if err := loader.Finish(); err != nil {
+		return err
+	}
+	// stop reading before the device boots the new firmware, then talk to
+	// it on the same port
+	loader.Close()
+	if err := loader.HardReset(); err != nil {
+		return err
+	}
+	s, err := session.New(&session.Config{Socket: serialPort})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if _, err := s.Expect("NodeMCU|Espore bootloader", 30*time.Second); err != nil {
+		fmt.Printf("WARNING: the device did not print its banner after booting: %s\n", err)
+	}
+	info, err := s.DeviceInfo()
+	if err != nil {
+		return fmt.Errorf("Flashed, but cannot reconnect to the device: %s", err)
+	}
+	version := "no version.json"
+	if info.Firmware != nil {
+		version = info.Firmware.String()
+	}
+	fmt.Printf("Device %s is up, firmware %s, %d bytes free\n", info.ChipID, version, info.Heap)
+	return nil
+}
+
+func printImage(w io.Writer, img *image.Image) {
+	fmt.Fprintf(w, "Version: %d\n", img.Version)
+	fmt.Fprintf(w, "Device:  %s (%s)\n", img.DeviceName, img.DeviceID)
+	if img.KeyID != "" {
+		fmt.Fprintf(w, "Signed:  %s\n", img.KeyID)
+	}
+	if img.Type == image.TypeDelta {
+		fmt.Fprintf(w, "Delta:   %s -> %s\n", img.BaseSHA1, img.TargetSHA1)
+	}
+	fmt.Fprintf(w, "Files:   %d (%d bytes)\n", len(img.Files), img.Size())
+	for _, f := range img.Files {
+		encoding := ""
+		if f.Compressed {
+			encoding = " (lzss)"
+		}
+		fmt.Fprintf(w, "%8d  %s  %s%s\n", len(f.Data), f.SHA1(), f.Path, encoding)
+	}
+}
+
+func printDiff(w io.Writer, a, b *image.Image) {
+	changes := image.Diff(a, b)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range changes {
+		switch c.Kind {
+		case image.Added, image.Removed:
+			fmt.Fprintf(tw, "%s\t%s\t%+d\t\n", c.Kind, c.Path, c.Delta())
+		default:
+			fmt.Fprintf(tw, "%s\t%s\t%+d\t(%d -> %d)\n", c.Kind, c.Path, c.Delta(), c.OldSize, c.NewSize)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "Files changed: %d, size %d -> %d (%+d)\n", len(changes), a.Size(), b.Size(), b.Size()-a.Size())
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func runHIL(config *config.BuildConfig, args []string) error {
+	flags := flag.NewFlagSet("hil", flag.ContinueOnError)
+	port := flags.String("port", "/dev/ttyUSB0", "Serial port the board is connected to")
+	junit := flags.Bool("junit", false, "Write JUnit XML instead of TAP")
+	output := flags.String("o", "", "File to write the report to instead of stdout")
+	transcripts := flags.String("transcripts", filepath.Join(config.Output, "hil"), "Directory to write the transcript of each test to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("No test scripts given")
+	}
+	var scripts []*hil.Script
+	for _, path := range flags.Args() {
+		script, err := hil.ReadScript(path)
+		if err != nil {
+			return err
+		}
+		scripts = append(scripts, script)
+	}
+	if err := os.MkdirAll(*transcripts, 0755); err != nil {
+		return err
+	}
+
+	socket, err := openSerialPort(*port)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	recorder := hil.NewRecorder(socket)
+	s, err := session.New(&session.Config{Socket: recorder})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var cases []*testreport.Case
+	for _, script := range scripts {
+		for _, c := range script.Run(s, recorder) {
+			name := unsafeFileChars.ReplaceAllString(c.Suite+"-"+c.Name, "_") + ".log"
+			if err := ioutil.WriteFile(filepath.Join(*transcripts, name), []byte(c.Output), 0666); err != nil {
+				return err
+			}
+			cases = append(cases, c)
+		}
+	}
+	return writeReport(cases, *junit, *output)
+}
+
+// writeReport writes the test results as TAP, or JUnit XML, to stdout or the
+// output file, and fails if any test failed
+func writeReport(cases []*testreport.Case, junit bool, output string) error {
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	write := testreport.WriteTAP
+	if junit {
+		write = testreport.WriteJUnit
+	}
+	if err := write(w, cases); err != nil {
+		return err
+	}
+	if failed := testreport.Failed(cases); failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(cases))
+	}
+	return nil
+}
+
+func runTests(config *config.BuildConfig, args []string) error {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	junit := flags.Bool("junit", false, "Write JUnit XML instead of TAP")
+	output := flags.String("o", "", "File to write the report to instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	suites, err := builder.LibraryTestSuites(config)
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]bool)
+	for _, name := range flags.Args() {
+		selected[name] = true
+	}
+	var cases []*testreport.Case
+	for _, suite := range suites {
+		if len(selected) > 0 && !selected[suite.Name] {
+			continue
+		}
+		delete(selected, suite.Name)
+		suiteCases, err := luatest.Run(suite)
+		if err != nil {
+			return err
+		}
+		cases = append(cases, suiteCases...)
+	}
+	for name := range selected {
+		return fmt.Errorf("No tests found in library %q", name)
+	}
+	return writeReport(cases, *junit, *output)
+}
+
+func emulate(config *config.BuildConfig, device string, d time.Duration) error {
+	tmpDir, err := ioutil.TempDir("", "espore-emulate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	img, err := builder.BuildEmulationImage(config, device, tmpDir)
+	if err != nil {
+		return err
+	}
+	chipID, _ := strconv.ParseUint(img.Manifest.ID, 10, 32)
+	e, err := emulator.New(&emulator.Config{
+		Image:  img.Image,
+		ChipID: uint32(chipID),
+		LFS:    img.LFS,
+	})
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	if img.Keys != nil {
+		if err := e.WriteFile(signing.DeviceKeysFile, img.Keys); err != nil {
+			return err
+		}
+	}
+	if err := e.Run(d); err != nil {
+		return err
+	}
+	if len(e.Failures) > 0 {
+		return fmt.Errorf("%s failed to run:\n%s", img.Manifest.Name, strings.Join(e.Failures, "\n"))
+	}
+	fmt.Printf("%s ran for %s with %d restarts\n", img.Manifest.Name, d, e.Restarts)
+	return nil
+}
+
+func printCommands() {
+	var names []string
+	for name := range commandHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", name, commandHandlers[name].usage)
+	}
+}
+
+func runCommand(config *config.EsporeConfig, args []string) error {
+	command, ok := commandHandlers[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command %q", args[0])
+	}
+	parameters := args[1:]
+	if len(parameters) < command.minParameters {
+		return fmt.Errorf("Command %q requires at least %d parameters", args[0], command.minParameters)
+	}
+	return command.handler(config, parameters)
+}
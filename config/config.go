@@ -11,6 +11,62 @@ type BuildConfig struct {
 	Libs    []string `json:"libs"`
 	Devices []string `json:"devices"`
 	Output  string   `json:"output"`
+	// LibraryRoots are directories holding versioned libraries laid out as
+	// <root>/<name>/<version>, used to resolve "name@constraint" dependencies
+	LibraryRoots []string `json:"libraryRoots"`
+	LockFile     string   `json:"lockFile"`
+	// Secrets is the file holding passwords and other values that must be
+	// kept out of the sources
+	Secrets string `json:"secrets"`
+	// SigningKeys is the file holding the keys images are signed with
+	SigningKeys string `json:"signingKeys"`
+	// Deltas is how many previous images of each device are kept in the
+	// history directory to build delta images from. Zero disables deltas.
+	Deltas int `json:"deltas"`
+	// History is the directory keeping previous images. It is outside of the
+	// output directory, which is emptied on each build.
+	History string `json:"history"`
+	// Inventory is a CSV or JSON file listing devices built from template
+	// device directories
+	Inventory string `json:"inventory"`
+	// Profiles maps build profile names, such as "debug" or "release", to
+	// the preprocessor defines they set on every device
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+	// Profile is the build profile in use
+	Profile string `json:"profile"`
+}
+
+const DefaultLockFile = "espore.lock"
+const DefaultSecretsFile = "secrets.json"
+const DefaultSigningKeysFile = "signing-keys.json"
+const DefaultHistoryDir = "history"
+
+func (bc *BuildConfig) GetLockFile() string {
+	if bc.LockFile != "" {
+		return bc.LockFile
+	}
+	return DefaultLockFile
+}
+
+func (bc *BuildConfig) GetSecretsFile() string {
+	if bc.Secrets != "" {
+		return bc.Secrets
+	}
+	return DefaultSecretsFile
+}
+
+func (bc *BuildConfig) GetSigningKeysFile() string {
+	if bc.SigningKeys != "" {
+		return bc.SigningKeys
+	}
+	return DefaultSigningKeysFile
+}
+
+func (bc *BuildConfig) GetHistoryDir() string {
+	if bc.History != "" {
+		return bc.History
+	}
+	return DefaultHistoryDir
 }
 
 var DefaultConfig = &EsporeConfig{
@@ -0,0 +1,304 @@
+package emulator
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func bytesReader(data []byte) *bytes.Reader {
+	return bytes.NewReader(data)
+}
+
+func trimExt(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+func (e *Emulator) openSjson() {
+	L := e.L
+	L.SetGlobal("sjson", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"encode": func(L *lua.LState) int {
+			var buf bytes.Buffer
+			if err := encodeJSON(&buf, L.CheckAny(1), 0); err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(lua.LString(buf.String()))
+			return 1
+		},
+		"decode": func(L *lua.LState) int {
+			d := json.NewDecoder(strings.NewReader(L.CheckString(1)))
+			d.UseNumber()
+			var v interface{}
+			if err := d.Decode(&v); err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(toLua(L, v))
+			return 1
+		},
+	}))
+}
+
+// encodeJSON writes a Lua value as JSON. Tables whose keys are 1..n become
+// arrays, other tables objects with their keys sorted.
+func encodeJSON(buf *bytes.Buffer, v lua.LValue, depth int) error {
+	if depth > 20 {
+		return fmt.Errorf("nesting too deep")
+	}
+	switch v := v.(type) {
+	case *lua.LNilType:
+		buf.WriteString("null")
+	case lua.LBool:
+		buf.WriteString(strconv.FormatBool(bool(v)))
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("cannot encode %v", f)
+		}
+		if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+			buf.WriteString(strconv.FormatInt(int64(f), 10))
+		} else {
+			buf.WriteString(strconv.FormatFloat(f, 'g', 14, 64))
+		}
+	case lua.LString:
+		data, _ := json.Marshal(string(v))
+		buf.Write(data)
+	case *lua.LTable:
+		n := v.MaxN()
+		count := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { count++ })
+		if n > 0 && n == count {
+			buf.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					buf.WriteByte(',')
+				}
+				if err := encodeJSON(buf, v.RawGetInt(i), depth+1); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+			return nil
+		}
+		values := make(map[string]lua.LValue)
+		var keys []string
+		v.ForEach(func(key, value lua.LValue) {
+			keys = append(keys, key.String())
+			values[key.String()] = value
+		})
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			data, _ := json.Marshal(key)
+			buf.Write(data)
+			buf.WriteByte(':')
+			if err := encodeJSON(buf, values[key], depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for key, item := range v {
+			t.RawSetString(key, toLua(L, item))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+var hashes = map[string]func() hash.Hash{
+	"MD5":    md5.New,
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA384": sha512.New384,
+	"SHA512": sha512.New,
+}
+
+func checkHash(L *lua.LState, n int) func() hash.Hash {
+	algo := strings.ToUpper(L.CheckString(n))
+	h, ok := hashes[algo]
+	if !ok {
+		L.ArgError(n, "unknown hash algorithm "+algo)
+	}
+	return h
+}
+
+const hasherTypeName = "crypto.hasher"
+
+// aesCrypt implements crypto.encrypt and crypto.decrypt: AES-ECB or AES-CBC
+// with a 16 bytes key and an optional IV, zero padding the input as NodeMCU
+// does
+func aesCrypt(L *lua.LState, encrypt bool) int {
+	algo := strings.ToUpper(L.CheckString(1))
+	key := []byte(L.CheckString(2))
+	data := []byte(L.CheckString(3))
+	iv := []byte(L.OptString(4, ""))
+	if algo != "AES-ECB" && algo != "AES-CBC" {
+		L.ArgError(1, "unsupported algorithm "+algo)
+	}
+	if len(key) != 16 {
+		L.ArgError(2, "key must be 16 bytes")
+	}
+	block, _ := aes.NewCipher(key)
+	iv = append(iv, make([]byte, aes.BlockSize)...)[:aes.BlockSize]
+	if pad := len(data) % aes.BlockSize; pad != 0 {
+		data = append(data, make([]byte, aes.BlockSize-pad)...)
+	}
+	out := make([]byte, len(data))
+	if algo == "AES-CBC" {
+		if encrypt {
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+		} else {
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		}
+	} else {
+		for i := 0; i < len(data); i += aes.BlockSize {
+			if encrypt {
+				block.Encrypt(out[i:], data[i:])
+			} else {
+				block.Decrypt(out[i:], data[i:])
+			}
+		}
+	}
+	L.Push(lua.LString(out))
+	return 1
+}
+
+func (e *Emulator) openCrypto() {
+	L := e.L
+	mt := L.NewTypeMetatable(hasherTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"update": func(L *lua.LState) int {
+			h := L.CheckUserData(1).Value.(hash.Hash)
+			h.Write([]byte(L.CheckString(2)))
+			return 0
+		},
+		"finalize": func(L *lua.LState) int {
+			h := L.CheckUserData(1).Value.(hash.Hash)
+			L.Push(lua.LString(h.Sum(nil)))
+			return 1
+		},
+	}))
+	newHasher := func(L *lua.LState, h hash.Hash) int {
+		ud := L.NewUserData()
+		ud.Value = h
+		L.SetMetatable(ud, mt)
+		L.Push(ud)
+		return 1
+	}
+	L.SetGlobal("crypto", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"hash": func(L *lua.LState) int {
+			h := checkHash(L, 1)()
+			h.Write([]byte(L.CheckString(2)))
+			L.Push(lua.LString(h.Sum(nil)))
+			return 1
+		},
+		"hmac": func(L *lua.LState) int {
+			h := hmac.New(checkHash(L, 1), []byte(L.CheckString(3)))
+			h.Write([]byte(L.CheckString(2)))
+			L.Push(lua.LString(h.Sum(nil)))
+			return 1
+		},
+		"fhash": func(L *lua.LState) int {
+			h := checkHash(L, 1)()
+			data, err := e.ReadFile(L.CheckString(2))
+			if err != nil {
+				L.RaiseError("%s", err)
+			}
+			h.Write(data)
+			L.Push(lua.LString(h.Sum(nil)))
+			return 1
+		},
+		"new_hash": func(L *lua.LState) int {
+			return newHasher(L, checkHash(L, 1)())
+		},
+		"new_hmac": func(L *lua.LState) int {
+			return newHasher(L, hmac.New(checkHash(L, 1), []byte(L.CheckString(2))))
+		},
+		"encrypt": func(L *lua.LState) int {
+			return aesCrypt(L, true)
+		},
+		"decrypt": func(L *lua.LState) int {
+			return aesCrypt(L, false)
+		},
+		"toHex": func(L *lua.LState) int {
+			L.Push(lua.LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+			return 1
+		},
+		"toBase64": func(L *lua.LState) int {
+			L.Push(lua.LString(base64.StdEncoding.EncodeToString([]byte(L.CheckString(1)))))
+			return 1
+		},
+	}))
+}
+
+func (e *Emulator) openEncoder() {
+	L := e.L
+	L.SetGlobal("encoder", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"toHex": func(L *lua.LState) int {
+			L.Push(lua.LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+			return 1
+		},
+		"fromHex": func(L *lua.LState) int {
+			data, err := hex.DecodeString(L.CheckString(1))
+			if err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(lua.LString(data))
+			return 1
+		},
+		"toBase64": func(L *lua.LState) int {
+			L.Push(lua.LString(base64.StdEncoding.EncodeToString([]byte(L.CheckString(1)))))
+			return 1
+		},
+		"fromBase64": func(L *lua.LState) int {
+			data, err := base64.StdEncoding.DecodeString(L.CheckString(1))
+			if err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(lua.LString(data))
+			return 1
+		},
+	}))
+}
@@ -0,0 +1,503 @@
+// Package emulator boots device images on the host. It runs the bootloader
+// and firmware in a Lua 5.1 VM with mocks of the NodeMCU modules a firmware
+// usually needs: file (backed by a temporary directory), tmr (on virtual
+// time), node, sjson, crypto, encoder, uart and a stubbed wifi. Missing
+// modules and boot loops can thus be caught without a board.
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"espore/initializer"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DefaultMaxRestarts is the number of restarts within the boot loop window
+// above which the device is considered to be in a boot loop
+const DefaultMaxRestarts = 3
+
+// DefaultBootLoopWindow is the virtual time span in which restarts count
+// towards MaxRestarts. Restarts the firmware expects, such as installing an
+// update and then flashing LFS, happen seconds apart; a device that keeps
+// crashing restarts many times within it.
+const DefaultBootLoopWindow = time.Minute
+
+// DefaultFailPatterns match the console lines the bootloader prints when the
+// firmware fails to start
+var DefaultFailPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^\[ ERROR \]`),
+	regexp.MustCompile(`^Error loading main module`),
+	regexp.MustCompile(`^Error invoking main function`),
+}
+
+type Config struct {
+	// Image is copied to the file system as update.img, as the initializer
+	// does, so the bootloader unpacks it on the first boot
+	Image string
+	// InitLua is the bootloader. Defaults to the one the initializer installs
+	InitLua string
+	// SkipInit leaves init.lua out of the file system, to run code other
+	// than a firmware
+	SkipInit bool
+	ChipID   uint32
+	// LFS holds the sources of the modules node.flashreload loads, by
+	// module name as luac.cross indexes them ("net,client")
+	LFS map[string][]byte
+	// Output receives the console output. Defaults to os.Stdout
+	Output      io.Writer
+	MaxRestarts int
+	// BootLoopWindow is the virtual time span in which more than MaxRestarts
+	// restarts are a boot loop. Defaults to DefaultBootLoopWindow
+	BootLoopWindow time.Duration
+	FailPatterns   []*regexp.Regexp
+}
+
+// BootLoopError is returned when the device keeps restarting
+type BootLoopError struct {
+	Restarts int
+	// Elapsed is the virtual time between the first and the last restart
+	Elapsed time.Duration
+}
+
+func (e *BootLoopError) Error() string {
+	return fmt.Sprintf("boot loop: %d restarts in %s", e.Restarts, e.Elapsed)
+}
+
+// Emulator is a virtual device
+type Emulator struct {
+	config Config
+	dir    string
+	clock  time.Duration
+	// L is the VM of the current boot, nil until the device boots
+	L        *lua.LState
+	cancel   context.CancelFunc
+	timers   []*timer
+	sequence int
+	files    []*os.File
+	restart  bool
+	// bootReason is reported by node.bootreason after the next boot
+	bootReason int
+	lfs        bool
+	console    *console
+	// Restarts counts the restarts since the emulator was created
+	Restarts int
+	// recentRestarts holds the virtual times of the restarts within the boot
+	// loop window
+	recentRestarts []time.Duration
+	// Failures lists the panics and the console lines that matched a fail
+	// pattern
+	Failures []string
+}
+
+// New creates a device with an empty file system holding only the bootloader
+// and the image to install
+func New(config *Config) (*Emulator, error) {
+	e := &Emulator{config: *config}
+	if e.config.InitLua == "" {
+		e.config.InitLua = initializer.InitLua
+	}
+	if e.config.Output == nil {
+		e.config.Output = os.Stdout
+	}
+	if e.config.MaxRestarts == 0 {
+		e.config.MaxRestarts = DefaultMaxRestarts
+	}
+	if e.config.BootLoopWindow == 0 {
+		e.config.BootLoopWindow = DefaultBootLoopWindow
+	}
+	if e.config.FailPatterns == nil {
+		e.config.FailPatterns = DefaultFailPatterns
+	}
+	e.console = &console{e: e}
+	dir, err := ioutil.TempDir("", "espore-emulator")
+	if err != nil {
+		return nil, err
+	}
+	e.dir = dir
+	if !e.config.SkipInit {
+		if err := e.WriteFile("init.lua", []byte(e.config.InitLua)); err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+	if e.config.Image != "" {
+		data, err := ioutil.ReadFile(e.config.Image)
+		if err == nil {
+			err = e.WriteFile("update.img", data)
+		}
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Dir returns the directory backing the file system of the device
+func (e *Emulator) Dir() string {
+	return e.dir
+}
+
+// Now returns the virtual time since the emulator was created
+func (e *Emulator) Now() time.Duration {
+	return e.clock
+}
+
+// Close shuts the VM down and removes the file system
+func (e *Emulator) Close() error {
+	e.shutdown()
+	return os.RemoveAll(e.dir)
+}
+
+func (e *Emulator) shutdown() {
+	for _, f := range e.files {
+		f.Close()
+	}
+	e.files = nil
+	if e.L != nil {
+		e.cancel()
+		e.L.Close()
+		e.L = nil
+	}
+	e.timers = nil
+}
+
+// Run advances virtual time by d, booting the device first if needed and
+// firing timers in order. It fails if the device restarts more than
+// MaxRestarts times within BootLoopWindow of virtual time.
+func (e *Emulator) Run(d time.Duration) error {
+	deadline := e.clock + d
+	if e.L == nil {
+		e.Boot()
+	}
+	for {
+		if e.restart {
+			e.Restarts++
+			if e.countRestart() > e.config.MaxRestarts {
+				e.shutdown()
+				return &BootLoopError{Restarts: len(e.recentRestarts), Elapsed: e.clock - e.recentRestarts[0]}
+			}
+			e.Boot()
+			continue
+		}
+		t := e.nextTimer()
+		if t == nil || t.due > deadline {
+			e.clock = deadline
+			e.console.flush()
+			return nil
+		}
+		e.clock = t.due
+		if err := e.fire(t); err != nil {
+			e.panic(err)
+		}
+	}
+}
+
+// countRestart records a restart at the current virtual time and returns the
+// number of restarts within the boot loop window
+func (e *Emulator) countRestart() int {
+	recent := e.recentRestarts[:0]
+	for _, at := range e.recentRestarts {
+		if e.clock-at < e.config.BootLoopWindow {
+			recent = append(recent, at)
+		}
+	}
+	e.recentRestarts = append(recent, e.clock)
+	return len(e.recentRestarts)
+}
+
+// Advance fires the timers due within d. Unlike Run, it does not boot the
+// device and stops at the first callback error or restart request, so it can
+// be called from Lua code driving the device.
+func (e *Emulator) Advance(d time.Duration) error {
+	deadline := e.clock + d
+	for {
+		if e.restart {
+			e.restart = false
+			return fmt.Errorf("device restart requested")
+		}
+		t := e.nextTimer()
+		if t == nil || t.due > deadline {
+			e.clock = deadline
+			return nil
+		}
+		e.clock = t.due
+		if err := e.fire(t); err != nil {
+			return fmt.Errorf("%s", errorMessage(err))
+		}
+	}
+}
+
+// Boot starts the VM from scratch, as after a reset, and runs init.lua
+func (e *Emulator) Boot() {
+	e.shutdown()
+	e.restart = false
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	L.SetContext(ctx)
+	e.L = L
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.LoadLibName, lua.OpenPackage},
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.DebugLibName, lua.OpenDebug},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	e.patchCompat()
+	e.openBase()
+	e.openFile()
+	e.openTmr()
+	e.openNode()
+	e.openUart()
+	e.openWifi()
+	e.openSjson()
+	e.openCrypto()
+	e.openEncoder()
+
+	if _, err := os.Stat(e.path("init.lua")); err != nil {
+		return
+	}
+	L.Push(L.GetGlobal("dofile"))
+	L.Push(lua.LString("init.lua"))
+	if err := L.PCall(1, 0, nil); err != nil && !e.restart {
+		// NodeMCU reports errors in init.lua but keeps running
+		e.console.writeLine(fmt.Sprintf("lua: %s", errorMessage(err)))
+	}
+}
+
+// fire runs a timer callback and returns its error, unless the device was
+// asked to restart in the meantime
+func (e *Emulator) fire(t *timer) error {
+	if t.ud == lua.LNil {
+		// tasks posted with node.task.post run once
+		e.removeTimer(t)
+	}
+	switch t.mode {
+	case alarmAuto:
+		t.due += t.interval
+	case alarmSingle:
+		t.running = false
+		t.registered = false
+	default:
+		t.running = false
+	}
+	e.L.Push(t.callback)
+	e.L.Push(t.ud)
+	if err := e.L.PCall(1, 0, nil); err != nil && !e.restart {
+		return err
+	}
+	return nil
+}
+
+// panic reports an error outside pcall, which makes NodeMCU restart
+func (e *Emulator) panic(err error) {
+	msg := fmt.Sprintf("PANIC: unprotected error in call to Lua API (%s)", errorMessage(err))
+	e.console.writeLine(msg)
+	e.Failures = append(e.Failures, msg)
+	e.requestRestart(bootException, false)
+}
+
+// requestRestart restarts the device once the running callback returns or,
+// if immediate, right away
+func (e *Emulator) requestRestart(reason int, immediate bool) {
+	e.bootReason = reason
+	e.restart = true
+	if immediate {
+		e.cancel()
+	}
+}
+
+func errorMessage(err error) string {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		return apiErr.Object.String()
+	}
+	return err.Error()
+}
+
+// path maps a file name on the device to the directory backing it
+func (e *Emulator) path(name string) string {
+	clean := filepath.Clean("/" + name)
+	return filepath.Join(e.dir, clean)
+}
+
+// patchCompat fixes where gopher-lua behaves differently from Lua 5.1
+func (e *Emulator) patchCompat() {
+	L := e.L
+	// string.match returns nil when there is no match instead of nothing
+	str := L.GetGlobal("string").(*lua.LTable)
+	match := L.GetField(str, "match")
+	L.SetField(str, "match", L.NewFunction(func(L *lua.LState) int {
+		top := L.GetTop()
+		L.Insert(match, 1)
+		L.Call(top, lua.MultRet)
+		if L.GetTop() == 0 {
+			L.Push(lua.LNil)
+		}
+		return L.GetTop()
+	}))
+	// error levels above 1 point one function further up the stack
+	L.SetGlobal("error", L.NewFunction(func(L *lua.LState) int {
+		obj := L.CheckAny(1)
+		level := L.OptInt(2, 1)
+		if level > 1 {
+			level++
+		}
+		L.Error(obj, level)
+		return 0
+	}))
+}
+
+func (e *Emulator) openBase() {
+	L := e.L
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		var parts []string
+		for i := 1; i <= L.GetTop(); i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		e.console.Write([]byte(strings.Join(parts, "\t") + "\n"))
+		return 0
+	}))
+	loadfile := func(L *lua.LState, name string) (*lua.LFunction, error) {
+		data, err := ioutil.ReadFile(e.path(name))
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s", name)
+		}
+		if bytes.HasPrefix(data, []byte("\x1bLua")) {
+			return nil, fmt.Errorf("%s: bytecode cannot be emulated, build without compile", name)
+		}
+		return L.Load(bytes.NewReader(data), name)
+	}
+	L.SetGlobal("loadfile", L.NewFunction(func(L *lua.LState) int {
+		fn, err := loadfile(L, L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(fn)
+		return 1
+	}))
+	L.SetGlobal("dofile", L.NewFunction(func(L *lua.LState) int {
+		fn, err := loadfile(L, L.CheckString(1))
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+		top := L.GetTop()
+		L.Push(fn)
+		L.Call(0, lua.MultRet)
+		return L.GetTop() - top
+	}))
+
+	// require looks for <name>.lc and <name>.lua in the file system, with
+	// dots in the module name standing for directories
+	loaders := L.GetField(L.GetGlobal("package"), "loaders").(*lua.LTable)
+	loaders.RawSetInt(2, L.NewFunction(func(L *lua.LState) int {
+		name := strings.Replace(L.CheckString(1), ".", "/", -1)
+		var messages []string
+		for _, fileName := range []string{name + ".lc", name + ".lua"} {
+			if _, err := os.Stat(e.path(fileName)); err != nil {
+				messages = append(messages, fmt.Sprintf("\n\tno file '%s'", fileName))
+				continue
+			}
+			fn, err := loadfile(L, fileName)
+			if err != nil {
+				L.RaiseError("%s", err)
+			}
+			L.Push(fn)
+			return 1
+		}
+		L.Push(lua.LString(strings.Join(messages, "")))
+		return 1
+	}))
+}
+
+type timerList []*timer
+
+func (e *Emulator) removeTimer(t *timer) {
+	for i, other := range e.timers {
+		if other == t {
+			e.timers = append(e.timers[:i], e.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextTimer returns the running timer due first, the oldest one on ties
+func (e *Emulator) nextTimer() *timer {
+	var running timerList
+	for _, t := range e.timers {
+		if t.running {
+			running = append(running, t)
+		}
+	}
+	if len(running) == 0 {
+		return nil
+	}
+	sort.SliceStable(running, func(i, j int) bool {
+		if running[i].due != running[j].due {
+			return running[i].due < running[j].due
+		}
+		return running[i].sequence < running[j].sequence
+	})
+	return running[0]
+}
+
+// console writes the output of the device and checks each line against the
+// fail patterns
+type console struct {
+	e    *Emulator
+	line []byte
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	c.e.config.Output.Write(p)
+	for _, b := range p {
+		if b == '\n' {
+			c.check(string(c.line))
+			c.line = c.line[:0]
+			continue
+		}
+		c.line = append(c.line, b)
+	}
+	return len(p), nil
+}
+
+func (c *console) writeLine(st string) {
+	c.Write([]byte(st + "\n"))
+}
+
+func (c *console) flush() {
+	if len(c.line) > 0 {
+		c.check(string(c.line))
+		c.line = c.line[:0]
+	}
+}
+
+func (c *console) check(line string) {
+	for _, p := range c.e.config.FailPatterns {
+		if p.MatchString(line) {
+			c.e.Failures = append(c.e.Failures, line)
+			return
+		}
+	}
+}
@@ -0,0 +1,593 @@
+package emulator_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"espore/builder"
+	"espore/builder/image"
+	"espore/builder/signing"
+	"espore/builder/spiffs"
+	"espore/emulator"
+	"espore/initializer"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// writeImage writes a version 1 device image holding the given files
+func writeImage(t *ut.DefaultTestTools, files map[string]string) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Version: 1 -- ESPore Device Image File\nDevice Id: 1\nDevice Name: test\nTotal files: %d\n\n", len(names))
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\n%d\n%s", name, len(files[name]), files[name])
+	}
+	f, err := ioutil.TempFile("", "espore-test-*.img")
+	t.Ok(err)
+	defer f.Close()
+	_, err = f.Write(buf.Bytes())
+	t.Ok(err)
+	return f.Name()
+}
+
+// writeImageV2 writes a version 2 image for the given device, letting
+// corrupt alter the encoded bytes before they are written
+func writeImageV2(t *ut.DefaultTestTools, deviceID string, files map[string]string, corrupt func([]byte)) string {
+	img := &image.Image{Version: image.Version2, DeviceID: deviceID, DeviceName: "test"}
+	for name, content := range files {
+		img.Files = append(img.Files, &image.File{Path: name, Data: []byte(content)})
+	}
+	sort.Slice(img.Files, func(i, j int) bool { return img.Files[i].Path < img.Files[j].Path })
+	data, err := img.Bytes()
+	t.Ok(err)
+	if corrupt != nil {
+		corrupt(data)
+	}
+	return writeImageBytes(t, data)
+}
+
+func writeImageBytes(t *ut.DefaultTestTools, data []byte) string {
+	f, err := ioutil.TempFile("", "espore-test-*.img")
+	t.Ok(err)
+	defer f.Close()
+	_, err = f.Write(data)
+	t.Ok(err)
+	return f.Name()
+}
+
+func TestBoot(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	img := writeImage(t, map[string]string{
+		"main.lua": `local util = require("lib.util")
+return function()
+    local f = file.open("state.json", "w")
+    f:write(sjson.encode({greeting = util.greet("main"), n = 2}))
+    f:close()
+    tmr.create():alarm(500, tmr.ALARM_SINGLE, function() print("timer at " .. tmr.time()) end)
+end`,
+		"lib/util.lua":   `return {greet = function(name) return "hello " .. name end}`,
+		"datafiles.json": `[]`,
+	})
+	defer os.Remove(img)
+
+	var out bytes.Buffer
+	e, err := emulator.New(&emulator.Config{Image: img, ChipID: 42, Output: &out})
+	t.Ok(err)
+	defer e.Close()
+
+	t.Ok(e.Run(20 * time.Second))
+	t.Equals(1, e.Restarts)
+	t.Equals(0, len(e.Failures))
+	t.Equals(20*time.Second, e.Now())
+	t.Assert(strings.Contains(out.String(), "Starting new firmware for the first time"), "Expected the firmware to start:\n%s", out.String())
+	t.Assert(strings.Contains(out.String(), "timer at 11"), "Expected the timer to fire on virtual time:\n%s", out.String())
+
+	state, err := e.ReadFile("state.json")
+	t.Ok(err)
+	t.Equals(`{"greeting":"hello main","n":2}`, string(state))
+	_, err = os.Stat(filepath.Join(e.Dir(), "update.img.fail"))
+	t.Ok(err)
+}
+
+func TestMissingModule(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	img := writeImage(t, map[string]string{
+		"main.lua": `local missing = require("missing")
+return function() end`,
+	})
+	defer os.Remove(img)
+
+	e, err := emulator.New(&emulator.Config{Image: img, Output: ioutil.Discard})
+	t.Ok(err)
+	defer e.Close()
+
+	t.Ok(e.Run(20 * time.Second))
+	t.Equals(1, len(e.Failures))
+	t.Assert(strings.HasPrefix(e.Failures[0], "Error loading main module"), "Unexpected failure %q", e.Failures[0])
+}
+
+func TestLFS(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	img := writeImage(t, map[string]string{
+		"lfs.img":  "LFS",
+		"main.lua": `return function() print(require("net.greet")) end`,
+	})
+	defer os.Remove(img)
+
+	var out bytes.Buffer
+	e, err := emulator.New(&emulator.Config{
+		Image:  img,
+		Output: &out,
+		LFS: map[string][]byte{
+			"__lfsinit": []byte(builder.LFSEmbeddedFiles["__lfsinit.lua"]),
+			"net,greet": []byte(`return "hello from LFS"`),
+		},
+	})
+	t.Ok(err)
+	defer e.Close()
+
+	t.Ok(e.Run(20 * time.Second))
+	t.Equals(1, e.Restarts)
+	t.Equals(0, len(e.Failures))
+	t.Assert(strings.Contains(out.String(), "LFS initialized\nhello from LFS\n"), "Expected main to load its module from LFS:\n%s", out.String())
+}
+
+func TestSPIFFSImage(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	fs, err := spiffs.Write(spiffs.Config{}, 64*1024, []*spiffs.File{
+		{Name: "init.lua", Data: []byte(initializer.InitLua)},
+		{Name: "lfs.img", Data: []byte("LFS")},
+		{Name: "main.lua", Data: []byte(`return function() print(require("net.greet")) end`)},
+		{Name: "datafiles.json", Data: []byte(`[]`)},
+	})
+	t.Ok(err)
+	files, err := spiffs.Read(spiffs.Config{}, fs)
+	t.Ok(err)
+
+	var out bytes.Buffer
+	e, err := emulator.New(&emulator.Config{
+		SkipInit: true,
+		Output:   &out,
+		LFS: map[string][]byte{
+			"__lfsinit": []byte(builder.LFSEmbeddedFiles["__lfsinit.lua"]),
+			"net,greet": []byte(`return "hello from LFS"`),
+		},
+	})
+	t.Ok(err)
+	defer e.Close()
+	for _, f := range files {
+		t.Ok(e.WriteFile(f.Name, f.Data))
+	}
+
+	t.Ok(e.Run(20 * time.Second))
+	t.Equals(1, e.Restarts)
+	t.Equals(0, len(e.Failures))
+	t.Assert(strings.Contains(out.String(), "Found LFS image. Flashing ..."), "Expected LFS to be flashed on first boot:\n%s", out.String())
+	t.Assert(strings.Contains(out.String(), "LFS initialized\nhello from LFS\n"), "Expected main to load its module from LFS:\n%s", out.String())
+}
+
+func TestBootLoop(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	e, err := emulator.New(&emulator.Config{
+		InitLua: `tmr.create():alarm(100, tmr.ALARM_SINGLE, function() error("boom") end)`,
+		Output:  ioutil.Discard,
+	})
+	t.Ok(err)
+	defer e.Close()
+
+	err = e.Run(time.Minute)
+	_, ok := err.(*emulator.BootLoopError)
+	t.Assert(ok, "Expected a boot loop error, got %v", err)
+	t.Equals(emulator.DefaultMaxRestarts+1, len(e.Failures))
+	t.Assert(strings.Contains(e.Failures[0], "boom"), "Unexpected failure %q", e.Failures[0])
+}
+
+func TestRestartWindow(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	// a firmware that restarts on purpose every 25 seconds is not in a boot
+	// loop, however long it runs
+	e, err := emulator.New(&emulator.Config{
+		InitLua: `tmr.create():alarm(25000, tmr.ALARM_SINGLE, function() node.restart() end)`,
+		Output:  ioutil.Discard,
+	})
+	t.Ok(err)
+	defer e.Close()
+
+	t.Ok(e.Run(2 * time.Minute))
+	for i := 0; i < 5; i++ {
+		t.Ok(e.Run(30 * time.Second))
+	}
+	t.Equals(10, e.Restarts)
+
+	// with a wider window, the same restarts are a boot loop
+	e, err = emulator.New(&emulator.Config{
+		InitLua:        `tmr.create():alarm(25000, tmr.ALARM_SINGLE, function() node.restart() end)`,
+		Output:         ioutil.Discard,
+		BootLoopWindow: 2 * time.Minute,
+	})
+	t.Ok(err)
+	defer e.Close()
+	err = e.Run(2 * time.Minute)
+	loop, ok := err.(*emulator.BootLoopError)
+	t.Assert(ok, "Expected a boot loop error, got %v", err)
+	t.Equals(emulator.DefaultMaxRestarts+1, loop.Restarts)
+	t.Equals(75*time.Second, loop.Elapsed)
+}
+
+func TestImageV2(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	img := writeImageV2(t, "42", map[string]string{
+		"main.lua":       `return function() print("v2 main") end`,
+		"datafiles.json": `[]`,
+	}, nil)
+	defer os.Remove(img)
+
+	var out bytes.Buffer
+	e, err := emulator.New(&emulator.Config{Image: img, ChipID: 42, Output: &out})
+	t.Ok(err)
+	defer e.Close()
+
+	t.Ok(e.Run(20 * time.Second))
+	t.Equals(1, e.Restarts)
+	t.Equals(0, len(e.Failures))
+	t.Assert(strings.Contains(out.String(), "v2 main\n"), "Expected the v2 image to run:\n%s", out.String())
+}
+
+func TestRejectInvalidImage(tx *testing.T) {
+	files := map[string]string{
+		"main.lua":       `return function() print("new main") end`,
+		"datafiles.json": `[]`,
+	}
+	tests := []struct {
+		name     string
+		deviceID string
+		corrupt  func([]byte)
+		reason   string
+	}{
+		{"corrupt file", "42", func(data []byte) {
+			i := bytes.Index(data, []byte("new main"))
+			data[i] = 'N'
+		}, "Hash mismatch in main.lua"},
+		{"corrupt trailer", "42", func(data []byte) {
+			data[len(data)-2] ^= 1
+		}, "Image hash mismatch"},
+		{"wrong device", "43", nil, "Image is for device 43"},
+	}
+	for _, test := range tests {
+		tx.Run(test.name, func(tx *testing.T) {
+			t := ut.BeginTest(tx, false)
+			defer t.FinishTest()
+
+			img := writeImageV2(t, test.deviceID, files, test.corrupt)
+			defer os.Remove(img)
+
+			var out bytes.Buffer
+			e, err := emulator.New(&emulator.Config{Image: img, ChipID: 42, Output: &out})
+			t.Ok(err)
+			defer e.Close()
+			t.Ok(e.WriteFile("main.lua", []byte(`return function() print("old main") end`)))
+
+			t.Ok(e.Run(20 * time.Second))
+			t.Equals(0, e.Restarts)
+			t.Equals(1, len(e.Failures))
+			t.Equals("[ ERROR ] (boot) Rejected update.img: "+test.reason, e.Failures[0])
+			t.Assert(strings.Contains(out.String(), "old main\n"), "Expected the previous firmware to keep running:\n%s", out.String())
+			_, err = os.Stat(filepath.Join(e.Dir(), "update.img"))
+			t.Assert(os.IsNotExist(err), "Expected the rejected image to be removed")
+		})
+	}
+}
+
+func TestSignedImage(tx *testing.T) {
+	deviceKeys := `{"k1":"old key","k2":"new key"}`
+	sign := func(keyID, key string) func(*image.Image) ([]byte, error) {
+		return func(img *image.Image) ([]byte, error) {
+			img.KeyID = keyID
+			return img.Sign([]byte(key))
+		}
+	}
+	tests := []struct {
+		name   string
+		encode func(*image.Image) ([]byte, error)
+		reason string
+	}{
+		{"current key", sign("k2", "new key"), ""},
+		{"previous key", sign("k1", "old key"), ""},
+		{"unsigned", (*image.Image).Bytes, "Image is not signed"},
+		{"unknown key", sign("k3", "new key"), "Image is signed with unknown key k3"},
+		{"wrong key", sign("k2", "old key"), "Signature mismatch for key k2"},
+	}
+	for _, test := range tests {
+		tx.Run(test.name, func(tx *testing.T) {
+			t := ut.BeginTest(tx, false)
+			defer t.FinishTest()
+
+			data, err := test.encode(&image.Image{
+				DeviceID: "DEFAULT",
+				Files: []*image.File{
+					{Path: "datafiles.json", Data: []byte(`[]`)},
+					{Path: "main.lua", Data: []byte(`return function() print("new main") end`)},
+				},
+			})
+			t.Ok(err)
+			img := writeImageBytes(t, data)
+			defer os.Remove(img)
+
+			var out bytes.Buffer
+			e, err := emulator.New(&emulator.Config{Image: img, Output: &out})
+			t.Ok(err)
+			defer e.Close()
+			t.Ok(e.WriteFile("boot.keys", []byte(deviceKeys)))
+			t.Ok(e.WriteFile("main.lua", []byte(`return function() print("old main") end`)))
+
+			t.Ok(e.Run(20 * time.Second))
+			if test.reason == "" {
+				t.Equals(0, len(e.Failures))
+				t.Assert(strings.Contains(out.String(), "new main\n"), "Expected the signed image to run:\n%s", out.String())
+			} else {
+				t.Equals([]string{"[ ERROR ] (boot) Rejected update.img: " + test.reason}, e.Failures)
+				t.Assert(strings.Contains(out.String(), "old main\n"), "Expected the previous firmware to keep running:\n%s", out.String())
+			}
+			keys, err := e.ReadFile("boot.keys")
+			t.Ok(err)
+			t.Equals(deviceKeys, string(keys))
+		})
+	}
+}
+
+func TestKeyRotation(tx *testing.T) {
+	k1 := map[string]string{"k1": "key one"}
+	k1k2 := map[string]string{"k1": "key one", "k2": "key two"}
+	k2 := map[string]string{"k2": "key two"}
+	tests := []struct {
+		name       string
+		deviceKeys map[string]string
+		// keyring and current key the image is built with
+		keyring  map[string]string
+		current  string
+		corrupt  bool
+		expected map[string]string
+		failures []string
+	}{
+		{"install pending key", k1, k1k2, "k1", false, k1k2, nil},
+		{"retire old key", k1k2, k2, "k2", false, k2, nil},
+		{"not provisioned", nil, k1, "k1", false, nil, nil},
+		{"corrupt keys", k1, k1k2, "k1", true, k1, []string{
+			"[ ERROR ] (boot) Keeping the current signing keys: Cannot decrypt boot.keys.new",
+		}},
+	}
+	for _, test := range tests {
+		tx.Run(test.name, func(tx *testing.T) {
+			t := ut.BeginTest(tx, false)
+			defer t.FinishTest()
+
+			keyring := signing.New(test.keyring)
+			t.Ok(keyring.Activate(test.current))
+			update, err := keyring.DeviceKeysUpdate()
+			t.Ok(err)
+			if test.corrupt {
+				update[len(update)-1] ^= 1
+			}
+			img := &image.Image{DeviceID: "DEFAULT", KeyID: test.current, Files: []*image.File{
+				{Path: "boot.keys.new", Data: update},
+				{Path: "datafiles.json", Data: []byte(`[]`)},
+				{Path: "main.lua", Data: []byte(`return function() print("new main") end`)},
+			}}
+			key, _ := keyring.Key(test.current)
+			data, err := img.Sign(key)
+			t.Ok(err)
+			path := writeImageBytes(t, data)
+			defer os.Remove(path)
+
+			var out bytes.Buffer
+			e, err := emulator.New(&emulator.Config{Image: path, Output: &out})
+			t.Ok(err)
+			defer e.Close()
+			if test.deviceKeys != nil {
+				keys, err := json.Marshal(test.deviceKeys)
+				t.Ok(err)
+				t.Ok(e.WriteFile("boot.keys", keys))
+			}
+
+			t.Ok(e.Run(20 * time.Second))
+			t.Equals(test.failures, e.Failures)
+			t.Assert(strings.Contains(out.String(), "new main\n"), "Expected the image to run:\n%s", out.String())
+			var keys map[string]string
+			if data, err := e.ReadFile("boot.keys"); err == nil {
+				t.Ok(json.Unmarshal(data, &keys))
+			}
+			t.Equals(test.expected, keys)
+			_, err = e.ReadFile("boot.keys.new")
+			t.Assert(err != nil, "Expected boot.keys.new to be removed")
+		})
+	}
+}
+
+func TestRollback(tx *testing.T) {
+	previous, err := (&image.Image{
+		DeviceID: "DEFAULT",
+		Files: []*image.File{
+			{Path: "datafiles.json", Data: []byte(`[]`)},
+			{Path: "main.lua", Data: []byte(`return function() print("old main") end`)},
+		},
+	}).Bytes()
+	if err != nil {
+		tx.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		old      []byte
+		expected string
+		failures []string
+	}{
+		// update.old predates the signing keys, it is restored all the same
+		{"unsigned previous version", previous, "old main\n", []string{
+			"[ ERROR ] (boot) Update failed to be accepted. Rolling back to previous version",
+		}},
+		{"corrupt previous version", []byte("garbage"), "new main\n", []string{
+			"[ ERROR ] (boot) Update failed to be accepted. Rolling back to previous version",
+			"[ ERROR ] (boot) Error restoring previous version: Unsupported image format version. Running the current firmware",
+		}},
+	}
+	for _, test := range tests {
+		tx.Run(test.name, func(tx *testing.T) {
+			t := ut.BeginTest(tx, false)
+			defer t.FinishTest()
+
+			var out bytes.Buffer
+			e, err := emulator.New(&emulator.Config{Output: &out})
+			t.Ok(err)
+			defer e.Close()
+			t.Ok(e.WriteFile("boot.keys", []byte(`{"k1":"key"}`)))
+			t.Ok(e.WriteFile("update.old", test.old))
+			t.Ok(e.WriteFile("update.img.fail", []byte("not accepted")))
+			t.Ok(e.WriteFile("main.lua", []byte(`return function() print("new main") end`)))
+
+			t.Ok(e.Run(20 * time.Second))
+			t.Equals(test.failures, e.Failures)
+			t.Assert(strings.HasSuffix(out.String(), test.expected), "Expected %q to run:\n%s", test.expected, out.String())
+		})
+	}
+}
+
+func TestDeltaImage(tx *testing.T) {
+	encode := func(t *ut.DefaultTestTools, files map[string]string, compress bool) []byte {
+		img := &image.Image{DeviceID: "DEFAULT", KeyID: "k1"}
+		for _, name := range []string{"main.lua", "lib/a.lua", "lib/b.lua", "lib/c.lua", "datafiles.json"} {
+			if content, ok := files[name]; ok {
+				img.Files = append(img.Files, &image.File{Path: name, Data: []byte(content)})
+			}
+		}
+		if compress {
+			img.Compress()
+		}
+		data, err := img.Sign([]byte("key"))
+		t.Ok(err)
+		return data
+	}
+	baseFiles := map[string]string{
+		"main.lua":       `return function() print(require("lib.a") .. require("lib.b")) end`,
+		"lib/a.lua":      `return "a1"` + strings.Repeat("\n-- padding to make it worth compressing", 50),
+		"lib/b.lua":      `return "b1"`,
+		"datafiles.json": `[]`,
+	}
+	targetFiles := map[string]string{
+		"main.lua":       `return function() print(require("lib.a") .. require("lib.c")) end`,
+		"lib/a.lua":      `return "a1"` + strings.Repeat("\n-- padding to make it worth compressing", 50),
+		"lib/c.lua":      `return "c2"` + strings.Repeat("\n-- more padding", 100),
+		"datafiles.json": `[]`,
+	}
+	tests := []struct {
+		name     string
+		base     map[string]string
+		compress bool
+		reason   string
+	}{
+		{"applied", baseFiles, false, ""},
+		{"applied compressed", baseFiles, true, ""},
+		{"other base", targetFiles, false, "Delta does not apply to the current firmware"},
+	}
+	for _, test := range tests {
+		tx.Run(test.name, func(tx *testing.T) {
+			t := ut.BeginTest(tx, false)
+			defer t.FinishTest()
+
+			base := encode(t, baseFiles, test.compress)
+			target := encode(t, targetFiles, test.compress)
+			delta, err := image.MakeDelta(base, target)
+			t.Ok(err)
+			delta.KeyID = "k1"
+			deltaData, err := delta.Sign([]byte("key"))
+			t.Ok(err)
+			img := writeImageBytes(t, deltaData)
+			defer os.Remove(img)
+
+			var out bytes.Buffer
+			e, err := emulator.New(&emulator.Config{Image: img, Output: &out})
+			t.Ok(err)
+			defer e.Close()
+			t.Ok(e.WriteFile("boot.keys", []byte(`{"k1":"key"}`)))
+			current := encode(t, test.base, test.compress)
+			t.Ok(e.WriteFile("update.old", current))
+			t.Ok(e.WriteFile("main.lua", []byte(test.base["main.lua"])))
+			for _, name := range []string{"lib/a.lua", "lib/b.lua", "lib/c.lua"} {
+				if content, ok := test.base[name]; ok {
+					t.Ok(e.WriteFile(name, []byte(content)))
+				}
+			}
+
+			t.Ok(e.Run(20 * time.Second))
+			if test.reason == "" {
+				t.Equals(0, len(e.Failures))
+				t.Assert(strings.Contains(out.String(), "a1c2\n"), "Expected the rebuilt image to run:\n%s", out.String())
+				unpacked, err := e.ReadFile("update.img.fail")
+				t.Ok(err)
+				t.Equals(string(target), string(unpacked))
+				_, err = e.ReadFile("lib/b.lua")
+				t.Assert(err != nil, "Expected lib/b.lua to be deleted")
+			} else {
+				t.Equals([]string{"[ ERROR ] (boot) Rejected update.img: " + test.reason}, e.Failures)
+				reason, err := e.ReadFile("delta.fail")
+				t.Ok(err)
+				t.Equals(test.reason, string(reason))
+				old, err := e.ReadFile("update.old")
+				t.Ok(err)
+				t.Equals(string(current), string(old))
+			}
+		})
+	}
+}
+
+func TestCompressedImage(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	data := strings.Repeat("abcabcabcabc", 300) + strings.Repeat("x", 5000)
+	img := &image.Image{DeviceID: "DEFAULT", Files: []*image.File{
+		{Path: "main.lua", Data: []byte(`return function() print("compressed main") end` + strings.Repeat("\n--", 100))},
+		{Path: "data.txt", Data: []byte(data)},
+		{Path: "datafiles.json", Data: []byte(`[]`)},
+	}}
+	t.Assert(img.Compress() > 0, "Expected compression to save space")
+	encoded, err := img.Bytes()
+	t.Ok(err)
+	path := writeImageBytes(t, encoded)
+	defer os.Remove(path)
+
+	var out bytes.Buffer
+	e, err := emulator.New(&emulator.Config{Image: path, Output: &out})
+	t.Ok(err)
+	defer e.Close()
+
+	t.Ok(e.Run(20 * time.Second))
+	t.Equals(0, len(e.Failures))
+	t.Assert(strings.Contains(out.String(), "compressed main\n"), "Expected the compressed image to run:\n%s", out.String())
+	unpacked, err := e.ReadFile("data.txt")
+	t.Ok(err)
+	t.Equals(data, string(unpacked))
+}
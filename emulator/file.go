@@ -0,0 +1,323 @@
+package emulator
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const fileTypeName = "file.obj"
+
+// fileChunk is the most a single read returns, as in NodeMCU
+const fileChunk = 1024
+
+// fsSize is the size reported for the emulated SPIFFS partition
+const fsSize = 3 * 1024 * 1024
+
+type fileObj struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+func (fo *fileObj) read(n int, delimiter int) []byte {
+	var data []byte
+	for len(data) < n {
+		b, err := fo.r.ReadByte()
+		if err != nil {
+			break
+		}
+		data = append(data, b)
+		if int(b) == delimiter {
+			break
+		}
+	}
+	return data
+}
+
+func (fo *fileObj) write(data string) bool {
+	// discard read-ahead so the write lands at the logical position
+	if fo.r.Buffered() > 0 {
+		if _, err := fo.f.Seek(int64(-fo.r.Buffered()), io.SeekCurrent); err != nil {
+			return false
+		}
+		fo.r.Reset(fo.f)
+	}
+	_, err := fo.f.WriteString(data)
+	return err == nil
+}
+
+func (fo *fileObj) seek(whence string, offset int64) (int64, bool) {
+	w := io.SeekCurrent
+	switch whence {
+	case "set":
+		w = io.SeekStart
+	case "end":
+		w = io.SeekEnd
+	case "cur":
+		offset -= int64(fo.r.Buffered())
+	default:
+		return 0, false
+	}
+	pos, err := fo.f.Seek(offset, w)
+	if err != nil {
+		return 0, false
+	}
+	fo.r.Reset(fo.f)
+	return pos, true
+}
+
+func (e *Emulator) openFile() {
+	L := e.L
+	var current *fileObj
+
+	open := func(name, mode string) *fileObj {
+		flags := map[string]int{
+			"r":  os.O_RDONLY,
+			"w":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+			"a":  os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+			"r+": os.O_RDWR,
+			"w+": os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+			"a+": os.O_RDWR | os.O_CREATE | os.O_APPEND,
+		}
+		flag, ok := flags[strings.TrimSuffix(mode, "b")]
+		if !ok {
+			L.ArgError(2, "invalid open mode")
+		}
+		path := e.path(name)
+		if flag&os.O_CREATE != 0 {
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return nil
+			}
+		}
+		f, err := os.OpenFile(path, flag, 0666)
+		if err != nil {
+			return nil
+		}
+		e.files = append(e.files, f)
+		return &fileObj{f: f, r: bufio.NewReader(f)}
+	}
+
+	// the methods work on the object given as first argument, the functions
+	// of the same name in the module on the file opened last
+	type fileFunc func(L *lua.LState, fo *fileObj, arg int) int
+	ops := map[string]fileFunc{
+		"read": func(L *lua.LState, fo *fileObj, arg int) int {
+			n, delimiter := fileChunk, -1
+			switch v := L.Get(arg).(type) {
+			case lua.LNumber:
+				n = int(v)
+				if n > fileChunk {
+					n = fileChunk
+				}
+			case lua.LString:
+				if len(v) > 0 {
+					delimiter = int(v[0])
+				}
+			}
+			data := fo.read(n, delimiter)
+			if len(data) == 0 {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(lua.LString(data))
+			}
+			return 1
+		},
+		"readline": func(L *lua.LState, fo *fileObj, arg int) int {
+			data := fo.read(fileChunk, '\n')
+			if len(data) == 0 {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(lua.LString(data))
+			}
+			return 1
+		},
+		"write": func(L *lua.LState, fo *fileObj, arg int) int {
+			if fo.write(L.CheckString(arg)) {
+				L.Push(lua.LTrue)
+			} else {
+				L.Push(lua.LNil)
+			}
+			return 1
+		},
+		"writeline": func(L *lua.LState, fo *fileObj, arg int) int {
+			if fo.write(L.CheckString(arg) + "\n") {
+				L.Push(lua.LTrue)
+			} else {
+				L.Push(lua.LNil)
+			}
+			return 1
+		},
+		"seek": func(L *lua.LState, fo *fileObj, arg int) int {
+			pos, ok := fo.seek(L.OptString(arg, "cur"), L.OptInt64(arg+1, 0))
+			if !ok {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(lua.LNumber(pos))
+			}
+			return 1
+		},
+		"flush": func(L *lua.LState, fo *fileObj, arg int) int {
+			fo.f.Sync()
+			return 0
+		},
+		"close": func(L *lua.LState, fo *fileObj, arg int) int {
+			fo.f.Close()
+			if fo == current {
+				current = nil
+			}
+			return 0
+		},
+	}
+
+	methods := make(map[string]lua.LGFunction)
+	for name, op := range ops {
+		op := op
+		methods[name] = func(L *lua.LState) int {
+			fo, ok := L.CheckUserData(1).Value.(*fileObj)
+			if !ok {
+				L.ArgError(1, "file object expected")
+			}
+			return op(L, fo, 2)
+		}
+	}
+	mt := L.NewTypeMetatable(fileTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), methods))
+
+	functions := map[string]lua.LGFunction{
+		"open": func(L *lua.LState) int {
+			fo := open(L.CheckString(1), L.OptString(2, "r"))
+			if fo == nil {
+				L.Push(lua.LNil)
+				return 1
+			}
+			current = fo
+			ud := L.NewUserData()
+			ud.Value = fo
+			L.SetMetatable(ud, mt)
+			L.Push(ud)
+			return 1
+		},
+		"exists": func(L *lua.LState) int {
+			info, err := os.Stat(e.path(L.CheckString(1)))
+			L.Push(lua.LBool(err == nil && !info.IsDir()))
+			return 1
+		},
+		"remove": func(L *lua.LState) int {
+			os.Remove(e.path(L.CheckString(1)))
+			return 0
+		},
+		"rename": func(L *lua.LState) int {
+			from, to := e.path(L.CheckString(1)), e.path(L.CheckString(2))
+			if _, err := os.Stat(to); err == nil {
+				L.Push(lua.LFalse)
+				return 1
+			}
+			if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+				L.Push(lua.LFalse)
+				return 1
+			}
+			L.Push(lua.LBool(os.Rename(from, to) == nil))
+			return 1
+		},
+		"list": func(L *lua.LState) int {
+			pattern := L.OptString(1, "")
+			list := L.NewTable()
+			names, sizes := e.listFiles()
+			for i, name := range names {
+				if pattern != "" {
+					L.Push(L.GetField(L.GetGlobal("string"), "match"))
+					L.Push(lua.LString(name))
+					L.Push(lua.LString(pattern))
+					L.Call(2, 1)
+					if L.Get(-1) == lua.LNil {
+						L.Pop(1)
+						continue
+					}
+					L.Pop(1)
+				}
+				list.RawSetString(name, lua.LNumber(sizes[i]))
+			}
+			L.Push(list)
+			return 1
+		},
+		"stat": func(L *lua.LState) int {
+			name := L.CheckString(1)
+			info, err := os.Stat(e.path(name))
+			if err != nil || info.IsDir() {
+				L.Push(lua.LNil)
+				return 1
+			}
+			st := L.NewTable()
+			st.RawSetString("name", lua.LString(name))
+			st.RawSetString("size", lua.LNumber(info.Size()))
+			L.Push(st)
+			return 1
+		},
+		"fsinfo": func(L *lua.LState) int {
+			_, sizes := e.listFiles()
+			var used int64
+			for _, size := range sizes {
+				used += size
+			}
+			L.Push(lua.LNumber(fsSize - used))
+			L.Push(lua.LNumber(used))
+			L.Push(lua.LNumber(fsSize))
+			return 3
+		},
+		"fscfg": func(L *lua.LState) int {
+			L.Push(lua.LNumber(0x40300000))
+			L.Push(lua.LNumber(fsSize))
+			return 2
+		},
+	}
+	for name, op := range ops {
+		op := op
+		functions[name] = func(L *lua.LState) int {
+			if current == nil {
+				L.Push(lua.LNil)
+				return 1
+			}
+			return op(L, current, 1)
+		}
+	}
+	L.SetGlobal("file", L.SetFuncs(L.NewTable(), functions))
+}
+
+// listFiles returns the files on the device and their sizes. SPIFFS has no
+// directories, so files in subdirectories are listed with their full path.
+func (e *Emulator) listFiles() ([]string, []int64) {
+	var names []string
+	var sizes []int64
+	filepath.Walk(e.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(e.dir, path)
+		if err != nil {
+			return nil
+		}
+		names = append(names, filepath.ToSlash(rel))
+		sizes = append(sizes, info.Size())
+		return nil
+	})
+	return names, sizes
+}
+
+// ReadFile returns the content of a file on the device
+func (e *Emulator) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(e.path(name))
+}
+
+// WriteFile stores a file on the device, as an upload would
+func (e *Emulator) WriteFile(name string, data []byte) error {
+	path := e.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0666)
+}
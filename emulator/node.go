@@ -0,0 +1,298 @@
+package emulator
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// lfsBase is the flash address reported for the LFS region
+	lfsBase = 0x40280000
+	lfsSize = 0x40000
+)
+
+// boot reasons reported by node.bootreason
+const (
+	bootPowerOn   = 0
+	bootException = 2
+	bootSoftware  = 4
+)
+
+func (e *Emulator) openNode() {
+	L := e.L
+	node := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"chipid": func(L *lua.LState) int {
+			L.Push(lua.LNumber(e.config.ChipID))
+			return 1
+		},
+		"flashid": func(L *lua.LState) int {
+			L.Push(lua.LNumber(0x1640e0))
+			return 1
+		},
+		"flashsize": func(L *lua.LState) int {
+			L.Push(lua.LNumber(4 * 1024 * 1024))
+			return 1
+		},
+		"heap": func(L *lua.LState) int {
+			L.Push(lua.LNumber(40000))
+			return 1
+		},
+		"info": func(L *lua.LState) int {
+			for _, v := range []int{3, 0, 0, int(e.config.ChipID), 0x1640e0, 4096, 0, 40000000} {
+				L.Push(lua.LNumber(v))
+			}
+			return 8
+		},
+		"bootreason": func(L *lua.LState) int {
+			raw := 1
+			if e.bootReason != bootPowerOn {
+				raw = 2
+			}
+			L.Push(lua.LNumber(raw))
+			L.Push(lua.LNumber(e.bootReason))
+			return 2
+		},
+		"restart": func(L *lua.LState) int {
+			e.requestRestart(bootSoftware, false)
+			return 0
+		},
+		"dsleep": func(L *lua.LState) int {
+			e.requestRestart(bootSoftware, false)
+			return 0
+		},
+		"random": func(L *lua.LState) int {
+			switch L.GetTop() {
+			case 0:
+				L.Push(lua.LNumber(rand.Float64()))
+			case 1:
+				L.Push(lua.LNumber(1 + rand.Intn(L.CheckInt(1))))
+			default:
+				l, u := L.CheckInt(1), L.CheckInt(2)
+				L.Push(lua.LNumber(l + rand.Intn(u-l+1)))
+			}
+			return 1
+		},
+		"setcpufreq": func(L *lua.LState) int {
+			L.Push(L.Get(1))
+			return 1
+		},
+		"getcpufreq": func(L *lua.LState) int {
+			L.Push(lua.LNumber(80))
+			return 1
+		},
+		"compile": func(L *lua.LState) int {
+			// the VM cannot run NodeMCU bytecode, so the "compiled" file
+			// keeps the source
+			name := L.CheckString(1)
+			data, err := e.ReadFile(name)
+			if err != nil {
+				L.RaiseError("cannot open %s", name)
+			}
+			if _, err := L.Load(bytesReader(data), name); err != nil {
+				L.RaiseError("%s", err)
+			}
+			if err := e.WriteFile(trimExt(name)+".lc", data); err != nil {
+				L.RaiseError("%s", err)
+			}
+			return 0
+		},
+	})
+	if e.config.LFS != nil {
+		L.SetField(node, "flashindex", L.NewFunction(e.flashindex))
+		L.SetField(node, "flashreload", L.NewFunction(func(L *lua.LState) int {
+			name := L.CheckString(1)
+			if _, err := e.ReadFile(name); err != nil {
+				L.Push(lua.LString(fmt.Sprintf("Cannot open %s", name)))
+				return 1
+			}
+			e.lfs = true
+			e.requestRestart(bootSoftware, true)
+			return 0
+		}))
+	}
+	L.SetField(node, "task", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"post": func(L *lua.LState) int {
+			fn, ok := L.Get(L.GetTop()).(*lua.LFunction)
+			if !ok {
+				L.ArgError(L.GetTop(), "function expected")
+			}
+			e.sequence++
+			e.timers = append(e.timers, &timer{
+				ud:       lua.LNil,
+				callback: fn,
+				due:      e.clock,
+				running:  true,
+				sequence: e.sequence,
+			})
+			return 0
+		},
+	}))
+	egc := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"setmode": func(L *lua.LState) int { return 0 },
+		"meminfo": func(L *lua.LState) int {
+			L.Push(lua.LNumber(0))
+			L.Push(lua.LNumber(0))
+			return 2
+		},
+	})
+	for name, v := range map[string]int{"NOT_ACTIVE": 0, "ON_ALLOC_FAILURE": 1, "ON_MEM_LIMIT": 2, "ALWAYS": 4} {
+		L.SetField(egc, name, lua.LNumber(v))
+	}
+	L.SetField(node, "egc", egc)
+	L.SetField(node, "CPU80MHZ", lua.LNumber(80))
+	L.SetField(node, "CPU160MHZ", lua.LNumber(160))
+	L.SetGlobal("node", node)
+}
+
+// flashindex returns the function of an LFS module or, if there is no such
+// module, the LFS description lfsinit uses for LFS._list and LFS._config
+func (e *Emulator) flashindex(L *lua.LState) int {
+	if !e.lfs {
+		L.Push(lua.LNil)
+		return 1
+	}
+	name := L.CheckString(1)
+	if src, ok := e.config.LFS[name]; ok {
+		fn, err := L.Load(bytesReader(src), name)
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+		L.Push(fn)
+		return 1
+	}
+	var names []string
+	for name := range e.config.LFS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := L.NewTable()
+	for _, name := range names {
+		list.Append(lua.LString(name))
+	}
+	L.Push(lua.LNumber(0))
+	L.Push(lua.LNumber(lfsBase))
+	L.Push(lua.LNumber(lfsBase))
+	L.Push(lua.LNumber(lfsSize))
+	L.Push(list)
+	return 5
+}
+
+func (e *Emulator) openUart() {
+	L := e.L
+	baud := 115200
+	uart := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"setup": func(L *lua.LState) int {
+			baud = L.CheckInt(2)
+			L.Push(lua.LNumber(baud))
+			return 1
+		},
+		"getconfig": func(L *lua.LState) int {
+			L.Push(lua.LNumber(baud))
+			L.Push(lua.LNumber(8))
+			L.Push(lua.LNumber(0))
+			L.Push(lua.LNumber(1))
+			return 4
+		},
+		"on": func(L *lua.LState) int {
+			return 0
+		},
+		"write": func(L *lua.LState) int {
+			for i := 2; i <= L.GetTop(); i++ {
+				switch v := L.Get(i).(type) {
+				case lua.LNumber:
+					e.console.Write([]byte{byte(v)})
+				default:
+					e.console.Write([]byte(L.CheckString(i)))
+				}
+			}
+			return 0
+		},
+	})
+	for name, v := range map[string]int{"PARITY_NONE": 0, "PARITY_EVEN": 1, "PARITY_ODD": 2, "STOPBITS_1": 1, "STOPBITS_1_5": 2, "STOPBITS_2": 3} {
+		L.SetField(uart, name, lua.LNumber(v))
+	}
+	L.SetGlobal("uart", uart)
+}
+
+// openWifi installs a wifi module that never connects
+func (e *Emulator) openWifi() {
+	L := e.L
+	mode := 1
+	noop := func(L *lua.LState) int { return 0 }
+	yes := func(L *lua.LState) int {
+		L.Push(lua.LTrue)
+		return 1
+	}
+	none := func(L *lua.LState) int {
+		L.Push(lua.LNil)
+		return 1
+	}
+	mac := func(L *lua.LState) int {
+		id := e.config.ChipID
+		L.Push(lua.LString(fmt.Sprintf("5c:cf:7f:%02x:%02x:%02x", byte(id>>16), byte(id>>8), byte(id))))
+		return 1
+	}
+	wifi := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"setmode": func(L *lua.LState) int {
+			mode = L.CheckInt(1)
+			L.Push(lua.LNumber(mode))
+			return 1
+		},
+		"getmode": func(L *lua.LState) int {
+			L.Push(lua.LNumber(mode))
+			return 1
+		},
+		"setphymode": func(L *lua.LState) int {
+			L.Push(L.Get(1))
+			return 1
+		},
+		"sleeptype": noop,
+	})
+	L.SetField(wifi, "sta", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"config":      yes,
+		"connect":     noop,
+		"disconnect":  noop,
+		"autoconnect": noop,
+		"sethostname": yes,
+		"gethostname": func(L *lua.LState) int {
+			L.Push(lua.LString(fmt.Sprintf("NODE-%X", e.config.ChipID)))
+			return 1
+		},
+		"getip":  none,
+		"getmac": mac,
+		"status": func(L *lua.LState) int {
+			L.Push(lua.LNumber(0))
+			return 1
+		},
+		"getrssi": none,
+	}))
+	L.SetField(wifi, "ap", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"config": yes,
+		"getip": func(L *lua.LState) int {
+			L.Push(lua.LString("192.168.4.1"))
+			L.Push(lua.LString("255.255.255.0"))
+			L.Push(lua.LString("192.168.4.1"))
+			return 3
+		},
+		"getmac": mac,
+	}))
+	eventmon := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"register":   noop,
+		"unregister": noop,
+	})
+	for i, name := range []string{"STA_CONNECTED", "STA_DISCONNECTED", "STA_AUTHMODE_CHANGE", "STA_GOT_IP", "STA_DHCP_TIMEOUT", "AP_STACONNECTED", "AP_STADISCONNECTED", "AP_PROBEREQRECVED"} {
+		L.SetField(eventmon, name, lua.LNumber(i))
+	}
+	L.SetField(wifi, "eventmon", eventmon)
+	for name, v := range map[string]int{
+		"NULLMODE": 0, "STATION": 1, "SOFTAP": 2, "STATIONAP": 3,
+		"STA_IDLE": 0, "STA_CONNECTING": 1, "STA_WRONGPWD": 2, "STA_APNOTFOUND": 3, "STA_FAIL": 4, "STA_GOTIP": 5,
+		"PHYMODE_B": 1, "PHYMODE_G": 2, "PHYMODE_N": 3,
+	} {
+		L.SetField(wifi, name, lua.LNumber(v))
+	}
+	L.SetGlobal("wifi", wifi)
+}
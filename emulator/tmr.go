@@ -0,0 +1,160 @@
+package emulator
+
+import (
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	alarmSingle = 0
+	alarmSemi   = 1
+	alarmAuto   = 2
+)
+
+const timerTypeName = "tmr.timer"
+
+type timer struct {
+	ud         lua.LValue
+	callback   *lua.LFunction
+	interval   time.Duration
+	mode       int
+	due        time.Duration
+	registered bool
+	running    bool
+	sequence   int
+}
+
+func (e *Emulator) checkTimer(L *lua.LState) *timer {
+	ud := L.CheckUserData(1)
+	t, ok := ud.Value.(*timer)
+	if !ok {
+		L.ArgError(1, "timer expected")
+	}
+	return t
+}
+
+func (e *Emulator) startTimer(t *timer) bool {
+	if !t.registered {
+		return false
+	}
+	e.sequence++
+	t.sequence = e.sequence
+	t.due = e.clock + t.interval
+	t.running = true
+	return true
+}
+
+func (e *Emulator) registerTimer(L *lua.LState, t *timer) {
+	t.interval = checkInterval(L, 2)
+	t.mode = L.CheckInt(3)
+	if t.mode < alarmSingle || t.mode > alarmAuto {
+		L.ArgError(3, "invalid mode")
+	}
+	t.callback = L.CheckFunction(4)
+	t.registered = true
+}
+
+func checkInterval(L *lua.LState, n int) time.Duration {
+	ms := L.CheckInt(n)
+	if ms <= 0 {
+		L.ArgError(n, "wrong arg range")
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (e *Emulator) openTmr() {
+	L := e.L
+	methods := map[string]lua.LGFunction{
+		"alarm": func(L *lua.LState) int {
+			t := e.checkTimer(L)
+			e.registerTimer(L, t)
+			L.Push(lua.LBool(e.startTimer(t)))
+			return 1
+		},
+		"register": func(L *lua.LState) int {
+			t := e.checkTimer(L)
+			e.registerTimer(L, t)
+			t.running = false
+			return 0
+		},
+		"start": func(L *lua.LState) int {
+			t := e.checkTimer(L)
+			if t.running {
+				L.Push(lua.LTrue)
+				return 1
+			}
+			L.Push(lua.LBool(e.startTimer(t)))
+			return 1
+		},
+		"stop": func(L *lua.LState) int {
+			t := e.checkTimer(L)
+			wasRunning := t.running
+			t.running = false
+			L.Push(lua.LBool(wasRunning))
+			return 1
+		},
+		"unregister": func(L *lua.LState) int {
+			t := e.checkTimer(L)
+			t.running = false
+			t.registered = false
+			t.callback = nil
+			return 0
+		},
+		"interval": func(L *lua.LState) int {
+			t := e.checkTimer(L)
+			t.interval = checkInterval(L, 2)
+			if t.running {
+				t.due = e.clock + t.interval
+			}
+			return 0
+		},
+		"state": func(L *lua.LState) int {
+			t := e.checkTimer(L)
+			if !t.registered {
+				L.Push(lua.LNil)
+				return 1
+			}
+			L.Push(lua.LBool(t.running))
+			L.Push(lua.LNumber(t.mode))
+			return 2
+		},
+	}
+	mt := L.NewTypeMetatable(timerTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), methods))
+
+	tmr := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"create": func(L *lua.LState) int {
+			t := &timer{}
+			ud := L.NewUserData()
+			ud.Value = t
+			L.SetMetatable(ud, mt)
+			t.ud = ud
+			e.timers = append(e.timers, t)
+			L.Push(ud)
+			return 1
+		},
+		"now": func(L *lua.LState) int {
+			L.Push(lua.LNumber(uint32(e.clock / time.Microsecond)))
+			return 1
+		},
+		"time": func(L *lua.LState) int {
+			L.Push(lua.LNumber(int64(e.clock / time.Second)))
+			return 1
+		},
+		"delay": func(L *lua.LState) int {
+			e.clock += time.Duration(L.CheckInt64(1)) * time.Microsecond
+			return 0
+		},
+		"wdclr": func(L *lua.LState) int {
+			return 0
+		},
+		"softwd": func(L *lua.LState) int {
+			return 0
+		},
+	})
+	L.SetField(tmr, "ALARM_SINGLE", lua.LNumber(alarmSingle))
+	L.SetField(tmr, "ALARM_SEMI", lua.LNumber(alarmSemi))
+	L.SetField(tmr, "ALARM_AUTO", lua.LNumber(alarmAuto))
+	L.SetGlobal("tmr", tmr)
+}
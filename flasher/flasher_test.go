@@ -0,0 +1,131 @@
+package flasher_test
+
+import (
+	"bytes"
+	"espore/flasher"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, item ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, item...))
+}
+
+func TestSLIP(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	data := []byte{1, 0xc0, 2, 0xdb, 3}
+	frame := flasher.EncodeSLIP(data)
+	t.Equals([]byte{0xc0, 1, 0xdb, 0xdc, 2, 0xdb, 0xdd, 3, 0xc0}, frame)
+
+	stream := append([]byte("boot noise"), frame...)
+	stream = append(stream, 0xc0, 0xc0, 4, 0xc0)
+	r := flasher.NewSLIPReader(bytes.NewReader(stream))
+	read, err := r.ReadFrame()
+	t.Ok(err)
+	t.Equals(data, read)
+	read, err = r.ReadFrame()
+	t.Ok(err)
+	t.Equals([]byte{4}, read)
+	_, err = r.ReadFrame()
+	t.Equals(io.EOF, err)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestFlashESP32(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	rom := flasher.NewSimulatedROM(flasher.ESP32, 4<<20)
+	rom.BootMessage = "NodeMCU booted\n"
+	defer rom.Close()
+	l, err := flasher.Connect(&flasher.Config{Port: rom})
+	t.Ok(err)
+	defer l.Close()
+	t.Equals(flasher.ESP32, l.Chip)
+
+	data := testData(5000)
+	var progress []int
+	t.Ok(l.WriteFlash(0x10000, data, func(written, total int) {
+		t.Equals(len(data), total)
+		progress = append(progress, written)
+	}))
+	t.Equals([]int{1024, 2048, 3072, 4096, 5000}, progress)
+	t.Equals(data, rom.Flash()[0x10000:0x10000+len(data)])
+	t.Equals(byte(0xff), rom.Flash()[0x10000+len(data)])
+
+	rom.Flash()[0x10000+100] ^= 1
+	err = l.Verify(0x10000, data)
+	t.Assert(err != nil, "Expected a verification error")
+	t.Assert(strings.HasPrefix(err.Error(), "Verification failed at 0x10000"), "Unexpected error: %s", err)
+
+	err = l.WriteFlash(0x10001, data, nil)
+	t.Assert(err != nil, "Expected an alignment error")
+	t.Equals("Offset 0x10001 is not a multiple of the sector size", err.Error())
+
+	t.Ok(l.Finish())
+	t.Equals(0, rom.Boots)
+	// the port is left to whoever talks to the firmware once it boots
+	l.Close()
+	t.Ok(l.HardReset())
+	t.Equals(1, rom.Boots)
+	boot, err := ioutil.ReadAll(rom)
+	t.Ok(err)
+	t.Assert(strings.HasSuffix(string(boot), "NodeMCU booted\n"), "Boot message not found in %q", boot)
+}
+
+func TestFlashESP8266(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	rom := flasher.NewSimulatedROM(flasher.ESP8266, 1<<20)
+	rom.ChipID = 1234567
+	defer rom.Close()
+	copy(rom.Flash(), bytes.Repeat([]byte{0x5a}, 0x10000))
+	log := &testLogger{}
+	l, err := flasher.Connect(&flasher.Config{Port: rom, FlashSize: 1 << 20, Log: log})
+	t.Ok(err)
+	t.Equals(flasher.ESP8266, l.Chip)
+
+	id, err := l.ChipID()
+	t.Ok(err)
+	t.Equals("1234567", id)
+
+	// the ROM cannot verify writes, so they must be allowed explicitly
+	data := testData(3000)
+	err = l.WriteFlash(0, data, nil)
+	t.Assert(err != nil, "Expected unverified writes to be refused")
+	t.Equals("Cannot verify writes on the ESP8266: the ROM bootloader cannot compute MD5 checksums. allow unverified writes to flash it anyway", err.Error())
+	t.Equals(bytes.Repeat([]byte{0x5a}, len(data)), rom.Flash()[:len(data)])
+	l.Close()
+
+	l, err = flasher.Connect(&flasher.Config{Port: rom, FlashSize: 1 << 20, Log: log, AllowUnverified: true})
+	t.Ok(err)
+	defer l.Close()
+
+	// writes over previous contents, so the region must be erased first
+	t.Ok(l.WriteFlash(0, data, nil))
+	t.Equals(data, rom.Flash()[:len(data)])
+	t.Equals([]string{"WARNING: ESP8266 ROM cannot verify the flash, 3000 bytes at 0x0 were written unverified\n"}, log.lines)
+	t.Equals(flasher.ErrMD5Unsupported, l.Verify(0, data))
+
+	err = l.WriteFlash(0xff000, testData(5000), nil)
+	t.Assert(err != nil, "Expected a size error")
+	t.Equals("5000 bytes at 0xff000 do not fit in a 1048576 bytes flash", err.Error())
+}
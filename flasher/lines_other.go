@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package flasher
+
+import "errors"
+
+const (
+	lineDTR = iota
+	lineRTS
+)
+
+// modemLines cannot drive the control lines on this platform. Use
+// Config.NoReset and put the chip into the bootloader by hand.
+type modemLines struct{}
+
+func openModemLines(name string) (*modemLines, error) {
+	return &modemLines{}, nil
+}
+
+func (m *modemLines) set(line int, on bool) error {
+	return errors.New("DTR and RTS cannot be driven on this platform, put the chip in the bootloader by hand")
+}
+
+func (m *modemLines) close() {}
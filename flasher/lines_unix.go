@@ -0,0 +1,45 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package flasher
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lineDTR = syscall.TIOCM_DTR
+	lineRTS = syscall.TIOCM_RTS
+)
+
+// modemLines drives the control lines of a serial port through a second
+// descriptor, as the serial package does not expose its own
+type modemLines struct {
+	f *os.File
+}
+
+func openModemLines(name string) (*modemLines, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &modemLines{f: f}, nil
+}
+
+func (m *modemLines) set(line int, on bool) error {
+	request := syscall.TIOCMBIC
+	if on {
+		request = syscall.TIOCMBIS
+	}
+	bits := line
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, m.f.Fd(), uintptr(request), uintptr(unsafe.Pointer(&bits))); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
+
+func (m *modemLines) close() {
+	m.f.Close()
+}
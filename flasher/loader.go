@@ -0,0 +1,486 @@
+// Package flasher programs the flash of ESP8266 and ESP32 chips through the
+// serial protocol of their ROM bootloader, as esptool.py does without its
+// flasher stub: the chip is reset into the bootloader with the DTR and RTS
+// lines, synchronized with, and sent the image in blocks that it writes to
+// flash.
+package flasher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ROM bootloader commands
+const (
+	cmdFlashBegin    = 0x02
+	cmdFlashData     = 0x03
+	cmdFlashEnd      = 0x04
+	cmdSync          = 0x08
+	cmdReadReg       = 0x0a
+	cmdSPISetParams  = 0x0b
+	cmdSPIAttach     = 0x0d
+	cmdSPIFlashMD5   = 0x13
+	directionRequest = 0x00
+	directionReply   = 0x01
+)
+
+const (
+	// FlashBlockSize is the size of the blocks sent with FLASH_DATA
+	FlashBlockSize = 0x400
+	// FlashSectorSize is the erase unit of the flash
+	FlashSectorSize = 0x1000
+	// chipDetectReg holds a value that tells the chip apart
+	chipDetectReg = 0x40001000
+	checksumSeed  = 0xef
+	// statusInvalidCommand is the error the ROM replies to unknown commands
+	statusInvalidCommand = 0x05
+)
+
+// Timeouts, scaled by the size of the data where noted
+const (
+	DefaultTimeout  = 3 * time.Second
+	syncTimeout     = 100 * time.Millisecond
+	eraseTimeoutMB  = 30 * time.Second
+	md5TimeoutMB    = 8 * time.Second
+	syncAttempts    = 5
+	connectAttempts = 7
+)
+
+// ErrMD5Unsupported is returned when the ROM cannot compute the MD5 of a
+// flash region, as the one of the ESP8266
+var ErrMD5Unsupported = errors.New("the ROM bootloader cannot compute MD5 checksums")
+
+// Chip describes a chip family the flasher supports
+type Chip struct {
+	Name string
+	// magic is the value of chipDetectReg
+	magic uint32
+	// md5 tells whether the ROM supports SPI_FLASH_MD5
+	md5 bool
+	// attach tells whether the SPI flash must be attached and configured
+	// before writing
+	attach bool
+}
+
+// Supported chips
+var (
+	ESP8266 = &Chip{Name: "ESP8266", magic: 0xfff0c101}
+	ESP32   = &Chip{Name: "ESP32", magic: 0x00f01d83, md5: true, attach: true}
+)
+
+var chips = []*Chip{ESP8266, ESP32}
+
+// Port is the serial port the ROM bootloader is reached through
+type Port interface {
+	io.ReadWriter
+	// SetDTR and SetRTS drive the control lines that development boards
+	// wire to GPIO0 and EN, so the chip can be reset into the bootloader
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+}
+
+// Logger receives the progress messages of the flasher
+type Logger interface {
+	Printf(fmt string, item ...interface{})
+}
+
+// Config of a connection to the ROM bootloader
+type Config struct {
+	Port Port
+	// NoReset skips the DTR/RTS reset, for boards without it that are put
+	// into the bootloader by hand
+	NoReset bool
+	// FlashSize is configured on chips that need it. Defaults to 4MB
+	FlashSize int
+	// AllowUnverified lets WriteFlash write to chips whose ROM cannot check
+	// the MD5 of the flash, as the ESP8266. Without it, writing to them fails.
+	AllowUnverified bool
+	Log             Logger
+}
+
+// Loader is a connection to the ROM bootloader of a chip
+type Loader struct {
+	config Config
+	Chip   *Chip
+	frames chan []byte
+	errs   chan error
+	done   chan struct{}
+	// stopped is closed when nothing reads from the port anymore
+	stopped chan struct{}
+	// statusLength is the size of the status at the end of replies: 2 bytes
+	// on the ESP8266, 4 on the ESP32
+	statusLength int
+}
+
+type defaultLogger struct{}
+
+func (dl *defaultLogger) Printf(fmt string, item ...interface{}) {
+	log.Printf(fmt, item...)
+}
+
+// Connect resets the chip into its bootloader, synchronizes with it and
+// detects the chip. Close the loader before closing the port.
+func Connect(config *Config) (*Loader, error) {
+	l := &Loader{
+		config:  *config,
+		frames:  make(chan []byte, 16),
+		errs:    make(chan error, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if l.config.Log == nil {
+		l.config.Log = &defaultLogger{}
+	}
+	if l.config.FlashSize == 0 {
+		l.config.FlashSize = 4 << 20
+	}
+	go l.readFrames()
+
+	var err error
+	for attempt := 0; attempt < connectAttempts; attempt++ {
+		if !l.config.NoReset {
+			if err = l.resetIntoBootloader(); err != nil {
+				break
+			}
+		}
+		if err = l.sync(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Cannot connect to the ROM bootloader: %s", err)
+	}
+	if err := l.detectChip(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if l.Chip.attach {
+		if err := l.attachFlash(); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Close stops reading from the port, returning once the port can be read
+// by someone else, such as a session talking to the flashed firmware
+func (l *Loader) Close() {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	<-l.stopped
+}
+
+func (l *Loader) readFrames() {
+	defer close(l.stopped)
+	r := NewSLIPReader(l.config.Port)
+	for {
+		frame, err := r.ReadFrame()
+		if err == io.EOF {
+			// serial ports report read timeouts as EOF
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+		if err != nil {
+			l.errs <- err
+			return
+		}
+		select {
+		case l.frames <- frame:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// resetIntoBootloader holds GPIO0 low while the chip comes out of reset
+func (l *Loader) resetIntoBootloader() error {
+	port := l.config.Port
+	steps := []func() error{
+		func() error { return port.SetDTR(false) }, // GPIO0 high
+		func() error { return port.SetRTS(true) },  // EN low, in reset
+		func() error { time.Sleep(100 * time.Millisecond); return nil },
+		func() error { return port.SetDTR(true) },  // GPIO0 low
+		func() error { return port.SetRTS(false) }, // EN high, out of reset
+		func() error { time.Sleep(50 * time.Millisecond); return nil },
+		func() error { return port.SetDTR(false) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HardReset restarts the chip into the flashed firmware. The loader cannot
+// be used afterwards.
+func (l *Loader) HardReset() error {
+	if err := l.config.Port.SetRTS(true); err != nil {
+		return err
+	}
+	time.Sleep(100 * time.Millisecond)
+	return l.config.Port.SetRTS(false)
+}
+
+func (l *Loader) sync() error {
+	payload := append([]byte{0x07, 0x07, 0x12, 0x20}, bytes.Repeat([]byte{0x55}, 32)...)
+	var err error
+	for i := 0; i < syncAttempts; i++ {
+		var reply *reply
+		if reply, err = l.command(cmdSync, payload, 0, syncTimeout); err == nil {
+			// the bootloader answers every sync several times, the
+			// extra replies are skipped by later commands
+			l.statusLength = len(reply.data)
+			return nil
+		}
+	}
+	return err
+}
+
+func (l *Loader) detectChip() error {
+	magic, err := l.ReadReg(chipDetectReg)
+	if err != nil {
+		return err
+	}
+	for _, chip := range chips {
+		if chip.magic == magic {
+			l.Chip = chip
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported chip, detection register is %#08x", magic)
+}
+
+func (l *Loader) attachFlash() error {
+	if _, err := l.command(cmdSPIAttach, make([]byte, 8), 0, DefaultTimeout); err != nil {
+		return err
+	}
+	// id, total size, block size, sector size, page size, status mask
+	params := []uint32{0, uint32(l.config.FlashSize), 64 * 1024, FlashSectorSize, 256, 0xffff}
+	_, err := l.command(cmdSPISetParams, words(params...), 0, DefaultTimeout)
+	return err
+}
+
+type reply struct {
+	value uint32
+	data  []byte
+}
+
+// command sends a request and waits for its reply, skipping replies to
+// other commands
+func (l *Loader) command(op byte, data []byte, checksum uint32, timeout time.Duration) (*reply, error) {
+	packet := make([]byte, 8, 8+len(data))
+	packet[0] = directionRequest
+	packet[1] = op
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(packet[4:], checksum)
+	packet = append(packet, data...)
+	if _, err := l.config.Port.Write(EncodeSLIP(packet)); err != nil {
+		return nil, err
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case frame := <-l.frames:
+			if len(frame) < 8 || frame[0] != directionReply || frame[1] != op {
+				continue
+			}
+			r := &reply{
+				value: binary.LittleEndian.Uint32(frame[4:]),
+				data:  frame[8:],
+			}
+			if size := int(binary.LittleEndian.Uint16(frame[2:])); size != len(r.data) {
+				return nil, fmt.Errorf("Invalid reply to command %#02x: %d bytes, expected %d", op, len(r.data), size)
+			}
+			if l.statusLength > 0 {
+				if len(r.data) < l.statusLength {
+					return nil, fmt.Errorf("Invalid reply to command %#02x: no status", op)
+				}
+				status := r.data[len(r.data)-l.statusLength:]
+				r.data = r.data[:len(r.data)-l.statusLength]
+				if status[0] != 0 {
+					return r, &StatusError{Command: op, Code: status[1]}
+				}
+			}
+			return r, nil
+		case err := <-l.errs:
+			l.errs <- err
+			return nil, err
+		case <-deadline.C:
+			return nil, fmt.Errorf("Timeout waiting for the reply to command %#02x", op)
+		}
+	}
+}
+
+// StatusError is a failure reported by the ROM bootloader
+type StatusError struct {
+	Command byte
+	Code    byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Command %#02x failed with error %#02x", e.Command, e.Code)
+}
+
+// ReadReg reads a 32 bit register of the chip
+func (l *Loader) ReadReg(address uint32) (uint32, error) {
+	r, err := l.command(cmdReadReg, words(address), 0, DefaultTimeout)
+	if err != nil {
+		return 0, err
+	}
+	return r.value, nil
+}
+
+// ChipID returns the id NodeMCU reports with node.chipid(), which the build
+// names device images after. Only the ESP8266 is supported.
+func (l *Loader) ChipID() (string, error) {
+	if l.Chip != ESP8266 {
+		return "", fmt.Errorf("Cannot read the chip id of an %s", l.Chip.Name)
+	}
+	mac0, err := l.ReadReg(0x3ff00050)
+	if err != nil {
+		return "", err
+	}
+	mac1, err := l.ReadReg(0x3ff00054)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d", mac0>>24|(mac1&0xffffff)<<8), nil
+}
+
+// WriteFlash erases the region at offset and writes data to it, then checks
+// the MD5 of the region. When the ROM cannot compute it, the write fails
+// before erasing anything unless Config.AllowUnverified is set. progress, if
+// not nil, is called with the bytes written so far.
+func (l *Loader) WriteFlash(offset int, data []byte, progress func(written, total int)) error {
+	if !l.Chip.md5 && !l.config.AllowUnverified {
+		return fmt.Errorf("Cannot verify writes on the %s: %s. allow unverified writes to flash it anyway", l.Chip.Name, ErrMD5Unsupported)
+	}
+	if offset%FlashSectorSize != 0 {
+		return fmt.Errorf("Offset %#x is not a multiple of the sector size", offset)
+	}
+	if offset+len(data) > l.config.FlashSize {
+		return fmt.Errorf("%d bytes at %#x do not fit in a %d bytes flash", len(data), offset, l.config.FlashSize)
+	}
+	blocks := (len(data) + FlashBlockSize - 1) / FlashBlockSize
+	eraseSize := len(data)
+	if l.Chip == ESP8266 {
+		eraseSize = esp8266EraseSize(offset, len(data))
+	}
+	begin := words(uint32(eraseSize), uint32(blocks), FlashBlockSize, uint32(offset))
+	if _, err := l.command(cmdFlashBegin, begin, 0, scaledTimeout(eraseTimeoutMB, len(data))); err != nil {
+		return fmt.Errorf("Cannot erase %d bytes at %#x: %s", len(data), offset, err)
+	}
+	for seq := 0; seq < blocks; seq++ {
+		block := bytes.Repeat([]byte{0xff}, FlashBlockSize)
+		copy(block, data[seq*FlashBlockSize:])
+		payload := append(words(uint32(len(block)), uint32(seq), 0, 0), block...)
+		if _, err := l.command(cmdFlashData, payload, checksum(block), DefaultTimeout); err != nil {
+			return fmt.Errorf("Cannot write block %d at %#x: %s", seq, offset+seq*FlashBlockSize, err)
+		}
+		if progress != nil {
+			written := (seq + 1) * FlashBlockSize
+			if written > len(data) {
+				written = len(data)
+			}
+			progress(written, len(data))
+		}
+	}
+	err := l.Verify(offset, data)
+	if err == ErrMD5Unsupported {
+		l.config.Log.Printf("WARNING: %s ROM cannot verify the flash, %d bytes at %#x were written unverified\n", l.Chip.Name, len(data), offset)
+		return nil
+	}
+	return err
+}
+
+// Verify compares the MD5 of the flash region at offset with that of data
+func (l *Loader) Verify(offset int, data []byte) error {
+	if !l.Chip.md5 {
+		return ErrMD5Unsupported
+	}
+	r, err := l.command(cmdSPIFlashMD5, words(uint32(offset), uint32(len(data)), 0, 0), 0, scaledTimeout(md5TimeoutMB, len(data)))
+	if err != nil {
+		return err
+	}
+	var actual string
+	switch len(r.data) {
+	case 32:
+		actual = string(r.data)
+	case 16:
+		actual = hex.EncodeToString(r.data)
+	default:
+		return fmt.Errorf("Invalid MD5 reply of %d bytes", len(r.data))
+	}
+	sum := md5.Sum(data)
+	if expected := hex.EncodeToString(sum[:]); actual != expected {
+		return fmt.Errorf("Verification failed at %#x: flash MD5 is %s, expected %s", offset, actual, expected)
+	}
+	return nil
+}
+
+// Finish ends the flashing session, leaving the chip in the bootloader until
+// it is reset
+func (l *Loader) Finish() error {
+	_, err := l.command(cmdFlashEnd, words(1), 0, DefaultTimeout)
+	return err
+}
+
+// esp8266EraseSize works around a bug of the ESP8266 ROM, which erases
+// more than asked when the region spans several 64KB blocks, as esptool.py
+// does
+func esp8266EraseSize(offset, size int) int {
+	const sectorsPerBlock = 16
+	sectors := (size + FlashSectorSize - 1) / FlashSectorSize
+	start := offset / FlashSectorSize
+	head := sectorsPerBlock - start%sectorsPerBlock
+	if sectors < head {
+		head = sectors
+	}
+	if sectors < 2*head {
+		return (sectors + 1) / 2 * FlashSectorSize
+	}
+	return (sectors - head) * FlashSectorSize
+}
+
+func scaledTimeout(perMB time.Duration, size int) time.Duration {
+	t := time.Duration(float64(perMB) * float64(size) / (1 << 20))
+	if t < DefaultTimeout {
+		return DefaultTimeout
+	}
+	return t
+}
+
+func checksum(data []byte) uint32 {
+	sum := byte(checksumSeed)
+	for _, b := range data {
+		sum ^= b
+	}
+	return uint32(sum)
+}
+
+func words(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], v)
+	}
+	return data
+}
@@ -0,0 +1,46 @@
+package flasher
+
+import (
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// romBaud is the speed the ROM bootloader detects on sync
+const romBaud = 115200
+
+// SerialPort is a serial port whose DTR and RTS lines can be driven
+type SerialPort struct {
+	*serial.Port
+	lines *modemLines
+}
+
+// OpenSerial opens a serial port to talk to the ROM bootloader
+func OpenSerial(name string) (*SerialPort, error) {
+	port, err := serial.OpenPort(&serial.Config{Name: name, Baud: romBaud, ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		return nil, err
+	}
+	lines, err := openModemLines(name)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	return &SerialPort{Port: port, lines: lines}, nil
+}
+
+// SetDTR sets the DTR line
+func (p *SerialPort) SetDTR(on bool) error {
+	return p.lines.set(lineDTR, on)
+}
+
+// SetRTS sets the RTS line
+func (p *SerialPort) SetRTS(on bool) error {
+	return p.lines.set(lineRTS, on)
+}
+
+// Close closes the port
+func (p *SerialPort) Close() error {
+	p.lines.close()
+	return p.Port.Close()
+}
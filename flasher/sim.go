@@ -0,0 +1,269 @@
+package flasher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// romBootMessage is what the chip prints when it starts the bootloader, at a
+// baud rate that makes it garbage on the port
+const romBootMessage = "\x00\xe0\xfc ets Jan  8 2013,rst cause:2, boot mode:(1,7)\r\n"
+
+// simReadTimeout is how long reads wait for data before returning EOF, like
+// the read timeout of a serial port
+const simReadTimeout = 10 * time.Millisecond
+
+const (
+	simOff = iota
+	simBootloader
+	simFirmware
+)
+
+// SimulatedROM is a chip with its ROM bootloader and flash, to test
+// flashing without hardware. It is the Port the flasher talks to: DTR and RTS
+// are wired to GPIO0 and EN, so bringing the chip out of reset with GPIO0 low
+// starts the bootloader and doing it with GPIO0 high boots the firmware.
+type SimulatedROM struct {
+	Chip *Chip
+	// ChipID is what the ESP8266 efuse registers report
+	ChipID uint32
+	// BootMessage is written to the port when the firmware boots
+	BootMessage string
+	// Boots counts the times the firmware booted
+	Boots int
+
+	mu      sync.Mutex
+	flash   []byte
+	out     bytes.Buffer
+	in      bytes.Buffer
+	reader  *SLIPReader
+	dtr     bool
+	rts     bool
+	mode    int
+	closed  bool
+	writing bool
+	offset  int
+	blocks  int
+	block   int
+	seq     int
+}
+
+// NewSimulatedROM returns a chip with an erased flash of the given size
+func NewSimulatedROM(chip *Chip, flashSize int) *SimulatedROM {
+	s := &SimulatedROM{
+		Chip:  chip,
+		flash: bytes.Repeat([]byte{0xff}, flashSize),
+	}
+	s.reader = NewSLIPReader(&s.in)
+	return s
+}
+
+// Flash returns the contents of the flash. Changing them simulates a
+// corruption.
+func (s *SimulatedROM) Flash() []byte {
+	return s.flash
+}
+
+// Read returns what the chip writes to the port. Like a serial port, it
+// returns EOF when nothing arrives for a while.
+func (s *SimulatedROM) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(simReadTimeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.out.Len() == 0 {
+		if s.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if time.Now().After(deadline) {
+			return 0, io.EOF
+		}
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		s.mu.Lock()
+	}
+	return s.out.Read(p)
+}
+
+// Write sends data to the chip. Only the bootloader answers.
+func (s *SimulatedROM) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.mode != simBootloader {
+		return len(p), nil
+	}
+	s.in.Write(p)
+	for {
+		frame, err := s.reader.ReadFrame()
+		if err != nil {
+			break
+		}
+		s.handle(frame)
+	}
+	return len(p), nil
+}
+
+// Close makes pending and later reads fail
+func (s *SimulatedROM) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// SetDTR drives GPIO0, low while DTR is on
+func (s *SimulatedROM) SetDTR(on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dtr = on
+	return nil
+}
+
+// SetRTS drives EN, holding the chip in reset while RTS is on
+func (s *SimulatedROM) SetRTS(on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if on {
+		s.mode = simOff
+	} else if s.rts {
+		if s.dtr {
+			s.startBootloader()
+		} else {
+			s.bootFirmware()
+		}
+	}
+	s.rts = on
+	return nil
+}
+
+func (s *SimulatedROM) startBootloader() {
+	s.mode = simBootloader
+	s.in.Reset()
+	s.reader = NewSLIPReader(&s.in)
+	s.writing = false
+	s.out.WriteString(romBootMessage)
+}
+
+func (s *SimulatedROM) bootFirmware() {
+	s.mode = simFirmware
+	s.Boots++
+	s.out.WriteString(s.BootMessage)
+}
+
+func (s *SimulatedROM) reply(op byte, value uint32, data []byte, errorCode byte) {
+	status := []byte{0, 0}
+	if errorCode != 0 {
+		status = []byte{1, errorCode}
+	}
+	if s.Chip.attach {
+		status = append(status, 0, 0)
+	}
+	data = append(append([]byte(nil), data...), status...)
+	packet := make([]byte, 8, 8+len(data))
+	packet[0] = directionReply
+	packet[1] = op
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(packet[4:], value)
+	s.out.Write(EncodeSLIP(append(packet, data...)))
+}
+
+func (s *SimulatedROM) handle(frame []byte) {
+	if len(frame) < 8 || frame[0] != directionRequest {
+		return
+	}
+	op := frame[1]
+	data := frame[8:]
+	if int(binary.LittleEndian.Uint16(frame[2:])) != len(data) {
+		return
+	}
+	word := func(i int) int {
+		if len(data) < 4*(i+1) {
+			return -1
+		}
+		return int(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	const (
+		errInvalid  = statusInvalidCommand
+		errChecksum = 0x07
+		errFlash    = 0x08
+	)
+
+	switch {
+	case op == cmdSync:
+		if bytes.Equal(data, append([]byte{0x07, 0x07, 0x12, 0x20}, bytes.Repeat([]byte{0x55}, 32)...)) {
+			for i := 0; i < 8; i++ {
+				s.reply(op, 0, nil, 0)
+			}
+		}
+	case op == cmdReadReg:
+		var value uint32
+		switch word(0) {
+		case chipDetectReg:
+			value = s.Chip.magic
+		case 0x3ff00050:
+			value = s.ChipID << 24
+		case 0x3ff00054:
+			value = s.ChipID >> 8
+		}
+		s.reply(op, value, nil, 0)
+	case (op == cmdSPIAttach || op == cmdSPISetParams) && s.Chip.attach:
+		s.reply(op, 0, nil, 0)
+	case op == cmdFlashBegin:
+		// the erase size, word 0, is ignored: the sectors written to are
+		// erased, which is what the ESP8266 erase size quirk amounts to
+		blocks, blockSize, offset := word(1), word(2), word(3)
+		if offset < 0 || blockSize != FlashBlockSize || offset+blocks*blockSize > len(s.flash) {
+			s.reply(op, 0, nil, errFlash)
+			return
+		}
+		end := offset + (blocks*blockSize+FlashSectorSize-1)/FlashSectorSize*FlashSectorSize
+		if end > len(s.flash) {
+			end = len(s.flash)
+		}
+		for i := offset; i < end; i++ {
+			s.flash[i] = 0xff
+		}
+		s.writing, s.offset, s.blocks, s.block, s.seq = true, offset, blocks, blockSize, 0
+		s.reply(op, 0, nil, 0)
+	case op == cmdFlashData:
+		size, seq := word(0), word(1)
+		if !s.writing || len(data) < 16 || size != len(data)-16 || seq != s.seq || s.seq >= s.blocks {
+			s.reply(op, 0, nil, errFlash)
+			return
+		}
+		block := data[16:]
+		if checksum(block) != binary.LittleEndian.Uint32(frame[4:]) {
+			s.reply(op, 0, nil, errChecksum)
+			return
+		}
+		// flash writes can only clear bits
+		for i, b := range block {
+			s.flash[s.offset+seq*s.block+i] &= b
+		}
+		s.seq++
+		s.reply(op, 0, nil, 0)
+	case op == cmdFlashEnd:
+		s.writing = false
+		s.reply(op, 0, nil, 0)
+		if word(0) == 0 {
+			s.bootFirmware()
+		}
+	case op == cmdSPIFlashMD5 && s.Chip.md5:
+		offset, size := word(0), word(1)
+		if offset < 0 || size < 0 || offset+size > len(s.flash) {
+			s.reply(op, 0, nil, errFlash)
+			return
+		}
+		sum := md5.Sum(s.flash[offset : offset+size])
+		s.reply(op, 0, []byte(hex.EncodeToString(sum[:])), 0)
+	default:
+		s.reply(op, 0, nil, errInvalid)
+	}
+}
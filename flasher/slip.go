@@ -0,0 +1,85 @@
+package flasher
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// SLIP special bytes. Frames start and end with slipEnd; slipEnd and slipEsc
+// inside a frame are escaped.
+const (
+	slipEnd    = 0xc0
+	slipEsc    = 0xdb
+	slipEscEnd = 0xdc
+	slipEscEsc = 0xdd
+)
+
+// EncodeSLIP returns data as a SLIP frame
+func EncodeSLIP(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(slipEnd)
+	for _, b := range data {
+		switch b {
+		case slipEnd:
+			buf.Write([]byte{slipEsc, slipEscEnd})
+		case slipEsc:
+			buf.Write([]byte{slipEsc, slipEscEsc})
+		default:
+			buf.WriteByte(b)
+		}
+	}
+	buf.WriteByte(slipEnd)
+	return buf.Bytes()
+}
+
+// SLIPReader reads SLIP frames, skipping whatever comes between them, such
+// as the boot messages of the chip
+type SLIPReader struct {
+	r       *bufio.Reader
+	inFrame bool
+	escaped bool
+	frame   []byte
+}
+
+// NewSLIPReader returns a reader of the frames in r
+func NewSLIPReader(r io.Reader) *SLIPReader {
+	return &SLIPReader{r: bufio.NewReader(r)}
+}
+
+// ReadFrame returns the next frame. A partial frame is kept when reading
+// fails, so a serial port read timeout can be retried.
+func (sr *SLIPReader) ReadFrame() ([]byte, error) {
+	for {
+		b, err := sr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case b == slipEnd:
+			if sr.inFrame && len(sr.frame) > 0 {
+				frame := sr.frame
+				sr.inFrame, sr.frame = false, nil
+				return frame, nil
+			}
+			// start of a frame, or back to back delimiters
+			sr.inFrame, sr.escaped, sr.frame = true, false, nil
+		case !sr.inFrame:
+		case sr.escaped:
+			sr.escaped = false
+			switch b {
+			case slipEscEnd:
+				sr.frame = append(sr.frame, slipEnd)
+			case slipEscEsc:
+				sr.frame = append(sr.frame, slipEsc)
+			default:
+				// invalid escape, drop the frame
+				sr.inFrame, sr.frame = false, nil
+			}
+		case b == slipEsc:
+			sr.escaped = true
+		default:
+			sr.frame = append(sr.frame, b)
+		}
+	}
+}
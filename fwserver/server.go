@@ -1,6 +1,9 @@
 package fwserver
 
 import (
+	"espore/builder/image"
+	"espore/session"
+	"espore/utils"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,6 +18,24 @@ import (
 	"github.com/rs/cors"
 )
 
+// VersionHeader carries the firmware version: devices send the one they
+// run and the server answers with the one of the image it serves
+const VersionHeader = "X-Firmware-Version"
+
+// AcceptDeltaHeader is sent by devices able to apply delta images. When the
+// image they report in If-None-Match has a delta to the current one, the
+// server sends the delta instead, with the Etag of the full image and the
+// base hash in DeltaBaseHeader. The bootloader leaves DeltaFailFile on the
+// device when a delta cannot be applied, so the updater knows to stop
+// sending this header and get the full image.
+const AcceptDeltaHeader = "X-Accept-Delta"
+
+// DeltaBaseHeader carries the hash of the image a delta response applies to
+const DeltaBaseHeader = "X-Delta-Base"
+
+// DeltaFailFile is the file the bootloader writes when applying a delta fails
+const DeltaFailFile = "delta.fail"
+
 type FirmwareServer struct {
 	server *http.Server
 	Base   string
@@ -63,15 +84,24 @@ func (fws *FirmwareServer) Log(r *http.Request, code int, err error, other inter
 	if agent == "" {
 		agent = "?"
 	}
+	version := r.Header.Get(VersionHeader)
+	if version == "" {
+		version = "?"
+	}
 	if other == nil {
 		other = ""
 	}
-	log.Printf("%s\t%s\t%s\t%s\t%d\t%s\t%v\t%v\n", r.RemoteAddr, name, id, agent, code, r.URL.Path, err, other)
+	log.Printf("%s\t%s\t%s\t%s\t%s\t%d\t%s\t%v\t%v\n", r.RemoteAddr, name, id, version, agent, code, r.URL.Path, err, other)
 }
 
 func (fws *FirmwareServer) Serve(w http.ResponseWriter, r *http.Request) error {
 	path := filepath.Join(fws.Base, strings.Replace(r.URL.Path, "..", "", -1))
 	fi, err := os.Stat(path)
+	if os.IsNotExist(err) && filepath.Ext(path) == ".img" {
+		// chips without an image of their own get the default one
+		path = filepath.Join(filepath.Dir(path), "DEFAULT.img")
+		fi, err = os.Stat(path)
+	}
 	if err != nil {
 		return err
 	}
@@ -81,6 +111,9 @@ func (fws *FirmwareServer) Serve(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	etag := fmt.Sprintf("%q", string(hash))
+	if version := readVersion(path); version != nil {
+		w.Header().Add(VersionHeader, version.String())
+	}
 
 	if r.Header.Get("If-None-Match") == etag {
 		w.WriteHeader(http.StatusNotModified)
@@ -88,14 +121,29 @@ func (fws *FirmwareServer) Serve(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	base := strings.Trim(r.Header.Get("If-None-Match"), `"`)
+	deltaPath := filepath.Join(filepath.Dir(path), image.DeltaFileName(strings.TrimSuffix(filepath.Base(path), ".img"), base))
+	delta := false
+	if r.Header.Get(AcceptDeltaHeader) != "" && image.IsHash(base) {
+		if dfi, err := os.Stat(deltaPath); err == nil && deltaTarget(deltaPath) == strings.TrimSpace(string(hash)) {
+			path, fi, delta = deltaPath, dfi, true
+		}
+	}
+
 	reader, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 	w.Header().Add("Etag", etag)
 	w.Header().Add("Content-Length", strconv.FormatInt(fi.Size(), 10))
 	w.Header().Add("Content-Type", "application/octet-stream")
-	w.Header().Add("X-ETag-Verify", "true")
+	if delta {
+		// the etag is the hash of the full image the delta rebuilds
+		w.Header().Add(DeltaBaseHeader, base)
+	} else {
+		w.Header().Add("X-ETag-Verify", "true")
+	}
 	_, err = io.Copy(w, reader)
 	if err == nil {
 		fws.Log(r, 200, nil, fi.Size())
@@ -103,6 +151,27 @@ func (fws *FirmwareServer) Serve(w http.ResponseWriter, r *http.Request) error {
 	return err
 }
 
+// deltaTarget returns the hash of the image a delta image rebuilds, or an
+// empty string if it cannot be read. A delta left from an older build must
+// not be sent, the device would install an image that is not the current one.
+func deltaTarget(deltaPath string) string {
+	img, err := image.ReadFile(deltaPath)
+	if err != nil || img.Type != image.TypeDelta {
+		return ""
+	}
+	return img.TargetSHA1
+}
+
+// readVersion reads the <id>.version.json the builder writes next to each
+// image, if any
+func readVersion(imagePath string) *session.FirmwareVersion {
+	var version session.FirmwareVersion
+	if err := utils.ReadJSON(strings.TrimSuffix(imagePath, ".img")+".version.json", &version); err != nil {
+		return nil
+	}
+	return &version
+}
+
 func (fws *FirmwareServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := fws.Serve(w, r)
 	if err != nil {
@@ -0,0 +1,74 @@
+package fwserver_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"espore/builder/image"
+	"espore/fwserver"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func encodeImage(t *ut.DefaultTestTools, content string) ([]byte, string) {
+	img := &image.Image{DeviceID: "1", DeviceName: "dev", Files: []*image.File{
+		{Path: "init.lua", Data: []byte("-- init")},
+		{Path: "main.lua", Data: []byte(content)},
+	}}
+	data, err := img.Bytes()
+	t.Ok(err)
+	sum := sha1.Sum(data)
+	return data, hex.EncodeToString(sum[:])
+}
+
+func writeDelta(t *ut.DefaultTestTools, dir string, base, target []byte, baseHash string) {
+	delta, err := image.MakeDelta(base, target)
+	t.Ok(err)
+	data, err := delta.Bytes()
+	t.Ok(err)
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, image.DeltaFileName("1", baseHash)), data, 0644))
+}
+
+func TestServeDelta(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-fwserver")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	base, baseHash := encodeImage(t, "print(1)")
+	old, _ := encodeImage(t, "print(2)")
+	current, currentHash := encodeImage(t, "print(3)")
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "1.img"), current, 0644))
+	t.Ok(ioutil.WriteFile(filepath.Join(dir, "1.img.hash"), []byte(currentHash), 0644))
+	fws := &fwserver.FirmwareServer{Base: dir}
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/1.img", nil)
+		r.Header.Set("If-None-Match", `"`+baseHash+`"`)
+		r.Header.Set(fwserver.AcceptDeltaHeader, "1")
+		w := httptest.NewRecorder()
+		fws.ServeHTTP(w, r)
+		t.Equals(200, w.Code)
+		t.Equals(`"`+currentHash+`"`, w.Header().Get("Etag"))
+		return w
+	}
+
+	// a delta left from an older build rebuilds the old image, the full
+	// current image is sent instead
+	writeDelta(t, dir, base, old, baseHash)
+	w := get()
+	t.Equals("", w.Header().Get(fwserver.DeltaBaseHeader))
+	t.Equals(string(current), w.Body.String())
+
+	writeDelta(t, dir, base, current, baseHash)
+	w = get()
+	t.Equals(baseHash, w.Header().Get(fwserver.DeltaBaseHeader))
+	delta, err := image.Read(w.Body.Bytes())
+	t.Ok(err)
+	t.Equals(currentHash, delta.TargetSHA1)
+}
@@ -12,5 +12,6 @@ require (
 	github.com/rivo/tview v0.0.0-20220812085834-0e6b21a48e96
 	github.com/rs/cors v1.7.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
-
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
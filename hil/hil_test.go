@@ -0,0 +1,133 @@
+package hil_test
+
+import (
+	"bytes"
+	"espore/hil"
+	"espore/session"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/epiclabs-io/ut"
+)
+
+// fakeDevice answers console lines like a board running the espore runtime
+type fakeDevice struct {
+	lock    sync.Mutex
+	input   []byte
+	output  bytes.Buffer
+	respond func(line string) string
+}
+
+func (d *fakeDevice) Write(p []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.input = append(d.input, p...)
+	for {
+		i := bytes.IndexByte(d.input, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(d.input[:i])
+		d.input = d.input[i+1:]
+		if line == `print("espore=" .. tostring(__espore ~= nil))` {
+			d.output.WriteString("espore=true\n")
+		} else {
+			d.output.WriteString(d.respond(line))
+		}
+	}
+	return len(p), nil
+}
+
+// Read returns io.EOF when there is nothing to read, as the serial port does
+// when its read timeout expires
+func (d *fakeDevice) Read(p []byte) (int, error) {
+	for i := 0; i < 5; i++ {
+		d.lock.Lock()
+		n, _ := d.output.Read(p)
+		d.lock.Unlock()
+		if n > 0 {
+			return n, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 0, io.EOF
+}
+
+func (d *fakeDevice) Close() error {
+	return nil
+}
+
+func TestScript(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-hil")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bench.json")
+	t.Ok(ioutil.WriteFile(path, []byte(`{
+	"timeout": "2s",
+	"tests": [{
+		"name": "console and rpc",
+		"steps": [
+			{"send": "print(1+1)"},
+			{"expect": "^(\\d+)$"},
+			{"rpc": "return node.heap()", "result": 30000},
+			{"restart": true},
+			{"expect": "bootloader"}
+		]
+	}, {
+		"name": "wrong result",
+		"steps": [{"rpc": "return node.heap()", "result": 1}]
+	}, {
+		"name": "silent device",
+		"steps": [{"expect": "never", "timeout": "300ms"}]
+	}]
+}`), 0666))
+
+	script, err := hil.ReadScript(path)
+	t.Ok(err)
+	t.Equals("bench", script.Name)
+
+	device := &fakeDevice{respond: func(line string) string {
+		switch {
+		case line == "print(1+1)":
+			return "2\r\n"
+		case line == "return node.heap()":
+			return "{\n\"ret\":30000\n}\n"
+		case line == "node.restart()":
+			return "\nEspore bootloader will launch in 3 seconds.\n"
+		}
+		return ""
+	}}
+	recorder := hil.NewRecorder(device)
+	s, err := session.New(&session.Config{Socket: recorder})
+	t.Ok(err)
+
+	cases := script.Run(s, recorder)
+	t.Equals(3, len(cases))
+	t.Equals("", cases[0].Failure)
+	t.Assert(strings.Contains(cases[0].Output, "] > print(1+1)\n"), "Expected the command in the transcript:\n%s", cases[0].Output)
+	t.Assert(strings.Contains(cases[0].Output, "] < 2\n"), "Expected the answer in the transcript:\n%s", cases[0].Output)
+	t.Equals(`step 1 (rpc "return node.heap()"): expected 1, got 30000`, cases[1].Failure)
+	t.Equals(`step 1 (expect "never"): "never" not found within 300ms`, cases[2].Failure)
+}
+
+func TestInvalidScript(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	dir, err := ioutil.TempDir("", "espore-hil")
+	t.Ok(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bad.json")
+	t.Ok(ioutil.WriteFile(path, []byte(`{"tests": [{"name": "x", "steps": [{"send": "a", "expect": "b"}]}]}`), 0666))
+	_, err = hil.ReadScript(path)
+	t.Assert(err != nil && strings.Contains(err.Error(), "exactly one of"), "Expected a validation error, got %v", err)
+}
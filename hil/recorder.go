@@ -0,0 +1,84 @@
+package hil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Recorder wraps the connection to a device and keeps a transcript of what
+// is sent and received, line by line, with the time since the last Reset
+type Recorder struct {
+	rw         io.ReadWriteCloser
+	lock       sync.Mutex
+	start      time.Time
+	transcript bytes.Buffer
+	sent       []byte
+	received   []byte
+}
+
+func NewRecorder(rw io.ReadWriteCloser) *Recorder {
+	return &Recorder{rw: rw, start: time.Now()}
+}
+
+func (r *Recorder) record(direction string, pending *[]byte, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, b := range data {
+		switch b {
+		case '\r':
+		case '\n':
+			r.writeLine(direction, *pending)
+			*pending = (*pending)[:0]
+		default:
+			*pending = append(*pending, b)
+		}
+	}
+}
+
+func (r *Recorder) writeLine(direction string, line []byte) {
+	fmt.Fprintf(&r.transcript, "[%8.3f] %s %s\n", time.Since(r.start).Seconds(), direction, line)
+}
+
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.rw.Read(p)
+	r.record("<", &r.received, p[:n])
+	return n, err
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.record(">", &r.sent, p)
+	return r.rw.Write(p)
+}
+
+func (r *Recorder) Close() error {
+	return r.rw.Close()
+}
+
+// Reset discards the transcript and restarts its clock
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.transcript.Reset()
+	r.sent = r.sent[:0]
+	r.received = r.received[:0]
+	r.start = time.Now()
+}
+
+// Transcript returns what was recorded since the last Reset, including
+// unterminated lines
+func (r *Recorder) Transcript() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.sent) > 0 {
+		r.writeLine(">", r.sent)
+		r.sent = r.sent[:0]
+	}
+	if len(r.received) > 0 {
+		r.writeLine("<", r.received)
+		r.received = r.received[:0]
+	}
+	return r.transcript.String()
+}
@@ -0,0 +1,87 @@
+package hil
+
+import (
+	"encoding/json"
+	"espore/session"
+	"espore/testreport"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Run runs the tests of the script in order and returns a case per test, with
+// the transcript of the test as output. A test stops at its first failing
+// step.
+func (script *Script) Run(s *session.Session, recorder *Recorder) []*testreport.Case {
+	var cases []*testreport.Case
+	for _, test := range script.Tests {
+		recorder.Reset()
+		start := time.Now()
+		c := &testreport.Case{Suite: script.Name, Name: test.Name}
+		for i, step := range test.Steps {
+			if err := script.runStep(s, step); err != nil {
+				c.Failure = fmt.Sprintf("step %d (%s): %s", i+1, step, err)
+				break
+			}
+		}
+		c.Time = time.Since(start)
+		c.Output = recorder.Transcript()
+		cases = append(cases, c)
+	}
+	return cases
+}
+
+func (script *Script) timeout(step *Step) time.Duration {
+	if step.Timeout > 0 {
+		return time.Duration(step.Timeout)
+	}
+	if script.Timeout > 0 {
+		return time.Duration(script.Timeout)
+	}
+	return session.DefaultTimeout
+}
+
+func (script *Script) runStep(s *session.Session, step *Step) error {
+	switch {
+	case step.Send != "":
+		return s.SendCommand(step.Send)
+	case step.Rpc != "":
+		return script.runRpc(s, step)
+	case step.Push != "":
+		to := step.To
+		if to == "" {
+			to = filepath.Base(step.Push)
+		}
+		return s.PushFile(filepath.Join(script.dir, step.Push), to)
+	case step.Restart:
+		return s.NodeRestart()
+	}
+	_, err := s.Expect(step.Expect, script.timeout(step))
+	return err
+}
+
+func (script *Script) runRpc(s *session.Session, step *Step) error {
+	defer func(timeout time.Duration) {
+		s.Timeout = timeout
+	}(s.Timeout)
+	s.Timeout = script.timeout(step)
+	result, err := s.Rpc(step.Rpc)
+	if err != nil || step.Result == nil {
+		return err
+	}
+	if len(result) == 0 {
+		result = []byte("null")
+	}
+	var expected, actual interface{}
+	if err := json.Unmarshal(step.Result, &expected); err != nil {
+		return fmt.Errorf("invalid expected result: %s", err)
+	}
+	if err := json.Unmarshal(result, &actual); err != nil {
+		return fmt.Errorf("invalid result %s: %s", result, err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		return fmt.Errorf("expected %s, got %s", step.Result, result)
+	}
+	return nil
+}
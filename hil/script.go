@@ -0,0 +1,147 @@
+// Package hil runs hardware-in-the-loop test scripts against a device
+// connected through a session. A script is a JSON file with a list of tests,
+// each made of steps that send Lua code, call RPCs, push files, restart the
+// device and wait for console output or RPC results:
+//
+//	{
+//		"name": "sensor",
+//		"timeout": "15s",
+//		"tests": [{
+//			"name": "boots",
+//			"steps": [
+//				{"restart": true},
+//				{"expect": "LFS initialized", "timeout": "30s"},
+//				{"push": "fixtures/config.json", "to": "config.json"},
+//				{"send": "print(node.heap() > 0)"},
+//				{"expect": "^true$"},
+//				{"rpc": "return require('config').load().interval", "result": 60}
+//			]
+//		}]
+//	}
+package hil
+
+import (
+	"encoding/json"
+	"espore/utils"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as "500ms" or "10s" in scripts
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var st string
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("durations must be strings such as \"10s\": %s", data)
+	}
+	duration, err := time.ParseDuration(st)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Step is a single action. Exactly one of Send, Rpc, Push, Restart or
+// Expect must be set.
+type Step struct {
+	// Send types Lua code into the console
+	Send string `json:"send,omitempty"`
+	// Rpc runs Lua code through the espore runtime. When Result is set, the
+	// returned value must equal it
+	Rpc    string          `json:"rpc,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	// Push uploads a file, relative to the script, as To. To defaults to
+	// the base name of the file
+	Push string `json:"push,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Restart reboots the device
+	Restart bool `json:"restart,omitempty"`
+	// Expect waits for a console line matching the regular expression.
+	// Lines read while waiting are consumed
+	Expect string `json:"expect,omitempty"`
+	// Timeout applies to Expect and Rpc. Defaults to the script timeout
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+func (step *Step) String() string {
+	switch {
+	case step.Send != "":
+		return fmt.Sprintf("send %q", step.Send)
+	case step.Rpc != "":
+		return fmt.Sprintf("rpc %q", step.Rpc)
+	case step.Push != "":
+		return fmt.Sprintf("push %q", step.Push)
+	case step.Restart:
+		return "restart"
+	}
+	return fmt.Sprintf("expect %q", step.Expect)
+}
+
+func (step *Step) validate() error {
+	actions := 0
+	for _, set := range []bool{step.Send != "", step.Rpc != "", step.Push != "", step.Restart, step.Expect != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("a step must have exactly one of send, rpc, push, restart or expect")
+	}
+	if step.Result != nil && step.Rpc == "" {
+		return fmt.Errorf("result is only allowed in rpc steps")
+	}
+	if step.Expect != "" {
+		if _, err := regexp.Compile(step.Expect); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Test struct {
+	Name  string  `json:"name"`
+	Steps []*Step `json:"steps"`
+}
+
+type Script struct {
+	// Name defaults to the file name without extension
+	Name string `json:"name"`
+	// Timeout is the default timeout of the steps. Defaults to
+	// session.DefaultTimeout
+	Timeout Duration `json:"timeout"`
+	Tests   []*Test  `json:"tests"`
+	// dir is where the files to push are looked up
+	dir string
+}
+
+// ReadScript reads and checks a test script
+func ReadScript(path string) (*Script, error) {
+	var script Script
+	if err := utils.ReadJSON(path, &script); err != nil {
+		return nil, fmt.Errorf("Error reading test script %s: %s", path, err)
+	}
+	script.dir = filepath.Dir(path)
+	if script.Name == "" {
+		script.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	for i, test := range script.Tests {
+		if test.Name == "" {
+			return nil, fmt.Errorf("%s: test %d has no name", path, i+1)
+		}
+		for j, step := range test.Steps {
+			if err := step.validate(); err != nil {
+				return nil, fmt.Errorf("%s: test %q, step %d: %s", path, test.Name, j+1, err)
+			}
+		}
+	}
+	return &script, nil
+}
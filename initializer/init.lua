@@ -4,7 +4,7 @@ print("Set boot to nil to stop\n\n\n")
 function runMain()
     runMain = nil
     local ok, mainFunc = pcall(require, "main")
-    if not ok then print("Error loading main module: ", modFunc) end
+    if not ok then print("Error loading main module: ", mainFunc) end
     if type(mainFunc) == "function" then
         local ok, err = pcall(mainFunc)
         if not ok then print("Error invoking main function: ", err) end
@@ -20,7 +20,12 @@ function boot()
         UPDATE_OLD_FILE = "update.old",
         LFS_NEW_FILE = "lfs.img",
         LFS_TMP_FILE = "lfs.img.tmp",
-        DATAFILES_JSON = "datafiles.json"
+        DELTA_TMP_FILE = "update.img.tmp",
+        DELTA_FAIL_FILE = "delta.fail",
+        DATAFILES_JSON = "datafiles.json",
+        KEYS_FILE = "boot.keys",
+        KEYS_UPDATE_FILE = "boot.keys.new",
+        KEYS_TMP_FILE = "boot.keys.tmp"
     }
 
     M.log = function(level, f, a)
@@ -40,7 +45,7 @@ function boot()
         return M.log("ERROR", f, a)
     end
 
-    M.readJSON = function(fileName)
+    M.readFile = function(fileName)
         local f = file.open(fileName, "r")
         if not f then return nil end
         local data = ""
@@ -53,6 +58,12 @@ function boot()
             end
         end
         f:close()
+        return data
+    end
+
+    M.readJSON = function(fileName)
+        local data = M.readFile(fileName)
+        if not data then return nil end
         local ok, obj = pcall(sjson.decode, data)
         if not ok then obj = nil end
         return obj
@@ -70,75 +81,371 @@ function boot()
         end)
     end
 
-    M.unpackImage = function(filename)
-        M.log_info("Unpacking %s...", filename)
-        local f = file.open(filename, "r")
-        if f == nil then
-            return nil, "Error opening " .. filename .. " firmware file."
+    -- newDecoder returns a function that decompresses LZSS data chunk by
+    -- chunk, keeping the last 1KB of output to resolve references
+    M.newDecoder = function()
+        local pending, window, flags, items = "", "", 0, 0
+        return function(chunk)
+            local input, pos, hist, literals = pending .. chunk, 1, window, {}
+            while true do
+                if items == 0 then
+                    if pos > #input then break end
+                    flags, items = input:byte(pos), 8
+                    pos = pos + 1
+                end
+                if flags % 2 == 1 then
+                    if pos > #input then break end
+                    literals[#literals + 1] = input:sub(pos, pos)
+                    pos = pos + 1
+                else
+                    if pos + 1 > #input then break end
+                    local b1, b2 = input:byte(pos, pos + 1)
+                    local dist, length = b1 * 4 + math.floor(b2 / 64) + 1, b2 % 64 + 3
+                    hist = hist .. table.concat(literals)
+                    literals = {}
+                    local start = #hist - dist + 1
+                    if dist >= length then
+                        hist = hist .. hist:sub(start, start + length - 1)
+                    else
+                        local rep = string.rep(hist:sub(start), math.ceil(length / dist))
+                        hist = hist .. rep:sub(1, length)
+                    end
+                    pos = pos + 2
+                end
+                flags, items = math.floor(flags / 2), items - 1
+            end
+            hist = hist .. table.concat(literals)
+            pending = input:sub(pos)
+            local out = hist:sub(#window + 1)
+            window = hist:sub(-1024)
+            return out
+        end
+    end
+
+    -- walkImage reads a version 1 or 2 image, calling
+    -- onFile(name, size, hash, sizeLine) before the content of each file and
+    -- onData(data, stored) with each chunk of it, as stored in the image and
+    -- decompressed. Either can return an error to stop. Version 2 images are checked
+    -- against the device id and the hashes of each file and the whole image.
+    -- Once the device has signing keys, images must also carry a valid
+    -- HMAC-SHA256 signature made with one of them, unless trusted is set for
+    -- an image the device accepted before, such as update.old.
+    -- Returns the list of files, or nil and an error, and the image header.
+    M.walkImage = function(f, onFile, onData, trusted)
+        local keys = not trusted and M.readJSON(M.KEYS_FILE) or nil
+        local imageHash = crypto.new_hash("SHA1")
+        -- the header is kept until we know which key to check it with
+        local mac, head = nil, ""
+        local function consume(data)
+            imageHash:update(data)
+            if mac then
+                mac:update(data)
+            elseif head then
+                head = head .. data
+            end
+        end
+        local function readline()
+            local line = f:readline()
+            if line ~= nil then consume(line) end
+            return line
+        end
+        local function toHex(digest)
+            return string.lower(encoder.toHex(digest))
         end
 
-        local totalFiles = nil
-        -- skip other headers. TODO: check these headers for validity
+        local line = readline()
+        local version = tonumber(string.match(line or "", "^Version:%s*(%d+)"))
+        if version ~= 1 and version ~= 2 then
+            return nil, "Unsupported image format version"
+        end
+        local header = {}
         repeat
-            line = f:readline()
-            if line ~= nil then
-                if totalFiles == nil then
-                    totalFiles = tonumber(
-                                     string.match(line, "Total files:%s*(%d*)\n"))
-                end
+            line = readline()
+            if line ~= nil and line ~= "\n" then
+                local key, value = string.match(line, "^([^:]+):%s*(.-)\n")
+                if key ~= nil then header[key] = value end
             end
         until (line == "\n" or line == nil)
         if line == nil then return nil, "Cannot find image file body" end
+        local totalFiles = tonumber(header["Total files"])
         if totalFiles == nil then
             return nil, "Cannot find Total Files header in firmware image"
         end
-        M.log_info("unpacking %d files...", totalFiles)
+        local id = header["Device Id"]
+        if version > 1 and id ~= tostring(node.chipid()) and id ~= "DEFAULT" then
+            return nil, "Image is for device " .. tostring(id)
+        end
+        local keyId = header["Key Id"]
+        if keys ~= nil then
+            if keyId == nil then return nil, "Image is not signed" end
+            if type(keys[keyId]) ~= "string" then
+                return nil, "Image is signed with unknown key " .. keyId
+            end
+            mac = crypto.new_hmac("SHA256", keys[keyId])
+            mac:update(head)
+        end
+        head = nil
+
         local fileList = {}
-        while totalFiles > 0 do
-            local targetFile = f:readline()
-            if targetFile == nil then
-                return nil, "cannot read targetFile name"
+        for _ = 1, totalFiles do
+            local targetFile = string.match(readline() or "", "(.+)\n")
+            if targetFile == nil then return nil, "Cannot parse targetFile" end
+            local sizeLine = readline() or ""
+            local stored, size = string.match(sizeLine, "^(%d+) lzss (%d+)\n")
+            local decode
+            if stored ~= nil and version > 1 then
+                decode = M.newDecoder()
+            else
+                stored = string.match(sizeLine, "^(%d+)\n")
+                size = stored
+            end
+            stored, size = tonumber(stored), tonumber(size)
+            if stored == nil then return nil, "cannot parse file size" end
+            local expected, fileHash
+            if version > 1 then
+                expected = string.match(readline() or "", "^(%x+)\n")
+                if expected == nil then
+                    return nil, "Cannot parse hash of " .. targetFile
+                end
+                fileHash = crypto.new_hash("SHA1")
+            end
+            local err = onFile and onFile(targetFile, size, expected, sizeLine:sub(1, -2))
+            if err then return nil, err end
+            -- compressed chunks are small, as they can grow a lot
+            local chunkSize, decoded = decode and 128 or 1024, 0
+            while stored > 0 do
+                local chunk = f:read(math.min(stored, chunkSize))
+                if chunk == nil then
+                    return nil, string.format(
+                               "Firmware file is corrupt, went past end of file unpacking %s (size=%d)",
+                               targetFile, stored)
+                end
+                consume(chunk)
+                local data = decode and decode(chunk) or chunk
+                if fileHash then fileHash:update(data) end
+                err = onData and onData(data, chunk)
+                if err then return nil, err end
+                stored = stored - chunk:len()
+                decoded = decoded + data:len()
             end
-            targetFile = string.match(targetFile, "(.+)\n")
-            if targetFile == nil then
-                return nil, "Cannot parse targetFile"
+            if decoded ~= size then
+                return nil, "Cannot decompress " .. targetFile
+            end
+            if fileHash and toHex(fileHash:finalize()) ~= string.lower(expected) then
+                return nil, "Hash mismatch in " .. targetFile
             end
             table.insert(fileList, targetFile)
-            local size = f:readline()
-            if size == nil then return nil, "cannot read file size" end
-            size = string.match(size, "([0-9]+)\n")
-            size = tonumber(size)
-            if size == nil then return nil, "cannot parse file size" end
-            M.log_info("unpacking %s. Size: %d", targetFile, size)
-            local data
-            local len
-            local tf = file.open(targetFile, "w+")
-            if tf == nil then
-                return nil, "Error opening targetFile " .. targetFile ..
-                           " for writing"
+        end
+        if version > 1 then
+            local digest = toHex(imageHash:finalize())
+            local trailer = f:readline() or ""
+            local expected = string.match(trailer, "^Image SHA1:%s*(%x+)\n")
+            if expected == nil or string.lower(expected) ~= digest then
+                return nil, "Image hash mismatch"
             end
-            repeat
-                data = f:read(math.min(size, 1024))
-                if data == nil then
-                    len = 0
-                else
-                    len = data:len()
-                    if tf:write(data) == nil then
-                        return nil, "Error writing to targetFile " .. targetFile
+            if mac then mac:update(trailer) end
+        end
+        if keyId ~= nil then
+            local signature = string.match(f:readline() or "", "^Signature:%s*(%x+)\n")
+            if signature == nil then return nil, "Cannot find the image signature" end
+            if mac and string.lower(signature) ~= toHex(mac:finalize()) then
+                return nil, "Signature mismatch for key " .. keyId
+            end
+        end
+        return fileList, nil, header
+    end
+
+    M.readImage = function(filename, onFile, onData, trusted)
+        local f = file.open(filename, "r")
+        if f == nil then
+            return nil, "Error opening " .. filename .. " firmware file."
+        end
+        local fileList, err, header = M.walkImage(f, onFile, onData, trusted)
+        f:close()
+        return fileList, err, header
+    end
+
+    -- verifyImage reads the whole image without writing anything
+    M.verifyImage = function(filename, trusted)
+        M.log_info("Verifying %s...", filename)
+        return M.readImage(filename, nil, nil, trusted)
+    end
+
+    -- applyDelta rebuilds the full image described by the delta image in
+    -- update.img from the files of update.old, the image the device runs, and
+    -- replaces the delta with it. Nothing else is touched.
+    M.applyDelta = function(header)
+        M.log_info("Applying delta update to %s...", M.UPDATE_OLD_FILE)
+        local function fhash(name)
+            return string.lower(encoder.toHex(crypto.fhash("sha1", name)))
+        end
+        if not file.exists(M.UPDATE_OLD_FILE) or fhash(M.UPDATE_OLD_FILE) ~=
+            string.lower(header["Base SHA1"]) then
+            return "Delta does not apply to the current firmware"
+        end
+        local base = file.open(M.UPDATE_OLD_FILE, "r")
+        local index = {}
+        local _, err = M.walkImage(base, function(name, size, hash, sizeLine)
+            index[name] = {pos = base:seek("cur"), sizeLine = sizeLine, hash = hash}
+        end, nil, true)
+        if err ~= nil then
+            base:close()
+            return "Invalid " .. M.UPDATE_OLD_FILE .. ": " .. err
+        end
+
+        local out = file.open(M.DELTA_TMP_FILE, "w")
+        local imageHash = crypto.new_hash("SHA1")
+        local function write(data)
+            imageHash:update(data)
+            if out:write(data) == nil then
+                return "Error writing to " .. M.DELTA_TMP_FILE
+            end
+        end
+        -- the .target file of the delta holds the header of the image and
+        -- the list of its files. copyUntil writes the files of the list that
+        -- come from update.old until reaching stop, the next one in the delta
+        local target, paths, nextPath = "", nil, 1
+        local function copyUntil(stop)
+            if paths == nil then
+                local head, list = string.match(target, "^(.-\n\n)(.*)$")
+                if head == nil then return "Invalid delta target" end
+                paths = {}
+                for path in string.gmatch(list, "([^\n]+)\n") do
+                    table.insert(paths, path)
+                end
+                local err = write(head)
+                if err then return err end
+            end
+            while paths[nextPath] ~= nil and paths[nextPath] ~= stop do
+                local name = paths[nextPath]
+                local entry = index[name]
+                if entry == nil then
+                    return name .. " is not in the delta nor in " .. M.UPDATE_OLD_FILE
+                end
+                local err = write(string.format("%s\n%s\n%s\n", name, entry.sizeLine, entry.hash))
+                base:seek("set", entry.pos)
+                local size = tonumber(string.match(entry.sizeLine, "^%d+"))
+                while err == nil and size > 0 do
+                    local data = base:read(math.min(size, 1024))
+                    if data == nil then
+                        return "Cannot read " .. name .. " from " .. M.UPDATE_OLD_FILE
                     end
+                    err = write(data)
+                    size = size - data:len()
+                end
+                if err then return err end
+                nextPath = nextPath + 1
+            end
+            if stop ~= nil then
+                if paths[nextPath] ~= stop then
+                    return stop .. " is not in the delta target"
                 end
-                size = size - len
-            until len == 0 or size == 0
-            tf:close()
-            if size > 0 then
-                return nil, string.format(
-                           "Firmware file is corrupt, went past end of file unpacking %s (size=%d)",
-                           targetFile, size)
+                nextPath = nextPath + 1
             end
-            totalFiles = totalFiles - 1
+        end
+        local inTarget
+        _, err = M.readImage(M.UPDATE_NEW_FILE, function(name, size, hash, sizeLine)
+            inTarget = name == ".target"
+            if inTarget then return end
+            return copyUntil(name) or write(string.format("%s\n%s\n%s\n", name, sizeLine, hash))
+        end, function(data, stored)
+            if inTarget then
+                target = target .. data
+            else
+                return write(stored)
+            end
+        end)
+        err = err or copyUntil(nil)
+        err = err or write("Image SHA1: " .. string.lower(encoder.toHex(imageHash:finalize())) .. "\n")
+        if err == nil and header["Target Signature"] then
+            err = write("Signature: " .. header["Target Signature"] .. "\n")
+        end
+        base:close()
+        out:close()
+        if err == nil and fhash(M.DELTA_TMP_FILE) ~= string.lower(header["Target SHA1"]) then
+            err = "Rebuilt image does not match the target hash"
+        end
+        if err ~= nil then
+            file.remove(M.DELTA_TMP_FILE)
+            return err
+        end
+        file.remove(M.UPDATE_NEW_FILE)
+        file.rename(M.DELTA_TMP_FILE, M.UPDATE_NEW_FILE)
+    end
+
+    -- checkUpdate verifies update.img, turning it into a full image first if
+    -- it is a delta. A delta that cannot be applied leaves delta.fail so the
+    -- updater downloads the full image next time.
+    M.checkUpdate = function()
+        local _, err, header = M.verifyImage(M.UPDATE_NEW_FILE)
+        if err == nil and header["Type"] == "delta" then
+            err = M.applyDelta(header)
+            if err ~= nil then
+                local f = file.open(M.DELTA_FAIL_FILE, "w")
+                if f then
+                    f:write(err)
+                    f:close()
+                end
+                return err
+            end
+            _, err, header = M.verifyImage(M.UPDATE_NEW_FILE)
+        end
+        if err == nil and header["Type"] ~= nil then
+            err = "Unsupported image type " .. header["Type"]
+        end
+        return err
+    end
+
+    M.unpackImage = function(filename, trusted)
+        M.log_info("Unpacking %s...", filename)
+        local tf, targetFile
+        local fileList, err, header = M.readImage(filename, function(name, size)
+            if tf ~= nil then tf:close() end
+            targetFile = name
+            M.log_info("unpacking %s. Size: %d", name, size)
+            tf = file.open(name, "w+")
+            if tf == nil then
+                return "Error opening targetFile " .. name .. " for writing"
+            end
+        end, function(data)
+            if tf:write(data) == nil then
+                return "Error writing to targetFile " .. targetFile
+            end
+        end, trusted)
+        if tf ~= nil then tf:close() end
+        return fileList, err, header
+    end
+
+    -- installKeys replaces the trusted keys with those in boot.keys.new, which
+    -- a signed image carries encrypted with the key it is signed with. A device
+    -- without keys cannot decrypt them and must be given its first keys over
+    -- the serial port.
+    M.installKeys = function(header)
+        local keyId = header["Key Id"]
+        local keys = M.readJSON(M.KEYS_FILE)
+        local data = M.readFile(M.KEYS_UPDATE_FILE)
+        file.remove(M.KEYS_UPDATE_FILE)
+        if keyId == nil or keys == nil or data == nil or type(keys[keyId]) ~= "string" then
+            return
+        end
+        local key = crypto.hash("sha256", keys[keyId]):sub(1, 16)
+        local ok, plain = pcall(crypto.decrypt, "AES-CBC", key, data:sub(17), data:sub(1, 16))
+        local n = ok and #plain or 0
+        while n > 0 and plain:byte(n) == 0 do n = n - 1 end
+        local newKeys
+        if ok then ok, newKeys = pcall(sjson.decode, plain:sub(1, n)) end
+        if not ok or type(newKeys) ~= "table" or next(newKeys) == nil then
+            return "Cannot decrypt " .. M.KEYS_UPDATE_FILE
+        end
+        local f = file.open(M.KEYS_TMP_FILE, "w")
+        if f == nil or f:write(plain:sub(1, n)) == nil then
+            if f then f:close() end
+            return "Error writing " .. M.KEYS_TMP_FILE
         end
         f:close()
-        return fileList, nil
+        file.remove(M.KEYS_FILE)
+        file.rename(M.KEYS_TMP_FILE, M.KEYS_FILE)
+        M.log_info("Installed signing keys")
     end
 
     M.cleanup = function(fileList)
@@ -150,6 +457,7 @@ function boot()
         list[M.UPDATE_OLD_FILE] = nil
         list[M.UPDATE_1ST_FILE] = nil
         list[M.UPDATE_FAIL_FILE] = nil
+        list[M.KEYS_FILE] = nil
         list["init.lua"] = nil
         for name, _ in pairs(list) do
             M.log_info("Removing %s", name)
@@ -169,19 +477,25 @@ function boot()
         end
     end
 
+    -- restorePreviousVersion unpacks update.old and restarts. It was
+    -- accepted already, so its signature is not checked: it may predate the
+    -- signing keys or be signed with a key retired since. If it cannot be
+    -- restored, the error is returned and the device runs the files it has.
     M.restorePreviousVersion =
         function() -- TODO: restore previous version should also restore updater-etag!
             M.log_info("Attempting to restore previous firmware version...")
             file.remove(M.UPDATE_1ST_FILE)
             file.remove(M.UPDATE_FAIL_FILE)
             file.remove(M.UPDATE_NEW_FILE)
-            fileList, err = M.unpackImage(M.UPDATE_OLD_FILE)
+            local fileList, err = M.verifyImage(M.UPDATE_OLD_FILE, true)
+            if err == nil then
+                fileList, err = M.unpackImage(M.UPDATE_OLD_FILE, true)
+            end
             if err ~= nil then
-                M.log_error("Error restoring previous version. Halt.")
-                return
-            else
-                M.cleanup(fileList)
+                M.log_error("Error restoring previous version: %s. Running the current firmware", err)
+                return err
             end
+            M.cleanup(fileList)
             M.log_info(
                 "Restarting after failed update and restoring previous version")
             M.flashLFS()
@@ -189,11 +503,14 @@ function boot()
         end
 
     M.start = function()
+        if not file.exists(M.KEYS_FILE) and file.exists(M.KEYS_TMP_FILE) then
+            -- the device lost power while installing new keys
+            file.rename(M.KEYS_TMP_FILE, M.KEYS_FILE)
+        end
         if file.exists(M.UPDATE_FAIL_FILE) then
             M.log_error(
                 "Update failed to be accepted. Rolling back to previous version")
-            M.restorePreviousVersion()
-            return
+            if M.restorePreviousVersion() == nil then return end
         else
             if file.exists(M.UPDATE_1ST_FILE) then
                 file.remove(M.LFS_TMP_FILE)
@@ -212,29 +529,46 @@ function boot()
                     __acceptFirmware = nil
                 ]], M.UPDATE_OLD_FILE, M.UPDATE_FAIL_FILE, M.UPDATE_OLD_FILE))
             else
+                local err
                 if file.exists(M.UPDATE_NEW_FILE) then
+                    err = M.checkUpdate()
+                    if err ~= nil then
+                        -- nothing was touched, keep running the current firmware
+                        M.log_error("Rejected %s: %s", M.UPDATE_NEW_FILE, err)
+                        file.remove(M.UPDATE_NEW_FILE)
+                    end
+                end
+                if err == nil and file.exists(M.UPDATE_NEW_FILE) then
                     file.remove(M.UPDATE_1ST_FILE)
                     file.rename(M.UPDATE_NEW_FILE, M.UPDATE_1ST_FILE)
-                    local fileList, err = M.unpackImage(M.UPDATE_1ST_FILE)
+                    local fileList, err, header = M.unpackImage(M.UPDATE_1ST_FILE)
                     if err ~= nil then
                         M.log_error("Error unpacking update file: %s", err)
-                        M.restorePreviousVersion()
-                        return
+                    else
+                        M.cleanup(fileList)
+                        local keysErr = M.installKeys(header)
+                        if keysErr ~= nil then
+                            M.log_error("Keeping the current signing keys: %s", keysErr)
+                        end
+                        err = M.flashLFS()
+                        if err ~= nil then
+                            M.log_error("Error flashing LFS: %s", err)
+                        end
                     end
-                    M.cleanup(fileList)
-                    if M.flashLFS() ~= nil then
-                        M.log_error("Error flashing LFS: %s", err)
-                        M.restorePreviousVersion()
+                    if err == nil then
+                        M.log_info(
+                            "new firmware was unpacked successfully. Restarting...")
+                        M.restart()
                         return
                     end
-                    M.log_info(
-                        "new firmware was unpacked successfully. Restarting...")
-                    M.restart()
-                    return
+                    if M.restorePreviousVersion() == nil then return end
                 end
             end
         end
 
+        -- devices programmed with a file system image flash LFS on first boot
+        M.flashLFS()
+
         if node.flashindex then
             local ok, err = pcall(node.flashindex("__lfsinit"))
             if not ok then
@@ -1,20 +1,29 @@
 package initializer
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"espore/builder/signing"
 	"espore/session"
 )
 
-func Initialize(outputDir string, session *session.Session) error {
+// Initialize provisions a device: it installs the signing keys, if any, the
+// image built for the device and the bootloader, then restarts it
+func Initialize(outputDir string, session *session.Session, keyring *signing.Keyring) error {
 	chipID, err := session.GetChipID()
 	if err != nil {
 		return err
 	}
 
+	if !keyring.Empty() {
+		if err = InstallKeys(session, keyring); err != nil {
+			return err
+		}
+	}
 	fwFile := filepath.Join(outputDir, fmt.Sprintf("%s.img", chipID))
 	if _, err = os.Stat(fwFile); err != nil {
 		fwFile = filepath.Join(outputDir, "DEFAULT.img")
@@ -29,3 +38,13 @@ func Initialize(outputDir string, session *session.Session) error {
 	}
 	return session.NodeRestart()
 }
+
+// InstallKeys writes the keys the bootloader accepts images signed with,
+// replacing those the device trusted before
+func InstallKeys(session *session.Session, keyring *signing.Keyring) error {
+	keys, err := keyring.DeviceFile()
+	if err != nil {
+		return err
+	}
+	return session.PushStream(bytes.NewReader(keys), int64(len(keys)), signing.DeviceKeysFile)
+}
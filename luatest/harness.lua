@@ -0,0 +1,114 @@
+-- Test harness loaded before each *_test.lua file. Test files register
+-- their tests with test() or skip(). Each test receives an object with the
+-- assertions below. Tests in the same file share the VM and run in order.
+local tests = {}
+
+function test(name, fn)
+    tests[#tests + 1] = {name = name, fn = fn}
+end
+
+function skip(name, fn)
+    tests[#tests + 1] = {name = name, fn = fn, skip = true}
+end
+
+local function dump(v, depth)
+    if type(v) == "string" then return string.format("%q", v) end
+    if type(v) ~= "table" then return tostring(v) end
+    depth = depth or 0
+    if depth > 3 then return "{...}" end
+    local keys = {}
+    for k in pairs(v) do keys[#keys + 1] = k end
+    table.sort(keys, function(a, b)
+        if type(a) == type(b) and (type(a) == "number" or type(a) == "string") then
+            return a < b
+        end
+        return type(a) < type(b)
+    end)
+    local parts = {}
+    if #keys == #v then
+        -- a sequence
+        for _, item in ipairs(v) do parts[#parts + 1] = dump(item, depth + 1) end
+        return "{" .. table.concat(parts, ", ") .. "}"
+    end
+    for _, k in ipairs(keys) do
+        local key = type(k) == "string" and k or "[" .. dump(k, depth + 1) .. "]"
+        parts[#parts + 1] = key .. " = " .. dump(v[k], depth + 1)
+    end
+    return "{" .. table.concat(parts, ", ") .. "}"
+end
+
+local function same(a, b)
+    if a == b then return true end
+    if type(a) ~= "table" or type(b) ~= "table" then return false end
+    for k, v in pairs(a) do if not same(v, b[k]) then return false end end
+    for k in pairs(b) do if a[k] == nil then return false end end
+    return true
+end
+
+-- fail raises the error at the line of the test that called the assertion
+local function fail(msg, reason)
+    if msg then reason = msg .. ": " .. reason end
+    error(reason, 3)
+end
+
+local T = {}
+T.__index = T
+
+function T:ok(value, msg)
+    if not value then fail(msg, "expected a true value, got " .. dump(value)) end
+end
+
+function T:not_ok(value, msg)
+    if value then fail(msg, "expected a false value, got " .. dump(value)) end
+end
+
+-- equal compares tables by content
+function T:equal(expected, actual, msg)
+    if not same(expected, actual) then
+        fail(msg, "expected " .. dump(expected) .. ", got " .. dump(actual))
+    end
+end
+
+function T:not_equal(unexpected, actual, msg)
+    if same(unexpected, actual) then
+        fail(msg, "expected a value other than " .. dump(actual))
+    end
+end
+
+function T:near(expected, actual, tolerance, msg)
+    if type(actual) ~= "number" or math.abs(expected - actual) > tolerance then
+        fail(msg, "expected " .. dump(expected) .. " +/- " .. tolerance ..
+                 ", got " .. dump(actual))
+    end
+end
+
+-- error expects fn to raise an error containing text, if given
+function T:error(fn, text, msg)
+    local ok, err = pcall(fn)
+    if ok then fail(msg, "expected an error") end
+    if text and not string.find(tostring(err), text, 1, true) then
+        fail(msg, "expected an error containing " .. dump(text) .. ", got " ..
+                 dump(err))
+    end
+end
+
+function T:fail(msg)
+    error(msg or "failed", 2)
+end
+
+-- advance moves the virtual clock forward, firing the timers due
+function T:advance(ms)
+    __advance(ms)
+end
+
+return {
+    count = function() return #tests end,
+    name = function(i) return tests[i].name end,
+    run = function(i)
+        local t = tests[i]
+        if t.skip then return "skip" end
+        local ok, err = pcall(t.fn, setmetatable({}, T))
+        if ok then return "ok" end
+        return "fail", tostring(err)
+    end
+}
@@ -0,0 +1,117 @@
+// Package luatest runs Lua unit tests on the host, in the emulator, with the
+// assertions of HarnessLua
+package luatest
+
+import (
+	"bytes"
+	"espore/emulator"
+	"espore/testreport"
+	"fmt"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Suite is a set of test files and the files they can load
+type Suite struct {
+	Name string
+	// Tests lists the test files to run
+	Tests []string
+	// Files holds the content of every file available to the tests, by path
+	Files map[string][]byte
+}
+
+// Run runs every test file of the suite in its own emulator and returns a
+// case per test. A test file that cannot be loaded yields a failed case.
+func Run(suite *Suite) ([]*testreport.Case, error) {
+	var cases []*testreport.Case
+	for _, testFile := range suite.Tests {
+		fileCases, err := runFile(suite, testFile)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, fileCases...)
+	}
+	return cases, nil
+}
+
+func runFile(suite *Suite, testFile string) ([]*testreport.Case, error) {
+	var output bytes.Buffer
+	e, err := emulator.New(&emulator.Config{SkipInit: true, Output: &output})
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+	for path, content := range suite.Files {
+		if err := e.WriteFile(path, content); err != nil {
+			return nil, err
+		}
+	}
+	e.Boot()
+	L := e.L
+	L.SetGlobal("__advance", L.NewFunction(func(L *lua.LState) int {
+		if err := e.Advance(time.Duration(L.CheckInt(1)) * time.Millisecond); err != nil {
+			L.RaiseError("%s", err)
+		}
+		return 0
+	}))
+
+	suiteName := suite.Name + "/" + testFile
+	if err := L.DoString(HarnessLua); err != nil {
+		return nil, fmt.Errorf("Error loading test harness: %s", err)
+	}
+	harness := L.Get(-1).(*lua.LTable)
+	L.Pop(1)
+	call := func(name string, args ...lua.LValue) ([]lua.LValue, error) {
+		err := L.CallByParam(lua.P{Fn: L.GetField(harness, name), NRet: 2, Protect: true}, args...)
+		if err != nil {
+			return nil, err
+		}
+		results := []lua.LValue{L.Get(-2), L.Get(-1)}
+		L.Pop(2)
+		return results, nil
+	}
+
+	start := time.Now()
+	L.Push(L.GetGlobal("dofile"))
+	L.Push(lua.LString(testFile))
+	if err := L.PCall(1, 0, nil); err != nil {
+		return []*testreport.Case{{
+			Suite:   suiteName,
+			Name:    "load",
+			Failure: err.Error(),
+			Time:    time.Since(start),
+			Output:  output.String(),
+		}}, nil
+	}
+
+	count, err := call("count")
+	if err != nil {
+		return nil, err
+	}
+	var cases []*testreport.Case
+	for i := 1; i <= int(lua.LVAsNumber(count[0])); i++ {
+		name, err := call("name", lua.LNumber(i))
+		if err != nil {
+			return nil, err
+		}
+		c := &testreport.Case{Suite: suiteName, Name: name[0].String()}
+		output.Reset()
+		start := time.Now()
+		result, err := call("run", lua.LNumber(i))
+		c.Time = time.Since(start)
+		if err != nil {
+			c.Failure = err.Error()
+		} else {
+			switch result[0].String() {
+			case "skip":
+				c.Skipped = true
+			case "fail":
+				c.Failure = result[1].String()
+			}
+		}
+		c.Output = output.String()
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
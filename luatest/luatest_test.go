@@ -0,0 +1,59 @@
+package luatest_test
+
+import (
+	"espore/luatest"
+	"strings"
+	"testing"
+
+	"github.com/epiclabs-io/ut"
+)
+
+func TestRun(tx *testing.T) {
+	t := ut.BeginTest(tx, false)
+	defer t.FinishTest()
+
+	suite := &luatest.Suite{
+		Name:  "libs/util",
+		Tests: []string{"util/counter_test.lua", "broken_test.lua"},
+		Files: map[string][]byte{
+			"util/counter.lua": []byte(`local M = {}
+function M.start(c) tmr.create():alarm(100, tmr.ALARM_AUTO, function() c.n = c.n + 1 end) end
+return M`),
+			"util/counter_test.lua": []byte(`local counter = require("util.counter")
+test("counts on virtual time", function(t)
+    local c = {n = 0}
+    counter.start(c)
+    t:advance(350)
+    t:equal(3, c.n)
+    t:equal({a = {1, 2}}, {a = {1, 2}})
+end)
+test("reports the failing line", function(t)
+    print("some output")
+    t:equal({1, 2}, {1, 3}, "lists")
+end)
+test("expects errors", function(t)
+    t:error(function() error("boom") end, "boom")
+    t:near(0.3, 0.1 + 0.2, 1e-9)
+end)
+skip("not ready", function(t) t:fail() end)
+`),
+			"broken_test.lua": []byte(`require("missing")`),
+		},
+	}
+	cases, err := luatest.Run(suite)
+	t.Ok(err)
+	t.Equals(5, len(cases))
+
+	t.Equals("libs/util/util/counter_test.lua", cases[0].Suite)
+	t.Equals("counts on virtual time", cases[0].Name)
+	t.Equals("", cases[0].Failure)
+
+	t.Equals("util/counter_test.lua:11: lists: expected {1, 2}, got {1, 3}", cases[1].Failure)
+	t.Equals("some output\n", cases[1].Output)
+
+	t.Equals("", cases[2].Failure)
+	t.Assert(cases[3].Skipped, "Expected the test to be skipped")
+
+	t.Equals("load", cases[4].Name)
+	t.Assert(strings.Contains(cases[4].Failure, "module missing not found"), "Unexpected failure %q", cases[4].Failure)
+}
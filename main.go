@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"espore/builder"
+	"espore/builder/signing"
 	"espore/cli"
 	"espore/cli/history"
 	"espore/config"
@@ -20,8 +21,12 @@ import (
 	"github.com/tarm/serial"
 )
 
+func openSerialPort(port string) (*serial.Port, error) {
+	return serial.OpenPort(&serial.Config{Name: port, Baud: 115200, ReadTimeout: time.Second * 1})
+}
+
 func getSerialSession(port string) (s *session.Session, close func(), err error) {
-	socket, err := serial.OpenPort(&serial.Config{Name: port, Baud: 115200, ReadTimeout: time.Second * 1})
+	socket, err := openSerialPort(port)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -41,14 +46,18 @@ func getSerialSession(port string) (s *session.Session, close func(), err error)
 
 }
 
-func initFirmware(outputDir string, port string) error {
+func initFirmware(config *config.BuildConfig, port string) error {
+	keyring, err := signing.Load(config.GetSigningKeysFile())
+	if err != nil {
+		return err
+	}
 	s, close, err := getSerialSession(port)
 	if err != nil {
 		return err
 	}
 
 	defer close()
-	return initializer.Initialize(outputDir, s)
+	return initializer.Initialize(config.Output, s, keyring)
 }
 
 func buildHistory(fileName string) (*history.History, error) {
@@ -82,7 +91,13 @@ func main() {
 	cliFlag := flag.Bool("cli", false, "Run the interactive UI")
 	serverFlag := flag.Bool("server", false, "Run the firmware server")
 	port := flag.String("port", "/dev/ttyUSB0", "Serial port to connect to")
+	profile := flag.String("profile", "", "Build profile to use, overriding the one in espore.json")
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command [parameters]]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		printCommands()
+	}
 	flag.Parse()
 
 	config, err := config.Read()
@@ -90,9 +105,20 @@ func main() {
 		log.Printf("Error: %s", err)
 	}
 
+	if *profile != "" {
+		config.Build.Profile = *profile
+	}
+
 	dataDir := config.GetDataDir()
 	os.MkdirAll(dataDir, 0755)
 
+	if flag.NArg() > 0 {
+		if err := runCommand(config, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *serverFlag {
 		fwserver.New(&fwserver.Config{
 			Port: 8080,
@@ -130,7 +156,7 @@ func main() {
 	}
 
 	if *initFlag {
-		if err := initFirmware(config.Build.Output, *port); err != nil {
+		if err := initFirmware(&config.Build, *port); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -23,6 +23,9 @@ import (
 const throttle = 100 * time.Millisecond
 const chunkSize = 128
 
+// DefaultTimeout is how long the session waits for the device to answer
+const DefaultTimeout = 10 * time.Second
+
 type Logger interface {
 	Printf(fmt string, item ...interface{})
 }
@@ -36,6 +39,9 @@ type Session struct {
 	*lockreader.LockReader
 	Log  Logger
 	File *fileman.Fileman
+	// Timeout is how long to wait for the device to answer. Zero means
+	// DefaultTimeout
+	Timeout time.Duration
 }
 
 type defaultLogger struct{}
@@ -55,6 +61,13 @@ func New(config *Config) (*Session, error) {
 	return s, nil
 }
 
+func (s *Session) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DefaultTimeout
+}
+
 func (s *Session) SendCommand(cmd string) error {
 	sw := NewLineWriter(s)
 	_, err := sw.Write([]byte(cmd))
@@ -81,7 +94,7 @@ func (s *Session) pushRuntime(socket io.Reader) error {
 	}
 
 	var r []string
-	if r, err = awaitRegex(socket, `(READY|module '__espore' not found:)$`); err != nil {
+	if r, err = awaitRegex(socket, `(READY|module '__espore' not found:)$`, s.timeout()); err != nil {
 		return errors.New("Pushing runtime failed")
 	}
 
@@ -97,7 +110,7 @@ func (s *Session) pushRuntime(socket io.Reader) error {
 			return err
 		}
 
-		if r, err = awaitRegex(socket, `(READY|module '__espore' not found:)$`); err != nil {
+		if r, err = awaitRegex(socket, `(READY|module '__espore' not found:)$`, s.timeout()); err != nil {
 			return errors.New("Pushing runtime failed")
 		}
 		if r[1] != "READY" {
@@ -136,7 +149,7 @@ func (s *Session) PushStream(reader io.Reader, size int64, dstName string) error
 			return err
 		}
 
-		if _, err := awaitRegex(socket, "BEGIN"); err != nil {
+		if _, err := awaitRegex(socket, "BEGIN", s.timeout()); err != nil {
 			return errors.New("Error waiting for upload BEGIN signal")
 		}
 
@@ -191,7 +204,7 @@ func (s *Session) PushStream(reader io.Reader, size int64, dstName string) error
 			var received = int64(0)
 			for received < size {
 				rc <- received
-				st, err := awaitRegex(socket, `(\d+)$`)
+				st, err := awaitRegex(socket, `(\d+)$`, s.timeout())
 				if err != nil {
 					recvErr = fmt.Errorf("Error waiting for download progress response: %s", err)
 					return
@@ -210,7 +223,7 @@ func (s *Session) PushStream(reader io.Reader, size int64, dstName string) error
 		if recvErr != nil {
 			return fmt.Errorf("Error receiving file: %s", recvErr)
 		}
-		m, err := awaitRegex(socket, "([0-9a-fA-F]{40})")
+		m, err := awaitRegex(socket, "([0-9a-fA-F]{40})", s.timeout())
 		if err != nil {
 			return errors.New("Error waiting for file checksum hash")
 		}
@@ -256,7 +269,7 @@ func (s *Session) Rpc(luaCode string) ([]byte, error) {
 		}
 		template := "__espore.call(function()\n%s\nend)"
 		s.RunCode(fmt.Sprintf(template, luaCode))
-		r, err := AwaitStjson(socket)
+		r, err := awaitStjson(socket, s.timeout())
 		if err != nil {
 			return errors.New("Error receiving RPC response")
 		}
@@ -287,7 +300,7 @@ func (s *Session) GetChipID() (string, error) {
 			return err
 		}
 
-		match, err := awaitRegex(reader, "id=(.*)")
+		match, err := awaitRegex(reader, "id=(.*)", s.timeout())
 		if err != nil {
 			return err
 		}
@@ -302,7 +315,7 @@ func (s *Session) ensureRuntime(reader io.Reader) error {
 	if err != nil {
 		return err
 	}
-	installedStr, err := awaitRegex(reader, "espore=(true|false)$")
+	installedStr, err := awaitRegex(reader, "espore=(true|false)$", s.timeout())
 	if err != nil {
 		return errors.New("Error ensuring __espore is installed")
 	}
@@ -344,9 +357,24 @@ func ReadLine(r io.Reader) (string, error) {
 	}
 }
 
-func awaitRegex(reader io.Reader, regexSt string) ([]string, error) {
-	timeout := time.After(time.Second * 10)
-	r := regexp.MustCompile(regexSt)
+// Expect waits until a line of the device output matches the regular
+// expression and returns the submatches. Lines read in the meantime are
+// discarded.
+func (s *Session) Expect(regexSt string, timeout time.Duration) ([]string, error) {
+	var match []string
+	err := s.LockReader.Lock(func(reader io.Reader) (err error) {
+		match, err = awaitRegex(reader, regexSt, timeout)
+		return err
+	})
+	return match, err
+}
+
+func awaitRegex(reader io.Reader, regexSt string, timeout time.Duration) ([]string, error) {
+	r, err := regexp.Compile(regexSt)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.After(timeout)
 
 	for {
 		line, err := ReadLine(reader)
@@ -358,17 +386,21 @@ func awaitRegex(reader io.Reader, regexSt string) ([]string, error) {
 			return match, nil
 		}
 		select {
-		case <-timeout:
-			return nil, errors.New("regex not found")
+		case <-deadline:
+			return nil, fmt.Errorf("%q not found within %s", regexSt, timeout)
 		default:
 
 		}
 	}
-	return nil, errors.New("regex not found")
+	return nil, fmt.Errorf("%q not found", regexSt)
 }
 
 func AwaitStjson(reader io.Reader) (string, error) {
-	timeout := time.After(time.Second * 10)
+	return awaitStjson(reader, DefaultTimeout)
+}
+
+func awaitStjson(reader io.Reader, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
 	openBrackets := 0
 	started := false
 
@@ -386,7 +418,7 @@ func AwaitStjson(reader io.Reader) (string, error) {
 			openBrackets--
 			fallthrough
 		case ",":
-			timeout = time.After(time.Second * 10)
+			deadline = time.After(timeout)
 		}
 		if started {
 			sb.WriteString(line)
@@ -396,9 +428,122 @@ func AwaitStjson(reader io.Reader) (string, error) {
 			}
 		}
 		select {
-		case <-timeout:
-			return "", errors.New("regex not found")
+		case <-deadline:
+			return "", fmt.Errorf("no response within %s", timeout)
 		default:
 		}
 	}
 }
+
+// FirmwareVersion describes the build a device runs, as stored in the
+// version.json file of its image
+type FirmwareVersion struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Dirty     bool   `json:"dirty"`
+	BuildTime string `json:"buildTime"`
+	Espore    string `json:"espore"`
+	// ImageHash is the SHA1 of the image, as in its .hash file. version.json
+	// cannot hold the hash of the image it is in, so the builder only sets it
+	// in the copy next to the image and devices report the hash of the image
+	// they run: update.img.fail while a new image is on trial, before
+	// __acceptFirmware, and update.old otherwise.
+	ImageHash string `json:"imageHash,omitempty"`
+}
+
+// String formats the version for headers and logs, as in
+// "1.2.0+3f2a1b9c-dirty"
+func (v *FirmwareVersion) String() string {
+	st := v.Version
+	if v.Commit != "" {
+		commit := v.Commit
+		if len(commit) > 8 {
+			commit = commit[:8]
+		}
+		st += "+" + commit
+		if v.Dirty {
+			st += "-dirty"
+		}
+	}
+	return st
+}
+
+// DeviceInfo is what a device reports about itself
+type DeviceInfo struct {
+	ChipID string `json:"chipId"`
+	Heap   int    `json:"heap"`
+	// Firmware is nil if the device has no version.json
+	Firmware *FirmwareVersion `json:"firmware"`
+}
+
+// DeviceInfo returns the chip id, free heap and firmware version of the
+// device
+func (s *Session) DeviceInfo() (*DeviceInfo, error) {
+	r, err := s.Rpc(`
+local f = file.open("version.json", "r")
+local data
+if f then
+	data = ""
+	repeat
+		local chunk = f:read()
+		data = data .. (chunk or "")
+	until chunk == nil
+	f:close()
+end
+local image
+for _, name in ipairs({"update.img.fail", "update.old"}) do
+	if file.exists(name) then
+		image = string.lower(encoder.toHex(crypto.fhash("sha1", name)))
+		break
+	end
+end
+return {chipId = tostring(node.chipid()), heap = node.heap(), firmware = data, image = image}`)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		DeviceInfo
+		Firmware string `json:"firmware"`
+		Image    string `json:"image"`
+	}
+	if err := json.Unmarshal(r, &response); err != nil {
+		return nil, errors.New("Error decoding device info")
+	}
+	info := response.DeviceInfo
+	if response.Firmware != "" {
+		info.Firmware = &FirmwareVersion{}
+		if err := json.Unmarshal([]byte(response.Firmware), info.Firmware); err != nil {
+			return nil, fmt.Errorf("Error decoding version.json: %s", err)
+		}
+		info.Firmware.ImageHash = response.Image
+	}
+	return &info, nil
+}
+
+// LFSConfig is the LFS partition of a device, as LFS._config reports it
+type LFSConfig struct {
+	Base   int64 `json:"base"`
+	Mapped int64 `json:"mapped"`
+	Size   int64 `json:"size"`
+}
+
+// LFSConfig returns the LFS partition of the device. Without an LFS image
+// loaded there is no LFS table, so node.flashindex is asked directly.
+func (s *Session) LFSConfig() (*LFSConfig, error) {
+	r, err := s.Rpc(`
+local c = LFS and LFS._config
+if not c and node.flashindex then
+	local _, base, mapped, size = node.flashindex("_config")
+	if base then c = {lfs_base = base, lfs_mapped = mapped, lfs_size = size} end
+end
+if not c then error("the firmware has no LFS partition") end
+return {base = c.lfs_base, mapped = c.lfs_mapped, size = c.lfs_size}`)
+	if err != nil {
+		return nil, err
+	}
+	var config LFSConfig
+	if err := json.Unmarshal(r, &config); err != nil {
+		return nil, errors.New("Error decoding LFS config")
+	}
+	return &config, nil
+}
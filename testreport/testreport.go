@@ -0,0 +1,151 @@
+// Package testreport writes test results in the TAP and JUnit XML formats
+// understood by CI servers.
+package testreport
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Case is the result of a single test
+type Case struct {
+	Suite string
+	Name  string
+	// Failure explains why the test failed. Empty if it passed
+	Failure string
+	Skipped bool
+	Time    time.Duration
+	// Output is what the test printed
+	Output string
+}
+
+// Failed counts the failed cases
+func Failed(cases []*Case) int {
+	failed := 0
+	for _, c := range cases {
+		if c.Failure != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// WriteTAP writes the results in the Test Anything Protocol, version 13.
+// Failure messages go in a YAML block after the test line.
+func WriteTAP(w io.Writer, cases []*Case) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "TAP version 13\n1..%d\n", len(cases))
+	for i, c := range cases {
+		name := strings.Replace(c.Suite+": "+c.Name, "#", "\\#", -1)
+		switch {
+		case c.Skipped:
+			fmt.Fprintf(&sb, "ok %d - %s # SKIP\n", i+1, name)
+		case c.Failure != "":
+			fmt.Fprintf(&sb, "not ok %d - %s\n  ---\n  message: |\n", i+1, name)
+			for _, line := range strings.Split(c.Failure, "\n") {
+				fmt.Fprintf(&sb, "    %s\n", line)
+			}
+			fmt.Fprintf(&sb, "  ...\n")
+		default:
+			fmt.Fprintf(&sb, "ok %d - %s\n", i+1, name)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitSuite struct {
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Cases    []*junitCase `xml:"testcase"`
+	time     time.Duration
+}
+
+type junitSuites struct {
+	XMLName  xml.Name      `xml:"testsuites"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Skipped  int           `xml:"skipped,attr"`
+	Time     string        `xml:"time,attr"`
+	Suites   []*junitSuite `xml:"testsuite"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the results as JUnit XML, with a test suite per
+// distinct Suite in order of appearance
+func WriteJUnit(w io.Writer, cases []*Case) error {
+	var report junitSuites
+	suites := make(map[string]*junitSuite)
+	var total time.Duration
+	for _, c := range cases {
+		suite, ok := suites[c.Suite]
+		if !ok {
+			suite = &junitSuite{Name: c.Suite}
+			suites[c.Suite] = suite
+			report.Suites = append(report.Suites, suite)
+		}
+		jc := &junitCase{
+			Name:      c.Name,
+			Classname: c.Suite,
+			Time:      seconds(c.Time),
+			SystemOut: c.Output,
+		}
+		suite.Tests++
+		report.Tests++
+		switch {
+		case c.Skipped:
+			jc.Skipped = &struct{}{}
+			suite.Skipped++
+			report.Skipped++
+		case c.Failure != "":
+			message := c.Failure
+			if i := strings.IndexByte(message, '\n'); i >= 0 {
+				message = message[:i]
+			}
+			jc.Failure = &junitFailure{Message: message, Text: c.Failure}
+			suite.Failures++
+			report.Failures++
+		}
+		suite.Cases = append(suite.Cases, jc)
+		suite.time += c.Time
+		total += c.Time
+	}
+	for _, suite := range report.Suites {
+		suite.Time = seconds(suite.time)
+	}
+	report.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}